@@ -0,0 +1,27 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// Command romualdo-lsp is a Language Server Protocol server for the Romualdo
+// Language. It talks to the editor through the standard input and output, and
+// provides diagnostics, go-to-definition, find-references, hover and code
+// completion. Configure the editor to run it for *.romulang files.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/stackedboxes/romulang/pkg/lsp"
+)
+
+func main() {
+	server := lsp.NewServer(os.Stdin, os.Stdout)
+	if err := server.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "romualdo-lsp: %v\n", err)
+		os.Exit(1)
+	}
+}
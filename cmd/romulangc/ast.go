@@ -9,49 +9,36 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
-	"gitlab.com/stackedboxes/romulang/pkg/frontend"
 )
 
-const (
-	exitCodeSuccess = iota
-	exitCodeCompilationError
-)
-
-func main() {
-
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: print_ast <file>\n")
-		os.Exit(1)
-	}
-
-	parseAndPrintAST(os.Args[1])
-}
-
-func parseAndPrintAST(path string) {
+// runAST runs the ast command.
+func runAST(args []string) int {
+	fs := newFlagSet("ast", sourcesUsage,
+		"Parses and type checks a Storyworld and prints its abstract syntax tree.\n\n"+
+			sourcesHelp)
 
-	source, err := ioutil.ReadFile(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
-		os.Exit(1)
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
 	}
 
-	root := frontend.Parse(string(source))
+	root, _, exitCode := parseFiles(posArgs)
 	if root == nil {
-		os.Exit(exitCodeCompilationError)
+		return exitCode
 	}
 
 	ap := &ASTPrinter{}
 	root.Walk(ap)
 	fmt.Println(ap)
 
-	os.Exit(exitCodeSuccess)
+	return exitCodeSuccess
 }
 
+// ASTPrinter is a visitor that generates a human-readable representation of
+// an AST.
 type ASTPrinter struct {
 	indentLevel int
 	builder     strings.Builder
@@ -68,7 +55,7 @@ func (ap *ASTPrinter) Enter(node ast.Node) {
 	case *ast.Storyworld:
 		ap.builder.WriteString("Storyworld\n")
 	case *ast.GlobalsBlock:
-		ap.builder.WriteString("GlobalsBlock\n")
+		ap.builder.WriteString(fmt.Sprintf("GlobalsBlock [@%v]\n", n.Version))
 	case *ast.Block:
 		ap.builder.WriteString("Block\n")
 	case *ast.IfStmt:
@@ -79,6 +66,8 @@ func (ap *ASTPrinter) Enter(node ast.Node) {
 		ap.builder.WriteString(fmt.Sprintf("VarDecl [%v: %v]\n", n.Name, n.Type()))
 	case *ast.BuiltInFunction:
 		ap.builder.WriteString(fmt.Sprintf("BuiltInFunction [%v]\n", n.Function))
+	case *ast.NativeCall:
+		ap.builder.WriteString(fmt.Sprintf("NativeCall [%v]\n", n.Function))
 	case *ast.VarRef:
 		ap.builder.WriteString(fmt.Sprintf("VarRef [%v: %v]\n", n.Name, n.Type()))
 	case *ast.FloatLiteral:
@@ -104,13 +93,27 @@ func (ap *ASTPrinter) Enter(node ast.Node) {
 	case *ast.Assignment:
 		ap.builder.WriteString(fmt.Sprintf("Assignment [%v]\n", n.VarName))
 	case *ast.WhileStmt:
-		ap.builder.WriteString("WhileStmt")
+		ap.builder.WriteString("WhileStmt\n")
 	case *ast.FunctionDecl:
 		ap.builder.WriteString(fmt.Sprintf("FunctionDecl [%v(%v):%v]\n", n.Name, n.Parameters, n.ReturnType))
+	case *ast.PassageDecl:
+		ap.builder.WriteString(fmt.Sprintf("PassageDecl [%v(%v):%v]\n", n.VersionedName(), n.Parameters, n.ReturnType))
+	case *ast.MetaBlock:
+		ap.builder.WriteString("MetaBlock\n")
 	case *ast.FunctionCall:
 		ap.builder.WriteString(fmt.Sprintf("FunctionCall [%v]\n", n.Function.Name))
 	case *ast.ReturnStmt:
 		ap.builder.WriteString("ReturnStmt\n")
+	case *ast.SayStmt:
+		ap.builder.WriteString("SayStmt\n")
+	case *ast.GotoStmt:
+		ap.builder.WriteString(fmt.Sprintf("GotoStmt [%v]\n", n.Passage.Name))
+	case *ast.GosubExpr:
+		ap.builder.WriteString(fmt.Sprintf("GosubExpr [%v]\n", n.Passage.Name))
+	case *ast.ListenExpr:
+		ap.builder.WriteString("ListenExpr\n")
+	case *ast.Attribute:
+		ap.builder.WriteString(fmt.Sprintf("Attribute [%v]\n", n.Name))
 	default:
 		panic(fmt.Sprintf("Unexpected node type: %T", n))
 	}
@@ -0,0 +1,89 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+// runBuild runs the build command.
+func runBuild(args []string) int {
+	fs := newFlagSet("build", sourcesUsage,
+		"Compiles a Storyworld, writing the bytecode to a compiled storyworld file\n"+
+			"("+cswExtension+") and the debug information to a sidecar file ("+debugInfoExtension+").\n\n"+
+			sourcesHelp)
+	outPath := fs.String("o", "", "path of the compiled storyworld file (default: source file or directory path with the "+cswExtension+" extension; required with multiple arguments)")
+	strip := fs.Bool("strip", false, "do not write the debug info file")
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+
+	if *outPath == "" && len(posArgs) > 1 {
+		fmt.Fprint(os.Stderr, "The -o flag is required when building from multiple arguments.\n")
+		return exitCodeUsageError
+	}
+
+	csw, di, exitCode := compileFiles(posArgs)
+	if csw == nil {
+		return exitCode
+	}
+
+	if *outPath == "" {
+		srcPath := filepath.Clean(posArgs[0])
+		*outPath = strings.TrimSuffix(srcPath, frontend.SourceExtension) + cswExtension
+	}
+
+	if err := writeToFile(*outPath, csw); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %v: %v\n", *outPath, err)
+		return exitCodeUsageError
+	}
+
+	diPath := debugInfoPath(*outPath)
+
+	if *strip {
+		// Remove any stale debug info file, which would not match the new
+		// compiled storyworld anyway.
+		if err := os.Remove(diPath); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error removing %v: %v\n", diPath, err)
+			return exitCodeUsageError
+		}
+		return exitCodeSuccess
+	}
+
+	if err := writeToFile(diPath, di); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %v: %v\n", diPath, err)
+		return exitCodeUsageError
+	}
+
+	return exitCodeSuccess
+}
+
+// writeToFile creates (or truncates) the file at path and serializes data to
+// it.
+func writeToFile(path string, data io.WriterTo) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = data.WriteTo(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,24 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+// runCheck runs the check command.
+func runCheck(args []string) int {
+	fs := newFlagSet("check", sourcesUsage,
+		"Checks a Storyworld for errors, running only the compiler frontend (that\n"+
+			"is, no code is generated). Errors are reported to the standard error.\n\n"+
+			sourcesHelp)
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+
+	_, _, exitCode = parseFiles(posArgs)
+	return exitCode
+}
@@ -0,0 +1,302 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/debugger"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// debugHelp is the help text shown by the help debugger command.
+const debugHelp = `Commands:
+    break, b [<file>:]<line> [if <expr>]   set a breakpoint, optionally conditional
+    delete <id>                            delete a breakpoint
+    breakpoints                            list the breakpoints
+    continue, c                            run until a breakpoint is hit
+    step, s                                step to the next line, entering calls
+    next, n                                step to the next line, over calls
+    out, finish                            run until the current function returns
+    backtrace, bt                          show the call stack
+    locals                                 show the local variables
+    globals                                show the global variables
+    stack                                  show the whole value stack
+    print, p <expr>                        evaluate an expression
+    list, l                                show the source around the current line
+    help                                   show this help
+    quit, q                                quit
+
+An empty line repeats the previous command.`
+
+// debugSession is an interactive debugging session in the terminal.
+type debugSession struct {
+	// debugger is the debugger running the Storyworld.
+	debugger *debugger.Debugger
+
+	// input is where commands and choices are read from.
+	input *bufio.Scanner
+
+	// sources caches the source files shown, split in lines. Files that could
+	// not be read map to nil.
+	sources map[string][]string
+
+	// lastCommand is the latest command entered, repeated on empty lines.
+	lastCommand string
+}
+
+// runDebug runs the debug command.
+func runDebug(args []string) int {
+	fs := newFlagSet("debug", sourcesUsage,
+		"Runs a Storyworld under an interactive debugger. The execution pauses\n"+
+			"before the first line; enter help at the (debug) prompt for the list of\n"+
+			"commands. The arguments can be either source code or a single compiled\n"+
+			"storyworld, in which case its debug info sidecar file is required.\n\n"+
+			sourcesHelp)
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+
+	csw, di, exitCode := loadStoryworld(posArgs, true)
+	if csw == nil {
+		return exitCode
+	}
+
+	theVM := vm.New()
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		printAttributes(event.Attributes)
+	})
+	d, err := debugger.New(theVM, csw, di)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot debug: %v\n", err)
+		return exitCodeUsageError
+	}
+
+	s := &debugSession{
+		debugger: d,
+		input:    bufio.NewScanner(os.Stdin),
+		sources:  map[string][]string{},
+	}
+	return s.run(d.Start(true))
+}
+
+// run drives the session, starting with the execution in a given status.
+// Returns the process exit code.
+func (s *debugSession) run(status vm.Status) int {
+	for {
+		switch status {
+		case vm.StatusFinished:
+			fmt.Println("The Storyworld finished.")
+			return exitCodeSuccess
+
+		case vm.StatusRuntimeError:
+			reportRuntimeError(s.debugger.VM)
+			return exitCodeInterpretationError
+
+		case vm.StatusWaitingForInput:
+			printAttributes(s.debugger.VM.Listening().Attributes)
+			fmt.Print("> ")
+			if !s.input.Scan() {
+				fmt.Fprint(os.Stderr, "\nNo more input, but the Storyworld is still listening.\n")
+				return exitCodeInterpretationError
+			}
+			status = s.debugger.Resume(s.input.Text())
+
+		case vm.StatusPaused:
+			s.showLocation()
+			var quit bool
+			status, quit = s.readCommands()
+			if quit {
+				return exitCodeSuccess
+			}
+		}
+	}
+}
+
+// readCommands reads and runs commands until one of them continues the
+// execution, in which case the new status is returned. quit is true if the
+// user wants to end the session.
+func (s *debugSession) readCommands() (status vm.Status, quit bool) {
+	for {
+		fmt.Print("(debug) ")
+		if !s.input.Scan() {
+			fmt.Println()
+			return status, true
+		}
+		line := strings.TrimSpace(s.input.Text())
+		if line == "" {
+			line = s.lastCommand
+		}
+		if line == "" {
+			continue
+		}
+		s.lastCommand = line
+
+		name, arg := splitREPLCommand(line)
+		switch name {
+		case "continue", "c":
+			return s.debugger.Continue(), false
+		case "step", "s":
+			return s.debugger.StepInto(), false
+		case "next", "n":
+			return s.debugger.StepOver(), false
+		case "out", "finish":
+			return s.debugger.StepOut(), false
+		case "quit", "q":
+			return status, true
+		default:
+			s.runCommand(name, arg)
+		}
+	}
+}
+
+// runCommand runs one of the commands that don't continue the execution.
+func (s *debugSession) runCommand(name, arg string) {
+	switch name {
+	case "break", "b":
+		s.setBreakpoint(arg)
+
+	case "delete":
+		id, err := strconv.Atoi(arg)
+		if err == nil {
+			err = s.debugger.ClearBreakpoint(id)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot delete breakpoint: %v\n", err)
+		}
+
+	case "breakpoints":
+		for _, bp := range s.debugger.Breakpoints() {
+			fmt.Printf("%v: %v", bp.ID, describeLine(bp.File, bp.Line))
+			if bp.Condition != "" {
+				fmt.Printf(" if %v", bp.Condition)
+			}
+			fmt.Printf(" (hit %v times)\n", bp.HitCount)
+		}
+
+	case "backtrace", "bt":
+		for i, f := range s.debugger.Frames() {
+			fmt.Printf("#%v %v at %v\n", i, f.Name, describeLine(f.File, f.Line))
+		}
+
+	case "locals":
+		for _, v := range s.debugger.Frames()[0].Locals {
+			fmt.Printf("%v: %v = %v\n", v.Name, v.Type, formatREPLValue(v.Value))
+		}
+
+	case "globals":
+		for _, g := range s.debugger.Globals() {
+			if !g.Value.IsFunction() && !g.Value.IsPassage() {
+				fmt.Printf("%v = %v\n", g.Name, formatREPLValue(g.Value))
+			}
+		}
+
+	case "stack":
+		for i, v := range s.debugger.ValueStack() {
+			fmt.Printf("[%v] %v\n", i, formatREPLValue(v))
+		}
+
+	case "print", "p":
+		value, valueType, err := s.debugger.Evaluate(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot evaluate: %v\n", err)
+			return
+		}
+		fmt.Printf("%v : %v\n", formatREPLValue(value), valueType)
+
+	case "list", "l":
+		f := s.debugger.Frames()[0]
+		for line := f.Line - 5; line <= f.Line+5; line++ {
+			if text, ok := s.sourceLine(f.File, line); ok {
+				marker := " "
+				if line == f.Line {
+					marker = ">"
+				}
+				fmt.Printf("%v %4d | %v\n", marker, line, text)
+			}
+		}
+
+	case "help":
+		fmt.Println(debugHelp)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v (enter help for help)\n", name)
+	}
+}
+
+// setBreakpoint sets a breakpoint as described by arg, which is in the format
+// "[<file>:]<line> [if <expr>]". Without a file, the breakpoint is set in the
+// current file.
+func (s *debugSession) setBreakpoint(arg string) {
+	where, condition := arg, ""
+	if i := strings.Index(arg, " if "); i >= 0 {
+		where, condition = strings.TrimSpace(arg[:i]), strings.TrimSpace(arg[i+4:])
+	}
+
+	file := s.debugger.Frames()[0].File
+	lineText := where
+	if i := strings.LastIndex(where, ":"); i >= 0 {
+		file, lineText = where[:i], where[i+1:]
+	}
+	line, err := strconv.Atoi(lineText)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid line number: %v\n", lineText)
+		return
+	}
+
+	bp, err := s.debugger.SetBreakpoint(file, line, condition)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot set breakpoint: %v\n", err)
+		return
+	}
+	fmt.Printf("Breakpoint %v at %v\n", bp.ID, describeLine(bp.File, bp.Line))
+}
+
+// showLocation shows where the execution is paused.
+func (s *debugSession) showLocation() {
+	if bp := s.debugger.HitBreakpoint(); bp != nil {
+		fmt.Printf("Breakpoint %v hit.\n", bp.ID)
+	}
+	f := s.debugger.Frames()[0]
+	fmt.Printf("%v at %v\n", f.Name, describeLine(f.File, f.Line))
+	if text, ok := s.sourceLine(f.File, f.Line); ok {
+		fmt.Printf("%6d | %v\n", f.Line, text)
+	}
+}
+
+// sourceLine returns a given line of a source file. ok is false if the file
+// cannot be read or doesn't have that line.
+func (s *debugSession) sourceLine(file string, line int) (text string, ok bool) {
+	lines, cached := s.sources[file]
+	if !cached {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		s.sources[file] = lines
+	}
+	if line < 1 || line > len(lines) {
+		return "", false
+	}
+	return lines[line-1], true
+}
+
+// describeLine returns a source code line in a human-readable way, like
+// "story.romulang:12".
+func describeLine(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %v", line)
+	}
+	return fmt.Sprintf("%v:%v", file, line)
+}
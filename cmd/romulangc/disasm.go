@@ -0,0 +1,86 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+)
+
+// runDisasm runs the disasm command.
+func runDisasm(args []string) int {
+	fs := newFlagSet("disasm", sourcesUsage,
+		"Disassembles a Storyworld. The arguments can be either source code or a\n"+
+			"single compiled storyworld; in the latter case, debug info is read from\n"+
+			"the sidecar file, if present.\n\n"+
+			"With -listing, each source code line is followed by the instructions\n"+
+			"generated from it. This requires debug info, which also tells which\n"+
+			"source files to read.\n\n"+
+			sourcesHelp)
+	noDebugInfo := fs.Bool("no-debug-info", false, "disassemble without debug info, even if available")
+	listing := fs.Bool("listing", false, "interleave the source code lines with the instructions generated from them")
+	sourcePath := fs.String("source", "", "source code file to use with -listing for all functions and Passages (default: the files named in the debug info)")
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+	path := strings.Join(posArgs, " ")
+
+	if *listing && *noDebugInfo {
+		fmt.Fprint(os.Stderr, "The -listing and -no-debug-info flags cannot be used together.\n")
+		return exitCodeUsageError
+	}
+
+	csw, di, exitCode := loadStoryworld(posArgs, !*noDebugInfo)
+	if csw == nil {
+		return exitCode
+	}
+
+	if !*listing {
+		fmt.Print(csw.Disassemble(di))
+		return exitCodeSuccess
+	}
+
+	if di == nil {
+		fmt.Fprintf(os.Stderr, "No debug info available for %v, cannot generate a listing.\n", path)
+		return exitCodeUsageError
+	}
+
+	sources := map[string]string{}
+	for i := range csw.Chunks {
+		file := di.ChunkFile(i)
+		if _, ok := sources[file]; ok {
+			continue
+		}
+
+		sourceFile := file
+		if *sourcePath != "" {
+			sourceFile = *sourcePath
+		}
+		source, err := ioutil.ReadFile(sourceFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", sourceFile, err)
+			return exitCodeUsageError
+		}
+		if bytes.HasPrefix(source, bytecode.CSWMagic) {
+			fmt.Fprintf(os.Stderr, "%v is a compiled storyworld; use -source to tell where the source code is.\n", sourceFile)
+			return exitCodeUsageError
+		}
+		sources[file] = string(source)
+	}
+
+	fmt.Print(csw.Listing(di, sources))
+
+	return exitCodeSuccess
+}
@@ -0,0 +1,91 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+// runFmt runs the fmt command.
+func runFmt(args []string) int {
+	fs := newFlagSet("fmt", sourcesUsage,
+		"Formats source files in the canonical Romualdo style. By default, the\n"+
+			"formatted code is written to the standard output.\n\n"+
+			"Each argument can be either a source file or a directory, in which case\n"+
+			"all "+frontend.SourceExtension+" files in it (and in its subdirectories) are formatted.")
+	check := fs.Bool("check", false, "don't write anything, just list the files that are not formatted (exits with an error status if there are any)")
+	write := fs.Bool("w", false, "rewrite the files that are not formatted in place")
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+
+	if *check && *write {
+		fmt.Fprint(os.Stderr, "The -check and -w flags cannot be used together.\n")
+		return exitCodeUsageError
+	}
+
+	fileSet := frontend.NewFileSet()
+	for _, path := range posArgs {
+		if err := fileSet.AddPath(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
+			return exitCodeUsageError
+		}
+	}
+
+	// Keep going after errors, so that all problems are reported in one go.
+	exitCode = exitCodeSuccess
+	for _, file := range fileSet.Files() {
+		formatted, diags := frontend.Format(file.Name, file.Source)
+		if diags.HasErrors() {
+			diagnostic.RenderList(os.Stderr, diags, fileSet.Sources())
+			exitCode = exitCodeCompilationError
+			continue
+		}
+
+		switch {
+		case *check:
+			if formatted != file.Source {
+				fmt.Println(file.Name)
+				if exitCode == exitCodeSuccess {
+					exitCode = exitCodeNotFormatted
+				}
+			}
+
+		case *write:
+			if formatted == file.Source {
+				continue
+			}
+			if err := rewriteFile(file.Name, formatted); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing %v: %v\n", file.Name, err)
+				return exitCodeUsageError
+			}
+
+		default:
+			fmt.Print(formatted)
+		}
+	}
+
+	return exitCode
+}
+
+// rewriteFile replaces the contents of the existing file at path with
+// contents, keeping its permissions.
+func rewriteFile(path, contents string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(contents), info.Mode().Perm())
+}
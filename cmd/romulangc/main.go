@@ -5,56 +5,130 @@
 * Licensed under the MIT license (see LICENSE.txt for details)                 *
 \******************************************************************************/
 
+// Command romulangc is the Romualdo Language compiler driver. It is the entry
+// point for the whole toolchain: it compiles, runs, disassembles and otherwise
+// inspects Storyworlds. Run "romulangc help" for details.
 package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
-
-	"gitlab.com/stackedboxes/romulang/pkg/backend"
-	"gitlab.com/stackedboxes/romulang/pkg/frontend"
-	"gitlab.com/stackedboxes/romulang/pkg/vm"
 )
 
 const (
 	exitCodeSuccess = iota
 	exitCodeCompilationError
 	exitCodeInterpretationError
+
+	// exitCodeNotFormatted is the exit code used by "fmt -check" when some
+	// file is not formatted.
+	exitCodeNotFormatted
 )
 
+// exitCodeUsageError is the exit code used when romulangc is not properly
+// invoked (bad command-line arguments, missing files and such). It is the same
+// value romulangc always used for these cases.
+const exitCodeUsageError = 1
+
+// command is one of the commands supported by romulangc.
+type command struct {
+	// name is the command name, as passed in the command line.
+	name string
+
+	// summary is a one-line description of the command.
+	summary string
+
+	// run runs the command with the given command-line arguments (not
+	// including the command name itself). Returns the process exit code.
+	run func(args []string) int
+}
+
+// commands contains all commands supported by romulangc. It is initialized in
+// init() because the help command needs to refer to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"build", "compile a Storyworld to bytecode and debug info files", runBuild},
+		{"run", "run a Storyworld, from source code or bytecode", runRun},
+		{"disasm", "disassemble a Storyworld", runDisasm},
+		{"ast", "print the abstract syntax tree of a Storyworld", runAST},
+		{"check", "check a Storyworld for errors, without generating code", runCheck},
+		{"fmt", "format source files in the canonical style", runFmt},
+		{"repl", "start an interactive session", runREPL},
+		{"debug", "run a Storyworld under an interactive debugger", runDebug},
+		{"help", "show help about romulangc or one of its commands", runHelp},
+	}
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(exitCodeUsageError)
+	}
 
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: romulangc <file>\n")
-		os.Exit(1)
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" {
+		// Like for the commands themselves, asking for help is not an error.
+		name = "help"
 	}
 
-	runFile(os.Args[1])
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n\n", os.Args[1])
+		printUsage()
+		os.Exit(exitCodeUsageError)
+	}
+
+	os.Exit(cmd.run(os.Args[2:]))
 }
 
-func runFile(path string) {
-	source, err := ioutil.ReadFile(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
-		os.Exit(1)
+// findCommand returns the command with a given name, or nil if there is no such
+// command.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
 	}
+	return nil
+}
 
-	root := frontend.Parse(string(source))
-	if root == nil {
-		os.Exit(exitCodeCompilationError)
+// printUsage prints the general usage instructions to the standard error.
+func printUsage() {
+	fmt.Fprint(os.Stderr, "Usage: romulangc <command> [flags] [arguments]\n\n")
+	fmt.Fprint(os.Stderr, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "    %-8v %v\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprint(os.Stderr, "\nUse \"romulangc help <command>\" for more information about a command.\n")
+}
 
-	csw, debugInfo, err := backend.GenerateCode(root)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(exitCodeCompilationError)
-	}
+// runHelp runs the help command.
+func runHelp(args []string) int {
+	fs := newFlagSet("help", "[command]",
+		"Shows help about romulangc or about one of its commands.")
 
-	theVM := vm.New()
-	if !theVM.Interpret(csw, debugInfo) {
-		os.Exit(exitCodeInterpretationError)
+	posArgs, exitCode, ok := parseArgs(fs, args, -1)
+	if !ok {
+		return exitCode
 	}
 
-	os.Exit(exitCodeSuccess)
+	switch len(posArgs) {
+	case 0:
+		printUsage()
+		return exitCodeSuccess
+
+	case 1:
+		cmd := findCommand(posArgs[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command: %v\n", posArgs[0])
+			return exitCodeUsageError
+		}
+		return cmd.run([]string{"-h"})
+
+	default:
+		fs.Usage()
+		return exitCodeUsageError
+	}
 }
@@ -0,0 +1,222 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+	"gitlab.com/stackedboxes/romulang/pkg/repl"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// replHelp is the help text shown by the :help REPL command.
+const replHelp = `Enter statements to run them, or expressions to see their values and types.
+Declarations (functions, Passages and globals blocks) are kept for the rest of
+the session; declaring something again replaces it. Top-level variables become
+global variables, so they are also kept.
+
+Commands:
+    :ast <code>       print the abstract syntax tree of the code, without running it
+    :disasm [<name>]  disassemble the functions, Passages and latest input, or
+                      just the function or Passage named <name>
+    :globals          list the global variables, with their types and values
+    :help             show this help
+    :quit             quit (end of input works, too)`
+
+// runREPL runs the repl command.
+func runREPL(args []string) int {
+	fs := newFlagSet("repl", "[<file or directory>...]",
+		"Starts an interactive session, in which Romualdo code is run as it is\n"+
+			"entered. Enter :help in the session for details.\n\n"+
+			"The declarations from the source files passed as arguments are loaded\n"+
+			"into the session. Each argument can be either a source file or a\n"+
+			"directory, in which case all "+frontend.SourceExtension+" files in it (and in its\n"+
+			"subdirectories) are used.")
+
+	posArgs, exitCode, ok := parseArgs(fs, args, -1)
+	if !ok {
+		return exitCode
+	}
+
+	theVM := vm.New()
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		printAttributes(event.Attributes)
+	})
+	session := repl.New(theVM)
+
+	fileSet := frontend.NewFileSet()
+	for _, path := range posArgs {
+		if err := fileSet.AddPath(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
+			return exitCodeUsageError
+		}
+	}
+	for _, file := range fileSet.Files() {
+		if _, err := session.Eval(file.Source); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %v:\n", file.Name)
+			reportInputErrors(err, file.Source)
+			return exitCodeCompilationError
+		}
+	}
+
+	fmt.Println("Romualdo REPL. Enter :help for help.")
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		code, ok := readREPLInput(input)
+		if !ok {
+			fmt.Println()
+			return exitCodeSuccess
+		}
+
+		if strings.HasPrefix(code, ":") {
+			if quit := runREPLCommand(session, code); quit {
+				return exitCodeSuccess
+			}
+			continue
+		}
+
+		evalREPLInput(session, input, code)
+	}
+}
+
+// readREPLInput reads the next input from the user, which can span multiple
+// lines. ok is false if there is no more input.
+func readREPLInput(input *bufio.Scanner) (code string, ok bool) {
+	fmt.Print(">>> ")
+	if !input.Scan() {
+		return "", false
+	}
+	code = strings.TrimSpace(input.Text())
+
+	// Only :ast takes code; the other commands are always single-line.
+	incomplete := func() bool {
+		if strings.HasPrefix(code, ":") {
+			name, arg := splitREPLCommand(code)
+			return name == ":ast" && arg != "" && repl.IsIncomplete(arg)
+		}
+		return repl.IsIncomplete(code)
+	}
+
+	for incomplete() {
+		fmt.Print("... ")
+		if !input.Scan() {
+			return "", false
+		}
+		code += "\n" + input.Text()
+	}
+
+	return code, true
+}
+
+// evalREPLInput evaluates code in session and prints the results. Input needed
+// by listen expressions is read from input.
+func evalREPLInput(session *repl.Session, input *bufio.Scanner, code string) {
+	result, err := session.Eval(code)
+	if err != nil {
+		reportInputErrors(err, code)
+		return
+	}
+
+	for result.Status == vm.StatusWaitingForInput {
+		printAttributes(session.VM.Listening().Attributes)
+		fmt.Print("> ")
+		if !input.Scan() {
+			return
+		}
+		result = session.Resume(input.Text())
+	}
+
+	if result.Status == vm.StatusRuntimeError {
+		reportRuntimeError(session.VM)
+		return
+	}
+
+	if result.Type != nil {
+		fmt.Printf("%v : %v\n", formatREPLValue(result.Value), result.Type)
+	}
+}
+
+// runREPLCommand runs one of the REPL commands (those starting with a colon).
+// Returns true if the session shall end.
+func runREPLCommand(session *repl.Session, code string) bool {
+	name, arg := splitREPLCommand(code)
+	switch name {
+	case ":ast":
+		node, err := session.AST(arg)
+		if err != nil {
+			reportInputErrors(err, arg)
+			return false
+		}
+		ap := &ASTPrinter{}
+		node.Walk(ap)
+		fmt.Print(ap)
+
+	case ":disasm":
+		listing, err := session.Disassemble(arg)
+		if err != nil {
+			reportInputErrors(err, "")
+			return false
+		}
+		fmt.Print(listing)
+
+	case ":globals":
+		for _, g := range session.Globals() {
+			fmt.Printf("%v: %v = %v\n", g.Name, g.Type, formatREPLValue(g.Value))
+		}
+
+	case ":help":
+		fmt.Println(replHelp)
+
+	case ":quit":
+		return true
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v (enter :help for help)\n", name)
+	}
+
+	return false
+}
+
+// splitREPLCommand splits a REPL command into its name and argument.
+func splitREPLCommand(code string) (name, arg string) {
+	parts := strings.SplitN(code, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// reportInputErrors prints err, which was caused by code entered by the user, to
+// the standard error.
+func reportInputErrors(err error, code string) {
+	var diags diagnostic.List
+	if !errors.As(err, &diags) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	for _, d := range diags {
+		diagnostic.Render(os.Stderr, d, code)
+	}
+}
+
+// formatREPLValue formats v for the REPL output. Unlike in the Storyworld
+// output, strings are quoted, so that they look like they do in the code.
+func formatREPLValue(v bytecode.Value) string {
+	if v.IsString() {
+		return fmt.Sprintf("%q", v.AsString())
+	}
+	return v.String()
+}
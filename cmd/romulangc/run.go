@@ -0,0 +1,194 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// runRun runs the run command.
+func runRun(args []string) int {
+	fs := newFlagSet("run", sourcesUsage,
+		"Runs a Storyworld. The arguments can be either source code or a single\n"+
+			"compiled storyworld; in the latter case, debug info is read from the\n"+
+			"sidecar file, if present. When the Storyworld listens, the choices are\n"+
+			"shown and the player's answer is read from the standard input, one per\n"+
+			"line.\n\n"+
+			sourcesHelp)
+	trace := fs.Bool("trace", false, "trace the execution, disassembling each instruction as it runs")
+	traceFormat := fs.String("trace-format", "text", "trace format: text (human-readable) or json (JSON Lines)")
+	traceFile := fs.String("trace-file", "", "write the trace to this file instead of the standard output (implies -trace)")
+	profile := fs.String("profile", "", "profile the execution and write a pprof profile to this file")
+	profileReport := fs.String("profile-report", "", "profile the execution and write a text report to this file")
+	noDebugInfo := fs.Bool("no-debug-info", false, "run without debug info, even if available")
+
+	posArgs, exitCode, ok := parseArgs(fs, args, oneOrMoreArgs)
+	if !ok {
+		return exitCode
+	}
+
+	csw, di, exitCode := loadStoryworld(posArgs, !*noDebugInfo)
+	if csw == nil {
+		return exitCode
+	}
+
+	theVM := vm.New()
+	if *trace || *traceFile != "" {
+		tracer, closeTrace, err := newTracer(*traceFormat, *traceFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitCodeUsageError
+		}
+		defer closeTrace()
+		theVM.Tracer = tracer
+	}
+	if *profile != "" || *profileReport != "" {
+		theVM.Profiler = vm.NewProfiler()
+		defer writeProfiles(theVM.Profiler, *profile, *profileReport)
+	}
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		printAttributes(event.Attributes)
+	})
+
+	input := bufio.NewScanner(os.Stdin)
+	status := theVM.Interpret(csw, di)
+	for status == vm.StatusWaitingForInput {
+		printAttributes(theVM.Listening().Attributes)
+		fmt.Print("> ")
+		if !input.Scan() {
+			fmt.Fprint(os.Stderr, "\nNo more input, but the Storyworld is still listening.\n")
+			return exitCodeInterpretationError
+		}
+		status = theVM.Resume(input.Text())
+	}
+
+	if status != vm.StatusFinished {
+		reportRuntimeError(theVM)
+		return exitCodeInterpretationError
+	}
+
+	return exitCodeSuccess
+}
+
+// newTracer creates the Tracer requested in the command line: format is the
+// trace format, and path is the file to write to (or an empty string to write
+// to the standard output). Traces written to files are buffered; the returned
+// function must be called when done tracing, to flush and close the file.
+func newTracer(format, path string) (vm.Tracer, func(), error) {
+	w := io.Writer(os.Stdout)
+	closeTrace := func() {}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error creating %v: %v", path, err)
+		}
+		buffered := bufio.NewWriter(f)
+		w = buffered
+		closeTrace = func() {
+			err := buffered.Flush()
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing %v: %v\n", path, err)
+			}
+		}
+	}
+
+	switch format {
+	case "text":
+		return vm.NewTextTracer(w), closeTrace, nil
+	case "json":
+		return vm.NewJSONTracer(w), closeTrace, nil
+	default:
+		closeTrace()
+		return nil, nil, fmt.Errorf("Unknown trace format: %v (expected text or json)", format)
+	}
+}
+
+// writeProfiles writes the statistics collected by profiler as a pprof profile
+// to pprofPath and as a text report to reportPath. Empty paths are skipped.
+// Errors are reported to the standard error.
+func writeProfiles(profiler *vm.Profiler, pprofPath, reportPath string) {
+	writeFile := func(path string, write func(w io.Writer) error) {
+		if path == "" {
+			return
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %v: %v\n", path, err)
+			return
+		}
+		buffered := bufio.NewWriter(f)
+		err = write(buffered)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %v: %v\n", path, err)
+		}
+	}
+
+	writeFile(pprofPath, profiler.WritePprof)
+	writeFile(reportPath, profiler.WriteReport)
+}
+
+// reportRuntimeError writes the runtime error that stopped theVM to the
+// standard error: the message, the source code excerpt where it happened, and
+// the stack trace. Does nothing if theVM didn't stop because of an error.
+func reportRuntimeError(theVM *vm.VM) {
+	d := theVM.LastError()
+	if d == nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%v\n", d)
+	showErrorSource(d)
+	for _, frame := range theVM.LastStackTrace() {
+		fmt.Fprintf(os.Stderr, "%v\n", frame)
+	}
+	fmt.Fprint(os.Stderr, "\n")
+}
+
+// showErrorSource shows the source code excerpt pointing to the runtime error
+// d. The source code is read from the file named in d (which comes from the
+// debug info), so this works only if that file is still around.
+func showErrorSource(d *diagnostic.Diagnostic) {
+	if d.File == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(d.File)
+	if err != nil {
+		return
+	}
+	diagnostic.RenderExcerpt(os.Stderr, d, string(data))
+}
+
+// printAttributes prints the attributes passed to a say statement or listen
+// expression to the standard output. The text comes first, followed by the
+// other attributes, one per line.
+func printAttributes(attrs vm.Attributes) {
+	if text, ok := attrs.Get("text"); ok {
+		fmt.Println(text)
+	}
+	for _, attr := range attrs {
+		if attr.Name != "text" {
+			fmt.Printf("    %v: %v\n", attr.Name, attr.Value)
+		}
+	}
+}
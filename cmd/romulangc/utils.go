@@ -0,0 +1,221 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020 Leandro Motta Barros                                          *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+const (
+	// cswExtension is the extension used for compiled storyworld files.
+	cswExtension = ".csw"
+
+	// debugInfoExtension is the extension used for debug info sidecar files.
+	debugInfoExtension = ".csd"
+)
+
+// newFlagSet creates a new flag set for the command named name. argsUsage
+// describes the positional arguments and description is a longer description
+// of the command; both are used in the help text.
+func newFlagSet(name, argsUsage, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: romulangc %v [flags] %v\n\n%v\n", name, argsUsage, description)
+
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprint(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// oneOrMoreArgs can be passed as the nArgs parameter of parseArgs to require at
+// least one positional argument.
+const oneOrMoreArgs = -2
+
+// sourcesUsage describes the positional arguments of the commands that take a
+// Storyworld split over multiple source files.
+const sourcesUsage = "<file or directory>..."
+
+// sourcesHelp explains the positional arguments of the commands that take a
+// Storyworld split over multiple source files.
+const sourcesHelp = "A Storyworld can be split over multiple source files. Each argument can\n" +
+	"be either a source file or a directory, in which case all " + frontend.SourceExtension + "\n" +
+	"files in it (and in its subdirectories) are used."
+
+// parseArgs parses the command-line arguments args using the flag set fs.
+// nArgs is the number of expected positional arguments (or -1 to accept any
+// number of them, or oneOrMoreArgs). Returns the positional arguments. If the command shall not
+// proceed (either because of an error or because help was requested), ok is
+// false and exitCode contains the exit code to use.
+func parseArgs(fs *flag.FlagSet, args []string, nArgs int) (posArgs []string, exitCode int, ok bool) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil, exitCodeSuccess, false
+	}
+	if err != nil {
+		return nil, exitCodeUsageError, false
+	}
+
+	if nArgs >= 0 && fs.NArg() != nArgs || nArgs == oneOrMoreArgs && fs.NArg() == 0 {
+		fs.Usage()
+		return nil, exitCodeUsageError, false
+	}
+
+	return fs.Args(), exitCodeSuccess, true
+}
+
+// parseFiles reads and parses the Storyworld made of the source files at paths.
+// Each path can be either a file or a directory; in the latter case, all source
+// files in the directory (and its subdirectories) are used. Returns the AST and
+// a map from file names to their source code, or, in case of errors, nils and
+// the exit code to use. Errors are reported to the standard error.
+func parseFiles(paths []string) (ast.Node, map[string]string, int) {
+	fileSet := frontend.NewFileSet()
+	for _, path := range paths {
+		if err := fileSet.AddPath(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
+			return nil, nil, exitCodeUsageError
+		}
+	}
+
+	root, diags := frontend.ParseFileSet(fileSet, nil)
+	if diags.HasErrors() {
+		reportErrors(fileSet.Sources(), diags)
+		return nil, nil, exitCodeCompilationError
+	}
+
+	return root, fileSet.Sources(), exitCodeSuccess
+}
+
+// reportErrors prints err to the standard error. If err is a diagnostic.List,
+// its Diagnostics are rendered with the offending source code, taken from
+// sources (which maps file names to their contents).
+func reportErrors(sources map[string]string, err error) {
+	var diags diagnostic.List
+	if !errors.As(err, &diags) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	diagnostic.RenderList(os.Stderr, diags, sources)
+}
+
+// compileFiles compiles the Storyworld made of the source files at paths (see
+// parseFiles). Returns the compiled storyworld and its debug info, or, in case
+// of errors, nils and the exit code to use. Errors are reported to the
+// standard error.
+func compileFiles(paths []string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo, int) {
+	root, sources, exitCode := parseFiles(paths)
+	if root == nil {
+		return nil, nil, exitCode
+	}
+
+	csw, di, err := backend.GenerateCode(root)
+	if err != nil {
+		reportErrors(sources, err)
+		return nil, nil, exitCodeCompilationError
+	}
+
+	return csw, di, exitCodeSuccess
+}
+
+// loadStoryworld loads the Storyworld at paths. This can be either a single
+// compiled storyworld or any number of source files and directories (see
+// parseFiles). For compiled storyworlds, the debug info is read from the
+// sidecar file, if it exists; it is an error if it exists but doesn't match the
+// compiled storyworld. Debug info is not loaded or generated if wantDebugInfo is
+// false. Returns the compiled storyworld and its debug info (which may be nil),
+// or, in case of errors, nils and the exit code to use. Errors are reported to
+// the standard error.
+func loadStoryworld(paths []string, wantDebugInfo bool) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo, int) {
+	if len(paths) != 1 || !isCompiledStoryworld(paths[0]) {
+		csw, di, exitCode := compileFiles(paths)
+		if !wantDebugInfo {
+			di = nil
+		}
+		return csw, di, exitCode
+	}
+
+	path := paths[0]
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", path, err)
+		return nil, nil, exitCodeUsageError
+	}
+
+	csw, err := bytecode.ReadCompiledStoryworld(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %v: %v\n", path, err)
+		return nil, nil, exitCodeUsageError
+	}
+
+	if !wantDebugInfo {
+		return csw, nil, exitCodeSuccess
+	}
+
+	diPath := debugInfoPath(path)
+	diFile, err := os.Open(diPath)
+	if os.IsNotExist(err) {
+		return csw, nil, exitCodeSuccess
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %v: %v\n", diPath, err)
+		return nil, nil, exitCodeUsageError
+	}
+	defer diFile.Close()
+
+	di, err := bytecode.ReadDebugInfo(diFile, csw)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %v: %v\n", diPath, err)
+		return nil, nil, exitCodeUsageError
+	}
+
+	return csw, di, exitCodeSuccess
+}
+
+// isCompiledStoryworld checks if the file at path is a compiled storyworld.
+// Returns false if it cannot tell (for example, because path is a directory or
+// doesn't exist); in this case, trying to read it as source code will report
+// the problem.
+func isCompiledStoryworld(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(bytecode.CSWMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, bytecode.CSWMagic)
+}
+
+// debugInfoPath returns the path of the debug info sidecar file corresponding
+// to the compiled storyworld at cswPath.
+func debugInfoPath(cswPath string) string {
+	return strings.TrimSuffix(cswPath, cswExtension) + debugInfoExtension
+}
@@ -7,16 +7,55 @@
 
 package ast
 
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
 // A Node is a node in Romualdo's AST (Abstract Syntax Tree).
 type Node interface {
 	// Type returns the type of Node.
 	Type() *Type
 
-	// Line returns the line of code that produced this node.
+	// Line returns the line of code that produced this node. This is the line
+	// where the node's Span starts.
 	Line() int
 
+	// Span returns the region of the source code that produced this node.
+	Span() Span
+
 	// Walk is used to traverse the AST using the visitor v. Must start by
 	// calling v.Enter(), then visit all subnodes (by calling their Walk()
 	// methods), and finish by calling v.Leave().
 	Walk(v Visitor)
 }
+
+// IsPublic checks if name is a public name. Names starting with an upper case
+// letter are public, and are visible everywhere in the Storyworld. Other names
+// are private, visible only in the file where they are declared.
+func IsPublic(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+// GlobalKey identifies a global name in a Storyworld. Since private names are
+// visible only in the file where they are declared, different files can declare
+// private names spelled the same way; File tells them apart. For public names,
+// File is always empty.
+type GlobalKey struct {
+	// File is the name of the file where the private name is declared, or an
+	// empty string for public names.
+	File string
+
+	// Name is the name itself.
+	Name string
+}
+
+// NewGlobalKey returns the GlobalKey of the global name declared in the file
+// named file. This is also the key a use of name in file refers to.
+func NewGlobalKey(name, file string) GlobalKey {
+	if IsPublic(name) {
+		return GlobalKey{Name: name}
+	}
+	return GlobalKey{File: file, Name: name}
+}
@@ -7,21 +7,44 @@
 
 package ast
 
+import "fmt"
+
 // BaseNode contains the functionality common to all AST nodes.
 type BaseNode struct {
-	// LineNumber stores the line number from where this node comes.
-	LineNumber int
+	// SourceSpan is the region of the source code from where this node comes.
+	SourceSpan Span
 }
 
 func (n *BaseNode) Line() int {
-	return n.LineNumber
+	return n.SourceSpan.Start.Line
+}
+
+func (n *BaseNode) Span() Span {
+	return n.SourceSpan
 }
 
 // Storyworld is an AST node representing the whole storyworld. It is the root
 // of the AST.
+//
+// A Storyworld can be split over multiple source files, in which case the
+// declarations from all of them are merged into a single Storyworld node. The
+// Span of such a Storyworld is the zero Span, as it doesn't correspond to a
+// single region of the source code. (The Spans of the declarations tell which
+// file each one came from.)
 type Storyworld struct {
 	BaseNode
 
+	// Files contains the names of the source files the Storyworld was parsed
+	// from, in the order they were parsed.
+	Files []string
+
+	// FileIDs maps the names of the source files to stable identifiers of
+	// them (their paths relative to the Storyworld root directory), which
+	// don't depend on where the compiler was run from. Private global names
+	// are qualified with these in the compiled Storyworld. May be nil, in which
+	// case the file names are used.
+	FileIDs map[string]string
+
 	// Declarations stores all the declarations that make up the Storyworld.
 	Declarations []Node
 }
@@ -38,6 +61,43 @@ func (n *Storyworld) Walk(v Visitor) {
 	v.Leave(n)
 }
 
+// LatestGlobalsBlock returns the globals block with the highest version, or nil
+// if the Storyworld has no globals block. Since globals blocks can only add
+// variables to the ones declared in previous versions, the latest one declares
+// all global variables of the Storyworld.
+func (n *Storyworld) LatestGlobalsBlock() *GlobalsBlock {
+	var latest *GlobalsBlock
+	for _, decl := range n.Declarations {
+		if g, ok := decl.(*GlobalsBlock); ok && (latest == nil || g.Version > latest.Version) {
+			latest = g
+		}
+	}
+	return latest
+}
+
+// GlobalVarsFiles returns the names of the files where each global variable of
+// the Storyworld was declared, indexed by the variable name. Each globals block
+// declares again all variables from the previous versions, but a variable
+// belongs to the file of the oldest globals block declaring it, which is where
+// it was introduced.
+func (n *Storyworld) GlobalVarsFiles() map[string]string {
+	files := map[string]string{}
+	versions := map[string]int{}
+	for _, decl := range n.Declarations {
+		g, ok := decl.(*GlobalsBlock)
+		if !ok {
+			continue
+		}
+		for _, v := range g.Vars {
+			if version, found := versions[v.Name]; !found || g.Version < version {
+				versions[v.Name] = g.Version
+				files[v.Name] = v.Span().Start.File
+			}
+		}
+	}
+	return files
+}
+
 // FloatLiteral is an AST node representing a floating point number literal.
 type FloatLiteral struct {
 	BaseNode
@@ -175,7 +235,9 @@ func (n *Binary) Type() *Type { // nolint: gocognit
 		case "==", "!=", "<", "<=", ">", ">=":
 			n.cachedType = TheTypeBool
 		case "+", "-", "*":
-			if n.LHS.Type().Tag == TypeString || n.LHS.Type().Tag == TypeBNum {
+			if n.hasInvalidOperand() {
+				n.cachedType = TheTypeInvalid
+			} else if n.LHS.Type().Tag == TypeString || n.LHS.Type().Tag == TypeBNum {
 				t := n.LHS.Type()
 				n.cachedType = t
 			} else if n.LHS.Type().Tag == TypeInt && n.RHS.Type().Tag == TypeInt {
@@ -185,13 +247,24 @@ func (n *Binary) Type() *Type { // nolint: gocognit
 				n.cachedType = TheTypeFloat
 			}
 		default:
-			n.cachedType = TheTypeFloat
+			if n.hasInvalidOperand() {
+				n.cachedType = TheTypeInvalid
+			} else {
+				n.cachedType = TheTypeFloat
+			}
 		}
 	}
 
 	return n.cachedType
 }
 
+// hasInvalidOperand checks if any of the operands has an invalid type. This
+// happens when an operand refers to an undeclared name; in this case the
+// result of the operation is invalid, too.
+func (n *Binary) hasInvalidOperand() bool {
+	return n.LHS.Type().Tag == TypeInvalid || n.RHS.Type().Tag == TypeInvalid
+}
+
 func (n *Binary) Walk(v Visitor) {
 	v.Enter(n)
 	n.LHS.Walk(v)
@@ -293,10 +366,46 @@ func (n *BuiltInFunction) Walk(v Visitor) {
 	v.Leave(n)
 }
 
+// NativeCall is an AST node representing a call to a native function, that is,
+// a function implemented by the program running the Storyworld.
+type NativeCall struct {
+	BaseNode
+
+	// Function contains the name of the native function being called.
+	Function string
+
+	// Arguments are the arguments passed to the native function.
+	Arguments []Node
+
+	// FunctionType is the type of the native function being called. It is
+	// nil if there is no native function with the given name.
+	FunctionType *Type
+}
+
+func (n *NativeCall) Type() *Type {
+	if n.FunctionType == nil {
+		return TheTypeInvalid
+	}
+	return n.FunctionType.ReturnType
+}
+
+func (n *NativeCall) Walk(v Visitor) {
+	v.Enter(n)
+	for _, arg := range n.Arguments {
+		arg.Walk(v)
+	}
+	v.Leave(n)
+}
+
 // GlobalsBlock is an AST node representing a globals block.
 type GlobalsBlock struct {
 	BaseNode
 
+	// Version is the globals block version. Each version can add new global
+	// variables or change the initializers of existing ones, when compared to
+	// the previous version.
+	Version int
+
 	// Vars contains the variables defined in this block.
 	Vars []*VarDecl
 }
@@ -318,6 +427,9 @@ type Parameter struct {
 	// Name is the parameter name.
 	Name string
 
+	// NameSpan is the region of the source code containing the name.
+	NameSpan Span
+
 	// Type is the parameter type.
 	Type *Type
 }
@@ -329,6 +441,9 @@ type FunctionDecl struct {
 	// Name contains the function name.
 	Name string
 
+	// NameSpan is the region of the source code containing the name.
+	NameSpan Span
+
 	// Parameters are the function parameters.
 	Parameters []Parameter
 
@@ -357,6 +472,89 @@ func (n *FunctionDecl) Walk(v Visitor) {
 	v.Leave(n)
 }
 
+// PassageDecl is an AST node representing a Passage declaration.
+type PassageDecl struct {
+	BaseNode
+
+	// Name contains the Passage name.
+	Name string
+
+	// NameSpan is the region of the source code containing the name (without
+	// the version).
+	NameSpan Span
+
+	// Version is the Passage version.
+	Version int
+
+	// Parameters are the Passage parameters.
+	Parameters []Parameter
+
+	// ReturnType is the Passage's return type.
+	ReturnType *Type
+
+	// Meta is the Passage's meta block. It is nil if the Passage doesn't have
+	// a meta block.
+	Meta *MetaBlock
+
+	// The statements comprising the Passage body.
+	Body *Block
+
+	//
+	// Fields used for code generation
+	//
+
+	// ChunkIndex is the index into the array of Chunks where the bytecode for
+	// this Passage is stored.
+	ChunkIndex int
+}
+
+func (n *PassageDecl) Type() *Type {
+	return TheTypeVoid
+}
+
+func (n *PassageDecl) Walk(v Visitor) {
+	v.Enter(n)
+	if n.Meta != nil {
+		n.Meta.Walk(v)
+	}
+	n.Body.Walk(v)
+	v.Leave(n)
+}
+
+// VersionedName returns the Passage name including its version, like
+// "Name@1". Different versions of a Passage can coexist in a Storyworld, and
+// this is how we tell them apart.
+func (n *PassageDecl) VersionedName() string {
+	return fmt.Sprintf("%v@%v", n.Name, n.Version)
+}
+
+// MetaVarName returns the name used to store the meta variable varName of this
+// Passage among the global variables. Each version of a Passage has its own set
+// of meta variables.
+func (n *PassageDecl) MetaVarName(varName string) string {
+	return n.VersionedName() + "." + varName
+}
+
+// MetaBlock is an AST node representing the meta block of a Passage.
+type MetaBlock struct {
+	BaseNode
+
+	// Vars contains the meta variables defined in this block.
+	Vars []*VarDecl
+}
+
+func (n *MetaBlock) Type() *Type {
+	return TheTypeVoid
+}
+
+func (n *MetaBlock) Walk(v Visitor) {
+	v.Enter(n)
+	for _, varDecl := range n.Vars {
+		varDecl.Walk(v)
+	}
+	v.Leave(n)
+}
+
 // FunctionCall is an AST node representing a function call.
 type FunctionCall struct {
 	BaseNode
@@ -369,10 +567,14 @@ type FunctionCall struct {
 
 	// FunctionType is the type of the function being called. This is the type
 	// of the function itself, including the return type and parameter types.
+	// It is nil if the function cannot be resolved.
 	FunctionType *Type
 }
 
 func (n *FunctionCall) Type() *Type {
+	if n.FunctionType == nil {
+		return TheTypeInvalid
+	}
 	return n.FunctionType.ReturnType
 }
 
@@ -413,6 +615,9 @@ type VarDecl struct {
 	// Name is teh variable name.
 	Name string
 
+	// NameSpan is the region of the source code containing the name.
+	NameSpan Span
+
 	// Initializer is the expression used to initialize thr variable.
 	Initializer Node
 
@@ -469,6 +674,9 @@ type Assignment struct {
 	// variable we are assigning to.
 	VarName string
 
+	// NameSpan is the region of the source code containing the variable name.
+	NameSpan Span
+
 	// VarType us the type of the variable receiving the assignment.
 	VarType *Type
 
@@ -669,3 +877,137 @@ func (n *Or) Walk(v Visitor) {
 	n.RHS.Walk(v)
 	v.Leave(n)
 }
+
+// SayStmt is an AST node representing a say statement. This sends a set of
+// attributes (for example, the narrative text and who is saying it) to the
+// program running the Storyworld.
+type SayStmt struct {
+	BaseNode
+
+	// Attributes contains the attributes being said, in the order they appear
+	// in the source code. A say statement with a plain expression, like
+	// `say "Hello"`, has a single attribute named "text".
+	Attributes []*Attribute
+}
+
+func (n *SayStmt) Type() *Type {
+	return TheTypeVoid
+}
+
+func (n *SayStmt) Walk(v Visitor) {
+	v.Enter(n)
+	for _, attr := range n.Attributes {
+		attr.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// ListenExpr is an AST node representing a listen expression. This suspends
+// the execution of the Storyworld, passing a set of attributes (typically
+// describing the choices available to the player) to the program running the
+// Storyworld. The value of the expression is the player's choice, as a string.
+type ListenExpr struct {
+	BaseNode
+
+	// Attributes contains the attributes passed to the program running the
+	// Storyworld, in the order they appear in the source code. Like with say
+	// statements, the short form (`listen "What now?"`) has a single attribute
+	// named "text".
+	Attributes []*Attribute
+}
+
+func (n *ListenExpr) Type() *Type {
+	return TheTypeString
+}
+
+func (n *ListenExpr) Walk(v Visitor) {
+	v.Enter(n)
+	for _, attr := range n.Attributes {
+		attr.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// Attribute is an AST node representing one of the attributes of a say
+// statement or listen expression.
+type Attribute struct {
+	BaseNode
+
+	// Name is the attribute name.
+	Name string
+
+	// Value is the attribute value.
+	Value Node
+}
+
+func (n *Attribute) Type() *Type {
+	return n.Value.Type()
+}
+
+func (n *Attribute) Walk(v Visitor) {
+	v.Enter(n)
+	n.Value.Walk(v)
+	v.Leave(n)
+}
+
+// GotoStmt is an AST node representing a goto statement. This abandons the
+// current Passage and transfers the control to another one. When the target
+// Passage returns, it returns directly to the caller of the abandoned Passage.
+type GotoStmt struct {
+	BaseNode
+
+	// Passage contains the Passage we are going to.
+	Passage *VarRef
+
+	// Arguments are the arguments passed to the Passage.
+	Arguments []Node
+
+	// PassageType is the type of the target Passage, including its return
+	// type and parameter types.
+	PassageType *Type
+}
+
+func (n *GotoStmt) Type() *Type {
+	return TheTypeVoid
+}
+
+func (n *GotoStmt) Walk(v Visitor) {
+	v.Enter(n)
+	n.Passage.Walk(v)
+	for _, arg := range n.Arguments {
+		arg.Walk(v)
+	}
+	v.Leave(n)
+}
+
+// GosubExpr is an AST node representing a gosub expression. This calls a
+// Passage, evaluating to the value it returns.
+type GosubExpr struct {
+	BaseNode
+
+	// Passage contains the Passage being called.
+	Passage *VarRef
+
+	// Arguments are the arguments passed to the Passage.
+	Arguments []Node
+
+	// PassageType is the type of the Passage being called, including its
+	// return type and parameter types.
+	PassageType *Type
+}
+
+func (n *GosubExpr) Type() *Type {
+	if n.PassageType == nil || n.PassageType.Tag != TypePassage {
+		return TheTypeInvalid
+	}
+	return n.PassageType.ReturnType
+}
+
+func (n *GosubExpr) Walk(v Visitor) {
+	v.Enter(n)
+	n.Passage.Walk(v)
+	for _, arg := range n.Arguments {
+		arg.Walk(v)
+	}
+	v.Leave(n)
+}
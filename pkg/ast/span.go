@@ -0,0 +1,61 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package ast
+
+import "fmt"
+
+// Position is a position in the source code.
+type Position struct {
+	// File is the name of the source file. Empty when parsing source code that
+	// doesn't come from a file (or whose file name is not known).
+	File string
+
+	// Offset is the (0-based) byte offset of the position from the start of
+	// the source code.
+	Offset int
+
+	// Line is the (1-based) line number.
+	Line int
+
+	// Column is the (1-based) column number, counted in runes (so that a
+	// multi-byte UTF-8 character counts as a single column).
+	Column int
+}
+
+// String converts the Position to a string in the "file:line:column" format.
+// The file is omitted if not known.
+func (p Position) String() string {
+	if p.File != "" {
+		return fmt.Sprintf("%v:%v:%v", p.File, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%v:%v", p.Line, p.Column)
+}
+
+// IsValid checks if the Position refers to an actual location in the source
+// code. The zero Position is not valid.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// Span is a region of the source code. Start is the position of the first
+// character in the region, End is the position just past the last one. Both
+// are always in the same file.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// String converts the Span to a string in the
+// "file:line:column-line:column" format. The file is omitted if not known.
+func (s Span) String() string {
+	lineCol := fmt.Sprintf("%v:%v-%v:%v", s.Start.Line, s.Start.Column, s.End.Line, s.End.Column)
+	if s.Start.File != "" {
+		return s.Start.File + ":" + lineCol
+	}
+	return lineCol
+}
@@ -40,6 +40,10 @@ const (
 	// TypeFunction identifies a function type. (The actual complete type of a
 	// function includes its parameter types and return type.)
 	TypeFunction
+
+	// TypePassage identifies a Passage type. Like with functions, the actual
+	// complete type of a Passage includes its parameter types and return type.
+	TypePassage
 )
 
 // Global instances of simple types, for which only one instance is ever
@@ -65,11 +69,11 @@ type Type struct {
 	Tag TypeTag
 
 	// ParameterTypes is a slice with the types the function parameters. Valid
-	// only of Tag == TypeFunction.
+	// only of Tag == TypeFunction or Tag == TypePassage.
 	ParameterTypes []*Type
 
 	// ReturnType is the type of the function return value. Valid only if
-	// Tag == TypeFunction.
+	// Tag == TypeFunction or Tag == TypePassage.
 	ReturnType *Type
 }
 
@@ -77,6 +81,8 @@ type Type struct {
 // his storyworld code.
 func (t Type) String() string {
 	switch t.Tag {
+	case TypeInvalid:
+		return "<invalid>"
 	case TypeVoid:
 		return "void"
 	case TypeInt:
@@ -89,12 +95,16 @@ func (t Type) String() string {
 		return "bool"
 	case TypeString:
 		return "string"
-	case TypeFunction:
+	case TypeFunction, TypePassage:
 		paramTypes := []string{}
 		for _, paramType := range t.ParameterTypes {
 			paramTypes = append(paramTypes, paramType.String())
 		}
-		return "function(" + strings.Join(paramTypes, ",") + "):" + t.ReturnType.String()
+		keyword := "function"
+		if t.Tag == TypePassage {
+			keyword = "passage"
+		}
+		return keyword + "(" + strings.Join(paramTypes, ",") + "):" + t.ReturnType.String()
 	default:
 		panic(fmt.Sprintf("unexpected type tag: %v", t.Tag))
 	}
@@ -110,3 +120,15 @@ func (t Type) IsNumeric() bool {
 func (t Type) IsUnboundedNumeric() bool {
 	return t.Tag == TypeInt || t.Tag == TypeFloat
 }
+
+// NativeFunction describes a native function: a function implemented by the
+// program running the Storyworld (the host), which the Storyworld can call.
+// This is what the compiler needs to know about native functions in order to
+// type-check calls to them.
+type NativeFunction struct {
+	// Name is the native function name.
+	Name string
+
+	// Type is the native function type. Its Tag is always TypeFunction.
+	Type *Type
+}
@@ -9,22 +9,71 @@ package backend
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
 	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
-// GenerateCode generates the bytecode for a given AST.
+// GenerateCode generates the bytecode for a given AST. In case of errors, the
+// returned error is a diagnostic.List.
 func GenerateCode(root ast.Node) (
 	chunk *bytecode.CompiledStoryworld,
 	debugInfo *bytecode.DebugInfo,
 	err error) {
 
+	csw := bytecode.NewCompiledStoryworld()
+	di := &bytecode.DebugInfo{}
+	if err := generate(root, csw, di, false); err != nil {
+		return nil, nil, err
+	}
+	return csw, di, nil
+}
+
+// AddCode generates the bytecode for a given AST and adds it to csw, whose
+// debug info is debugInfo. The AST is an increment to the Storyworld csw was
+// compiled from (see frontend.ParseIncrement()). Things declared in it replace
+// the ones declared before with the same names: global variables get their new
+// initial values, and functions and Passages get new Chunks. The code compiled
+// before refers to globals by index, so from now on it calls the new versions.
+//
+// In case of errors, the returned error is a diagnostic.List, and csw and
+// debugInfo are left unchanged.
+func AddCode(root ast.Node, csw *bytecode.CompiledStoryworld, debugInfo *bytecode.DebugInfo) error {
+	chunks := len(csw.Chunks)
+	constants := len(csw.Constants)
+	globals := append([]bytecode.GlobalVar{}, csw.Globals...)
+	entryPassage := csw.EntryPassage
+	globalsVersion := csw.GlobalsVersion
+
+	err := generate(root, csw, debugInfo, true)
+	if err != nil {
+		csw.Chunks = csw.Chunks[:chunks]
+		csw.Constants = csw.Constants[:constants]
+		csw.Globals = globals
+		csw.EntryPassage = entryPassage
+		csw.GlobalsVersion = globalsVersion
+		debugInfo.ChunksNames = debugInfo.ChunksNames[:chunks]
+		debugInfo.ChunksFiles = debugInfo.ChunksFiles[:chunks]
+		debugInfo.ChunksLines = debugInfo.ChunksLines[:chunks]
+		debugInfo.ChunksSpans = debugInfo.ChunksSpans[:chunks]
+		debugInfo.ChunksLocals = debugInfo.ChunksLocals[:chunks]
+	}
+	return err
+}
+
+// generate generates the bytecode for root into csw and debugInfo. If
+// incremental is true, csw may already contain code and globals, as explained
+// in AddCode().
+func generate(root ast.Node, csw *bytecode.CompiledStoryworld, debugInfo *bytecode.DebugInfo, incremental bool) (
+	err error) {
+
 	defer func() {
 		if r := recover(); r != nil {
-			chunk = nil
-			if e, ok := r.(*codeGeneratorError); ok {
-				err = e
+			if d, ok := r.(*diagnostic.Diagnostic); ok {
+				err = diagnostic.List{d}
 				return
 			}
 			panic(fmt.Sprintf("Unexpected error type: %T", r))
@@ -33,39 +82,46 @@ func GenerateCode(root ast.Node) (
 
 	passOne := &codeGeneratorPassOne{
 		codeGenerator: &codeGenerator{
-			csw:       bytecode.NewCompiledStoryworld(),
-			debugInfo: &bytecode.DebugInfo{},
-			nodeStack: make([]ast.Node, 0, 64),
+			csw:             csw,
+			debugInfo:       debugInfo,
+			nodeStack:       make([]ast.Node, 0, 64),
+			passageVersions: map[string]int{},
+			incremental:     incremental,
 		},
 	}
+	if incremental {
+		passOne.codeGenerator.findPassageVersions()
+	}
 	root.Walk(passOne)
 
 	if len(passOne.codeGenerator.nodeStack) > 0 {
-		return nil, nil, &codeGeneratorError{
-			msg: "Internal Compiler Error: node stack not empty between passes",
-		}
+		return diagnostic.List{{
+			Code:     diagnostic.CodeInternalError,
+			Severity: diagnostic.SeverityError,
+			Message:  "Internal compiler error: node stack not empty between passes",
+		}}
 	}
 
 	passTwo := &codeGeneratorPassTwo{
 		codeGenerator: &codeGenerator{
-			csw:       passOne.codeGenerator.csw,
-			debugInfo: passOne.codeGenerator.debugInfo,
-			nodeStack: passOne.codeGenerator.nodeStack,
+			csw:             passOne.codeGenerator.csw,
+			debugInfo:       passOne.codeGenerator.debugInfo,
+			nodeStack:       passOne.codeGenerator.nodeStack,
+			passageVersions: passOne.codeGenerator.passageVersions,
+			globalVarsFiles: passOne.codeGenerator.globalVarsFiles,
+			fileIDs:         passOne.codeGenerator.fileIDs,
+			incremental:     incremental,
 		},
 		currentChunkIndex: -1, // start with an invalid value, for easier debugging
 	}
 	root.Walk(passTwo)
-	return passTwo.codeGenerator.csw, passTwo.codeGenerator.debugInfo, nil
-}
 
-// codeGeneratorError is a type used in panics to report an error in code
-// generation.
-type codeGeneratorError struct {
-	msg string
-}
+	// Tie the debug information to the generated code. The hash is computed
+	// here, once, while the globals still have their initial values.
+	passTwo.codeGenerator.csw.UpdateHash()
+	passTwo.codeGenerator.debugInfo.CSWHash = passTwo.codeGenerator.csw.Hash()
 
-func (e *codeGeneratorError) Error() string {
-	return e.msg
+	return nil
 }
 
 // codeGenerator contains the code that is common among the actual code
@@ -85,12 +141,80 @@ type codeGenerator struct {
 	// scopeDepth keeps track of the current scope depth we are in. Level 0 is
 	// the global scope, and each nested block is one scope level deeper.
 	scopeDepth int
+
+	// passageVersions maps each Passage name (as returned by globalName()) to
+	// its latest version. Filled in pass one.
+	passageVersions map[string]int
+
+	// globalVarsFiles maps the names of the global variables to the files
+	// where they were declared. Filled in pass one.
+	globalVarsFiles map[string]string
+
+	// fileIDs maps the names of the source files to their stable identifiers
+	// (see ast.Storyworld.FileIDs). Filled in pass one.
+	fileIDs map[string]string
+
+	// incremental tells if we are adding code to a CompiledStoryworld that
+	// already contains some (see AddCode()). In this case, global names can
+	// be declared again.
+	incremental bool
 }
 
+// entryPassageName is the name of the Passage from where the execution of a
+// Storyworld starts.
+const entryPassageName = "Main"
+
 //
 // Other functions
 //
 
+// globalName returns the name under which the global name declared (or used)
+// in the file named file is stored in the globals pool. Private names are
+// qualified with the file identifier, like "chapters/intro.romulang:helper",
+// because different files can declare private names spelled the same way.
+// Public names, and names from unnamed files, are stored as they are.
+func (cg *codeGenerator) globalName(name, file string) string {
+	if ast.IsPublic(name) || file == "" {
+		return name
+	}
+	if id, ok := cg.fileIDs[file]; ok {
+		file = id
+	}
+	return file + ":" + name
+}
+
+// findPassageVersions fills cg.passageVersions with the latest version of each
+// Passage already in the globals pool.
+func (cg *codeGenerator) findPassageVersions() {
+	for _, g := range cg.csw.Globals {
+		if !g.Value.IsPassage() {
+			continue
+		}
+		at := strings.LastIndex(g.Name, "@")
+		version, err := strconv.Atoi(g.Name[at+1:])
+		if at < 0 || err != nil {
+			cg.ice("malformed Passage global name '%v'", g.Name)
+		}
+		if name := g.Name[:at]; version > cg.passageVersions[name] {
+			cg.passageVersions[name] = version
+		}
+	}
+}
+
+// passageGlobalName returns the name under which the given version of a Passage
+// is stored in the globals pool. Like ast.PassageDecl.VersionedName(), but
+// qualified as described in globalName().
+func (cg *codeGenerator) passageGlobalName(n *ast.PassageDecl) string {
+	return fmt.Sprintf("%v@%v", cg.globalName(n.Name, n.Span().Start.File), n.Version)
+}
+
+// metaVarGlobalName returns the name under which the meta variable varName of
+// the Passage n is stored in the globals pool. Like
+// ast.PassageDecl.MetaVarName(), but qualified as described in globalName().
+func (cg *codeGenerator) metaVarGlobalName(n *ast.PassageDecl, varName string) string {
+	return cg.passageGlobalName(n) + "." + varName
+}
+
 // isInsideGlobalsBlock checks if we are currently inside a globals block.
 func (cg *codeGenerator) isInsideGlobalsBlock() bool {
 	for _, node := range cg.nodeStack {
@@ -102,6 +226,17 @@ func (cg *codeGenerator) isInsideGlobalsBlock() bool {
 	return false
 }
 
+// isInsideMetaBlock checks if we are currently inside a Passage's meta block.
+func (cg *codeGenerator) isInsideMetaBlock() bool {
+	for _, node := range cg.nodeStack {
+		_, ok := node.(*ast.MetaBlock)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
 // beginScope gets called when we enter into a new scope.
 func (cg *codeGenerator) beginScope() {
 	cg.scopeDepth++
@@ -135,10 +270,11 @@ func (cg *codeGenerator) valueFromNode(node ast.Node) bytecode.Value {
 	case *ast.FloatLiteral:
 		return bytecode.NewValueFloat(n.Value)
 	case *ast.BNumLiteral:
-		// BNums are internally represented as floats.
-		return bytecode.NewValueFloat(n.Value)
+		return bytecode.NewValueBNum(n.Value)
 	case *ast.FunctionDecl:
 		return bytecode.NewValueFunction(n.ChunkIndex)
+	case *ast.PassageDecl:
+		return bytecode.NewValuePassage(n.ChunkIndex)
 	default:
 		cg.ice("Unexpected node of type %T", node)
 	}
@@ -148,20 +284,51 @@ func (cg *codeGenerator) valueFromNode(node ast.Node) bytecode.Value {
 // currentLine returns the source code line corresponding to whatever we are
 // currently compiling.
 func (cg *codeGenerator) currentLine() int {
+	if len(cg.nodeStack) == 0 {
+		return 0
+	}
 	return cg.nodeStack[len(cg.nodeStack)-1].Line()
 }
 
-// error panics, reporting an error on the current node with a given error
-// message.
-func (cg *codeGenerator) error(format string, a ...interface{}) {
-	e := &codeGeneratorError{
-		msg: fmt.Sprintf("[line %v]: %v", cg.currentLine(),
-			fmt.Sprintf(format, a...)),
+// currentSpan returns the region of the source code corresponding to whatever
+// we are currently compiling.
+func (cg *codeGenerator) currentSpan() ast.Span {
+	if len(cg.nodeStack) == 0 {
+		return ast.Span{}
+	}
+	return cg.nodeStack[len(cg.nodeStack)-1].Span()
+}
+
+// currentSourceSpan is like currentSpan, but returns the span in the format
+// used in the DebugInfo.
+func (cg *codeGenerator) currentSourceSpan() bytecode.SourceSpan {
+	span := cg.currentSpan()
+	return bytecode.SourceSpan{
+		StartLine:   span.Start.Line,
+		StartColumn: span.Start.Column,
+		EndLine:     span.End.Line,
+		EndColumn:   span.End.Column,
 	}
-	panic(e)
+}
+
+// error panics, reporting an error on the current node with a given error code
+// and message. The panic value is a *diagnostic.Diagnostic, which GenerateCode
+// recovers from.
+func (cg *codeGenerator) error(code diagnostic.Code, format string, a ...interface{}) {
+	span := cg.currentSpan()
+	panic(&diagnostic.Diagnostic{
+		Code:      code,
+		Severity:  diagnostic.SeverityError,
+		File:      span.Start.File,
+		Line:      span.Start.Line,
+		Column:    span.Start.Column,
+		EndLine:   span.End.Line,
+		EndColumn: span.End.Column,
+		Message:   fmt.Sprintf(format, a...),
+	})
 }
 
 // ice reports an internal compiler error.
 func (cg *codeGenerator) ice(format string, a ...interface{}) {
-	cg.error(fmt.Sprintf("Internal compiler error: %v", fmt.Sprintf(format, a...)))
+	cg.error(diagnostic.CodeInternalError, "Internal compiler error: %v", fmt.Sprintf(format, a...))
 }
@@ -14,4 +14,9 @@ type local struct {
 
 	// depth is the nesting level (AKA scope depth) of the local variable.
 	depth int
+
+	// debugIndex is the index of the local variable in the DebugInfo's
+	// ChunksLocals entry for the current Chunk, or -1 if it is not recorded
+	// there.
+	debugIndex int
 }
@@ -18,6 +18,16 @@ import (
 // This implements the ast.Visitor interface.
 type codeGeneratorPassOne struct {
 	codeGenerator *codeGenerator
+
+	// inMeta tells if we are inside a Passage's meta block.
+	inMeta bool
+
+	// globalsBlock is the globals block we are currently inside, or nil.
+	globalsBlock *ast.GlobalsBlock
+
+	// globalsVersions maps the name of each global variable declared in the
+	// latest globals block to the globals version that introduced it.
+	globalsVersions map[string]int
 }
 
 //
@@ -33,30 +43,95 @@ func (cg *codeGeneratorPassOne) Enter(node ast.Node) {
 	}
 
 	switch n := node.(type) {
+	case *ast.Storyworld:
+		cg.findGlobalsVersions(n)
+		cg.codeGenerator.globalVarsFiles = n.GlobalVarsFiles()
+		cg.codeGenerator.fileIDs = n.FileIDs
+
+	case *ast.GlobalsBlock:
+		cg.globalsBlock = n
+
+	case *ast.MetaBlock:
+		cg.inMeta = true
+
 	case *ast.VarDecl:
+		if cg.inMeta {
+			// Meta variables are handled along with their Passages.
+			break
+		}
+		if cg.globalsBlock.Version != cg.codeGenerator.csw.GlobalsVersion {
+			// Older globals blocks are only used to tell which version
+			// introduced each variable.
+			break
+		}
+
 		// Global variable
-		created := cg.codeGenerator.csw.SetGlobal(n.Name, cg.codeGenerator.valueFromNode(n.Initializer))
-		if !created {
+		name := cg.codeGenerator.globalName(n.Name, cg.codeGenerator.globalVarsFiles[n.Name])
+		created := cg.codeGenerator.csw.SetGlobal(name, cg.codeGenerator.valueFromNode(n.Initializer))
+		if !created && !cg.codeGenerator.incremental {
 			cg.codeGenerator.ice(
 				"duplicate definition of global name '%v' during pass one",
-				n.Name)
+				name)
 		}
+		i := cg.codeGenerator.csw.GetGlobalIndex(name)
+		cg.codeGenerator.csw.Globals[i].Version = cg.globalsVersions[n.Name]
 
 	case *ast.FunctionDecl:
 		// Add a new Chunk for this function, create global representing it.
-		bytecode.AddChunk(cg.codeGenerator.csw, cg.codeGenerator.debugInfo, n)
-		created := cg.codeGenerator.csw.SetGlobal(n.Name, cg.codeGenerator.valueFromNode(n))
-		if !created {
+		// The debug info is for humans, which know the file from elsewhere, so
+		// the Chunk name there is not qualified.
+		name := cg.codeGenerator.globalName(n.Name, n.Span().Start.File)
+		n.ChunkIndex = bytecode.AddChunk(cg.codeGenerator.csw, cg.codeGenerator.debugInfo, n.Name, n.Span().Start.File)
+		created := cg.codeGenerator.csw.SetGlobal(name, cg.codeGenerator.valueFromNode(n))
+		if !created && !cg.codeGenerator.incremental {
 			cg.codeGenerator.ice(
 				"duplicate definition of global name '%v' during pass one",
-				n.Name)
+				name)
+		}
+
+	case *ast.PassageDecl:
+		// Add a new Chunk for this Passage, create global representing it. Each
+		// version of the Passage gets its own Chunk and global.
+		versionedName := cg.codeGenerator.passageGlobalName(n)
+		n.ChunkIndex = bytecode.AddChunk(cg.codeGenerator.csw, cg.codeGenerator.debugInfo, n.VersionedName(), n.Span().Start.File)
+		created := cg.codeGenerator.csw.SetGlobal(versionedName, cg.codeGenerator.valueFromNode(n))
+		if !created && !cg.codeGenerator.incremental {
+			cg.codeGenerator.ice(
+				"duplicate definition of global name '%v' during pass one",
+				versionedName)
+		}
+
+		name := cg.codeGenerator.globalName(n.Name, n.Span().Start.File)
+		if n.Version > cg.codeGenerator.passageVersions[name] {
+			cg.codeGenerator.passageVersions[name] = n.Version
+			if n.Name == entryPassageName {
+				cg.codeGenerator.csw.EntryPassage = n.ChunkIndex
+			}
+		}
+
+		// Meta variables are stored as globals, too.
+		if n.Meta != nil {
+			for _, v := range n.Meta.Vars {
+				metaName := cg.codeGenerator.metaVarGlobalName(n, v.Name)
+				created := cg.codeGenerator.csw.SetGlobal(metaName, cg.codeGenerator.valueFromNode(v.Initializer))
+				if !created && !cg.codeGenerator.incremental {
+					cg.codeGenerator.ice(
+						"duplicate definition of global name '%v' during pass one",
+						metaName)
+				}
+			}
 		}
 	}
 }
 
 func (cg *codeGeneratorPassOne) Leave(node ast.Node) {
-	if _, ok := node.(*ast.Block); ok {
+	switch node.(type) {
+	case *ast.Block:
 		cg.codeGenerator.endScope()
+	case *ast.GlobalsBlock:
+		cg.globalsBlock = nil
+	case *ast.MetaBlock:
+		cg.inMeta = false
 	}
 
 	if cg.codeGenerator.scopeDepth > 0 {
@@ -66,3 +141,32 @@ func (cg *codeGeneratorPassOne) Leave(node ast.Node) {
 
 func (cg *codeGeneratorPassOne) Event(node ast.Node, event int) {
 }
+
+//
+// Other functions
+//
+
+// findGlobalsVersions sets the globals version of the CompiledStoryworld to the
+// latest globals block version found in sw, and fills cg.globalsVersions with
+// the version that introduced each global variable.
+func (cg *codeGeneratorPassOne) findGlobalsVersions(sw *ast.Storyworld) {
+	cg.globalsVersions = map[string]int{}
+
+	latest := sw.LatestGlobalsBlock()
+	if latest == nil {
+		return
+	}
+	cg.codeGenerator.csw.GlobalsVersion = latest.Version
+
+	for _, decl := range sw.Declarations {
+		g, ok := decl.(*ast.GlobalsBlock)
+		if !ok {
+			continue
+		}
+		for _, v := range g.Vars {
+			if ver, ok := cg.globalsVersions[v.Name]; !ok || g.Version < ver {
+				cg.globalsVersions[v.Name] = g.Version
+			}
+		}
+	}
+}
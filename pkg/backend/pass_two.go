@@ -8,10 +8,12 @@
 package backend
 
 import (
+	"fmt"
 	"math"
 
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
 	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // codeGeneratorPassTwo does the actual bytecode generation. It fills in the
@@ -27,6 +29,10 @@ type codeGeneratorPassTwo struct {
 	// currentChunkIndex contains the index of the chunk we are currently
 	// generating code for.
 	currentChunkIndex int
+
+	// currentPassage is the Passage we are currently generating code for. It
+	// is nil when we are not inside a Passage.
+	currentPassage *ast.PassageDecl
 }
 
 //
@@ -44,27 +50,23 @@ func (cg *codeGeneratorPassTwo) Enter(node ast.Node) {
 		n.ConditionAddress = len(cg.currentChunk().Code)
 
 	case *ast.FunctionDecl:
-		// Even though the function body is already a Block that does the
-		// scoping little dance, we do it also for function declarations -- here
-		// and on Leave(), where we pop the descoped arguments. Not sure this is
-		// the most elegant way to do it.
-		cg.codeGenerator.beginScope()
+		cg.enterCallable(n.Parameters, n.ChunkIndex)
 
-		// According to our calling convention, the callable thing is passed as
-		// the zeroth argument in a function call. It will always be on the
-		// stack in calls. So, here we define a pseudo, nameless local variable
-		// to take the corresponding spot on our list of local variables.
-		if !cg.defineLocalVariable("") {
-			break
-		}
+	case *ast.PassageDecl:
+		// For the VM, Passages follow the same calling convention as
+		// functions.
+		cg.enterCallable(n.Parameters, n.ChunkIndex)
+		cg.currentPassage = n
 
-		for _, param := range n.Parameters {
-			if !cg.defineLocalVariable(param.Name) {
-				break
-			}
-		}
+	case *ast.NativeCall:
+		// Native functions are identified by name. The name goes on the stack
+		// before the arguments, like the callee in a regular function call.
+		cg.emitConstant(cg.newInternedValueString(n.Function))
+
+	case *ast.Attribute:
+		// The attribute name goes to the stack right before its value.
+		cg.emitConstant(cg.newInternedValueString(n.Name))
 
-		cg.currentChunkIndex = n.ChunkIndex
 	default:
 		// nothing
 	}
@@ -82,10 +84,14 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) { // nolint: funlen, gocycl
 		cg.emitConstant(bytecode.NewValueInt(n.Value))
 
 	case *ast.BNumLiteral:
-		// For the VM, a BNum is just a float.
-		cg.emitConstant(bytecode.NewValueFloat(n.Value))
+		cg.emitConstant(bytecode.NewValueBNum(n.Value))
 
 	case *ast.BoolLiteral:
+		if cg.codeGenerator.isInsideGlobalsBlock() || cg.codeGenerator.isInsideMetaBlock() {
+			// Initialized directly from the AST, like constants are (see
+			// emitConstant()).
+			break
+		}
 		if n.Value {
 			cg.emitBytes(bytecode.OpTrue)
 		} else {
@@ -199,30 +205,26 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) { // nolint: funlen, gocycl
 		}
 		cg.emitBytes(bytecode.OpPrint)
 
-	case *ast.GlobalsBlock:
+	case *ast.GlobalsBlock, *ast.MetaBlock:
 		break
 
 	case *ast.VarDecl:
-		if cg.codeGenerator.isInsideGlobalsBlock() {
-			// Globals were already handled by the globalsExtractor.
+		if cg.codeGenerator.isInsideGlobalsBlock() || cg.codeGenerator.isInsideMetaBlock() {
+			// Globals and meta variables were already handled by pass one.
 			break
 		}
-		cg.defineLocalVariable(n.Name)
+		cg.defineLocalVariable(n.Name, n.Type(), n.NameSpan.Start.Line)
 
 	case *ast.VarRef:
 		localIndex := cg.resolveLocal(n.Name)
 		if localIndex < 0 {
 			// It's a global
-			i := cg.codeGenerator.csw.GetGlobalIndex(n.Name)
+			globalName := cg.resolveGlobalName(n.Name)
+			i := cg.codeGenerator.csw.GetGlobalIndex(globalName)
 			if i < 0 {
-				cg.codeGenerator.ice("global variable '%v' not found in the globals pool", n.Name)
-			}
-			if i > 255 {
-				// TODO: Can this even happen? I guess GetGlobalIndex will never return
-				// anything over 255.
-				cg.codeGenerator.error("Currently only up to 255 global variables are supported.")
+				cg.codeGenerator.ice("global variable '%v' not found in the globals pool", globalName)
 			}
-			cg.emitBytes(bytecode.OpReadGlobal, byte(i))
+			cg.emitGlobalOp(bytecode.OpReadGlobal, bytecode.OpReadGlobalLong, i)
 		} else {
 			// It's a local
 			cg.emitBytes(bytecode.OpReadLocal, byte(localIndex))
@@ -232,16 +234,11 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) { // nolint: funlen, gocycl
 		localIndex := cg.resolveLocal(n.VarName)
 		if localIndex < 0 {
 			// It's a global
-			i := cg.codeGenerator.csw.GetGlobalIndex(n.VarName)
+			i := cg.codeGenerator.csw.GetGlobalIndex(cg.resolveGlobalName(n.VarName))
 			if i < 0 {
-				cg.codeGenerator.error("Global variable '%v' not declared.", n.VarName)
+				cg.codeGenerator.error(diagnostic.CodeUndeclaredGlobal, "Global variable '%v' not declared.", n.VarName)
 			}
-			if i > 255 {
-				// TODO: Can this even happen? I guess GetGlobalIndex will never return
-				// anything over 255.
-				cg.codeGenerator.error("Currently only up to 255 global variables are supported.")
-			}
-			cg.emitBytes(bytecode.OpWriteGlobal, byte(i))
+			cg.emitGlobalOp(bytecode.OpWriteGlobal, bytecode.OpWriteGlobalLong, i)
 		} else {
 			// It's a local
 			cg.emitBytes(bytecode.OpWriteLocal, byte(localIndex))
@@ -263,40 +260,36 @@ func (cg *codeGeneratorPassTwo) Leave(node ast.Node) { // nolint: funlen, gocycl
 		// Create a function object referring to the Chunk of compiled bytecode
 		// we just generated and store it in a global variable with the function
 		// name.
-		f := bytecode.Value{
-			Value: bytecode.Function{
-				ChunkIndex: cg.currentChunkIndex,
-			},
-		}
-		cg.codeGenerator.csw.SetGlobal(n.Name, f)
+		f := bytecode.NewValueFunction(cg.currentChunkIndex)
+		cg.codeGenerator.csw.SetGlobal(cg.codeGenerator.globalName(n.Name, n.Span().Start.File), f)
 
-		// No need to worry about duplicate `main`s: the semantic checker
-		// already verified this.
-		if n.Name == "main" {
-			cg.codeGenerator.csw.FirstChunk = cg.currentChunkIndex
-		}
+		cg.leaveCallable(n.ReturnType)
 
-		cg.codeGenerator.endScope()
-		cg.popDescopedLocals()
+	case *ast.PassageDecl:
+		// The global representing the Passage was created in pass one.
+		cg.leaveCallable(n.ReturnType)
+		cg.currentPassage = nil
 
-		// TODO: For now, we add an implicit return at the end of all void
-		// functions. Later on we'll want to do that only if the function
-		// doesn't already have a return statement at the end.
-		if n.ReturnType.Tag == ast.TypeVoid {
-			cg.emitBytes(bytecode.OpReturnVoid)
-		}
+	case *ast.FunctionCall:
+		cg.emitBytes(bytecode.OpCall, cg.argumentCount(n.Arguments))
 
-		// Leave the current chunk index invalid, as we are outside of any function.
-		cg.currentChunkIndex = -1
+	case *ast.NativeCall:
+		cg.emitBytes(bytecode.OpCallNative, cg.argumentCount(n.Arguments))
 
-	case *ast.FunctionCall:
-		argCount := len(n.Arguments)
-		maxArgs := math.MaxUint8
-		if argCount > maxArgs {
-			cg.codeGenerator.error("Found function call with %v arguments, max supported is %v.",
-				argCount, maxArgs)
-		}
-		cg.emitBytes(bytecode.OpCall, uint8(argCount))
+	case *ast.Attribute:
+		break
+
+	case *ast.SayStmt:
+		cg.emitBytes(bytecode.OpSay, cg.attributeCount(n.Attributes))
+
+	case *ast.ListenExpr:
+		cg.emitBytes(bytecode.OpListen, cg.attributeCount(n.Attributes))
+
+	case *ast.GotoStmt:
+		cg.emitBytes(bytecode.OpGoto, cg.argumentCount(n.Arguments))
+
+	case *ast.GosubExpr:
+		cg.emitBytes(bytecode.OpGosub, cg.argumentCount(n.Arguments))
 
 	case *ast.ReturnStmt:
 		if n.ReturnValue == nil {
@@ -395,6 +388,85 @@ func (cg *codeGeneratorPassTwo) currentLines() *[]int {
 	return &cg.codeGenerator.debugInfo.ChunksLines[cg.currentChunkIndex]
 }
 
+// currentSpans returns the current array mapping instructions to source code
+// spans. Same ugliness as currentLines().
+func (cg *codeGeneratorPassTwo) currentSpans() *[]bytecode.SourceSpan {
+	return &cg.codeGenerator.debugInfo.ChunksSpans[cg.currentChunkIndex]
+}
+
+// currentDebugLocals returns the local variables recorded in the debug info
+// for the current Chunk. Same ugliness as currentLines().
+func (cg *codeGeneratorPassTwo) currentDebugLocals() *[]bytecode.LocalVar {
+	return &cg.codeGenerator.debugInfo.ChunksLocals[cg.currentChunkIndex]
+}
+
+// enterCallable does the work needed when entering a function or Passage
+// declaration. parameters are the declared parameters and chunkIndex is the
+// index of the Chunk that will receive the generated code.
+func (cg *codeGeneratorPassTwo) enterCallable(parameters []ast.Parameter, chunkIndex int) {
+	// Even though the function body is already a Block that does the scoping
+	// little dance, we do it also for function declarations -- here and on
+	// leaveCallable(), where we pop the descoped arguments. Not sure this is
+	// the most elegant way to do it.
+	cg.codeGenerator.beginScope()
+
+	cg.currentChunkIndex = chunkIndex
+
+	// According to our calling convention, the callable thing is passed as the
+	// zeroth argument in a function call. It will always be on the stack in
+	// calls. So, here we define a pseudo, nameless local variable to take the
+	// corresponding spot on our list of local variables.
+	if !cg.defineLocalVariable("", nil, 0) {
+		return
+	}
+
+	for _, param := range parameters {
+		if !cg.defineLocalVariable(param.Name, param.Type, param.NameSpan.Start.Line) {
+			return
+		}
+	}
+}
+
+// leaveCallable does the work needed when leaving a function or Passage
+// declaration. returnType is the declared return type.
+func (cg *codeGeneratorPassTwo) leaveCallable(returnType *ast.Type) {
+	cg.codeGenerator.endScope()
+	cg.popDescopedLocals()
+
+	// TODO: For now, we add an implicit return at the end of all void
+	// functions. Later on we'll want to do that only if the function doesn't
+	// already have a return statement at the end.
+	if returnType.Tag == ast.TypeVoid {
+		cg.emitBytes(bytecode.OpReturnVoid)
+	}
+
+	// Leave the current chunk index invalid, as we are outside of any function.
+	cg.currentChunkIndex = -1
+}
+
+// argumentCount returns the number of arguments in args, as used in the
+// immediate operand of the CALL, GOTO and GOSUB instructions.
+func (cg *codeGeneratorPassTwo) argumentCount(args []ast.Node) byte {
+	argCount := len(args)
+	maxArgs := math.MaxUint8
+	if argCount > maxArgs {
+		cg.codeGenerator.error(diagnostic.CodeTooManyArguments, "Found call with %v arguments, max supported is %v.",
+			argCount, maxArgs)
+	}
+	return uint8(argCount)
+}
+
+// attributeCount returns the number of attributes in attrs, as used in the
+// immediate operand of the SAY and LISTEN instructions.
+func (cg *codeGeneratorPassTwo) attributeCount(attrs []*ast.Attribute) byte {
+	attrCount := len(attrs)
+	maxAttrs := math.MaxUint8
+	if attrCount > maxAttrs {
+		cg.codeGenerator.error(diagnostic.CodeTooManyAttributes, "Found %v attributes, max supported is %v.", attrCount, maxAttrs)
+	}
+	return uint8(attrCount)
+}
+
 // emitBytes writes one or more bytes to the bytecode chunk being generated.
 func (cg *codeGeneratorPassTwo) emitBytes(bytes ...byte) {
 	for _, b := range bytes {
@@ -402,14 +474,17 @@ func (cg *codeGeneratorPassTwo) emitBytes(bytes ...byte) {
 		chunk.Code = append(chunk.Code, b)
 		lines := cg.currentLines()
 		*lines = append(*lines, cg.codeGenerator.currentLine())
+		spans := cg.currentSpans()
+		*spans = append(*spans, cg.codeGenerator.currentSourceSpan())
 	}
 }
 
 // emitConstant emits the bytecode for a constant having a given value.
 func (cg *codeGeneratorPassTwo) emitConstant(value bytecode.Value) {
-	if cg.codeGenerator.isInsideGlobalsBlock() {
-		// Globals are initialized directly from the initializer value from the
-		// AST. No need to push the initializer value to the stack.
+	if cg.codeGenerator.isInsideGlobalsBlock() || cg.codeGenerator.isInsideMetaBlock() {
+		// Globals and meta variables are initialized directly from the
+		// initializer value from the AST. No need to push the initializer value
+		// to the stack.
 		return
 	}
 
@@ -423,6 +498,24 @@ func (cg *codeGeneratorPassTwo) emitConstant(value bytecode.Value) {
 	}
 }
 
+// emitGlobalOp emits the bytecode for an instruction reading or writing the
+// global variable at index. op is the opcode taking a single-byte index, used
+// whenever possible; longOp is the one taking a 31-bit index.
+func (cg *codeGeneratorPassTwo) emitGlobalOp(op, longOp uint8, index int) {
+	if index >= bytecode.MaxGlobals {
+		cg.codeGenerator.error(diagnostic.CodeTooManyGlobals, "Too many global variables.")
+		return
+	}
+
+	if index <= math.MaxUint8 {
+		cg.emitBytes(op, byte(index))
+	} else {
+		operandStart := len(cg.currentChunk().Code) + 1
+		cg.emitBytes(longOp, 0, 0, 0, 0)
+		bytecode.EncodeUInt31(cg.currentChunk().Code[operandStart:], index)
+	}
+}
+
 // makeConstant adds value to the pool of constants and returns the index in
 // which it was added. If there is already a constant with this value, its index
 // is returned (hey, we don't need duplicate constants, right? They are
@@ -434,30 +527,47 @@ func (cg *codeGeneratorPassTwo) makeConstant(value bytecode.Value) int {
 
 	constantIndex := cg.codeGenerator.csw.AddConstant(value)
 	if constantIndex >= bytecode.MaxConstantsPerChunk {
-		cg.codeGenerator.error("Too many constants in one chunk.")
+		cg.codeGenerator.error(diagnostic.CodeTooManyConstants, "Too many constants in one chunk.")
 		return 0
 	}
 
 	return constantIndex
 }
 
-// defineLocalVariable creates a new local variable called name (in other words,
-// this appends a proper entry to cg.locals). Assumes the corresponding value is
-// on the stack already. Returns true on success. On error, emits a compilation
-// error and returns false.
-func (cg *codeGeneratorPassTwo) defineLocalVariable(name string) bool {
+// defineLocalVariable creates a new local variable called name, of type
+// varType, declared at a given source code line (in other words, this appends a
+// proper entry to cg.locals). Assumes the corresponding value is on the stack
+// already. Named variables are also recorded in the debug info; they are live
+// from the next instruction on. Returns true on success. On error, emits a
+// compilation error and returns false.
+func (cg *codeGeneratorPassTwo) defineLocalVariable(name string, varType *ast.Type, line int) bool {
 	if len(cg.locals) == 256 {
-		cg.codeGenerator.error("Currently only up to 255 global variables are supported.")
+		cg.codeGenerator.error(diagnostic.CodeTooManyGlobals, "Currently only up to 255 global variables are supported.")
 		return false
 	}
 
 	for _, local := range cg.locals {
 		if local.name == name {
-			cg.codeGenerator.error("Local variable %q already defined. Shadowing not allowed.", name)
+			cg.codeGenerator.error(diagnostic.CodeShadowedLocal, "Local variable %q already defined. Shadowing not allowed.", name)
 		}
 	}
 
-	cg.locals = append(cg.locals, local{name: name, depth: cg.codeGenerator.scopeDepth})
+	debugIndex := -1
+	if name != "" {
+		debugLocals := cg.currentDebugLocals()
+		debugIndex = len(*debugLocals)
+		start := len(cg.currentChunk().Code)
+		*debugLocals = append(*debugLocals, bytecode.LocalVar{
+			Name:    name,
+			Type:    varType.String(),
+			Slot:    len(cg.locals),
+			StartIP: start,
+			EndIP:   start,
+			Line:    line,
+		})
+	}
+
+	cg.locals = append(cg.locals, local{name: name, depth: cg.codeGenerator.scopeDepth, debugIndex: debugIndex})
 	return true
 }
 
@@ -471,6 +581,9 @@ func (cg *codeGeneratorPassTwo) popDescopedLocals() {
 		// "function body block". This is wasteful but not a bug: these pops
 		// here will be unreachable code, because the RETURN_* will make us
 		// leave the function before we reach them.
+		if debugIndex := cg.locals[len(cg.locals)-1].debugIndex; debugIndex >= 0 {
+			(*cg.currentDebugLocals())[debugIndex].EndIP = len(cg.currentChunk().Code)
+		}
 		cg.emitBytes(bytecode.OpPop)
 		cg.locals = cg.locals[:len(cg.locals)-1]
 	}
@@ -496,6 +609,30 @@ func (cg *codeGeneratorPassTwo) resolveLocal(name string) int {
 	return -1
 }
 
+// resolveGlobalName returns the name under which the global variable referred
+// to as name (in the code we are currently generating) is stored in the
+// globals pool. Meta variables of the current Passage are stored with names
+// qualified by the Passage's versioned name, and Passage names refer to the
+// latest version of the Passage. Anything else is stored under its own name,
+// qualified by its file if private (see codeGenerator.globalName()).
+func (cg *codeGeneratorPassTwo) resolveGlobalName(name string) string {
+	if cg.currentPassage != nil && cg.currentPassage.Meta != nil {
+		for _, v := range cg.currentPassage.Meta.Vars {
+			if v.Name == name {
+				return cg.codeGenerator.metaVarGlobalName(cg.currentPassage, name)
+			}
+		}
+	}
+
+	file := cg.codeGenerator.currentSpan().Start.File
+	globalName := cg.codeGenerator.globalName(name, file)
+	if version, ok := cg.codeGenerator.passageVersions[globalName]; ok {
+		return fmt.Sprintf("%v@%v", globalName, version)
+	}
+
+	return globalName
+}
+
 // patchJump patches a jump instruction. This means two things. First, setting
 // the operand of the jump instruction at addressToPatch to jumpOffset. Second,
 // if a short jump instruction is currently used and the requested jump offset
@@ -510,7 +647,7 @@ func (cg *codeGeneratorPassTwo) resolveLocal(name string) int {
 // longer jump offsets.
 func (cg *codeGeneratorPassTwo) patchJump(addressToPatch, jumpOffset int) {
 	if jumpOffset > math.MaxInt32 || jumpOffset < math.MinInt32 {
-		cg.codeGenerator.error("Jump offset of %v is larger than supported.", jumpOffset)
+		cg.codeGenerator.error(diagnostic.CodeJumpTooLong, "Jump offset of %v is larger than supported.", jumpOffset)
 	}
 
 	if cg.isShortJumpOpcode(cg.currentChunk().Code[addressToPatch]) {
@@ -533,6 +670,9 @@ func (cg *codeGeneratorPassTwo) patchJump(addressToPatch, jumpOffset int) {
 		lines := cg.currentLines()
 		*lines = append(*lines, 0x00, 0x00, 0x00)
 		copy((*lines)[addressToPatch+4:], (*lines)[addressToPatch+1:end])
+		spans := cg.currentSpans()
+		*spans = append(*spans, bytecode.SourceSpan{}, bytecode.SourceSpan{}, bytecode.SourceSpan{})
+		copy((*spans)[addressToPatch+4:], (*spans)[addressToPatch+1:end])
 
 		// Don't return yet, we'll patch the jump offset right after this if
 		// block.
@@ -55,6 +55,16 @@ const (
 	OpWriteGlobal
 	OpReadLocal
 	OpWriteLocal
+	OpSay
+	OpListen
+	OpGoto
+	OpGosub
+	OpCallNative
+	OpReadGlobalLong
+	OpWriteGlobalLong
+
+	// Not really an opcode.
+	numberOfOpcodes
 )
 
 const (
@@ -68,6 +78,13 @@ const (
 	// have bytecode.OpConstantLong, which can deal with the whole range of
 	// supported indices between: 0 to 2_147_483_647 (=2^31-1).
 	MaxConstantsPerChunk = 2_147_483_648
+
+	// MaxGlobals is the maximum number of global variables (including
+	// functions, Passages and meta variables) a Storyworld can have. Like with
+	// constants, bytecode.OpReadGlobal and bytecode.OpWriteGlobal support
+	// indices between 0 and 255, and bytecode.OpReadGlobalLong and
+	// bytecode.OpWriteGlobalLong support the whole range.
+	MaxGlobals = 2_147_483_648
 )
 
 // A Chunk is a chunk of bytecode.
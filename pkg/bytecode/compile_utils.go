@@ -7,15 +7,16 @@
 
 package bytecode
 
-import "gitlab.com/stackedboxes/romulang/pkg/ast"
-
-// AddChunk adds a new Chunk to csw and the corresponding debug information to
-// di. Also sets funcDecl.ChunkIndex. Returns the new Chunk.
-func AddChunk(csw *CompiledStoryworld, di *DebugInfo, funcDecl *ast.FunctionDecl) *Chunk {
-	funcDecl.ChunkIndex = len(csw.Chunks)
-	newChunk := &Chunk{}
-	csw.Chunks = append(csw.Chunks, newChunk)
-	di.ChunksNames = append(di.ChunksNames, funcDecl.Name)
+// AddChunk adds a new, empty Chunk to csw and the corresponding debug
+// information to di. name is the name of the function or Passage whose code
+// will be stored in the Chunk, and file is the name of the source file where
+// it was declared. Returns the index of the new Chunk.
+func AddChunk(csw *CompiledStoryworld, di *DebugInfo, name, file string) int {
+	csw.Chunks = append(csw.Chunks, &Chunk{})
+	di.ChunksNames = append(di.ChunksNames, name)
+	di.ChunksFiles = append(di.ChunksFiles, file)
 	di.ChunksLines = append(di.ChunksLines, []int{})
-	return newChunk
+	di.ChunksSpans = append(di.ChunksSpans, []SourceSpan{})
+	di.ChunksLocals = append(di.ChunksLocals, []LocalVar{})
+	return len(csw.Chunks) - 1
 }
@@ -8,9 +8,10 @@
 package bytecode
 
 import (
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"strings"
 )
 
@@ -20,7 +21,7 @@ import (
 var CSWMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x43, 0x53, 0x57, 0x1A}
 
 // CSWVersion is the current version of a Romualdo Compiled Storyworld.
-const CSWVersion byte = 0
+const CSWVersion byte = 3
 
 // GlobalVar represents a global variable.
 type GlobalVar struct {
@@ -29,6 +30,11 @@ type GlobalVar struct {
 
 	// Value is the value of the global variable.
 	Value Value
+
+	// Version is the version of the globals block that introduced this
+	// variable. It is zero for globals that are not declared in a globals
+	// block, like functions, Passages and meta variables.
+	Version int
 }
 
 // CompiledStoryworld is a compiled, binary version of a Romualdo Language
@@ -42,21 +48,51 @@ type GlobalVar struct {
 //
 // - Magic
 //
-// - 32-bit version (currently 0)
+// - 32-bit version (currently 3)
 //
 // - 32-bit size (binary data size in bytes)
 //
 // - 32-bit CRC32 of the binary data (using the IEEE polynomial)
 //
 // - Binary data
+//
+// The binary data is comprised of:
+//
+// - 32-bit index of the Chunk of the entry Passage
+//
+// - 32-bit globals version
+//
+// - The string table: a 32-bit count followed by that many strings. Each string
+// is encoded as a 32-bit length followed by that many bytes of UTF-8 data.
+//
+// - The constants: a 32-bit count followed by that many Values.
+//
+// - The globals: a 32-bit count followed by that many globals. Each global is
+// encoded as a string (the name), a 32-bit globals version (the one that
+// introduced it) and a Value.
+//
+// - The Chunks: a 32-bit count followed by that many Chunks. Each Chunk is
+// encoded as a 32-bit length followed by that many bytes of bytecode.
+//
+// Each Value is encoded as a ValueKind byte followed by the payload, which
+// depends on the kind: floats and bnums are encoded as their 64-bit IEEE 754
+// representation; ints as 64-bit two's complement integers; bools as a single
+// byte (0 or 1); strings as a 32-bit index into the string table; and functions
+// and Passages as the 32-bit index of their Chunk.
 type CompiledStoryworld struct {
 	// Chunks is a slide with all Chunks of bytecode containing the compiled
 	// data. There is one Chunk for each
 	Chunks []*Chunk
 
-	// FirstChunk indexes the element in Chunks from where the Storyworld
-	// execution starts. In other words, it points to the "main" chunk.
-	FirstChunk int
+	// EntryPassage indexes the element in Chunks from where the Storyworld
+	// execution starts. In other words, it points to the Chunk of the entry
+	// Passage.
+	EntryPassage int
+
+	// GlobalsVersion is the version of the latest globals block of the
+	// Storyworld, or zero if it has no globals block. Used to upgrade saved
+	// states created by older versions of the Storyworld.
+	GlobalsVersion int
 
 	// Globals contains all the global variables.
 	Globals []GlobalVar
@@ -66,6 +102,10 @@ type CompiledStoryworld struct {
 
 	// Strings contains all the strings used in all Chunks.
 	Strings *StringInterner
+
+	// hash is the hash of the immutable contents of the CompiledStoryworld, as
+	// computed by UpdateHash(). Nil if not computed yet.
+	hash []byte
 }
 
 // NewCompiledStoryworld creates a new CompiledStoryworld. Goes without saying.
@@ -98,16 +138,277 @@ func (csw *CompiledStoryworld) SearchConstant(value Value) int {
 // ReadCompiledStoryworld deserializes a CompiledStoryworld, reading the binary
 // data from r.
 func ReadCompiledStoryworld(r io.Reader) (*CompiledStoryworld, error) {
-	// TODO: not implemented yet. This should probably use a string interner
-	// passed as parameter to allow all strings to be interned (both constants
-	// and the ones created in run-time).
-	return nil, errors.New("not implemented yet")
+	data, err := readWithHeader(r, CSWMagic, uint32(CSWVersion), "compiled storyworld")
+	if err != nil {
+		return nil, err
+	}
+
+	csw := NewCompiledStoryworld()
+	d := &deserializer{data: data, what: "compiled storyworld"}
+
+	csw.EntryPassage = d.readUInt32("entry passage chunk index")
+	csw.GlobalsVersion = d.readUInt32("globals version")
+
+	n := d.readCount("string count", 4)
+	stringTable := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		stringTable = append(stringTable, csw.Strings.Intern(d.readString("string")))
+	}
+
+	n = d.readCount("constant count", 1)
+	for i := 0; i < n; i++ {
+		csw.Constants = append(csw.Constants, readValue(d, stringTable))
+	}
+
+	n = d.readCount("global count", 9)
+	for i := 0; i < n; i++ {
+		name := d.readString("global name")
+		version := d.readUInt32("global version")
+		value := readValue(d, stringTable)
+		csw.Globals = append(csw.Globals, GlobalVar{Name: name, Value: value, Version: version})
+	}
+
+	n = d.readCount("chunk count", 4)
+	for i := 0; i < n; i++ {
+		csw.Chunks = append(csw.Chunks, &Chunk{Code: d.readBytes("chunk code")})
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if err := csw.validate(); err != nil {
+		return nil, fmt.Errorf("compiled storyworld: %w", err)
+	}
+
+	csw.UpdateHash()
+
+	return csw, nil
 }
 
 // WriteTo serializes a CompiledStoryworld, writing the binary data to w.
 func (csw *CompiledStoryworld) WriteTo(w io.Writer) (n int64, err error) {
-	// TODO: not implemented yet.
-	return 0, errors.New("not implemented yet")
+	return writeWithHeader(w, CSWMagic, uint32(CSWVersion), csw.serialize())
+}
+
+// Hash returns a hash (currently, SHA-256) of csw. Only the contents that
+// don't change as the Storyworld runs are hashed: the entry Passage, the
+// globals version, the constants, the Chunks, and the names, versions and
+// initial values of the globals. So, the hash stays the same while csw is
+// running.
+//
+// The hash is computed by UpdateHash(), which the compiler and
+// ReadCompiledStoryworld() call once csw is complete. If it was never called,
+// Hash() calls it, taking the current values of the globals as their initial
+// values.
+func (csw *CompiledStoryworld) Hash() []byte {
+	if csw.hash == nil {
+		csw.UpdateHash()
+	}
+	return csw.hash
+}
+
+// UpdateHash computes the hash returned by Hash() and stores it in csw. Call it
+// after changing the code or the initial values of a CompiledStoryworld, and
+// never while it is running.
+func (csw *CompiledStoryworld) UpdateHash() {
+	s := &serializer{}
+
+	s.writeUInt32(csw.EntryPassage)
+	s.writeUInt32(csw.GlobalsVersion)
+
+	s.writeUInt32(len(csw.Constants))
+	for _, v := range csw.Constants {
+		writeHashedValue(s, v)
+	}
+
+	s.writeUInt32(len(csw.Globals))
+	for _, g := range csw.Globals {
+		s.writeString(g.Name)
+		s.writeUInt32(g.Version)
+		writeHashedValue(s, g.Value)
+	}
+
+	s.writeUInt32(len(csw.Chunks))
+	for _, chunk := range csw.Chunks {
+		s.writeBytes(chunk.Code)
+	}
+
+	h := sha256.Sum256(s.bytes())
+	csw.hash = h[:]
+}
+
+// serialize serializes the binary data of csw (that is, everything but the
+// header).
+func (csw *CompiledStoryworld) serialize() []byte {
+	s := &serializer{}
+
+	s.writeUInt32(csw.EntryPassage)
+	s.writeUInt32(csw.GlobalsVersion)
+
+	// The string table contains all interned strings, plus any string used in
+	// a Value that for whatever reason was not interned.
+	allStrings := NewStringInterner()
+	for _, str := range csw.Strings.Strings() {
+		allStrings.Intern(str)
+	}
+	for _, v := range csw.Constants {
+		if v.IsString() {
+			allStrings.Intern(v.AsString())
+		}
+	}
+	for _, g := range csw.Globals {
+		if g.Value.IsString() {
+			allStrings.Intern(g.Value.AsString())
+		}
+	}
+
+	stringTable := allStrings.Strings()
+	stringIndices := make(map[string]int, len(stringTable))
+	s.writeUInt32(len(stringTable))
+	for i, str := range stringTable {
+		s.writeString(str)
+		stringIndices[str] = i
+	}
+
+	s.writeUInt32(len(csw.Constants))
+	for _, v := range csw.Constants {
+		writeValue(s, v, stringIndices)
+	}
+
+	s.writeUInt32(len(csw.Globals))
+	for _, g := range csw.Globals {
+		s.writeString(g.Name)
+		s.writeUInt32(g.Version)
+		writeValue(s, g.Value, stringIndices)
+	}
+
+	s.writeUInt32(len(csw.Chunks))
+	for _, chunk := range csw.Chunks {
+		s.writeBytes(chunk.Code)
+	}
+
+	return s.bytes()
+}
+
+// validate checks if the cross-references within csw are consistent. This
+// catches some cases of corrupted or maliciously crafted data that would
+// otherwise crash the VM.
+func (csw *CompiledStoryworld) validate() error {
+	if len(csw.Chunks) > 0 && csw.EntryPassage >= len(csw.Chunks) {
+		return fmt.Errorf("entry passage chunk index %v out of range (have %v chunks)",
+			csw.EntryPassage, len(csw.Chunks))
+	}
+
+	checkFunction := func(v Value, what string) error {
+		chunkIndex := -1
+		switch {
+		case v.IsFunction():
+			chunkIndex = v.AsFunction().ChunkIndex
+		case v.IsPassage():
+			chunkIndex = v.AsPassage().ChunkIndex
+		}
+		if chunkIndex >= len(csw.Chunks) {
+			return fmt.Errorf("%v refers to chunk %v, but there are only %v chunks",
+				what, chunkIndex, len(csw.Chunks))
+		}
+		return nil
+	}
+
+	for i, v := range csw.Constants {
+		if err := checkFunction(v, fmt.Sprintf("constant %v", i)); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range csw.Globals {
+		if err := checkFunction(g.Value, fmt.Sprintf("global '%v'", g.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeValue serializes the Value v using s. stringIndices maps the strings in
+// the string table to their indices.
+func writeValue(s *serializer, v Value, stringIndices map[string]int) {
+	kind := v.Kind()
+	s.writeByte(byte(kind))
+
+	switch kind {
+	case ValueFloat:
+		s.writeUInt64(math.Float64bits(v.AsFloat()))
+	case ValueBNum:
+		s.writeUInt64(math.Float64bits(v.AsBNum()))
+	case ValueInt:
+		s.writeUInt64(uint64(v.AsInt()))
+	case ValueBool:
+		if v.AsBool() {
+			s.writeByte(1)
+		} else {
+			s.writeByte(0)
+		}
+	case ValueString:
+		s.writeUInt32(stringIndices[v.AsString()])
+	case ValueFunction:
+		s.writeUInt32(v.AsFunction().ChunkIndex)
+	case ValuePassage:
+		s.writeUInt32(v.AsPassage().ChunkIndex)
+	default:
+		panic(fmt.Sprintf("Unexpected value kind: %v", kind))
+	}
+}
+
+// writeHashedValue serializes the Value v using s, for hashing purposes. It is
+// like writeValue, but strings are written in full instead of as indices into
+// the string table, which changes as the Storyworld runs.
+func writeHashedValue(s *serializer, v Value) {
+	if v.IsString() {
+		s.writeByte(byte(ValueString))
+		s.writeString(v.AsString())
+		return
+	}
+	writeValue(s, v, nil)
+}
+
+// readValue deserializes a Value using d. stringTable is the string table.
+func readValue(d *deserializer, stringTable []string) Value {
+	kind := ValueKind(d.readByte("value kind"))
+	if d.err != nil {
+		return Value{}
+	}
+
+	switch kind {
+	case ValueFloat:
+		return NewValueFloat(math.Float64frombits(d.readUInt64("float value")))
+	case ValueBNum:
+		return NewValueBNum(math.Float64frombits(d.readUInt64("bnum value")))
+	case ValueInt:
+		return NewValueInt(int64(d.readUInt64("int value")))
+	case ValueBool:
+		b := d.readByte("bool value")
+		if b > 1 {
+			d.fail("invalid bool value: %v", b)
+		}
+		return NewValueBool(b == 1)
+	case ValueString:
+		i := d.readUInt32("string index")
+		if d.err == nil && i >= len(stringTable) {
+			d.fail("string index %v out of range (have %v strings)", i, len(stringTable))
+		}
+		if d.err != nil {
+			return Value{}
+		}
+		return NewValueString(stringTable[i])
+	case ValueFunction:
+		return NewValueFunction(d.readUInt32("function chunk index"))
+	case ValuePassage:
+		return NewValuePassage(d.readUInt32("passage chunk index"))
+	default:
+		d.fail("unknown value kind %v", kind)
+		return Value{}
+	}
 }
 
 // GetGlobalIndex returns the index into csw.Globals where the global variable
@@ -136,47 +437,136 @@ func (csw *CompiledStoryworld) SetGlobal(name string, value Value) bool {
 	return false
 }
 
-// Disassemble disassembles the compiled storyworld and returns a string
-// representation of it. The fi argument can be nil, but in this case the
-// disassembling will be less friendly.
-// TODO: Make di really optional.
-func (csw *CompiledStoryworld) Disassemble(di *DebugInfo) string {
-	var out strings.Builder
+// UpgradeGlobals takes the global variables saved while running an older (or
+// the same) version of the Storyworld, and returns them upgraded to the
+// globals layout of csw. savedVersion is the globals version of the Storyworld
+// the globals were saved from.
+//
+// Functions and Passages always come from csw, as code may have changed; any
+// function or Passage in saved is ignored. Variables present in saved keep
+// their saved values. Variables introduced by a globals version newer than
+// savedVersion get their initial values from csw. Meta variables of Passage
+// versions that no longer exist in csw are dropped. Anything else is an
+// incompatibility and is reported as an error.
+func (csw *CompiledStoryworld) UpgradeGlobals(savedVersion int, saved []GlobalVar) ([]GlobalVar, error) {
+	if savedVersion > csw.GlobalsVersion {
+		return nil, fmt.Errorf("cannot upgrade globals from version %v to older version %v",
+			savedVersion, csw.GlobalsVersion)
+	}
 
-	fmt.Fprint(&out, "== Globals ==\n")
+	savedByName := make(map[string]GlobalVar, len(saved))
+	for _, g := range saved {
+		if g.Value.IsFunction() || g.Value.IsPassage() {
+			continue
+		}
+		if csw.GetGlobalIndex(g.Name) < 0 {
+			if g.Version == 0 {
+				// A meta variable of a Passage version that was removed.
+				continue
+			}
+			return nil, fmt.Errorf("saved global '%v' does not exist in globals version %v",
+				g.Name, csw.GlobalsVersion)
+		}
+		savedByName[g.Name] = g
+	}
 
-	for _, global := range csw.Globals {
-		name := global.Name
-		value := global.Value.Value
-		// TODO: This is showing the Go type. OK for now, but should be the Romualdo type.
-		fmt.Fprintf(&out, "Global  %v '%v' (%T)\n", name, value, value)
+	result := make([]GlobalVar, 0, len(csw.Globals))
+	for _, g := range csw.Globals {
+		s, ok := savedByName[g.Name]
+
+		switch {
+		case g.Value.IsFunction() || g.Value.IsPassage():
+			// Code always comes from the current version.
+
+		case ok:
+			if s.Value.Kind() != g.Value.Kind() {
+				return nil, fmt.Errorf("saved global '%v' has a value of the wrong kind (%v, expected %v)",
+					g.Name, s.Value.Kind(), g.Value.Kind())
+			}
+			g.Value = s.Value
+
+		case g.Version != 0 && g.Version <= savedVersion:
+			return nil, fmt.Errorf("global '%v' (from globals version %v) missing from saved globals version %v",
+				g.Name, g.Version, savedVersion)
+		}
+
+		result = append(result, g)
 	}
 
-	fmt.Fprint(&out, "\n\n")
+	return result, nil
+}
+
+// Disassemble disassembles the compiled storyworld and returns a string
+// representation of it. The di argument can be nil, but in this case the
+// disassembling will be less friendly: chunks are identified by their indices,
+// and neither source code lines nor local variable names are shown.
+func (csw *CompiledStoryworld) Disassemble(di *DebugInfo) string {
+	var out strings.Builder
+
+	csw.disassembleGlobals(&out)
 
 	for i, chunk := range csw.Chunks {
-		fmt.Fprintf(&out, "== %v ==\n", di.ChunksNames[i])
+		var lines []int
+		if di != nil {
+			fmt.Fprintf(&out, "== %v ==\n", di.ChunksNames[i])
+			lines = di.ChunksLines[i]
+		} else {
+			fmt.Fprintf(&out, "== chunk %v ==\n", i)
+		}
 
 		for offset := 0; offset < len(chunk.Code); {
-			offset = csw.DisassembleInstruction(chunk, &out, offset, di.ChunksLines[i])
+			offset = csw.DisassembleInstruction(chunk, &out, offset, lines, di.chunkLocals(i))
 		}
 	}
 
 	return out.String()
 }
 
+// disassembleGlobals writes the list of globals to out.
+func (csw *CompiledStoryworld) disassembleGlobals(out io.Writer) {
+	fmt.Fprint(out, "== Globals ==\n")
+
+	for _, global := range csw.Globals {
+		name := global.Name
+		value := global.Value
+		fmt.Fprintf(out, "Global  %v '%v' (%v)", name, value, value.Kind())
+		if global.Version > 0 {
+			fmt.Fprintf(out, " @%v", global.Version)
+		}
+		fmt.Fprint(out, "\n")
+	}
+
+	fmt.Fprint(out, "\n\n")
+}
+
 // DisassembleInstruction disassembles the instruction at a given offset and
 // returns the offset of the next instruction to disassemble. Output is written
-// to out.
-func (csw *CompiledStoryworld) DisassembleInstruction(chunk *Chunk, out io.Writer, offset int, lines []int) int { // nolint: gocyclo, funlen
+// to out. lines contains the source code lines for chunk (as in
+// DebugInfo.ChunksLines) and can be nil if no debug information is available.
+// Likewise, locals contains the local variables of chunk (as in
+// DebugInfo.ChunksLocals), used to show their names, and can be nil.
+func (csw *CompiledStoryworld) DisassembleInstruction(chunk *Chunk, out io.Writer, offset int, lines []int,
+	locals []LocalVar) int {
 	fmt.Fprintf(out, "%04v ", offset)
 
-	if offset > 0 && lines[offset] == lines[offset-1] {
+	if lines == nil {
+		fmt.Fprint(out, "   ? ")
+	} else if offset > 0 && lines[offset] == lines[offset-1] {
 		fmt.Fprint(out, "   | ")
 	} else {
 		fmt.Fprintf(out, "%4d ", lines[offset])
 	}
 
+	return csw.DisassembleOpcode(chunk, out, offset, locals)
+}
+
+// DisassembleOpcode disassembles the instruction at a given offset, writing
+// just the opcode name and its operands to out (unlike DisassembleInstruction,
+// which also writes the offset and source code line). locals is used to show
+// the names of local variables, and can be nil. Returns the offset of the next
+// instruction to disassemble.
+func (csw *CompiledStoryworld) DisassembleOpcode(chunk *Chunk, out io.Writer, offset int,
+	locals []LocalVar) int { // nolint: gocyclo, funlen
 	instruction := chunk.Code[offset]
 
 	switch instruction {
@@ -247,16 +637,28 @@ func (csw *CompiledStoryworld) DisassembleInstruction(chunk *Chunk, out io.Write
 		return csw.disassembleSimpleInstruction(out, "BLEND", offset)
 
 	case OpJump:
-		return csw.disassembleSByteInstruction(chunk, out, "JUMP", offset)
+		return csw.disassembleJumpInstruction(chunk, out, "JUMP", offset)
 
 	case OpJumpLong:
-		return csw.disassembleSIntInstruction(chunk, out, "JUMP_LONG", offset)
+		return csw.disassembleJumpLongInstruction(chunk, out, "JUMP_LONG", offset)
 
 	case OpJumpIfFalse:
-		return csw.disassembleSByteInstruction(chunk, out, "JUMP_IF_FALSE", offset)
+		return csw.disassembleJumpInstruction(chunk, out, "JUMP_IF_FALSE", offset)
 
 	case OpJumpIfFalseLong:
-		return csw.disassembleSIntInstruction(chunk, out, "JUMP_IF_FALSE_LONG", offset)
+		return csw.disassembleJumpLongInstruction(chunk, out, "JUMP_IF_FALSE_LONG", offset)
+
+	case OpJumpIfFalseNoPop:
+		return csw.disassembleJumpInstruction(chunk, out, "JUMP_IF_FALSE_NO_POP", offset)
+
+	case OpJumpIfFalseNoPopLong:
+		return csw.disassembleJumpLongInstruction(chunk, out, "JUMP_IF_FALSE_NO_POP_LONG", offset)
+
+	case OpJumpIfTrueNoPop:
+		return csw.disassembleJumpInstruction(chunk, out, "JUMP_IF_TRUE_NO_POP", offset)
+
+	case OpJumpIfTrueNoPopLong:
+		return csw.disassembleJumpLongInstruction(chunk, out, "JUMP_IF_TRUE_NO_POP_LONG", offset)
 
 	case OpCall:
 		return csw.disassembleUByteInstruction(chunk, out, "CALL", offset)
@@ -282,17 +684,38 @@ func (csw *CompiledStoryworld) DisassembleInstruction(chunk *Chunk, out io.Write
 	case OpPrint:
 		return csw.disassembleSimpleInstruction(out, "PRINT", offset)
 
+	case OpSay:
+		return csw.disassembleUByteInstruction(chunk, out, "SAY", offset)
+
+	case OpListen:
+		return csw.disassembleUByteInstruction(chunk, out, "LISTEN", offset)
+
+	case OpGoto:
+		return csw.disassembleUByteInstruction(chunk, out, "GOTO", offset)
+
+	case OpGosub:
+		return csw.disassembleUByteInstruction(chunk, out, "GOSUB", offset)
+
+	case OpCallNative:
+		return csw.disassembleUByteInstruction(chunk, out, "CALL_NATIVE", offset)
+
 	case OpReadGlobal:
 		return csw.disassembleGlobalInstruction(chunk, out, "READ_GLOBAL", offset)
 
 	case OpWriteGlobal:
 		return csw.disassembleGlobalInstruction(chunk, out, "WRITE_GLOBAL", offset)
 
+	case OpReadGlobalLong:
+		return csw.disassembleGlobalLongInstruction(chunk, out, "READ_GLOBAL_LONG", offset)
+
+	case OpWriteGlobalLong:
+		return csw.disassembleGlobalLongInstruction(chunk, out, "WRITE_GLOBAL_LONG", offset)
+
 	case OpReadLocal:
-		return csw.disassembleUByteInstruction(chunk, out, "READ_LOCAL", offset)
+		return csw.disassembleLocalInstruction(chunk, out, "READ_LOCAL", offset, locals)
 
 	case OpWriteLocal:
-		return csw.disassembleUByteInstruction(chunk, out, "WRITE_LOCAL", offset)
+		return csw.disassembleLocalInstruction(chunk, out, "WRITE_LOCAL", offset, locals)
 
 	default:
 		fmt.Fprintf(out, "Unknown opcode %d\n", instruction)
@@ -340,14 +763,41 @@ func (csw *CompiledStoryworld) disassembleGlobalInstruction(chunk *Chunk, out io
 	return offset + 2
 }
 
-// disassembleSByteInstruction disassembles an instruction that has a signed
+// disassembleGlobalLongInstruction disassembles an OpReadGlobalLong or
+// OpWriteGlobalLong instruction at a given offset. name is the instruction
+// name, and the output is written to out. Returns the offset to the next
+// instruction.
+func (csw *CompiledStoryworld) disassembleGlobalLongInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
+	index := DecodeUInt31(chunk.Code[offset+1:])
+	fmt.Fprintf(out, "%-16s %4d '%v'\n", name, index, csw.Globals[index].Name)
+	return offset + 5
+}
+
+// disassembleLocalInstruction disassembles an OpReadLocal or OpWriteLocal
+// instruction at a given offset. name is the instruction name, and the output
+// is written to out. The variable name is looked up in locals, and shown if
+// known. Returns the offset to the next instruction.
+func (csw *CompiledStoryworld) disassembleLocalInstruction(chunk *Chunk, out io.Writer, name string, offset int,
+	locals []LocalVar) int {
+	slot := chunk.Code[offset+1]
+	if varName := localName(locals, int(slot), offset); varName != "" {
+		fmt.Fprintf(out, "%-16s %4d (%v)\n", name, slot, varName)
+	} else {
+		fmt.Fprintf(out, "%-16s %4d\n", name, slot)
+	}
+
+	return offset + 2
+}
+
+// disassembleJumpInstruction disassembles a jump instruction with a signed
 // byte immediate argument at a given offset. name is the instruction name, and
-// the output is written to out. Returns the offset to the next instruction.
-func (csw *CompiledStoryworld) disassembleSByteInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
+// the output is written to out. Besides the jump offset, shows the target
+// address of the jump. Returns the offset to the next instruction.
+func (csw *CompiledStoryworld) disassembleJumpInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
 	arg := int8(chunk.Code[offset+1])
-	fmt.Fprintf(out, "%-16s %4d\n", name, arg)
+	fmt.Fprintf(out, "%-16s %4d -> %04d\n", name, arg, offset+2+int(arg))
 
-	return offset + 1
+	return offset + 2
 }
 
 // disassembleUByteInstruction disassembles an instruction that has an unsigned
@@ -358,16 +808,16 @@ func (csw *CompiledStoryworld) disassembleUByteInstruction(chunk *Chunk, out io.
 	arg := chunk.Code[offset+1]
 	fmt.Fprintf(out, "%-16s %4d\n", name, arg)
 
-	return offset + 1
+	return offset + 2
 }
 
-// disassembleSIntInstruction disassembles an instruction that has a 32-bit
-// signed integer immediate argument at a given offset. name is the
-// instruction name, and the output is written to out. Returns the offset to the
-// next instruction.
-func (csw *CompiledStoryworld) disassembleSIntInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
+// disassembleJumpLongInstruction disassembles a jump instruction with a 32-bit
+// signed integer immediate argument at a given offset. name is the instruction
+// name, and the output is written to out. Besides the jump offset, shows the
+// target address of the jump. Returns the offset to the next instruction.
+func (csw *CompiledStoryworld) disassembleJumpLongInstruction(chunk *Chunk, out io.Writer, name string, offset int) int {
 	arg := DecodeSInt32(chunk.Code[offset+1:])
-	fmt.Fprintf(out, "%-16s %4d\n", name, arg)
+	fmt.Fprintf(out, "%-16s %4d -> %04d\n", name, arg, offset+5+arg)
 
-	return offset + 4
+	return offset + 5
 }
@@ -0,0 +1,229 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that a CompiledStoryworld using every opcode and every kind of Value
+// survives a round-trip through serialization and deserialization.
+func TestCompiledStoryworldRoundTrip(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+
+	var buf bytes.Buffer
+	n, err := csw.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	csw2, err := ReadCompiledStoryworld(&buf)
+	assert.NoError(t, err)
+	if csw2 == nil {
+		return
+	}
+
+	assert.Equal(t, csw.EntryPassage, csw2.EntryPassage)
+	assert.Equal(t, csw.GlobalsVersion, csw2.GlobalsVersion)
+	assert.Equal(t, csw.Chunks, csw2.Chunks)
+	assert.Equal(t, csw.Constants, csw2.Constants)
+	assert.Equal(t, csw.Globals, csw2.Globals)
+
+	// After reading, all strings are interned, even the ones that weren't
+	// before serialization.
+	assert.Equal(t, []string{"Só um teste", "not interned"}, csw2.Strings.Strings())
+
+	// Serializing again must produce exactly the same bytes.
+	var buf1, buf2 bytes.Buffer
+	_, err = csw.WriteTo(&buf1)
+	assert.NoError(t, err)
+	_, err = csw2.WriteTo(&buf2)
+	assert.NoError(t, err)
+	assert.Equal(t, buf1.Bytes(), buf2.Bytes())
+}
+
+// Tests that reading invalid data fails with descriptive errors.
+func TestReadCompiledStoryworldErrors(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := newTestCompiledStoryworld(t).WriteTo(&buf)
+	assert.NoError(t, err)
+	good := buf.Bytes()
+
+	// Bad magic
+	data := append([]byte{}, good...)
+	data[0] = 'X'
+	_, err = ReadCompiledStoryworld(bytes.NewReader(data))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad magic")
+
+	// Unknown version
+	data = append([]byte{}, good...)
+	binary.LittleEndian.PutUint32(data[8:], uint32(CSWVersion)+1)
+	_, err = ReadCompiledStoryworld(bytes.NewReader(data))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported compiled storyworld version")
+
+	// Truncated header
+	_, err = ReadCompiledStoryworld(bytes.NewReader(good[:10]))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "truncated")
+
+	// Truncated data
+	_, err = ReadCompiledStoryworld(bytes.NewReader(good[:len(good)-3]))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "truncated")
+
+	// Corrupted data
+	data = append([]byte{}, good...)
+	data[len(data)-1]++
+	_, err = ReadCompiledStoryworld(bytes.NewReader(data))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CRC32")
+
+	// Consistent header, but data that lies about its own size
+	csw := newTestCompiledStoryworld(t)
+	payload := csw.serialize()
+	payload = payload[:len(payload)-2]
+	buf.Reset()
+	_, err = writeWithHeader(&buf, CSWMagic, uint32(CSWVersion), payload)
+	assert.NoError(t, err)
+	_, err = ReadCompiledStoryworld(&buf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "truncated")
+}
+
+// Tests upgrading globals saved under older globals versions.
+func TestUpgradeGlobals(t *testing.T) {
+	csw := NewCompiledStoryworld()
+	csw.GlobalsVersion = 3
+	csw.SetGlobal("a", NewValueInt(1))
+	csw.SetGlobal("b", NewValueString("new"))
+	csw.SetGlobal("c", NewValueBool(true))
+	csw.SetGlobal("Main@1", NewValuePassage(0))
+	csw.Globals[0].Version = 1
+	csw.Globals[1].Version = 1
+	csw.Globals[2].Version = 3
+
+	// Saved values are kept, new variables get their initial values and code
+	// comes from the current version.
+	saved := []GlobalVar{
+		{Name: "a", Value: NewValueInt(10), Version: 1},
+		{Name: "b", Value: NewValueString("old"), Version: 1},
+		{Name: "Main@1", Value: NewValuePassage(9)},
+	}
+	upgraded, err := csw.UpgradeGlobals(2, saved)
+	assert.NoError(t, err)
+	assert.Equal(t, []GlobalVar{
+		{Name: "a", Value: NewValueInt(10), Version: 1},
+		{Name: "b", Value: NewValueString("old"), Version: 1},
+		{Name: "c", Value: NewValueBool(true), Version: 3},
+		{Name: "Main@1", Value: NewValuePassage(0)},
+	}, upgraded)
+
+	// Upgrading to the same version is fine, too.
+	saved = append(saved, GlobalVar{Name: "c", Value: NewValueBool(false), Version: 3})
+	upgraded, err = csw.UpgradeGlobals(3, saved)
+	assert.NoError(t, err)
+	assert.Equal(t, NewValueBool(false), upgraded[2].Value)
+
+	// Cannot downgrade
+	_, err = csw.UpgradeGlobals(4, saved)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "older version")
+
+	// Missing variable that should be in the save
+	_, err = csw.UpgradeGlobals(1, saved[1:2])
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "'a'")
+
+	// Unknown variable
+	_, err = csw.UpgradeGlobals(1, []GlobalVar{{Name: "zzz", Value: NewValueInt(0), Version: 1}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "'zzz'")
+
+	// Removed code and meta variables of removed Passages are not a problem.
+	saved = append(saved,
+		GlobalVar{Name: "Gone@1", Value: NewValuePassage(3)},
+		GlobalVar{Name: "gone", Value: NewValueFunction(4)},
+		GlobalVar{Name: "Gone@1.seen", Value: NewValueBool(true)})
+	upgraded, err = csw.UpgradeGlobals(3, saved)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(upgraded))
+
+	// Kind mismatch
+	_, err = csw.UpgradeGlobals(1, []GlobalVar{{Name: "a", Value: NewValueFloat(1)}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong kind")
+}
+
+// newTestCompiledStoryworld creates a CompiledStoryworld for testing purposes.
+// It contains every opcode and every kind of Value.
+func newTestCompiledStoryworld(t *testing.T) *CompiledStoryworld {
+	csw := NewCompiledStoryworld()
+
+	csw.Chunks = []*Chunk{{Code: []byte{OpReturnVoid}}, {}}
+	csw.EntryPassage = 1
+
+	csw.AddConstant(NewValueFloat(math.Pi))
+	csw.AddConstant(NewValueInt(-171))
+	csw.AddConstant(NewValueBool(true))
+	csw.AddConstant(NewValueString(csw.Strings.Intern("Só um teste")))
+	csw.AddConstant(NewValueFunction(0))
+	csw.AddConstant(NewValuePassage(1))
+	csw.AddConstant(NewValueBNum(0.1))
+
+	csw.SetGlobal("f", NewValueFloat(-0.5))
+	csw.SetGlobal("i", NewValueInt(math.MaxInt64))
+	csw.SetGlobal("b", NewValueBool(false))
+	csw.SetGlobal("s", NewValueString("not interned"))
+	csw.SetGlobal("fn", NewValueFunction(1))
+	csw.SetGlobal("Main@1", NewValuePassage(1))
+	csw.SetGlobal("bn", NewValueBNum(0.9))
+
+	csw.GlobalsVersion = 2
+	csw.Globals[0].Version = 1
+	csw.Globals[1].Version = 2
+
+	code := []byte{}
+	for op := OpNop; op < numberOfOpcodes; op++ {
+		code = append(code, op)
+		code = append(code, testOperands(t, op)...)
+	}
+	csw.Chunks[1].Code = code
+
+	return csw
+}
+
+// testOperands returns some valid immediate operands for the opcode op.
+func testOperands(t *testing.T, op uint8) []byte {
+	switch op {
+	case OpConstant, OpReadGlobal, OpWriteGlobal, OpReadLocal, OpWriteLocal,
+		OpCall, OpJump, OpJumpIfFalse, OpJumpIfFalseNoPop, OpJumpIfTrueNoPop,
+		OpSay, OpListen, OpGoto, OpGosub, OpCallNative:
+		return []byte{0x03}
+
+	case OpConstantLong, OpJumpLong, OpJumpIfFalseLong, OpJumpIfFalseNoPopLong,
+		OpJumpIfTrueNoPopLong, OpReadGlobalLong, OpWriteGlobalLong:
+		return []byte{0x01, 0x00, 0x00, 0x00}
+
+	case OpNop, OpTrue, OpFalse, OpEqual, OpNotEqual, OpGreater, OpGreaterEqual,
+		OpLess, OpLessEqual, OpAdd, OpAddBNum, OpSubtract, OpSubtractBNum,
+		OpMultiply, OpDivide, OpPop, OpPower, OpNot, OpNegate, OpBlend,
+		OpReturnValue, OpReturnVoid, OpToInt, OpToFloat, OpToBNum, OpToString,
+		OpPrint:
+		return []byte{}
+
+	default:
+		t.Fatalf("Test doesn't know the operands of opcode %v", op)
+		return nil
+	}
+}
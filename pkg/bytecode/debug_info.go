@@ -8,37 +8,451 @@
 package bytecode
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
 )
 
+// DebugInfoMagic is the "magic number" identifying a Romualdo Debug Info file.
+// It is comprised of the "RmldDbg" string followed by a SUB character (which
+// in times long gone used to represent a "soft end-of-file").
+var DebugInfoMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x44, 0x62, 0x67, 0x1A}
+
+// DebugInfoVersion is the current version of a Romualdo Debug Info file.
+const DebugInfoVersion byte = 3
+
+// errDebugInfoHashMismatch is the error returned when trying to use a
+// DebugInfo with the wrong CompiledStoryworld.
+var errDebugInfoHashMismatch = errors.New("debug info does not match the compiled storyworld (hash mismatch)")
+
 // DebugInfo contains debug information matching a CompiledStoryworld. All
 // information that is not strictly necessary to run a Storyworld but is useful
 // for debugging, producing better error reporting, etc, belongs here. This can
-// be serialized and deserialized.
+// be serialized and deserialized, and is meant to be stored in a separate
+// "sidecar" file, so that it can be left out of release builds.
+//
+// The serialized format uses the same header as CompiledStoryworld (see its
+// documentation), but with DebugInfoMagic and DebugInfoVersion. The binary
+// data is comprised of:
+//
+// - The CSWHash, as a 32-bit length followed by that many bytes.
+//
+// - A 32-bit count of Chunks, followed by that many Chunk entries.
+//
+// - A 32-bit count of span tables (which is either zero or the number of
+// Chunks), followed by that many span tables.
+//
+// - A 32-bit count of local variable tables (which is either zero or the number
+// of Chunks), followed by that many local variable tables.
+//
+// Each Chunk entry contains the Chunk name and the name of the source file
+// (both encoded as a 32-bit length followed by that many bytes of UTF-8 data)
+// and the Chunk lines. Lines are run-length
+// encoded: a 32-bit count of runs, followed by that many pairs of 32-bit
+// integers (the line number and the number of consecutive bytecode bytes
+// generated from that line).
+//
+// Span tables are run-length encoded, too: a 32-bit count of runs, followed by
+// that many groups of five 32-bit integers (the start line, start column, end
+// line and end column of the span, and the number of consecutive bytecode
+// bytes generated from that span).
+//
+// Local variable tables are a 32-bit count of local variables, followed by
+// that many entries. Each entry contains the variable name and type (encoded
+// like the Chunk name), followed by four 32-bit integers: the slot, the start
+// and end of its live range, and the line where it was declared.
 type DebugInfo struct {
-	// ChunksNames contains the names of the functions on a CompiledStoryworld.
+	// CSWHash is the hash of the CompiledStoryworld this DebugInfo refers to
+	// (as returned by CompiledStoryworld.Hash()). It is used to make sure we
+	// don't mix up debug information and compiled storyworlds that don't
+	// belong together.
+	CSWHash []byte
+
+	// ChunksNames contains the names of the functions and Passages on a
+	// CompiledStoryworld. Passage names include the version, like "Name@1".
 	// There is one entry for each entry in the corresponding
 	// CompiledStoryworld.Chunks.
 	ChunksNames []string
 
+	// ChunksFiles contains the names of the source files where each function
+	// and Passage was declared (a Chunk always comes from a single file). It
+	// is indexed just like ChunksNames. This is optional: it may be nil if the
+	// file names are not known, and individual entries may be empty.
+	ChunksFiles []string
+
 	// The source code line that generated each instruction of each Chunk. This
 	// must be interpreted like this: ChunksLines[chunkIndex][codeIndex]
 	// contains the source code line that generated the bytecode at
 	// CompiledStoryworld.Chunks[chunkIndex].Code[codeIndex]. Notice that we
 	// have one entry for each entry in Code. Very space-inefficient, but very
-	// simple.
+	// simple. (The serialized format is smarter than this, though.)
 	ChunksLines [][]int
+
+	// The region of the source code that generated each instruction of each
+	// Chunk. This is indexed just like ChunksLines, and is usually the span of
+	// the innermost expression or statement that generated the instruction.
+	// This is optional: it may be nil if only line information is available.
+	ChunksSpans [][]SourceSpan
+
+	// ChunksLocals contains the local variables (including parameters) of
+	// each Chunk, in the order they were declared. It is indexed just like
+	// ChunksNames. This is optional: it may be nil if nothing is known about
+	// local variables.
+	ChunksLocals [][]LocalVar
+}
+
+// LocalVar describes a local variable or parameter of a function or Passage,
+// as stored in the DebugInfo.
+type LocalVar struct {
+	// Name is the variable name.
+	Name string
+
+	// Type is the variable type, as it would be written in the source code.
+	Type string
+
+	// Slot is the variable index in the stack frame, as used in the operand of
+	// the READ_LOCAL and WRITE_LOCAL instructions.
+	Slot int
+
+	// StartIP is the offset of the first instruction in which the variable is
+	// live (that is, is in scope and initialized).
+	StartIP int
+
+	// EndIP is the offset just past the last instruction in which the variable
+	// is live.
+	EndIP int
+
+	// Line is the source code line where the variable was declared.
+	Line int
+}
+
+// SourceSpan is a region of the source code, as stored in the DebugInfo. Lines
+// and columns are 1-based, and columns are counted in runes. The end position
+// is just past the last character of the region. The zero value means the
+// region is not known.
+type SourceSpan struct {
+	StartLine   int
+	StartColumn int
+	EndLine     int
+	EndColumn   int
 }
 
 // ReadDebugInfo deserializes a DebugInformation, reading the binary data from
-// r.
-func ReadDebugInfo(r io.Reader) (*DebugInfo, error) {
-	return nil, errors.New("not implemented yet")
+// r. The DebugInfo must match csw, the CompiledStoryworld it refers to;
+// otherwise an error is returned.
+func ReadDebugInfo(r io.Reader, csw *CompiledStoryworld) (*DebugInfo, error) {
+	data, err := readWithHeader(r, DebugInfoMagic, uint32(DebugInfoVersion), "debug info")
+	if err != nil {
+		return nil, err
+	}
+
+	if csw == nil {
+		return nil, errors.New("no compiled storyworld to match the debug info against")
+	}
+
+	di := &DebugInfo{}
+	d := &deserializer{data: data, what: "debug info"}
+
+	di.CSWHash = d.readBytes("compiled storyworld hash")
+	if d.err == nil && !bytes.Equal(di.CSWHash, csw.Hash()) {
+		return nil, errDebugInfoHashMismatch
+	}
+
+	n := d.readCount("chunk count", 8)
+	for i := 0; i < n; i++ {
+		if i >= len(csw.Chunks) {
+			d.fail("more chunks than in the compiled storyworld (%v)", len(csw.Chunks))
+			break
+		}
+
+		di.ChunksNames = append(di.ChunksNames, d.readString("chunk name"))
+		di.ChunksFiles = append(di.ChunksFiles, d.readString("chunk file"))
+
+		lines := []int{}
+		runs := d.readCount("line run count", 8)
+		for j := 0; j < runs; j++ {
+			line := d.readUInt32("line number")
+			length := d.readUInt32("line run length")
+			if d.err != nil {
+				break
+			}
+			if len(lines)+length > len(csw.Chunks[i].Code) {
+				d.fail("more line entries than bytes of code in chunk %v", i)
+				break
+			}
+			for k := 0; k < length; k++ {
+				lines = append(lines, line)
+			}
+		}
+		di.ChunksLines = append(di.ChunksLines, lines)
+	}
+
+	n = d.readCount("span table count", 4)
+	if d.err == nil && n != 0 && n != len(di.ChunksNames) {
+		d.fail("%v span tables, expected zero or %v", n, len(di.ChunksNames))
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		spans := []SourceSpan{}
+		runs := d.readCount("span run count", 20)
+		for j := 0; j < runs; j++ {
+			span := SourceSpan{
+				StartLine:   d.readUInt32("span start line"),
+				StartColumn: d.readUInt32("span start column"),
+				EndLine:     d.readUInt32("span end line"),
+				EndColumn:   d.readUInt32("span end column"),
+			}
+			length := d.readUInt32("span run length")
+			if d.err != nil {
+				break
+			}
+			if len(spans)+length > len(csw.Chunks[i].Code) {
+				d.fail("more span entries than bytes of code in chunk %v", i)
+				break
+			}
+			for k := 0; k < length; k++ {
+				spans = append(spans, span)
+			}
+		}
+		di.ChunksSpans = append(di.ChunksSpans, spans)
+	}
+
+	n = d.readCount("local variable table count", 4)
+	if d.err == nil && n != 0 && n != len(di.ChunksNames) {
+		d.fail("%v local variable tables, expected zero or %v", n, len(di.ChunksNames))
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		locals := []LocalVar{}
+		count := d.readCount("local variable count", 24)
+		for j := 0; j < count; j++ {
+			local := LocalVar{
+				Name:    d.readString("local variable name"),
+				Type:    d.readString("local variable type"),
+				Slot:    d.readUInt32("local variable slot"),
+				StartIP: d.readUInt32("local variable start"),
+				EndIP:   d.readUInt32("local variable end"),
+				Line:    d.readUInt32("local variable line"),
+			}
+			if d.err != nil {
+				break
+			}
+			locals = append(locals, local)
+		}
+		di.ChunksLocals = append(di.ChunksLocals, locals)
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if err := di.CheckMatch(csw); err != nil {
+		return nil, err
+	}
+
+	return di, nil
 }
 
 // WriteTo serializes a DebugInfo, writing the binary data to w.
 func (di *DebugInfo) WriteTo(w io.Writer) (n int64, err error) {
-	// TODO: not implemented yet.
-	return 0, errors.New("not implemented yet")
+	if len(di.ChunksNames) != len(di.ChunksLines) {
+		return 0, fmt.Errorf("inconsistent debug info: %v chunk names, but %v chunk lines",
+			len(di.ChunksNames), len(di.ChunksLines))
+	}
+	if di.ChunksFiles != nil && len(di.ChunksNames) != len(di.ChunksFiles) {
+		return 0, fmt.Errorf("inconsistent debug info: %v chunk names, but %v chunk files",
+			len(di.ChunksNames), len(di.ChunksFiles))
+	}
+	if di.ChunksSpans != nil && len(di.ChunksNames) != len(di.ChunksSpans) {
+		return 0, fmt.Errorf("inconsistent debug info: %v chunk names, but %v chunk spans",
+			len(di.ChunksNames), len(di.ChunksSpans))
+	}
+	if di.ChunksLocals != nil && len(di.ChunksNames) != len(di.ChunksLocals) {
+		return 0, fmt.Errorf("inconsistent debug info: %v chunk names, but %v chunk locals",
+			len(di.ChunksNames), len(di.ChunksLocals))
+	}
+
+	s := &serializer{}
+
+	s.writeBytes(di.CSWHash)
+
+	s.writeUInt32(len(di.ChunksNames))
+	for i, name := range di.ChunksNames {
+		s.writeString(name)
+		s.writeString(di.ChunkFile(i))
+
+		// Run-length encode the lines.
+		lines := di.ChunksLines[i]
+		runs := [][2]int{}
+		for _, line := range lines {
+			if len(runs) > 0 && runs[len(runs)-1][0] == line {
+				runs[len(runs)-1][1]++
+			} else {
+				runs = append(runs, [2]int{line, 1})
+			}
+		}
+
+		s.writeUInt32(len(runs))
+		for _, run := range runs {
+			s.writeUInt32(run[0])
+			s.writeUInt32(run[1])
+		}
+	}
+
+	s.writeUInt32(len(di.ChunksSpans))
+	for _, spans := range di.ChunksSpans {
+		// Run-length encode the spans.
+		type spanRun struct {
+			span   SourceSpan
+			length int
+		}
+		runs := []spanRun{}
+		for _, span := range spans {
+			if len(runs) > 0 && runs[len(runs)-1].span == span {
+				runs[len(runs)-1].length++
+			} else {
+				runs = append(runs, spanRun{span, 1})
+			}
+		}
+
+		s.writeUInt32(len(runs))
+		for _, run := range runs {
+			s.writeUInt32(run.span.StartLine)
+			s.writeUInt32(run.span.StartColumn)
+			s.writeUInt32(run.span.EndLine)
+			s.writeUInt32(run.span.EndColumn)
+			s.writeUInt32(run.length)
+		}
+	}
+
+	s.writeUInt32(len(di.ChunksLocals))
+	for _, locals := range di.ChunksLocals {
+		s.writeUInt32(len(locals))
+		for _, local := range locals {
+			s.writeString(local.Name)
+			s.writeString(local.Type)
+			s.writeUInt32(local.Slot)
+			s.writeUInt32(local.StartIP)
+			s.writeUInt32(local.EndIP)
+			s.writeUInt32(local.Line)
+		}
+	}
+
+	return writeWithHeader(w, DebugInfoMagic, uint32(DebugInfoVersion), s.bytes())
+}
+
+// CheckMatch checks if di is the debug information corresponding to csw.
+// Returns nil if so, or an error describing the mismatch.
+func (di *DebugInfo) CheckMatch(csw *CompiledStoryworld) error {
+	if csw == nil {
+		return errors.New("no compiled storyworld to match the debug info against")
+	}
+
+	if !bytes.Equal(di.CSWHash, csw.Hash()) {
+		return errDebugInfoHashMismatch
+	}
+
+	if len(di.ChunksNames) != len(csw.Chunks) || len(di.ChunksLines) != len(csw.Chunks) {
+		return fmt.Errorf("debug info has information about %v chunks, but the compiled storyworld has %v",
+			len(di.ChunksNames), len(csw.Chunks))
+	}
+
+	if di.ChunksFiles != nil && len(di.ChunksFiles) != len(csw.Chunks) {
+		return fmt.Errorf("debug info has file names for %v chunks, but the compiled storyworld has %v",
+			len(di.ChunksFiles), len(csw.Chunks))
+	}
+
+	for i, chunk := range csw.Chunks {
+		if len(di.ChunksLines[i]) != len(chunk.Code) {
+			return fmt.Errorf("debug info has %v line entries for chunk %v, but the chunk has %v bytes of code",
+				len(di.ChunksLines[i]), i, len(chunk.Code))
+		}
+	}
+
+	if di.ChunksSpans != nil {
+		if len(di.ChunksSpans) != len(csw.Chunks) {
+			return fmt.Errorf("debug info has span information about %v chunks, but the compiled storyworld has %v",
+				len(di.ChunksSpans), len(csw.Chunks))
+		}
+
+		for i, chunk := range csw.Chunks {
+			if len(di.ChunksSpans[i]) != len(chunk.Code) {
+				return fmt.Errorf("debug info has %v span entries for chunk %v, but the chunk has %v bytes of code",
+					len(di.ChunksSpans[i]), i, len(chunk.Code))
+			}
+		}
+	}
+
+	if di.ChunksLocals != nil {
+		if len(di.ChunksLocals) != len(csw.Chunks) {
+			return fmt.Errorf("debug info has local variables of %v chunks, but the compiled storyworld has %v",
+				len(di.ChunksLocals), len(csw.Chunks))
+		}
+
+		for i, chunk := range csw.Chunks {
+			for _, local := range di.ChunksLocals[i] {
+				if local.StartIP > local.EndIP || local.EndIP > len(chunk.Code) {
+					return fmt.Errorf("debug info has local variable %q of chunk %v live from %v to %v, "+
+						"but the chunk has %v bytes of code", local.Name, i, local.StartIP, local.EndIP, len(chunk.Code))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ChunkFile returns the name of the source file from which the Chunk with
+// index chunkIndex was compiled, or an empty string if not known.
+func (di *DebugInfo) ChunkFile(chunkIndex int) string {
+	if chunkIndex < 0 || chunkIndex >= len(di.ChunksFiles) {
+		return ""
+	}
+	return di.ChunksFiles[chunkIndex]
+}
+
+// LocalsAt returns the local variables of the Chunk with index chunkIndex that
+// are live at the instruction at offset ip, ordered by slot. Returns nil if
+// nothing is known about local variables.
+func (di *DebugInfo) LocalsAt(chunkIndex, ip int) []LocalVar {
+	locals := di.chunkLocals(chunkIndex)
+	if locals == nil {
+		return nil
+	}
+
+	result := []LocalVar{}
+	for _, local := range locals {
+		if ip >= local.StartIP && ip < local.EndIP {
+			result = append(result, local)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Slot < result[j].Slot })
+	return result
+}
+
+// LocalName returns the name of the local variable of the Chunk with index
+// chunkIndex that uses a given slot at the instruction at offset ip, or an
+// empty string if not known.
+func (di *DebugInfo) LocalName(chunkIndex, slot, ip int) string {
+	return localName(di.chunkLocals(chunkIndex), slot, ip)
+}
+
+// chunkLocals returns the local variables of the Chunk with index chunkIndex,
+// or nil if not known.
+func (di *DebugInfo) chunkLocals(chunkIndex int) []LocalVar {
+	if di == nil || chunkIndex < 0 || chunkIndex >= len(di.ChunksLocals) {
+		return nil
+	}
+	return di.ChunksLocals[chunkIndex]
+}
+
+// localName returns the name of the variable among locals that uses a given
+// slot at the instruction at offset ip, or an empty string if there is none.
+func localName(locals []LocalVar, slot, ip int) string {
+	for _, local := range locals {
+		if local.Slot == slot && ip >= local.StartIP && ip < local.EndIP {
+			return local.Name
+		}
+	}
+	return ""
 }
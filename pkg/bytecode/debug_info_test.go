@@ -0,0 +1,150 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that a DebugInfo survives a round-trip through serialization and
+// deserialization.
+func TestDebugInfoRoundTrip(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+	di := newTestDebugInfo(csw)
+
+	buf := &bytes.Buffer{}
+	_, err := di.WriteTo(buf)
+	assert.Nil(t, err)
+
+	di2, err := ReadDebugInfo(buf, csw)
+	assert.Nil(t, err)
+	assert.Equal(t, di, di2)
+
+	// Spans and locals are optional.
+	di.ChunksSpans = nil
+	di.ChunksLocals = nil
+	buf.Reset()
+	_, err = di.WriteTo(buf)
+	assert.Nil(t, err)
+
+	di2, err = ReadDebugInfo(buf, csw)
+	assert.Nil(t, err)
+	assert.Equal(t, di, di2)
+}
+
+// Tests that a DebugInfo is refused when used with the wrong
+// CompiledStoryworld.
+func TestReadDebugInfoMismatch(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+	di := newTestDebugInfo(csw)
+
+	buf := &bytes.Buffer{}
+	_, err := di.WriteTo(buf)
+	assert.Nil(t, err)
+	data := buf.Bytes()
+
+	otherCSW := newTestCompiledStoryworld(t)
+	otherCSW.SetGlobal("another", NewValueInt(1))
+	_, err = ReadDebugInfo(bytes.NewReader(data), otherCSW)
+	assert.Equal(t, errDebugInfoHashMismatch, err)
+
+	_, err = ReadDebugInfo(bytes.NewReader(data), nil)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, errDebugInfoHashMismatch, di.CheckMatch(otherCSW))
+	assert.Nil(t, di.CheckMatch(csw))
+}
+
+// Tests that a DebugInfo still matches its CompiledStoryworld after the
+// globals and interned strings change, like they do when the Storyworld runs.
+func TestDebugInfoAfterRun(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+	di := newTestDebugInfo(csw)
+	hash := csw.Hash()
+
+	buf := &bytes.Buffer{}
+	_, err := di.WriteTo(buf)
+	assert.Nil(t, err)
+
+	csw.Globals[0].Value = NewValueString(csw.Strings.Intern("changed while running"))
+	assert.Equal(t, hash, csw.Hash())
+
+	di2, err := ReadDebugInfo(buf, csw)
+	assert.Nil(t, err)
+	assert.Nil(t, di2.CheckMatch(csw))
+}
+
+// Tests that local variables are looked up by their live ranges, and that the
+// disassembler shows their names.
+func TestDebugInfoLocals(t *testing.T) {
+	csw := NewCompiledStoryworld()
+	csw.AddConstant(NewValueInt(1))
+	csw.Chunks = []*Chunk{{Code: []byte{
+		OpConstant, 0,
+		OpReadLocal, 1,
+		OpWriteLocal, 2,
+		OpPop,
+		OpPop,
+		OpReadLocal, 1,
+		OpReturnValue,
+	}}}
+
+	di := &DebugInfo{
+		CSWHash:     csw.Hash(),
+		ChunksNames: []string{"f"},
+		ChunksLines: [][]int{{2, 2, 3, 3, 3, 3, 3, 4, 5, 5, 5}},
+		ChunksLocals: [][]LocalVar{{
+			{Name: "n", Type: "int", Slot: 1, StartIP: 0, EndIP: 11, Line: 1},
+			{Name: "counter", Type: "int", Slot: 2, StartIP: 2, EndIP: 7, Line: 2},
+		}},
+	}
+	assert.Nil(t, di.CheckMatch(csw))
+
+	assert.Equal(t, []LocalVar{di.ChunksLocals[0][0]}, di.LocalsAt(0, 0))
+	assert.Equal(t, di.ChunksLocals[0], di.LocalsAt(0, 4))
+	assert.Equal(t, []LocalVar{di.ChunksLocals[0][0]}, di.LocalsAt(0, 8))
+	assert.Nil(t, di.LocalsAt(1, 0))
+	assert.Equal(t, "counter", di.LocalName(0, 2, 4))
+	assert.Equal(t, "", di.LocalName(0, 2, 8))
+
+	disassembly := csw.Disassemble(di)
+	assert.Contains(t, disassembly, "READ_LOCAL          1 (n)\n")
+	assert.Contains(t, disassembly, "WRITE_LOCAL         2 (counter)\n")
+	assert.Contains(t, csw.Disassemble(nil), "WRITE_LOCAL         2\n")
+
+	di.ChunksLocals[0][1].EndIP = 12
+	assert.NotNil(t, di.CheckMatch(csw))
+}
+
+// newTestDebugInfo creates a DebugInfo for testing purposes, matching csw.
+func newTestDebugInfo(csw *CompiledStoryworld) *DebugInfo {
+	di := &DebugInfo{CSWHash: csw.Hash()}
+	for i, chunk := range csw.Chunks {
+		di.ChunksNames = append(di.ChunksNames, "chunk"+string(rune('A'+i)))
+		di.ChunksFiles = append(di.ChunksFiles, "file"+string(rune('A'+i%2))+".romulang")
+		lines := []int{}
+		for j := range chunk.Code {
+			lines = append(lines, 10+j/3)
+		}
+		di.ChunksLines = append(di.ChunksLines, lines)
+		spans := []SourceSpan{}
+		for j := range chunk.Code {
+			spans = append(spans, SourceSpan{10 + j/3, 1 + j/2, 10 + j/3, 5 + j/2})
+		}
+		di.ChunksSpans = append(di.ChunksSpans, spans)
+		locals := []LocalVar{}
+		if len(chunk.Code) > 0 {
+			locals = append(locals, LocalVar{"x", "int", 1, 0, len(chunk.Code), 10})
+		}
+		di.ChunksLocals = append(di.ChunksLocals, locals)
+	}
+	return di
+}
@@ -0,0 +1,84 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Listing returns a listing of the compiled storyworld in which each source
+// code line is followed by the instructions generated from it. sources maps the
+// names of the files from which csw was compiled to their source code, and di
+// is the corresponding debug info (which is required here, because this is
+// where the mapping between instructions and source code lines comes from).
+// The source code of each Chunk is looked up by the file name in di, which is
+// an empty string if di doesn't know it.
+//
+// Source code lines are shown with their line numbers. When the generated code
+// moves forward in the source code, all lines skipped over (comments, blank
+// lines, etc) are shown, too, so that the listing reads like the original
+// source code. When the code moves back to a line already shown (like the jump
+// back in a loop), that line is shown again.
+func (csw *CompiledStoryworld) Listing(di *DebugInfo, sources map[string]string) string {
+	var out strings.Builder
+
+	sourcesLines := map[string][]string{}
+	for file, source := range sources {
+		sourcesLines[file] = strings.Split(source, "\n")
+	}
+
+	csw.disassembleGlobals(&out)
+
+	for i, chunk := range csw.Chunks {
+		file := di.ChunkFile(i)
+		if file != "" {
+			fmt.Fprintf(&out, "== %v (%v) ==\n", di.ChunksNames[i], file)
+		} else {
+			fmt.Fprintf(&out, "== %v ==\n", di.ChunksNames[i])
+		}
+
+		// sourceLine returns the source code line number n (one-based), or an
+		// empty string if there is no such line.
+		sourceLines := sourcesLines[file]
+		sourceLine := func(n int) string {
+			if n < 1 || n > len(sourceLines) {
+				return ""
+			}
+			return strings.TrimRight(sourceLines[n-1], "\r")
+		}
+
+		lines := di.ChunksLines[i]
+		lastLine := 0     // the line shown most recently
+		greatestLine := 0 // the greatest line shown so far
+
+		for offset := 0; offset < len(chunk.Code); {
+			line := lines[offset]
+			if line != lastLine {
+				first := line
+				if greatestLine != 0 && line > greatestLine {
+					first = greatestLine + 1
+				}
+				for n := first; n <= line; n++ {
+					fmt.Fprintf(&out, "%4d | %v\n", n, sourceLine(n))
+				}
+				lastLine = line
+				if line > greatestLine {
+					greatestLine = line
+				}
+			}
+
+			fmt.Fprintf(&out, "            %04v ", offset)
+			offset = csw.DisassembleOpcode(chunk, &out, offset, di.chunkLocals(i))
+		}
+
+		fmt.Fprint(&out, "\n")
+	}
+
+	return out.String()
+}
@@ -0,0 +1,73 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that the listing interleaves source code and instructions, and shows
+// constants, globals and jump targets.
+func TestListing(t *testing.T) {
+	source := "globals@1\n" +
+		"    G: int = 0\n" +
+		"end\n" +
+		"\n" +
+		"function main(): void\n" +
+		"    # Loop forever\n" +
+		"    while true do\n" +
+		"        G = 1\n" +
+		"    end\n" +
+		"end\n"
+
+	csw := NewCompiledStoryworld()
+	csw.SetGlobal("G", NewValueInt(0))
+	csw.SetGlobal("main", NewValueFunction(0))
+	csw.AddConstant(NewValueInt(1))
+	// A loop: lines 7 and 8 are the condition and the body, line 10 is the
+	// end of the function.
+	csw.Chunks = []*Chunk{{Code: []byte{
+		OpTrue,
+		OpJumpIfFalse, 7,
+		OpConstant, 0,
+		OpWriteGlobal, 0,
+		OpPop,
+		OpJump, 0xF6,
+		OpReturnVoid,
+	}}}
+
+	di := &DebugInfo{
+		CSWHash:     csw.Hash(),
+		ChunksNames: []string{"main"},
+		ChunksFiles: []string{"main.romulang"},
+		ChunksLines: [][]int{{7, 7, 7, 8, 8, 8, 8, 8, 7, 7, 10}},
+	}
+
+	expected := "== Globals ==\n" +
+		"Global  G '0' (int)\n" +
+		"Global  main '<function 0>' (function)\n" +
+		"\n\n" +
+		"== main (main.romulang) ==\n" +
+		"   7 |     while true do\n" +
+		"            0000 TRUE\n" +
+		"            0001 JUMP_IF_FALSE       7 -> 0010\n" +
+		"   8 |         G = 1\n" +
+		"            0003 CONSTANT            0 '1'\n" +
+		"            0005 WRITE_GLOBAL        0 'G'\n" +
+		"            0007 POP\n" +
+		"   7 |     while true do\n" +
+		"            0008 JUMP              -10 -> 0000\n" +
+		"   9 |     end\n" +
+		"  10 | end\n" +
+		"            0010 RETURN_VOID\n" +
+		"\n"
+
+	assert.Equal(t, expected, csw.Listing(di, map[string]string{"main.romulang": source}))
+}
@@ -0,0 +1,257 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// This file contains the low-level machinery shared by all our binary formats.
+// Each of them looks like this:
+//
+// - Magic (8 bytes)
+//
+// - 32-bit version
+//
+// - 32-bit size (binary data size in bytes)
+//
+// - 32-bit CRC32 of the binary data (using the IEEE polynomial)
+//
+// - Binary data
+//
+// All data is little endian.
+
+// headerSize is the size, in bytes, of the header preceding the binary data.
+const headerSize = 8 + 4 + 4 + 4
+
+// writeWithHeader writes data to w, preceded by the standard header with the
+// given magic and version.
+func writeWithHeader(w io.Writer, magic []byte, version uint32, data []byte) (int64, error) {
+	if int64(len(data)) > math.MaxUint32 {
+		return 0, errors.New("data too large to serialize")
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[8:], version)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(data))
+
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := w.Write(data)
+	return int64(n + m), err
+}
+
+// readWithHeader reads the standard header and the binary data following it
+// from r. Checks that the magic and version match the expected ones, and that
+// the data is complete and not corrupted. what is a human-friendly name of the
+// thing being read, used in error messages. Returns the binary data.
+func readWithHeader(r io.Reader, magic []byte, version uint32, what string) ([]byte, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated %v: incomplete header", what)
+		}
+		return nil, fmt.Errorf("reading %v header: %w", what, err)
+	}
+
+	if !bytes.Equal(header[:8], magic) {
+		return nil, fmt.Errorf("not a %v: bad magic number %x", what, header[:8])
+	}
+
+	v := binary.LittleEndian.Uint32(header[8:])
+	if v != version {
+		return nil, fmt.Errorf("unsupported %v version %v (expected version %v)", what, v, version)
+	}
+
+	size := binary.LittleEndian.Uint32(header[12:])
+	expectedCRC := binary.LittleEndian.Uint32(header[16:])
+
+	data := make([]byte, size)
+	n, err := io.ReadFull(r, data)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated %v: expected %v bytes of data, got %v", what, size, n)
+		}
+		return nil, fmt.Errorf("reading %v data: %w", what, err)
+	}
+
+	if crc := crc32.ChecksumIEEE(data); crc != expectedCRC {
+		return nil, fmt.Errorf("corrupted %v: CRC32 is %08x, expected %08x", what, crc, expectedCRC)
+	}
+
+	return data, nil
+}
+
+// serializer helps to encode data in our binary formats. It always writes to
+// memory, so it never fails.
+type serializer struct {
+	buf bytes.Buffer
+}
+
+// bytes returns the data serialized so far.
+func (s *serializer) bytes() []byte {
+	return s.buf.Bytes()
+}
+
+// writeByte writes a single byte.
+func (s *serializer) writeByte(b byte) {
+	s.buf.WriteByte(b)
+}
+
+// writeUInt32 writes an unsigned 32-bit integer. Panics if v doesn't fit.
+func (s *serializer) writeUInt32(v int) {
+	if v < 0 || int64(v) > math.MaxUint32 {
+		panic(fmt.Sprintf("Value does not fit into 32 bits: %v", v))
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	s.buf.Write(b[:])
+}
+
+// writeUInt64 writes an unsigned 64-bit integer.
+func (s *serializer) writeUInt64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	s.buf.Write(b[:])
+}
+
+// writeBytes writes a length-prefixed sequence of bytes.
+func (s *serializer) writeBytes(b []byte) {
+	s.writeUInt32(len(b))
+	s.buf.Write(b)
+}
+
+// writeString writes a length-prefixed string.
+func (s *serializer) writeString(str string) {
+	s.writeUInt32(len(str))
+	s.buf.WriteString(str)
+}
+
+// deserializer helps to decode data in our binary formats. Errors are sticky:
+// after the first error, all reads return zero values and err keeps the first
+// error found.
+type deserializer struct {
+	// data is the data being decoded.
+	data []byte
+
+	// pos is the position of the next byte to be read from data.
+	pos int
+
+	// what is a human-friendly name of the thing being decoded, used in error
+	// messages.
+	what string
+
+	// err is the first error found while decoding.
+	err error
+}
+
+// fail records an error, unless we already had one.
+func (d *deserializer) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%v: %v", d.what, fmt.Sprintf(format, a...))
+	}
+}
+
+// take returns the next n bytes from the data. If there aren't enough bytes,
+// records an error and returns nil.
+func (d *deserializer) take(n int, field string) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data)-d.pos < n {
+		d.fail("truncated data while reading %v at offset %v", field, d.pos)
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+// readByte reads a single byte.
+func (d *deserializer) readByte(field string) byte {
+	b := d.take(1, field)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readUInt32 reads an unsigned 32-bit integer. Values that don't fit into 31
+// bits are reported as errors, so that the result can be safely used as an int
+// everywhere.
+func (d *deserializer) readUInt32(field string) int {
+	b := d.take(4, field)
+	if b == nil {
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(b)
+	if v > math.MaxInt32 {
+		d.fail("value of %v out of range: %v", field, v)
+		return 0
+	}
+	return int(v)
+}
+
+// readUInt64 reads an unsigned 64-bit integer.
+func (d *deserializer) readUInt64(field string) uint64 {
+	b := d.take(8, field)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// readBytes reads a length-prefixed sequence of bytes. The returned slice is a
+// copy, so it doesn't alias the data being decoded.
+func (d *deserializer) readBytes(field string) []byte {
+	n := d.readUInt32(field + " length")
+	b := d.take(n, field)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// readString reads a length-prefixed string.
+func (d *deserializer) readString(field string) string {
+	n := d.readUInt32(field + " length")
+	return string(d.take(n, field))
+}
+
+// readCount reads a 32-bit element count. Each element takes at least
+// minElementSize bytes, so we can detect absurd counts (typically coming from
+// corrupted data) before trying to allocate memory for them.
+func (d *deserializer) readCount(field string, minElementSize int) int {
+	n := d.readUInt32(field)
+	if d.err == nil && n*minElementSize > len(d.data)-d.pos {
+		d.fail("truncated data: %v says there are %v elements, but not enough data for them", field, n)
+		return 0
+	}
+	return n
+}
+
+// finish checks if all data was consumed. Returns the first error found while
+// decoding, if any.
+func (d *deserializer) finish() error {
+	if d.err == nil && d.pos != len(d.data) {
+		d.fail("%v unexpected bytes at the end of data", len(d.data)-d.pos)
+	}
+	return d.err
+}
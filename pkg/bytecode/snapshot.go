@@ -0,0 +1,386 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// SnapshotMagic is the "magic number" identifying a Romualdo VM Snapshot. It is
+// comprised of the "RmldSnp" string followed by a SUB character (which in
+// times long gone used to represent a "soft end-of-file").
+var SnapshotMagic = []byte{0x52, 0x6D, 0x6C, 0x64, 0x53, 0x6E, 0x70, 0x1A}
+
+// SnapshotVersion is the current version of a Romualdo VM Snapshot.
+const SnapshotVersion byte = 1
+
+// Snapshot is the state of a Storyworld being run by the VM, in a form that can
+// be serialized and deserialized. This is what saved games are made of. It is
+// created and used by the VM; hosts are not expected to look into it.
+//
+// References to Chunks (in call frames and in function and Passage values) are
+// indices into Snapshot.Chunks, which identifies the Chunks of the
+// CompiledStoryworld the Snapshot was taken from. This allows to restore a
+// Snapshot using a newer version of the Storyworld, in which Chunks may be
+// stored in a different order.
+//
+// The serialized format uses the same header as CompiledStoryworld (see its
+// documentation), but with SnapshotMagic and SnapshotVersion. The binary data
+// is comprised of:
+//
+// - The string table, encoded just like in a CompiledStoryworld.
+//
+// - The Chunks: a 32-bit count followed by that many pairs of string (the
+// name) and hash (a 32-bit length followed by that many bytes).
+//
+// - The 32-bit globals version.
+//
+// - The globals, encoded just like in a CompiledStoryworld.
+//
+// - The stack: a 32-bit count followed by that many Values.
+//
+// - The call frames: a 32-bit count followed by that many triplets of 32-bit
+// integers (Chunk index, instruction pointer and stack base).
+//
+// - The listen attributes: a 32-bit count followed by that many pairs of
+// string (the name) and Value.
+//
+// Values are encoded just like in a CompiledStoryworld.
+type Snapshot struct {
+	// Chunks identifies the Chunks of the CompiledStoryworld the Snapshot was
+	// taken from.
+	Chunks []SnapshotChunk
+
+	// GlobalsVersion is the globals version of the CompiledStoryworld the
+	// Snapshot was taken from.
+	GlobalsVersion int
+
+	// Globals contains the global variables and their values. Functions and
+	// Passages are not included, as they always come from the
+	// CompiledStoryworld the Snapshot is restored into.
+	Globals []GlobalVar
+
+	// Strings contains all strings interned by the VM.
+	Strings []string
+
+	// Stack contains the VM stack, from bottom to top.
+	Stack []Value
+
+	// Frames contains the call frames, from the outermost to the innermost.
+	Frames []SnapshotFrame
+
+	// Listening contains the attributes passed to the listen expression the
+	// VM was waiting on.
+	Listening []SnapshotAttribute
+}
+
+// SnapshotChunk identifies a Chunk in a Snapshot.
+type SnapshotChunk struct {
+	// Name is the name of the function or Passage (including the version,
+	// like "Name@1") whose code is in the Chunk.
+	Name string
+
+	// Hash is the hash of the Chunk (as returned by
+	// CompiledStoryworld.ChunkHash()).
+	Hash []byte
+}
+
+// SnapshotFrame is a call frame in a Snapshot.
+type SnapshotFrame struct {
+	// ChunkIndex is the index into Snapshot.Chunks of the Chunk running.
+	ChunkIndex int
+
+	// IP is the instruction pointer.
+	IP int
+
+	// StackBase is the index into Snapshot.Stack of the first stack slot
+	// used by this frame.
+	StackBase int
+}
+
+// SnapshotAttribute is an attribute passed to a listen expression.
+type SnapshotAttribute struct {
+	// Name is the attribute name.
+	Name string
+
+	// Value is the attribute value.
+	Value Value
+}
+
+// ChunkHash returns a hash (currently, SHA-256) of csw.Chunks[chunkIndex].
+// Besides the code itself, the hash covers the constants and the names of the
+// globals used by the code. The code refers to them by index, so the same code
+// can mean something else in a different version of the Storyworld.
+func (csw *CompiledStoryworld) ChunkHash(chunkIndex int) []byte {
+	chunk := csw.Chunks[chunkIndex]
+	s := &serializer{}
+	s.writeBytes(chunk.Code)
+
+	for offset := 0; offset < len(chunk.Code); {
+		switch chunk.Code[offset] {
+		case OpConstant:
+			writeHashedValue(s, csw.Constants[chunk.Code[offset+1]])
+		case OpConstantLong:
+			writeHashedValue(s, csw.Constants[DecodeUInt31(chunk.Code[offset+1:])])
+		case OpReadGlobal, OpWriteGlobal:
+			s.writeString(csw.Globals[chunk.Code[offset+1]].Name)
+		case OpReadGlobalLong, OpWriteGlobalLong:
+			s.writeString(csw.Globals[DecodeUInt31(chunk.Code[offset+1:])].Name)
+		}
+		offset = csw.DisassembleOpcode(chunk, ioutil.Discard, offset, nil)
+	}
+
+	h := sha256.Sum256(s.bytes())
+	return h[:]
+}
+
+// IsInstructionStart checks if offset is the offset of an instruction in
+// csw.Chunks[chunkIndex] (as opposed to being out of the Chunk or in the middle
+// of an instruction).
+func (csw *CompiledStoryworld) IsInstructionStart(chunkIndex, offset int) bool {
+	chunk := csw.Chunks[chunkIndex]
+	for i := 0; i < len(chunk.Code); {
+		if i == offset {
+			return true
+		}
+		i = csw.DisassembleOpcode(chunk, ioutil.Discard, i, nil)
+	}
+	return false
+}
+
+// ChunksNames returns the name of the function or Passage whose code is in each
+// of csw.Chunks. These names are taken from the globals, so they are available
+// even without debug information. Chunks not referenced by any global get an
+// empty name.
+func (csw *CompiledStoryworld) ChunksNames() []string {
+	names := make([]string, len(csw.Chunks))
+	for _, g := range csw.Globals {
+		switch {
+		case g.Value.IsFunction():
+			names[g.Value.AsFunction().ChunkIndex] = g.Name
+		case g.Value.IsPassage():
+			names[g.Value.AsPassage().ChunkIndex] = g.Name
+		}
+	}
+	return names
+}
+
+// MatchChunks maps the Chunks referenced by s to the Chunks of csw, by name.
+// Returns a slice in which element i is the index into csw.Chunks of the Chunk
+// corresponding to s.Chunks[i], or -1 if there is no such Chunk in csw.
+func (s *Snapshot) MatchChunks(csw *CompiledStoryworld) []int {
+	indices := map[string]int{}
+	for i, name := range csw.ChunksNames() {
+		if name != "" {
+			indices[name] = i
+		}
+	}
+
+	result := make([]int, len(s.Chunks))
+	for i, c := range s.Chunks {
+		index, ok := indices[c.Name]
+		if !ok {
+			index = -1
+		}
+		result[i] = index
+	}
+	return result
+}
+
+// ReadSnapshot deserializes a Snapshot, reading the binary data from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	data, err := readWithHeader(r, SnapshotMagic, uint32(SnapshotVersion), "snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{}
+	d := &deserializer{data: data, what: "snapshot"}
+
+	n := d.readCount("string count", 4)
+	stringTable := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		stringTable = append(stringTable, d.readString("string"))
+	}
+	s.Strings = stringTable
+
+	n = d.readCount("chunk count", 8)
+	for i := 0; i < n; i++ {
+		name := d.readString("chunk name")
+		hash := d.readBytes("chunk hash")
+		s.Chunks = append(s.Chunks, SnapshotChunk{Name: name, Hash: hash})
+	}
+
+	s.GlobalsVersion = d.readUInt32("globals version")
+
+	n = d.readCount("global count", 9)
+	for i := 0; i < n; i++ {
+		name := d.readString("global name")
+		version := d.readUInt32("global version")
+		value := readValue(d, stringTable)
+		s.Globals = append(s.Globals, GlobalVar{Name: name, Value: value, Version: version})
+	}
+
+	n = d.readCount("stack size", 1)
+	for i := 0; i < n; i++ {
+		s.Stack = append(s.Stack, readValue(d, stringTable))
+	}
+
+	n = d.readCount("frame count", 12)
+	for i := 0; i < n; i++ {
+		s.Frames = append(s.Frames, SnapshotFrame{
+			ChunkIndex: d.readUInt32("frame chunk index"),
+			IP:         d.readUInt32("frame instruction pointer"),
+			StackBase:  d.readUInt32("frame stack base"),
+		})
+	}
+
+	n = d.readCount("listen attribute count", 5)
+	for i := 0; i < n; i++ {
+		name := d.readString("listen attribute name")
+		value := readValue(d, stringTable)
+		s.Listening = append(s.Listening, SnapshotAttribute{Name: name, Value: value})
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+
+	return s, nil
+}
+
+// WriteTo serializes a Snapshot, writing the binary data to w.
+func (s *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+	ser := &serializer{}
+
+	// Like in a CompiledStoryworld, the string table contains the interned
+	// strings, plus any string used in a Value.
+	allStrings := NewStringInterner()
+	for _, str := range s.Strings {
+		allStrings.Intern(str)
+	}
+	internValue := func(v Value) {
+		if v.IsString() {
+			allStrings.Intern(v.AsString())
+		}
+	}
+	for _, g := range s.Globals {
+		internValue(g.Value)
+	}
+	for _, v := range s.Stack {
+		internValue(v)
+	}
+	for _, a := range s.Listening {
+		internValue(a.Value)
+	}
+
+	stringTable := allStrings.Strings()
+	stringIndices := make(map[string]int, len(stringTable))
+	ser.writeUInt32(len(stringTable))
+	for i, str := range stringTable {
+		ser.writeString(str)
+		stringIndices[str] = i
+	}
+
+	ser.writeUInt32(len(s.Chunks))
+	for _, c := range s.Chunks {
+		ser.writeString(c.Name)
+		ser.writeBytes(c.Hash)
+	}
+
+	ser.writeUInt32(s.GlobalsVersion)
+
+	ser.writeUInt32(len(s.Globals))
+	for _, g := range s.Globals {
+		ser.writeString(g.Name)
+		ser.writeUInt32(g.Version)
+		writeValue(ser, g.Value, stringIndices)
+	}
+
+	ser.writeUInt32(len(s.Stack))
+	for _, v := range s.Stack {
+		writeValue(ser, v, stringIndices)
+	}
+
+	ser.writeUInt32(len(s.Frames))
+	for _, f := range s.Frames {
+		ser.writeUInt32(f.ChunkIndex)
+		ser.writeUInt32(f.IP)
+		ser.writeUInt32(f.StackBase)
+	}
+
+	ser.writeUInt32(len(s.Listening))
+	for _, a := range s.Listening {
+		ser.writeString(a.Name)
+		writeValue(ser, a.Value, stringIndices)
+	}
+
+	return writeWithHeader(w, SnapshotMagic, uint32(SnapshotVersion), ser.bytes())
+}
+
+// validate checks if the cross-references within s are consistent.
+func (s *Snapshot) validate() error {
+	checkChunkRef := func(v Value, where string) error {
+		index := -1
+		switch {
+		case v.IsFunction():
+			index = v.AsFunction().ChunkIndex
+		case v.IsPassage():
+			index = v.AsPassage().ChunkIndex
+		default:
+			return nil
+		}
+		if index >= len(s.Chunks) {
+			return fmt.Errorf("%v refers to chunk %v, but there are only %v chunks",
+				where, index, len(s.Chunks))
+		}
+		return nil
+	}
+
+	for i, v := range s.Stack {
+		if err := checkChunkRef(v, fmt.Sprintf("stack slot %v", i)); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range s.Globals {
+		if err := checkChunkRef(g.Value, fmt.Sprintf("global '%v'", g.Name)); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range s.Listening {
+		if err := checkChunkRef(a.Value, fmt.Sprintf("listen attribute '%v'", a.Name)); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range s.Frames {
+		if f.ChunkIndex >= len(s.Chunks) {
+			return fmt.Errorf("frame %v refers to chunk %v, but there are only %v chunks",
+				i, f.ChunkIndex, len(s.Chunks))
+		}
+		if f.StackBase > len(s.Stack) {
+			return fmt.Errorf("frame %v has stack base %v, but the stack size is %v",
+				i, f.StackBase, len(s.Stack))
+		}
+		if i > 0 && f.StackBase < s.Frames[i-1].StackBase {
+			return fmt.Errorf("frame %v has stack base %v, below the one of the previous frame (%v)",
+				i, f.StackBase, s.Frames[i-1].StackBase)
+		}
+	}
+
+	return nil
+}
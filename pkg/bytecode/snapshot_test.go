@@ -0,0 +1,111 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that a Snapshot survives a round-trip through serialization and
+// deserialization.
+func TestSnapshotRoundTrip(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+	s := &Snapshot{
+		Chunks: []SnapshotChunk{
+			{Name: "fn", Hash: csw.ChunkHash(0)},
+			{Name: "Main@1", Hash: csw.ChunkHash(1)},
+		},
+		GlobalsVersion: 2,
+		Globals:        csw.Globals,
+		Strings:        []string{"Só um teste", "not interned"},
+		Stack:          []Value{NewValuePassage(1), NewValueInt(3), NewValueString("Olá")},
+		Frames:         []SnapshotFrame{{ChunkIndex: 1, IP: 7, StackBase: 0}},
+		Listening:      []SnapshotAttribute{{Name: "text", Value: NewValueString("Who?")}},
+	}
+
+	var buf bytes.Buffer
+	_, err := s.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	s2, err := ReadSnapshot(&buf)
+	assert.NoError(t, err)
+	if s2 == nil {
+		return
+	}
+
+	// Strings used in Values end up in the string table, too.
+	assert.Equal(t, []string{"Olá", "Só um teste", "Who?", "not interned"}, s2.Strings)
+	s2.Strings = s.Strings
+	assert.Equal(t, s, s2)
+}
+
+// Tests that reading an inconsistent Snapshot fails.
+func TestReadSnapshotErrors(t *testing.T) {
+	s := &Snapshot{
+		Chunks: []SnapshotChunk{{Name: "Main@1"}},
+		Frames: []SnapshotFrame{{ChunkIndex: 1}},
+	}
+
+	var buf bytes.Buffer
+	_, err := s.WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = ReadSnapshot(&buf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "frame 0 refers to chunk 1")
+
+	s = &Snapshot{
+		Chunks:    []SnapshotChunk{{Name: "Main@1"}},
+		Listening: []SnapshotAttribute{{Name: "options", Value: NewValueFunction(2)}},
+	}
+	buf.Reset()
+	_, err = s.WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = ReadSnapshot(&buf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "listen attribute 'options' refers to chunk 2")
+
+	_, err = ReadSnapshot(bytes.NewReader(CSWMagic))
+	assert.Error(t, err)
+}
+
+// Tests that Chunk hashes cover the constants and globals used by the code.
+func TestChunkHash(t *testing.T) {
+	csw := NewCompiledStoryworld()
+	csw.AddConstant(NewValueInt(1))
+	csw.SetGlobal("a", NewValueInt(0))
+	csw.SetGlobal("b", NewValueInt(0))
+	csw.Chunks = []*Chunk{
+		{Code: []byte{OpConstant, 0, OpWriteGlobal, 0, OpReturnVoid}},
+		{Code: []byte{OpConstant, 0, OpWriteGlobal, 0, OpReturnVoid}},
+	}
+	hash := csw.ChunkHash(0)
+	assert.Equal(t, hash, csw.ChunkHash(1))
+
+	csw.Constants[0] = NewValueInt(2)
+	assert.NotEqual(t, hash, csw.ChunkHash(0))
+
+	csw.Constants[0] = NewValueInt(1)
+	csw.Globals[0].Name = "c"
+	assert.NotEqual(t, hash, csw.ChunkHash(0))
+
+	assert.True(t, csw.IsInstructionStart(0, 2))
+	assert.False(t, csw.IsInstructionStart(0, 3))
+	assert.False(t, csw.IsInstructionStart(0, 5))
+}
+
+// Tests that the Chunks referenced by a Snapshot are matched by name.
+func TestSnapshotMatchChunks(t *testing.T) {
+	csw := newTestCompiledStoryworld(t)
+	assert.Equal(t, []string{"", "Main@1"}, csw.ChunksNames())
+
+	s := &Snapshot{Chunks: []SnapshotChunk{{Name: "Main@1"}, {Name: "Gone@1"}, {Name: ""}}}
+	assert.Equal(t, []int{1, -1, -1}, s.MatchChunks(csw))
+}
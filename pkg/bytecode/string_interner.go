@@ -7,6 +7,8 @@
 
 package bytecode
 
+import "sort"
+
 // StringInterner is used to intern strings.
 type StringInterner struct {
 	strings map[string]string
@@ -30,3 +32,13 @@ func (si *StringInterner) Intern(s string) string {
 	si.strings[s] = s
 	return s
 }
+
+// Strings returns all strings interned in si, sorted in lexicographic order.
+func (si *StringInterner) Strings() []string {
+	result := make([]string, 0, len(si.strings))
+	for s := range si.strings {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -9,7 +9,7 @@ package bytecode
 
 import (
 	"fmt"
-	"reflect"
+	"math"
 )
 
 // A ValueKind represents one of the types a value in the Romualdo Virtual
@@ -23,10 +23,6 @@ const (
 	// they are repsented by a 64-bit IEEE 754 number, but I'd argue that if you
 	// depend on the exact representation, Romualdo is not the right tool for
 	// you.
-	//
-	// On the VM level, this is also used for Bounded Numbers. The compiler
-	// knows the difference between a float and a bnum, but for the VM they are
-	// all floats.
 	ValueFloat ValueKind = iota
 
 	// ValueInt identifies a signed integer value. In this implementation, they
@@ -42,8 +38,39 @@ const (
 
 	// ValueFunction identifies a function value.
 	ValueFunction
+
+	// ValuePassage identifies a Passage value.
+	ValuePassage
+
+	// ValueBNum identifies a bounded number (bnum) value. These are
+	// represented just like floats, but are a distinct kind so that the VM
+	// can tell them apart (for example, to format them as "0.1b").
+	ValueBNum
 )
 
+// String converts the ValueKind to a string, using the same name the Romualdo
+// language uses for the corresponding type.
+func (k ValueKind) String() string {
+	switch k {
+	case ValueFloat:
+		return "float"
+	case ValueInt:
+		return "int"
+	case ValueBool:
+		return "bool"
+	case ValueString:
+		return "string"
+	case ValueFunction:
+		return "function"
+	case ValuePassage:
+		return "passage"
+	case ValueBNum:
+		return "bnum"
+	default:
+		return fmt.Sprintf("<unknown kind %d>", int(k))
+	}
+}
+
 // Function is the runtime representation of a function. We don't include any
 // sort of information about return and parameter types because type-checking is
 // all done statically at compile-time.
@@ -53,30 +80,73 @@ type Function struct {
 	ChunkIndex int
 }
 
+// Passage is the runtime representation of a Passage. For the VM, a Passage is
+// pretty much like a function. Having a separate type allows the VM to know
+// when a Passage is running, though.
+type Passage struct {
+	// ChunkIndex points to the Chunk that contains this Passage's bytecode.
+	// It's an index into the global slice of Chunks.
+	ChunkIndex int
+}
+
 // Value is a Romualdo language value.
+//
+// This is a tagged union: kind tells what kind of value we have, and this
+// determines which of the other fields holds the actual value. Numbers,
+// Booleans, functions and Passages are all stored unboxed in bits, so creating
+// and passing around these Values doesn't allocate memory. (This used to be an
+// interface{}, which caused an allocation for virtually every arithmetic
+// operation executed by the VM.)
+//
+// The zero Value is the floating-point number 0.0.
 type Value struct {
-	Value interface{}
+	// kind is the kind of value stored.
+	kind ValueKind
+
+	// bits stores the value for all kinds but strings. Ints are stored as their
+	// two's complement representation, floats and bnums as their IEEE 754
+	// representation, Booleans as 0 or 1, and functions and Passages as the
+	// index of their Chunk.
+	bits uint64
+
+	// str stores the value for strings.
+	str string
 }
 
 // NewValueFloat creates a new Value initialized to the floating-point number
 // v.
 func NewValueFloat(v float64) Value {
 	return Value{
-		Value: v,
+		kind: ValueFloat,
+		bits: math.Float64bits(v),
+	}
+}
+
+// NewValueBNum creates a new Value initialized to the bounded number v.
+func NewValueBNum(v float64) Value {
+	return Value{
+		kind: ValueBNum,
+		bits: math.Float64bits(v),
 	}
 }
 
 // NewValueInt creates a new Value initialized to the integer number v.
 func NewValueInt(v int64) Value {
 	return Value{
-		Value: v,
+		kind: ValueInt,
+		bits: uint64(v),
 	}
 }
 
 // NewValueBool creates a new Value initialized to the Boolean value v.
 func NewValueBool(v bool) Value {
+	var bits uint64
+	if v {
+		bits = 1
+	}
 	return Value{
-		Value: v,
+		kind: ValueBool,
+		bits: bits,
 	}
 }
 
@@ -88,115 +158,164 @@ func NewValueBool(v bool) Value {
 // string handling more efficient.
 func NewValueString(v string) Value {
 	return Value{
-		Value: v,
+		kind: ValueString,
+		str:  v,
 	}
 }
 
 // NewValueFunction creates a new Value of type Function, that will run the code at the given Chunk index.
 func NewValueFunction(index int) Value {
 	return Value{
-		Value: Function{
-			ChunkIndex: index,
-		},
+		kind: ValueFunction,
+		bits: uint64(index),
+	}
+}
+
+// NewValuePassage creates a new Value of type Passage, that will run the code at
+// the given Chunk index.
+func NewValuePassage(index int) Value {
+	return Value{
+		kind: ValuePassage,
+		bits: uint64(index),
 	}
 }
 
 // AsFloat returns this Value's value, assuming it is a floating-point number.
 func (v Value) AsFloat() float64 {
-	return v.Value.(float64)
+	v.assertKind(ValueFloat)
+	return math.Float64frombits(v.bits)
+}
+
+// AsBNum returns this Value's value, assuming it is a bounded number.
+func (v Value) AsBNum() float64 {
+	v.assertKind(ValueBNum)
+	return math.Float64frombits(v.bits)
 }
 
 // AsInt returns this Value's value, assuming it is an integer number.
 func (v Value) AsInt() int64 {
-	return v.Value.(int64)
+	v.assertKind(ValueInt)
+	return int64(v.bits)
 }
 
 // AsBool returns this Value's value, assuming it is a Boolean value.
 func (v Value) AsBool() bool {
-	return v.Value.(bool)
+	v.assertKind(ValueBool)
+	return v.bits != 0
 }
 
 // AsString returns this Value's value, assuming it is a string value.
 func (v Value) AsString() string {
-	return v.Value.(string)
+	v.assertKind(ValueString)
+	return v.str
 }
 
 // AsFunction returns this Value's value, assuming it is a function value.
 func (v Value) AsFunction() Function {
-	return v.Value.(Function)
+	v.assertKind(ValueFunction)
+	return Function{ChunkIndex: int(v.bits)}
+}
+
+// AsPassage returns this Value's value, assuming it is a Passage value.
+func (v Value) AsPassage() Passage {
+	v.assertKind(ValuePassage)
+	return Passage{ChunkIndex: int(v.bits)}
+}
+
+// assertKind panics if v is not of the given kind. This is what the As*()
+// methods use to keep the behavior of a failed type assertion, which is what
+// they did back when Values were implemented as interface{}s.
+func (v Value) assertKind(kind ValueKind) {
+	if v.kind != kind {
+		panic(fmt.Sprintf("Value is a %v, not a %v", v.kind, kind))
+	}
+}
+
+// Kind returns the kind of this Value.
+func (v Value) Kind() ValueKind {
+	return v.kind
 }
 
 // IsFloat checks if the value contains a floating-point number.
 func (v Value) IsFloat() bool {
-	_, ok := v.Value.(float64)
-	return ok
+	return v.kind == ValueFloat
+}
+
+// IsBNum checks if the value contains a bounded number.
+func (v Value) IsBNum() bool {
+	return v.kind == ValueBNum
 }
 
 // IsInt checks if the value contains an integer number.
 func (v Value) IsInt() bool {
-	_, ok := v.Value.(int64)
-	return ok
+	return v.kind == ValueInt
 }
 
 // IsBool checks if the value contains a Boolean value.
 func (v Value) IsBool() bool {
-	_, ok := v.Value.(bool)
-	return ok
+	return v.kind == ValueBool
 }
 
 // IsString checks if the value contains a string value.
 func (v Value) IsString() bool {
-	_, ok := v.Value.(string)
-	return ok
+	return v.kind == ValueString
 }
 
 // IsFunction checks if the value contains a function value.
 func (v Value) IsFunction() bool {
-	_, ok := v.Value.(Function)
-	return ok
+	return v.kind == ValueFunction
+}
+
+// IsPassage checks if the value contains a Passage value.
+func (v Value) IsPassage() bool {
+	return v.kind == ValuePassage
 }
 
 // String converts the value to a string.
 func (v Value) String() string {
-	switch vv := v.Value.(type) {
-	case float64:
-		return fmt.Sprintf("%g", vv)
-	case int64:
-		return fmt.Sprintf("%d", vv)
-	case bool:
-		return fmt.Sprintf("%v", vv)
-	case string:
-		return vv
-	case Function:
+	switch v.kind {
+	case ValueFloat:
+		return fmt.Sprintf("%g", v.AsFloat())
+	case ValueBNum:
+		return fmt.Sprintf("%gb", v.AsBNum())
+	case ValueInt:
+		return fmt.Sprintf("%d", v.AsInt())
+	case ValueBool:
+		return fmt.Sprintf("%v", v.AsBool())
+	case ValueString:
+		return v.str
+	case ValueFunction:
 		// TODO: Would be nice to include the function name if we had the debug
 		// information around. Hard to access this info from here, though.
-		return fmt.Sprintf("<function %d>", vv.ChunkIndex)
+		return fmt.Sprintf("<function %d>", v.bits)
+	case ValuePassage:
+		return fmt.Sprintf("<passage %d>", v.bits)
 	default:
-		return fmt.Sprintf("<Unexpected type %T>", vv)
+		return fmt.Sprintf("<Unexpected kind %v>", v.kind)
 	}
 }
 
 // ValuesEqual checks if a and b are considered equal.
 func ValuesEqual(a, b Value) bool {
-	if reflect.TypeOf(a.Value) != reflect.TypeOf(b.Value) {
+	if a.kind != b.kind {
 		return false
 	}
 
-	switch va := a.Value.(type) {
-	case bool:
-		return va == b.Value.(bool)
-	case float64:
-		return va == b.Value.(float64)
-	case int64:
-		return va == b.Value.(int64)
-	case string:
-		return va == b.Value.(string)
-	case Function:
+	switch a.kind {
+	case ValueFloat, ValueBNum:
+		// Compare as floats, not as bits, so that we get the IEEE 754 semantics
+		// (e.g., 0.0 == -0.0 and NaN != NaN).
+		return math.Float64frombits(a.bits) == math.Float64frombits(b.bits)
+	case ValueString:
+		return a.str == b.str
+	case ValueInt, ValueBool, ValuePassage:
+		return a.bits == b.bits
+	case ValueFunction:
 		// TODO: Not sure if makes sense, but for now let's consider that two
 		// functions are the same if they have the same bytecode.
-		return va.ChunkIndex == b.Value.(Function).ChunkIndex
+		return a.bits == b.bits
 
 	default:
-		panic(fmt.Sprintf("Unexpected Value type: %T", va))
+		panic(fmt.Sprintf("Unexpected Value kind: %v", a.kind))
 	}
 }
@@ -0,0 +1,75 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package bytecode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that Values store and return what they were created with.
+func TestValueKinds(t *testing.T) {
+	v := NewValueInt(-171)
+	assert.Equal(t, ValueInt, v.Kind())
+	assert.True(t, v.IsInt())
+	assert.False(t, v.IsFloat())
+	assert.Equal(t, int64(-171), v.AsInt())
+
+	v = NewValueFloat(-1.25)
+	assert.Equal(t, ValueFloat, v.Kind())
+	assert.True(t, v.IsFloat())
+	assert.Equal(t, -1.25, v.AsFloat())
+
+	v = NewValueBNum(0.25)
+	assert.Equal(t, ValueBNum, v.Kind())
+	assert.True(t, v.IsBNum())
+	assert.False(t, v.IsFloat())
+	assert.Equal(t, 0.25, v.AsBNum())
+	assert.Equal(t, "0.25b", v.String())
+	assert.Equal(t, "bnum", v.Kind().String())
+
+	v = NewValueBool(true)
+	assert.Equal(t, ValueBool, v.Kind())
+	assert.True(t, v.AsBool())
+	assert.False(t, NewValueBool(false).AsBool())
+
+	v = NewValueString("Romualdo")
+	assert.Equal(t, ValueString, v.Kind())
+	assert.Equal(t, "Romualdo", v.AsString())
+
+	v = NewValueFunction(3)
+	assert.Equal(t, ValueFunction, v.Kind())
+	assert.Equal(t, Function{ChunkIndex: 3}, v.AsFunction())
+
+	v = NewValuePassage(4)
+	assert.Equal(t, ValuePassage, v.Kind())
+	assert.Equal(t, Passage{ChunkIndex: 4}, v.AsPassage())
+
+	assert.Equal(t, ValueFloat, Value{}.Kind())
+	assert.Equal(t, 0.0, Value{}.AsFloat())
+
+	assert.Panics(t, func() { NewValueInt(1).AsFloat() })
+}
+
+// Tests ValuesEqual.
+func TestValuesEqual(t *testing.T) {
+	assert.True(t, ValuesEqual(NewValueInt(1), NewValueInt(1)))
+	assert.False(t, ValuesEqual(NewValueInt(1), NewValueInt(2)))
+	assert.False(t, ValuesEqual(NewValueInt(1), NewValueFloat(1.0)))
+	assert.True(t, ValuesEqual(NewValueBNum(0.5), NewValueBNum(0.5)))
+	assert.False(t, ValuesEqual(NewValueBNum(0.5), NewValueFloat(0.5)))
+	assert.True(t, ValuesEqual(NewValueFloat(0.0), NewValueFloat(math.Copysign(0, -1))))
+	assert.False(t, ValuesEqual(NewValueFloat(math.NaN()), NewValueFloat(math.NaN())))
+	assert.True(t, ValuesEqual(NewValueBool(false), NewValueBool(false)))
+	assert.True(t, ValuesEqual(NewValueString("a"), NewValueString("a")))
+	assert.False(t, ValuesEqual(NewValueString("a"), NewValueString("b")))
+	assert.False(t, ValuesEqual(NewValueFunction(1), NewValuePassage(1)))
+	assert.True(t, ValuesEqual(NewValuePassage(1), NewValuePassage(1)))
+}
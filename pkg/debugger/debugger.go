@@ -0,0 +1,469 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// Debugger runs a Storyworld under the control of the user. All the methods
+// that run code (Start, Continue, the stepping methods and Resume) return the
+// VM status when the execution stops. With vm.StatusPaused, the Storyworld
+// can be inspected and the execution continued.
+//
+// Stepping works on source code lines: stepping stops as soon as the execution
+// reaches a different line.
+type Debugger struct {
+	// VM is the Virtual Machine running the Storyworld.
+	VM *vm.VM
+
+	// csw is the compiled storyworld being debugged.
+	csw *bytecode.CompiledStoryworld
+
+	// di is the debug info for csw.
+	di *bytecode.DebugInfo
+
+	// breakpoints contains the breakpoints set, in the order they were set.
+	breakpoints []*Breakpoint
+
+	// nextBreakpointID is the ID to use for the next breakpoint set.
+	nextBreakpointID int
+
+	// mode tells how the execution shall proceed.
+	mode stepMode
+
+	// from is where the execution was when it was last continued. Stepping
+	// stops relative to this.
+	from position
+
+	// skipCurrent is set when continuing, so that the execution doesn't pause
+	// right away at the instruction where it was paused.
+	skipCurrent bool
+
+	// hit is the breakpoint that caused the latest pause, if any.
+	hit *Breakpoint
+}
+
+// stepMode tells how the execution shall proceed when continued.
+type stepMode int
+
+const (
+	// modeRun means running until a breakpoint is hit.
+	modeRun stepMode = iota
+
+	// modeStepInto means pausing at the next line, even if it is in a called
+	// function or Passage.
+	modeStepInto
+
+	// modeStepOver means pausing at the next line of the current function or
+	// Passage (or of its caller, if it returns).
+	modeStepOver
+
+	// modeStepOut means pausing when the current function or Passage returns.
+	modeStepOut
+)
+
+// position is a point in the execution of a Storyworld, at the source code
+// level.
+type position struct {
+	chunkIndex int
+	line       int
+	depth      int
+}
+
+// location is a point in the bytecode.
+type location struct {
+	chunkIndex int
+	ip         int
+}
+
+// Breakpoint is a point in the source code where the execution shall pause.
+type Breakpoint struct {
+	// ID identifies the breakpoint.
+	ID int
+
+	// File is the name of the source file, as stored in the debug info. An
+	// empty File means any file.
+	File string
+
+	// Line is the source code line.
+	Line int
+
+	// Condition is a Romualdo expression of type bool. If not empty, the
+	// execution pauses only if it evaluates to true.
+	Condition string
+
+	// HitCount is the number of times the execution paused at the breakpoint.
+	HitCount int
+
+	// locations contains the instructions where the breakpoint is.
+	locations map[location]bool
+
+	// condition is the compiled Condition, or nil if there is no condition or
+	// if it was not compiled yet.
+	condition *expression
+}
+
+// Frame is a function or Passage in the call stack.
+type Frame struct {
+	// Name is the function or Passage name.
+	Name string
+
+	// File is the name of the source file where the function or Passage was
+	// declared. May be empty if not known.
+	File string
+
+	// Line is the source code line being run.
+	Line int
+
+	// Locals contains the local variables (including parameters) live at the
+	// point being run, ordered by slot.
+	Locals []Variable
+
+	// Slots contains the values in the frame's part of the stack. Slot 0 is the
+	// function or Passage itself, followed by its arguments, local variables
+	// and temporary values.
+	Slots []bytecode.Value
+}
+
+// Variable is a variable and its current value.
+type Variable struct {
+	// Name is the variable name.
+	Name string
+
+	// Type is the variable type, as it would be written in the source code.
+	Type string
+
+	// Value is the current value of the variable.
+	Value bytecode.Value
+}
+
+// New creates a new Debugger, which will run csw on theVM. di is the debug info
+// corresponding to csw, which is required.
+func New(theVM *vm.VM, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) (*Debugger, error) {
+	if di == nil {
+		return nil, errors.New("debugging requires debug info")
+	}
+	if err := di.CheckMatch(csw); err != nil {
+		return nil, err
+	}
+
+	d := &Debugger{
+		VM:               theVM,
+		csw:              csw,
+		di:               di,
+		nextBreakpointID: 1,
+	}
+	theVM.Debugger = d
+	return d, nil
+}
+
+// Start starts running the Storyworld from the beginning. If stopOnEntry is
+// true, the execution pauses right before the first line.
+func (d *Debugger) Start(stopOnEntry bool) vm.Status {
+	d.mode = modeRun
+	if stopOnEntry {
+		d.mode = modeStepInto
+	}
+	d.from = position{chunkIndex: -1}
+	d.skipCurrent = false
+	d.hit = nil
+	return d.VM.Interpret(d.csw, d.di)
+}
+
+// Continue runs until a breakpoint is hit.
+func (d *Debugger) Continue() vm.Status {
+	return d.resume(modeRun)
+}
+
+// StepInto runs until the next line, even if it is in a function or Passage
+// called from the current line.
+func (d *Debugger) StepInto() vm.Status {
+	return d.resume(modeStepInto)
+}
+
+// StepOver runs until the next line of the current function or Passage,
+// without pausing in functions and Passages called from the current line
+// (unless they hit a breakpoint).
+func (d *Debugger) StepOver() vm.Status {
+	return d.resume(modeStepOver)
+}
+
+// StepOut runs until the current function or Passage returns.
+func (d *Debugger) StepOut() vm.Status {
+	return d.resume(modeStepOut)
+}
+
+// Resume continues running a Storyworld that is waiting for input. choice is
+// the player's choice. Whatever was being done (like stepping) goes on.
+func (d *Debugger) Resume(choice string) vm.Status {
+	d.hit = nil
+	return d.VM.Resume(choice)
+}
+
+// SetBreakpoint sets a breakpoint at a given line of file. An empty file means
+// any file, which is handy for Storyworlds made of a single file. condition
+// is either empty or a Romualdo expression of type bool, which may refer to
+// global variables and to the local variables in scope at the breakpoint.
+func (d *Debugger) SetBreakpoint(file string, line int, condition string) (*Breakpoint, error) {
+	bp := &Breakpoint{
+		File:      file,
+		Line:      line,
+		Condition: condition,
+		locations: map[location]bool{},
+	}
+
+	// The breakpoint is at the first instruction of each run of instructions
+	// generated from the line. The condition must be valid in the scope of all
+	// these instructions.
+	scope := []bytecode.LocalVar{}
+	scopeFile := ""
+	for chunkIndex, lines := range d.di.ChunksLines {
+		if !fileMatches(d.di.ChunkFile(chunkIndex), file) {
+			continue
+		}
+		for ip, l := range lines {
+			if l == line && (ip == 0 || lines[ip-1] != line) {
+				bp.locations[location{chunkIndex, ip}] = true
+				scope = append(scope, d.di.LocalsAt(chunkIndex, ip)...)
+				scopeFile = d.di.ChunkFile(chunkIndex)
+			}
+		}
+	}
+	if len(bp.locations) == 0 {
+		return nil, fmt.Errorf("no code at line %v%v", line, describeFile(file))
+	}
+
+	if condition != "" {
+		cond, err := d.compileExpression(condition, d.variables(declaredVariables(scope), scopeFile))
+		if err != nil {
+			return nil, err
+		}
+		if cond.resultType.Tag != ast.TypeBool {
+			return nil, fmt.Errorf("breakpoint condition must be a bool, not %v", cond.resultType)
+		}
+	}
+
+	bp.ID = d.nextBreakpointID
+	d.nextBreakpointID++
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp, nil
+}
+
+// ClearBreakpoint removes the breakpoint with a given ID.
+func (d *Debugger) ClearBreakpoint(id int) error {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %v", id)
+}
+
+// Breakpoints returns the breakpoints set, in the order they were set.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return append([]*Breakpoint{}, d.breakpoints...)
+}
+
+// HitBreakpoint returns the breakpoint that caused the latest pause, or nil if
+// the latest pause was caused by stepping.
+func (d *Debugger) HitBreakpoint() *Breakpoint {
+	return d.hit
+}
+
+// Frames returns the call stack, from the innermost frame (the function or
+// Passage being run) to the outermost one (the entry Passage).
+func (d *Debugger) Frames() []Frame {
+	callStack := d.VM.CallStack()
+	frames := make([]Frame, len(callStack))
+	for i, f := range callStack {
+		// For all but the innermost frame, IP points past the call instruction.
+		ip := f.IP
+		if i < len(callStack)-1 {
+			ip--
+		}
+		locals := []Variable{}
+		for _, local := range d.di.LocalsAt(f.ChunkIndex, ip) {
+			if local.Slot < len(f.Slots) {
+				locals = append(locals, Variable{Name: local.Name, Type: local.Type, Value: f.Slots[local.Slot]})
+			}
+		}
+		frames[len(callStack)-1-i] = Frame{
+			Name:   d.di.ChunksNames[f.ChunkIndex],
+			File:   d.di.ChunkFile(f.ChunkIndex),
+			Line:   d.lineAt(f.ChunkIndex, ip),
+			Locals: locals,
+			Slots:  f.Slots,
+		}
+	}
+	return frames
+}
+
+// Globals returns the global variables (including functions and Passages),
+// with their current values.
+func (d *Debugger) Globals() []bytecode.GlobalVar {
+	return append([]bytecode.GlobalVar{}, d.csw.Globals...)
+}
+
+// ValueStack returns the whole VM stack, from the bottom to the top.
+func (d *Debugger) ValueStack() []bytecode.Value {
+	return d.VM.ValueStack()
+}
+
+// ShouldPause implements the vm.Debugger interface.
+func (d *Debugger) ShouldPause(theVM *vm.VM) bool {
+	if d.skipCurrent {
+		d.skipCurrent = false
+		return false
+	}
+
+	chunkIndex, ip, depth := theVM.Position()
+	for _, bp := range d.breakpoints {
+		if bp.locations[location{chunkIndex, ip}] && d.conditionHolds(bp) {
+			bp.HitCount++
+			d.hit = bp
+			return true
+		}
+	}
+
+	here := position{chunkIndex: chunkIndex, line: d.lineAt(chunkIndex, ip), depth: depth}
+	switch d.mode {
+	case modeStepInto:
+		return here != d.from
+	case modeStepOver:
+		return depth < d.from.depth || depth == d.from.depth && here != d.from
+	case modeStepOut:
+		return depth < d.from.depth
+	default:
+		return false
+	}
+}
+
+// resume continues a paused execution in a given mode.
+func (d *Debugger) resume(mode stepMode) vm.Status {
+	chunkIndex, ip, depth := d.VM.Position()
+	d.mode = mode
+	d.from = position{chunkIndex: chunkIndex, line: d.lineAt(chunkIndex, ip), depth: depth}
+	d.skipCurrent = true
+	d.hit = nil
+	return d.VM.Continue()
+}
+
+// conditionHolds checks if the condition of bp holds. Breakpoints without
+// conditions always hold, and so do those whose conditions cannot be evaluated
+// (it's better to pause than to silently ignore the problem).
+//
+// Conditions are compiled when first evaluated, and compiled again whenever
+// the variables in scope change, as they may when a breakpoint is in many
+// places.
+func (d *Debugger) conditionHolds(bp *Breakpoint) bool {
+	if bp.Condition == "" {
+		return true
+	}
+
+	vars := d.variables(d.currentLocals(), d.currentFile())
+	if bp.condition == nil || !bp.condition.compatibleWith(vars) {
+		cond, err := d.compileExpression(bp.Condition, vars)
+		if err != nil {
+			return true
+		}
+		bp.condition = cond
+	}
+
+	value, err := bp.condition.evaluate(vars)
+	return err != nil || !value.IsBool() || value.AsBool()
+}
+
+// currentLocals returns the local variables live at the point being run.
+func (d *Debugger) currentLocals() []Variable {
+	frames := d.Frames()
+	if len(frames) == 0 {
+		return nil
+	}
+	return frames[0].Locals
+}
+
+// currentFile returns the name of the source file of the function or Passage
+// being run, or an empty string if not known.
+func (d *Debugger) currentFile() string {
+	frames := d.Frames()
+	if len(frames) == 0 {
+		return ""
+	}
+	return frames[0].File
+}
+
+// variables returns the variables that can be used in expressions in the
+// source file named file: the global variables visible from there with their
+// current values, plus locals. Local variables hide global ones with the same
+// name.
+func (d *Debugger) variables(locals []Variable, file string) []Variable {
+	vars := []Variable{}
+	for _, g := range d.csw.Globals {
+		name := g.Name
+		// Private globals are qualified with the file they belong to, like
+		// "intro.romulang:count".
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			if !fileMatches(file, name[:i]) {
+				continue
+			}
+			name = name[i+1:]
+		}
+		vars = append(vars, Variable{Name: name, Type: typeOfValue(g.Value).String(), Value: g.Value})
+	}
+	return evaluableVariables(append(vars, locals...))
+}
+
+// declaredVariables returns locals as Variables, with their zero values. This
+// is used to compile expressions before the variables get actual values.
+func declaredVariables(locals []bytecode.LocalVar) []Variable {
+	vars := []Variable{}
+	for _, local := range locals {
+		vars = append(vars, Variable{Name: local.Name, Type: local.Type})
+	}
+	return vars
+}
+
+// lineAt returns the source code line of the instruction at ip in the Chunk
+// at chunkIndex.
+func (d *Debugger) lineAt(chunkIndex, ip int) int {
+	lines := d.di.ChunksLines[chunkIndex]
+	if ip < 0 || ip >= len(lines) {
+		return 0
+	}
+	return lines[ip]
+}
+
+// fileMatches checks if chunkFile (a file name from the debug info) matches
+// file (a file name given by the user). The user can omit any leading
+// directories, and an empty file matches anything.
+func fileMatches(chunkFile, file string) bool {
+	if file == "" {
+		return true
+	}
+	chunkFile = filepath.ToSlash(chunkFile)
+	file = filepath.ToSlash(file)
+	return chunkFile == file || strings.HasSuffix(chunkFile, "/"+file)
+}
+
+// describeFile returns file formatted for error messages, like " of
+// story.romulang", or an empty string if file is empty.
+func describeFile(file string) string {
+	if file == "" {
+		return ""
+	}
+	return " of " + file
+}
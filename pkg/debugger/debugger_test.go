@@ -0,0 +1,243 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package debugger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// testSource is the Storyworld debugged in the tests. Line numbers matter.
+const testSource = `globals@1
+    Count: int = 0
+end
+
+passage Main@1(): void
+    say "start"
+    while Count < 3 do
+        Count = Count + 1
+        say string(twice(Count))
+    end
+    say "done"
+end
+
+function twice(x: int): int
+    var y: int = 0
+    y = x * 2
+    return y
+end
+`
+
+// Tests that the execution pauses at breakpoints.
+func TestBreakpoints(t *testing.T) {
+	d, said := newTestDebugger(t)
+
+	_, err := d.SetBreakpoint("story.romulang", 4, "")
+	assert.Error(t, err)
+	_, err = d.SetBreakpoint("other.romulang", 9, "")
+	assert.Error(t, err)
+
+	bp, err := d.SetBreakpoint("story.romulang", 9, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bp.ID)
+
+	assert.Equal(t, vm.StatusPaused, d.Start(false))
+	assert.Equal(t, bp, d.HitBreakpoint())
+	assert.Equal(t, 9, d.Frames()[0].Line)
+	assert.Equal(t, []string{"start"}, *said)
+
+	assert.Equal(t, vm.StatusPaused, d.Continue())
+	assert.Equal(t, []string{"start", "2"}, *said)
+	assert.Equal(t, 2, bp.HitCount)
+
+	assert.NoError(t, d.ClearBreakpoint(bp.ID))
+	assert.Error(t, d.ClearBreakpoint(bp.ID))
+	assert.Empty(t, d.Breakpoints())
+	assert.Equal(t, vm.StatusFinished, d.Continue())
+	assert.Equal(t, []string{"start", "2", "4", "6", "done"}, *said)
+}
+
+// Tests that the execution pauses at conditional breakpoints only when their
+// conditions are true.
+func TestConditionalBreakpoints(t *testing.T) {
+	d, said := newTestDebugger(t)
+
+	_, err := d.SetBreakpoint("", 9, "Count")
+	assert.Error(t, err)
+	_, err = d.SetBreakpoint("", 9, "Count = ")
+	assert.Error(t, err)
+
+	bp, err := d.SetBreakpoint("", 9, "Count == 2")
+	assert.NoError(t, err)
+
+	assert.Equal(t, vm.StatusPaused, d.Start(false))
+	assert.Equal(t, bp, d.HitBreakpoint())
+	assert.Equal(t, []string{"start", "2"}, *said)
+	assert.Equal(t, vm.StatusFinished, d.Continue())
+	assert.Equal(t, 1, bp.HitCount)
+
+	// Conditions can use local variables, too.
+	d, said = newTestDebugger(t)
+	_, err = d.SetBreakpoint("", 9, "x == 3")
+	assert.Error(t, err)
+	bp, err = d.SetBreakpoint("", 16, "x == 3")
+	assert.NoError(t, err)
+	assert.Equal(t, vm.StatusPaused, d.Start(false))
+	assert.Equal(t, bp, d.HitBreakpoint())
+	assert.Equal(t, []string{"start", "2", "4"}, *said)
+}
+
+// Tests stepping into, over and out of functions.
+func TestStepping(t *testing.T) {
+	d, said := newTestDebugger(t)
+
+	assert.Equal(t, vm.StatusPaused, d.Start(true))
+	assert.Equal(t, 6, d.Frames()[0].Line)
+
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 7, d.Frames()[0].Line)
+	assert.Equal(t, []string{"start"}, *said)
+
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 8, d.Frames()[0].Line)
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 9, d.Frames()[0].Line)
+
+	assert.Equal(t, vm.StatusPaused, d.StepInto())
+	frames := d.Frames()
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, "twice", frames[0].Name)
+	assert.Equal(t, 15, frames[0].Line)
+	assert.Equal(t, "Main@1", frames[1].Name)
+	assert.Equal(t, 9, frames[1].Line)
+	assert.Equal(t, int64(1), frames[0].Slots[1].AsInt())
+	assert.Equal(t, []Variable{{Name: "x", Type: "int", Value: bytecode.NewValueInt(1)}}, frames[0].Locals)
+	assert.Empty(t, frames[1].Locals)
+
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 16, d.Frames()[0].Line)
+	assert.Equal(t, []Variable{
+		{Name: "x", Type: "int", Value: bytecode.NewValueInt(1)},
+		{Name: "y", Type: "int", Value: bytecode.NewValueInt(0)},
+	}, d.Frames()[0].Locals)
+
+	assert.Equal(t, vm.StatusPaused, d.StepOut())
+	frames = d.Frames()
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, 9, frames[0].Line)
+	assert.Equal(t, []string{"start"}, *said)
+
+	// Stepping over a line that calls a function doesn't stop in it.
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, []string{"start", "2"}, *said)
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 9, d.Frames()[0].Line)
+	assert.Equal(t, vm.StatusPaused, d.StepOver())
+	assert.Equal(t, 1, len(d.Frames()))
+	assert.Equal(t, []string{"start", "2", "4"}, *said)
+}
+
+// Tests that expressions are evaluated using the current values of the
+// global and local variables.
+func TestEvaluate(t *testing.T) {
+	d, _ := newTestDebugger(t)
+	_, err := d.SetBreakpoint("", 16, "")
+	assert.NoError(t, err)
+	assert.Equal(t, vm.StatusPaused, d.Start(false))
+	assert.Equal(t, vm.StatusPaused, d.Continue())
+
+	value, valueType, err := d.Evaluate("Count * 10 + 1")
+	assert.NoError(t, err)
+	assert.Equal(t, ast.TheTypeInt, valueType)
+	assert.Equal(t, int64(21), value.AsInt())
+
+	value, valueType, err = d.Evaluate(`"Count is " + string(Count)`)
+	assert.NoError(t, err)
+	assert.Equal(t, ast.TheTypeString, valueType)
+	assert.Equal(t, "Count is 2", value.AsString())
+
+	// Local variables can be used, too.
+	value, _, err = d.Evaluate("x * 100 + y")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), value.AsInt())
+
+	_, _, err = d.Evaluate("nope + 1")
+	assert.Error(t, err)
+	_, _, err = d.Evaluate("")
+	assert.Error(t, err)
+
+	globals := d.Globals()
+	assert.Equal(t, "Count", globals[0].Name)
+	assert.Equal(t, int64(2), globals[0].Value.AsInt())
+	assert.NotEmpty(t, d.ValueStack())
+}
+
+// Tests that private global variables can be used in expressions, by their
+// names as seen from the file being run.
+func TestEvaluatePrivateGlobals(t *testing.T) {
+	d, _ := newTestDebuggerFor(t, "globals@1\n"+
+		"    count: int = 7\n"+
+		"end\n"+
+		"\n"+
+		"passage Main@1(): void\n"+
+		"    say string(count)\n"+
+		"end\n")
+	_, err := d.SetBreakpoint("", 6, "count > 5")
+	assert.NoError(t, err)
+	assert.Equal(t, vm.StatusPaused, d.Start(false))
+
+	value, _, err := d.Evaluate("count + 1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), value.AsInt())
+}
+
+// Tests that a Debugger cannot be created without debug info.
+func TestNewWithoutDebugInfo(t *testing.T) {
+	_, err := New(vm.New(), &bytecode.CompiledStoryworld{}, nil)
+	assert.Error(t, err)
+}
+
+// newTestDebugger returns a Debugger for testSource. It also returns the
+// texts said by the Storyworld.
+func newTestDebugger(t *testing.T) (*Debugger, *[]string) {
+	return newTestDebuggerFor(t, testSource)
+}
+
+// newTestDebuggerFor is like newTestDebugger, but for the Storyworld whose
+// source code is source.
+func newTestDebuggerFor(t *testing.T, source string) (*Debugger, *[]string) {
+	fs := frontend.NewFileSet()
+	fs.AddSource("story.romulang", source)
+	root, diags := frontend.ParseFileSet(fs, nil)
+	if diags.HasErrors() {
+		t.Fatalf("Compilation failed: %v", diags)
+	}
+	csw, di, err := backend.GenerateCode(root)
+	if err != nil {
+		t.Fatalf("Code generation failed: %v", err)
+	}
+
+	said := []string{}
+	theVM := vm.New()
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+
+	d, err := New(theVM, csw, di)
+	if err != nil {
+		t.Fatalf("Creating the debugger failed: %v", err)
+	}
+	return d, &said
+}
@@ -0,0 +1,16 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The debugger package implements a source-level debugger for Storyworlds
+// running on the Romualdo Virtual Machine: line breakpoints (optionally
+// conditional), stepping, and inspection of the call stack, the value stack
+// and local and global variables. It relies on the debug info generated by the
+// compiler.
+//
+// This package contains no user interface; see the debug command of romulangc
+// for a terminal front end.
+package debugger
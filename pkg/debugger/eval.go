@@ -0,0 +1,232 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// resultVar is the name of the global variable to which the value of an
+// evaluated expression is assigned.
+const resultVar = "dbg__result"
+
+// identifierRE matches a valid identifier. Global variables whose names are
+// not identifiers (like those of Passages, which include the version) cannot
+// be used in expressions.
+var identifierRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expression is a Romualdo expression compiled for evaluation by the
+// debugger.
+//
+// Expressions are compiled as a tiny Storyworld on their own, which declares
+// the variables visible to the expression as global variables. To evaluate the
+// expression, the current values of the variables are copied into it, and it
+// is run on a separate VM.
+type expression struct {
+	// csw is the compiled Storyworld that evaluates the expression.
+	csw *bytecode.CompiledStoryworld
+
+	// resultType is the type of the expression.
+	resultType *ast.Type
+
+	// signature identifies the variables (names and types) the expression was
+	// compiled with.
+	signature string
+}
+
+// Evaluate evaluates a Romualdo expression and returns its value and type. The
+// expression may refer to global variables and to the local variables of the
+// function or Passage being run, as long as they are of basic types.
+func (d *Debugger) Evaluate(expr string) (bytecode.Value, *ast.Type, error) {
+	vars := d.variables(d.currentLocals(), d.currentFile())
+	e, err := d.compileExpression(expr, vars)
+	if err != nil {
+		return bytecode.Value{}, nil, err
+	}
+	value, err := e.evaluate(vars)
+	if err != nil {
+		return bytecode.Value{}, nil, err
+	}
+	return value, e.resultType, nil
+}
+
+// compileExpression compiles expr, which can use the variables in vars. Only
+// the variable names and types matter here, not their values.
+func (d *Debugger) compileExpression(expr string, vars []Variable) (*expression, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, errors.New("empty expression")
+	}
+
+	// First we compile the expression as it is, to know its type...
+	root, diags := frontend.Parse(expressionSource(vars, nil, expr))
+	if diags.HasErrors() {
+		return nil, expressionError(diags)
+	}
+	body := root.(*ast.Storyworld).Declarations[1].(*ast.PassageDecl).Body
+	if len(body.Statements) != 1 {
+		return nil, errors.New("not a single expression")
+	}
+	stmt, ok := body.Statements[0].(*ast.ExpressionStmt)
+	if !ok {
+		return nil, errors.New("not an expression")
+	}
+	resultType := stmt.Expr.Type()
+	if !isBasicType(resultType.String()) {
+		return nil, fmt.Errorf("cannot evaluate expressions of type %v", resultType)
+	}
+
+	// ...and then we compile it for real, assigning its value to a global
+	// variable, from which we can read it.
+	root, diags = frontend.Parse(expressionSource(vars, resultType, resultVar+" = "+expr))
+	if diags.HasErrors() {
+		return nil, expressionError(diags)
+	}
+	csw, _, err := backend.GenerateCode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &expression{csw: csw, resultType: resultType, signature: signature(vars)}, nil
+}
+
+// compatibleWith checks if the expression can be evaluated with vars, that is,
+// if it was compiled with variables of the same names and types.
+func (e *expression) compatibleWith(vars []Variable) bool {
+	return e.signature == signature(vars)
+}
+
+// evaluate evaluates the expression, using the values of the given variables.
+func (e *expression) evaluate(vars []Variable) (bytecode.Value, error) {
+	for _, v := range vars {
+		if i := e.csw.GetGlobalIndex(v.Name); i >= 0 && e.csw.Globals[i].Value.Kind() == v.Value.Kind() {
+			e.csw.Globals[i].Value = v.Value
+		}
+	}
+
+	theVM := vm.New()
+	if status := theVM.Interpret(e.csw, nil); status != vm.StatusFinished {
+		return bytecode.Value{}, errors.New("evaluation failed")
+	}
+	return e.csw.Globals[e.csw.GetGlobalIndex(resultVar)].Value, nil
+}
+
+// evaluableVariables returns the variables in vars that can be used in
+// expressions: those of basic types, with names that are identifiers. When
+// many variables share the same name, the last one is used.
+func evaluableVariables(vars []Variable) []Variable {
+	result := []Variable{}
+	indices := map[string]int{}
+	for _, v := range vars {
+		if !identifierRE.MatchString(v.Name) || v.Name == resultVar || !isBasicType(v.Type) {
+			continue
+		}
+		if i, ok := indices[v.Name]; ok {
+			result[i] = v
+			continue
+		}
+		indices[v.Name] = len(result)
+		result = append(result, v)
+	}
+	return result
+}
+
+// signature returns a string identifying the names and types of vars.
+func signature(vars []Variable) string {
+	var sb strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&sb, "%v:%v;", v.Name, v.Type)
+	}
+	return sb.String()
+}
+
+// expressionSource returns the source code of the Storyworld used to evaluate
+// an expression. It declares vars, plus the result variable if resultType is
+// not nil. The Main Passage contains just body.
+func expressionSource(vars []Variable, resultType *ast.Type, body string) string {
+	var sb strings.Builder
+	sb.WriteString("globals@1\n")
+	for _, v := range vars {
+		fmt.Fprintf(&sb, "    %v: %v = %v\n", v.Name, v.Type, zeroValue(v.Type))
+	}
+	if resultType != nil {
+		fmt.Fprintf(&sb, "    %v: %v = %v\n", resultVar, resultType, zeroValue(resultType.String()))
+	}
+	sb.WriteString("end\n")
+	sb.WriteString("passage Main@1(): void\n")
+	sb.WriteString(body)
+	sb.WriteString("\nend\n")
+	return sb.String()
+}
+
+// typeOfValue returns the type of a Value. Returns TheTypeInvalid for kinds of
+// values which are not of a basic type.
+func typeOfValue(v bytecode.Value) *ast.Type {
+	switch v.Kind() {
+	case bytecode.ValueInt:
+		return ast.TheTypeInt
+	case bytecode.ValueFloat:
+		return ast.TheTypeFloat
+	case bytecode.ValueBNum:
+		return ast.TheTypeBNum
+	case bytecode.ValueBool:
+		return ast.TheTypeBool
+	case bytecode.ValueString:
+		return ast.TheTypeString
+	default:
+		return ast.TheTypeInvalid
+	}
+}
+
+// isBasicType checks if typeName is the name of one of the basic types: int,
+// float, bnum, bool or string.
+func isBasicType(typeName string) bool {
+	return zeroValue(typeName) != ""
+}
+
+// zeroValue returns the source code for the zero value of the basic type named
+// typeName, or an empty string if it is not a basic type. BNums cannot be
+// zero, so their "zero" is the neutral 0.5b.
+func zeroValue(typeName string) string {
+	switch typeName {
+	case "int":
+		return "0"
+	case "float":
+		return "0.0"
+	case "bnum":
+		return "0.5b"
+	case "bool":
+		return "false"
+	case "string":
+		return `""`
+	default:
+		return ""
+	}
+}
+
+// expressionError converts the errors in diags into a single error. Positions
+// are dropped, as they refer to the synthetic source code.
+func expressionError(diags diagnostic.List) error {
+	messages := []string{}
+	for _, d := range diags {
+		if d.Severity == diagnostic.SeverityError {
+			messages = append(messages, d.Message)
+		}
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,208 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package diagnostic
+
+// Code identifies a kind of Diagnostic. Codes are stable: once assigned, a code
+// is never reused for a different kind of problem, even if the message wording
+// changes. This allows tools and tests to rely on them.
+//
+// Codes are grouped by the compiler stage that reports them: E1xxx for syntax
+// errors, E2xxx for semantic errors, E3xxx for name resolution errors, E4xxx
+// for type errors, E5xxx for code generation errors (mostly implementation
+// limits) and E9xxx for internal errors. Runtime errors use R0xxx.
+type Code string
+
+// Syntax errors, reported by the parser.
+const (
+	// CodeInvalidToken is used when the scanner finds something that is not a
+	// valid token, like an unterminated string.
+	CodeInvalidToken Code = "E1000"
+
+	// CodeUnexpectedToken is used when the parser finds a token that doesn't
+	// fit the grammar at that point.
+	CodeUnexpectedToken Code = "E1001"
+
+	// CodeInvalidAssignmentTarget is used when assigning to something that is
+	// not a variable.
+	CodeInvalidAssignmentTarget Code = "E1002"
+
+	// CodeInvalidVersion is used when a Passage or globals block version is not
+	// a positive integer.
+	CodeInvalidVersion Code = "E1003"
+
+	// CodeVoidParameter is used when a parameter is declared as void.
+	CodeVoidParameter Code = "E1004"
+
+	// CodeWrongBuiltInArity is used when a built-in function is called with
+	// the wrong number of arguments.
+	CodeWrongBuiltInArity Code = "E1005"
+
+	// CodeBNumOutOfRange is used when a bnum literal is out of the valid range.
+	CodeBNumOutOfRange Code = "E1006"
+
+	// CodeTooManyArguments is used when a call has more arguments than
+	// supported.
+	CodeTooManyArguments Code = "E1007"
+
+	// CodeNotCallable is used when trying to call something that cannot be
+	// called.
+	CodeNotCallable Code = "E1008"
+)
+
+// Semantic errors, reported by the semantic checker.
+const (
+	// CodeEntryPassageNotFound is used when the entry Passage doesn't exist.
+	CodeEntryPassageNotFound Code = "E2001"
+
+	// CodeBadEntryPassage is used when the entry Passage has the wrong
+	// signature.
+	CodeBadEntryPassage Code = "E2002"
+
+	// CodeDuplicateGlobalsBlock is used when two globals blocks have the same
+	// version.
+	CodeDuplicateGlobalsBlock Code = "E2003"
+
+	// CodeMissingGlobalsBlock is used when there is a gap in the globals block
+	// versions.
+	CodeMissingGlobalsBlock Code = "E2004"
+
+	// CodeDuplicateGlobal is used when a globals block declares the same
+	// variable twice.
+	CodeDuplicateGlobal Code = "E2005"
+
+	// CodeGlobalRemoved is used when a globals block removes a variable
+	// declared in the previous version.
+	CodeGlobalRemoved Code = "E2006"
+
+	// CodeGlobalTypeChanged is used when a globals block changes the type of a
+	// variable declared in the previous version.
+	CodeGlobalTypeChanged Code = "E2007"
+
+	// CodeRedeclaredName is used when a global name is declared twice.
+	CodeRedeclaredName Code = "E2008"
+
+	// CodeDuplicatePassage is used when two Passages have the same name and
+	// version.
+	CodeDuplicatePassage Code = "E2009"
+
+	// CodeDuplicateMetaVar is used when a meta block declares the same
+	// variable twice.
+	CodeDuplicateMetaVar Code = "E2010"
+
+	// CodeDuplicateAttribute is used when a say or listen has the same
+	// attribute twice.
+	CodeDuplicateAttribute Code = "E2011"
+
+	// CodeOutsidePassage is used when something that is valid only inside
+	// Passages is used elsewhere.
+	CodeOutsidePassage Code = "E2012"
+
+	// CodeNonLiteralInitializer is used when a variable is initialized with
+	// something other than a literal.
+	CodeNonLiteralInitializer Code = "E2013"
+)
+
+// Name resolution errors, reported when setting the types of variables.
+const (
+	// CodeUndeclaredName is used when referring to a name that was not
+	// declared.
+	CodeUndeclaredName Code = "E3001"
+
+	// CodeUnknownNativeFunction is used when calling a native function that
+	// was not registered.
+	CodeUnknownNativeFunction Code = "E3002"
+
+	// CodeNotVisible is used when referring to a private name declared in
+	// another file.
+	CodeNotVisible Code = "E3003"
+)
+
+// Type errors, reported by the type checker.
+const (
+	// CodeTypeMismatch is used when assigning or initializing a variable with
+	// a value of the wrong type.
+	CodeTypeMismatch Code = "E4001"
+
+	// CodeBadOperandType is used when an operator is used with operands of
+	// unsupported types.
+	CodeBadOperandType Code = "E4002"
+
+	// CodeNonBoolCondition is used when the condition of an if or while is not
+	// Boolean.
+	CodeNonBoolCondition Code = "E4003"
+
+	// CodeBadAttributeType is used when a say or listen attribute has an
+	// unsupported type.
+	CodeBadAttributeType Code = "E4004"
+
+	// CodeCallingPassage is used when calling a Passage like a function.
+	CodeCallingPassage Code = "E4005"
+
+	// CodeNotAPassage is used when a goto or gosub targets something that is
+	// not a Passage.
+	CodeNotAPassage Code = "E4006"
+
+	// CodeGotoReturnTypeMismatch is used when a goto targets a Passage with a
+	// different return type.
+	CodeGotoReturnTypeMismatch Code = "E4007"
+
+	// CodeWrongArgumentCount is used when calling something with the wrong
+	// number of arguments.
+	CodeWrongArgumentCount Code = "E4008"
+
+	// CodeWrongArgumentType is used when passing an argument of the wrong type.
+	CodeWrongArgumentType Code = "E4009"
+
+	// CodeWrongReturnType is used when returning a value of the wrong type.
+	CodeWrongReturnType Code = "E4010"
+
+	// CodeBadConversion is used when a type conversion is not supported.
+	CodeBadConversion Code = "E4011"
+
+	// CodeVoidVariable is used when declaring a variable of type void.
+	CodeVoidVariable Code = "E4012"
+)
+
+// Code generation errors, reported by the backend.
+const (
+	// CodeTooManyGlobals is used when there are more global variables than
+	// supported.
+	CodeTooManyGlobals Code = "E5001"
+
+	// CodeTooManyConstants is used when a Chunk has more constants than
+	// supported.
+	CodeTooManyConstants Code = "E5002"
+
+	// CodeTooManyAttributes is used when a say or listen has more attributes
+	// than supported.
+	CodeTooManyAttributes Code = "E5003"
+
+	// CodeShadowedLocal is used when a local variable shadows another one.
+	CodeShadowedLocal Code = "E5004"
+
+	// CodeJumpTooLong is used when a jump is longer than supported.
+	CodeJumpTooLong Code = "E5005"
+
+	// CodeUndeclaredGlobal is used when the backend finds a reference to a
+	// global variable that doesn't exist.
+	CodeUndeclaredGlobal Code = "E5006"
+)
+
+// Internal errors.
+const (
+	// CodeInternalError is used for internal compiler errors, that is, bugs in
+	// the compiler itself.
+	CodeInternalError Code = "E9000"
+)
+
+// Runtime errors, reported by the VM.
+const (
+	// CodeRuntimeError is used for errors detected while running a
+	// Storyworld.
+	CodeRuntimeError Code = "R0001"
+)
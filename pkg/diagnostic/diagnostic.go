@@ -0,0 +1,144 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package diagnostic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity tells how serious a Diagnostic is.
+type Severity int
+
+const (
+	// SeverityError identifies an error. Errors prevent the Storyworld from
+	// being compiled or run.
+	SeverityError Severity = iota
+
+	// SeverityWarning identifies a warning. Warnings point to something that
+	// looks wrong, but that doesn't prevent the Storyworld from being compiled.
+	SeverityWarning
+)
+
+// String converts the Severity to a string.
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("<unknown severity %d>", int(s))
+	}
+}
+
+// Diagnostic is a message about a Storyworld, like an error found while
+// compiling it.
+type Diagnostic struct {
+	// Code identifies the kind of problem being reported.
+	Code Code
+
+	// Severity tells how serious the problem is.
+	Severity Severity
+
+	// File is the name of the source file where the problem is. Empty if
+	// unknown.
+	File string
+
+	// Line is the (1-based) line number where the problem is. Zero if unknown.
+	Line int
+
+	// Column is the (1-based) column where the problem starts. Zero if
+	// unknown.
+	Column int
+
+	// EndLine is the line where the problem ends. Zero means the problem
+	// ends on the same line it starts.
+	EndLine int
+
+	// EndColumn is the column just past the end of the problem, on EndLine.
+	// Zero if unknown.
+	EndColumn int
+
+	// Message is the human-readable description of the problem.
+	Message string
+}
+
+// Error converts the Diagnostic to a string in the traditional
+// "file:line:column: severity[code]: message" format. Parts that are not
+// known are omitted. Implements the error interface.
+func (d *Diagnostic) Error() string {
+	var sb strings.Builder
+
+	location := d.location()
+	if location != "" {
+		sb.WriteString(location)
+		sb.WriteString(": ")
+	}
+
+	fmt.Fprintf(&sb, "%v[%v]: %v", d.Severity, d.Code, d.Message)
+	return sb.String()
+}
+
+// location returns the location of the Diagnostic in the "file:line:column"
+// format. Parts that are not known are omitted.
+func (d *Diagnostic) location() string {
+	parts := []string{}
+	if d.File != "" {
+		parts = append(parts, d.File)
+	}
+	if d.Line > 0 {
+		parts = append(parts, fmt.Sprintf("%v", d.Line))
+		if d.Column > 0 {
+			parts = append(parts, fmt.Sprintf("%v", d.Column))
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+// List is a list of Diagnostics.
+type List []*Diagnostic
+
+// Error converts the List to a string, with one Diagnostic per line.
+// Implements the error interface.
+func (l List) Error() string {
+	msgs := make([]string, len(l))
+	for i, d := range l {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns l as an error, or nil if l contains no errors. Use this instead
+// of returning a List directly as an error, because a nil List converted to an
+// error is not a nil error.
+func (l List) Err() error {
+	if !l.HasErrors() {
+		return nil
+	}
+	return l
+}
+
+// HasErrors checks if l contains at least one Diagnostic with SeverityError.
+func (l List) HasErrors() bool {
+	for _, d := range l {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Codes returns the codes of all Diagnostics in l, in order.
+func (l List) Codes() []Code {
+	codes := make([]Code, len(l))
+	for i, d := range l {
+		codes[i] = d.Code
+	}
+	return codes
+}
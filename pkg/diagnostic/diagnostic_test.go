@@ -0,0 +1,108 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package diagnostic
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests the conversion of Diagnostics to strings.
+func TestDiagnosticError(t *testing.T) {
+	d := &Diagnostic{
+		Code:     CodeTypeMismatch,
+		Severity: SeverityError,
+		File:     "main.romulang",
+		Line:     3,
+		Column:   7,
+		Message:  "Oops.",
+	}
+	assert.Equal(t, "main.romulang:3:7: error[E4001]: Oops.", d.Error())
+
+	d.Column = 0
+	assert.Equal(t, "main.romulang:3: error[E4001]: Oops.", d.Error())
+
+	d.File = ""
+	d.Severity = SeverityWarning
+	assert.Equal(t, "3: warning[E4001]: Oops.", d.Error())
+
+	d.Line = 0
+	assert.Equal(t, "warning[E4001]: Oops.", d.Error())
+}
+
+// Tests List.Err() and friends.
+func TestList(t *testing.T) {
+	var l List
+	assert.Nil(t, l.Err())
+	assert.False(t, l.HasErrors())
+
+	l = append(l, &Diagnostic{Code: CodeJumpTooLong, Severity: SeverityWarning})
+	assert.Nil(t, l.Err())
+
+	l = append(l, &Diagnostic{Code: CodeUndeclaredName, Severity: SeverityError})
+	err := l.Err()
+	assert.NotNil(t, err)
+
+	var l2 List
+	assert.True(t, errors.As(err, &l2))
+	assert.Equal(t, []Code{CodeJumpTooLong, CodeUndeclaredName}, l2.Codes())
+}
+
+// Tests Render().
+func TestRender(t *testing.T) {
+	source := "passage Main@1(): void\n\tvar ação: int = \"x\"\nend\n"
+
+	sb := &strings.Builder{}
+	Render(sb, &Diagnostic{
+		Code:      CodeTypeMismatch,
+		File:      "main.romulang",
+		Line:      2,
+		Column:    18,
+		EndColumn: 21,
+		Message:   "Bad.",
+	}, source)
+	assert.Equal(t,
+		"main.romulang:2:18: error[E4001]: Bad.\n"+
+			"    2 |  var ação: int = \"x\"\n"+
+			"      |                  ^^^\n",
+		sb.String())
+
+	// Unknown column: mark the whole line, except for the indentation.
+	sb.Reset()
+	Render(sb, &Diagnostic{Code: CodeTypeMismatch, Line: 2, Message: "Bad."}, source)
+	assert.Equal(t,
+		"2: error[E4001]: Bad.\n"+
+			"    2 |  var ação: int = \"x\"\n"+
+			"      |  ^^^^^^^^^^^^^^^^^^^\n",
+		sb.String())
+
+	// Multi-line problem: mark up to the end of the first line.
+	sb.Reset()
+	Render(sb, &Diagnostic{Code: CodeTypeMismatch, Line: 2, Column: 11, EndLine: 3, EndColumn: 4, Message: "Bad."}, source)
+	assert.Equal(t,
+		"2:11: error[E4001]: Bad.\n"+
+			"    2 |  var ação: int = \"x\"\n"+
+			"      |           ^^^^^^^^^^\n",
+		sb.String())
+
+	// Only the excerpt.
+	sb.Reset()
+	RenderExcerpt(sb, &Diagnostic{Code: CodeTypeMismatch, Line: 2, Column: 18, EndColumn: 21, Message: "Bad."}, source)
+	assert.Equal(t,
+		"    2 |  var ação: int = \"x\"\n"+
+			"      |                  ^^^\n",
+		sb.String())
+
+	// No source: only the message.
+	sb.Reset()
+	Render(sb, &Diagnostic{Code: CodeTypeMismatch, Line: 2, Message: "Bad."}, "")
+	assert.Equal(t, "2: error[E4001]: Bad.\n", sb.String())
+}
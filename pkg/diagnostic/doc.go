@@ -0,0 +1,10 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The diagnostic package contains the definitions used to report errors (and
+// possibly other kinds of messages) about Storyworlds to the user.
+package diagnostic
@@ -0,0 +1,112 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package diagnostic
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Render writes d to w in a human-friendly format: the message (as returned by
+// Diagnostic.Error()), followed by the offending line of source code and a
+// caret line pointing to the problem. It looks like this:
+//
+//	file.romulang:3:18: error[E4001]: Cannot initialize variable...
+//	    3 |     var x: int = "nope"
+//	      |                  ^^^^^^
+//
+// source is the whole source code of d.File. If it is empty or doesn't contain
+// d.Line, only the message is written. If the column is not known, the whole
+// line is marked. Problems spanning multiple lines are marked up to the end of
+// their first line.
+func Render(w io.Writer, d *Diagnostic, source string) {
+	fmt.Fprintf(w, "%v\n", d.Error())
+	RenderExcerpt(w, d, source)
+}
+
+// RenderExcerpt is like Render, but writes only the source code excerpt (that
+// is, the offending line and the caret line), without the message. This is
+// useful when the message was already reported elsewhere.
+func RenderExcerpt(w io.Writer, d *Diagnostic, source string) {
+	line, ok := sourceLine(source, d.Line)
+	if !ok {
+		return
+	}
+
+	// Tabs would make the caret line misaligned, so we replace them.
+	line = strings.ReplaceAll(line, "\t", " ")
+
+	gutter := fmt.Sprintf("%5d | ", d.Line)
+	emptyGutter := strings.Repeat(" ", len(gutter)-2) + "| "
+	fmt.Fprintf(w, "%v%v\n", gutter, line)
+
+	first, last := caretRange(d, line)
+	if last < first {
+		return
+	}
+	fmt.Fprintf(w, "%v%v%v\n", emptyGutter, strings.Repeat(" ", first-1), strings.Repeat("^", last-first+1))
+}
+
+// RenderList writes all Diagnostics in l to w, using Render. sources maps file
+// names to their source code; Diagnostics whose file is not in sources are
+// rendered without the source excerpt.
+func RenderList(w io.Writer, l List, sources map[string]string) {
+	for _, d := range l {
+		Render(w, d, sources[d.File])
+	}
+}
+
+// sourceLine returns line number n (1-based) from source, without the line
+// terminator. ok is false if there is no such line.
+func sourceLine(source string, n int) (line string, ok bool) {
+	if source == "" || n <= 0 {
+		return "", false
+	}
+	lines := strings.Split(source, "\n")
+	if n > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[n-1], "\r"), true
+}
+
+// caretRange returns the first and last (1-based, inclusive) columns of line to
+// be marked with carets when rendering d. Columns here count runes, just like
+// Diagnostic columns.
+func caretRange(d *Diagnostic, line string) (first, last int) {
+	lineLen := utf8.RuneCountInString(line)
+
+	if d.Column <= 0 {
+		// Unknown column: mark the whole line, except for the indentation.
+		trimmed := strings.TrimLeft(line, " ")
+		first = lineLen - utf8.RuneCountInString(trimmed) + 1
+		return first, lineLen
+	}
+
+	first = d.Column
+	if d.EndLine > d.Line {
+		// Multi-line problem: we show only its first line, so mark everything
+		// from the start of the problem to the end of this line.
+		return first, lineLen
+	}
+
+	last = d.EndColumn - 1
+	if last < first {
+		last = first
+	}
+	if last > lineLen {
+		// Problems at the end of the line (like an unexpected end of file) get
+		// a caret just past the last character.
+		last = lineLen + 1
+		if first > last {
+			first = last
+		}
+	}
+	return first, last
+}
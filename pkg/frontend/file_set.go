@@ -0,0 +1,180 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceExtension is the extension used by Romualdo Language source files.
+const SourceExtension = ".romulang"
+
+// SourceFile is a source file that is part of a FileSet.
+type SourceFile struct {
+	// Name is the name of the file. This is what appears in positions and
+	// error messages.
+	Name string
+
+	// Source is the source code in the file.
+	Source string
+}
+
+// FileSet is a set of source files that together make up a Storyworld. Files
+// are kept in the order they were added, which is also the order in which
+// they are parsed.
+type FileSet struct {
+	files []*SourceFile
+
+	// roots contains the directories added with AddDir and the directories
+	// of the files added with AddFile. The Storyworld root is the innermost
+	// directory containing all of them.
+	roots []string
+}
+
+// NewFileSet creates a new, empty FileSet.
+func NewFileSet() *FileSet {
+	return &FileSet{}
+}
+
+// AddSource adds a file named name with the given source code to the FileSet.
+// Nothing is read from the disk. If the FileSet already contains a file with
+// this name, its source code is replaced.
+func (fs *FileSet) AddSource(name, source string) {
+	for _, f := range fs.files {
+		if f.Name == name {
+			f.Source = source
+			return
+		}
+	}
+	fs.files = append(fs.files, &SourceFile{Name: name, Source: source})
+}
+
+// AddFile reads the file at path and adds it to the FileSet. The path is used
+// as the file name.
+func (fs *FileSet) AddFile(path string) error {
+	fs.roots = append(fs.roots, filepath.Dir(path))
+	return fs.addFile(path)
+}
+
+// addFile is like AddFile, but doesn't change the Storyworld root.
+func (fs *FileSet) addFile(path string) error {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fs.AddSource(path, string(source))
+	return nil
+}
+
+// AddDir adds all Romualdo source files (that is, files with SourceExtension)
+// found in the directory dir and its subdirectories. Files are added in
+// lexical order, so that the result doesn't depend on the file system.
+func (fs *FileSet) AddDir(dir string) error {
+	paths := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, SourceExtension) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("no %v files found in %v", SourceExtension, dir)
+	}
+
+	fs.roots = append(fs.roots, dir)
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := fs.addFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPath adds the file or directory at path to the FileSet, using either
+// AddFile or AddDir.
+func (fs *FileSet) AddPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fs.AddDir(path)
+	}
+	return fs.AddFile(path)
+}
+
+// Files returns the files in the FileSet, in the order they were added.
+func (fs *FileSet) Files() []*SourceFile {
+	return fs.files
+}
+
+// Sources returns a map from file names to their source code.
+func (fs *FileSet) Sources() map[string]string {
+	sources := make(map[string]string, len(fs.files))
+	for _, f := range fs.files {
+		sources[f.Name] = f.Source
+	}
+	return sources
+}
+
+// fileIDs returns a map from file names to stable identifiers of the files:
+// their paths relative to the Storyworld root, with forward slashes. Unlike
+// the file names, these don't depend on the working directory. Files added
+// with AddSource are identified by their names, unless they happen to be
+// under the Storyworld root.
+func (fs *FileSet) fileIDs() map[string]string {
+	root := ""
+	for i, dir := range fs.roots {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			root = abs
+			continue
+		}
+		for !isInside(abs, root) {
+			root = filepath.Dir(root)
+		}
+	}
+
+	ids := make(map[string]string, len(fs.files))
+	for _, f := range fs.files {
+		ids[f.Name] = filepath.ToSlash(f.Name)
+		if root == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(f.Name); err == nil && isInside(abs, root) {
+			rel, err := filepath.Rel(root, abs)
+			if err == nil {
+				ids[f.Name] = filepath.ToSlash(rel)
+			}
+		}
+	}
+	return ids
+}
+
+// isInside checks if the absolute path is inside the absolute directory dir
+// (or is dir itself).
+func isInside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
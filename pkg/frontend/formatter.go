@@ -0,0 +1,781 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+)
+
+// indentation is what we use for each level of indentation in formatted code.
+const indentation = "    "
+
+// maxLineWidth is the width formatted lines should not exceed. Expressions
+// that would make a line longer than this are wrapped, if possible.
+const maxLineWidth = 80
+
+// Format formats source, the contents of the file named file, in the canonical
+// Romualdo style: four spaces of indentation per block level, one statement
+// per line, single spaces around binary operators, one blank line between
+// declarations, and so on. Comments are preserved, and so are single blank
+// lines between statements (multiple blank lines are collapsed into one).
+// Parentheses are added only where needed. Chains of binary operators that
+// don't fit in maxLineWidth columns are wrapped before the operators, and so
+// are those containing comments, which are kept where they are.
+//
+// Only the syntax is checked, so any syntactically valid code can be formatted.
+// In case of syntax errors, returns an empty string and the errors found.
+//
+// Formatting is idempotent: formatting formatted code doesn't change it.
+func Format(file, source string) (string, diagnostic.List) {
+	p := newParser(file, source)
+	sw := p.parse()
+	if p.diagnostics.HasErrors() {
+		return "", p.diagnostics
+	}
+
+	f := &formatter{
+		source:      source,
+		comments:    p.scanner.comments,
+		atLineStart: true,
+		blockStart:  true,
+	}
+	f.storyworld(sw)
+	return f.out.String(), nil
+}
+
+// formatter pretty-prints an AST back to source code. The AST knows where
+// everything came from in the source code, which is what allows the formatter
+// to put back the comments (which are not part of the AST) and the blank
+// lines.
+type formatter struct {
+	// source is the source code being formatted.
+	source string
+
+	// comments contains the comments from the source code that haven't been
+	// output yet.
+	comments []*comment
+
+	// out is where the formatted code is written to.
+	out bytes.Buffer
+
+	// indent is the current indentation level.
+	indent int
+
+	// atLineStart tells if we are at the start of an output line (and
+	// therefore the indentation must be written before anything else).
+	atLineStart bool
+
+	// blockStart tells if nothing has been output yet in the current block.
+	// Blank lines are not kept at the start of blocks.
+	blockStart bool
+
+	// lastLine is the last source code line output so far.
+	lastLine int
+
+	// flat tells if expressions must be output in a single line, no matter
+	// how long they are. Used to measure expressions.
+	flat bool
+
+	// reserved is the number of columns reserved for whatever comes after the
+	// expression being output, in the same line (like the "then" after the
+	// condition of an if statement).
+	reserved int
+}
+
+// storyworld formats a whole Storyworld.
+func (f *formatter) storyworld(sw *ast.Storyworld) {
+	for i, decl := range sw.Declarations {
+		if i > 0 {
+			f.blankLine()
+		}
+		f.beginLine(decl.Span().Start)
+
+		switch n := decl.(type) {
+		case *ast.GlobalsBlock:
+			f.globalsBlock(n)
+		case *ast.FunctionDecl:
+			f.functionDecl(n)
+		case *ast.PassageDecl:
+			f.passageDecl(n)
+		default:
+			panic(fmt.Sprintf("Unexpected declaration type: %T", decl))
+		}
+	}
+
+	// Comments after the last declaration.
+	f.flushComments(ast.Position{Offset: len(f.source) + 1})
+}
+
+// globalsBlock formats a globals block.
+func (f *formatter) globalsBlock(n *ast.GlobalsBlock) {
+	f.write(fmt.Sprintf("globals@%v", n.Version))
+	f.endLine(n.Span().Start)
+	f.varDecls(n.Vars)
+	f.closeBlock(n.Span())
+}
+
+// functionDecl formats a function declaration.
+func (f *formatter) functionDecl(n *ast.FunctionDecl) {
+	f.write("function " + n.Name + signature(n.Parameters, n.ReturnType))
+	f.endLine(n.Body.Span().Start)
+	f.body(n.Body)
+}
+
+// passageDecl formats a Passage declaration.
+func (f *formatter) passageDecl(n *ast.PassageDecl) {
+	f.write(fmt.Sprintf("passage %v@%v%v", n.Name, n.Version, signature(n.Parameters, n.ReturnType)))
+	if n.Meta == nil {
+		f.endLine(n.Body.Span().Start)
+	} else {
+		// Like in the rest of the code, the meta block is not indented.
+		f.endLine(n.NameSpan.Start)
+		f.flushComments(n.Meta.Span().Start)
+		f.write("meta")
+		f.endLine(n.Meta.Span().Start)
+		f.varDecls(n.Meta.Vars)
+		f.closeBlock(n.Meta.Span())
+	}
+	f.body(n.Body)
+}
+
+// signature returns the parameter list and return type of a function or
+// Passage, formatted.
+func signature(params []ast.Parameter, returnType *ast.Type) string {
+	ps := []string{}
+	for _, param := range params {
+		ps = append(ps, param.Name+": "+typeString(param.Type))
+	}
+	return "(" + strings.Join(ps, ", ") + "): " + typeString(returnType)
+}
+
+// typeString returns the type t, formatted.
+func typeString(t *ast.Type) string {
+	if t.Tag != ast.TypeFunction {
+		return t.String()
+	}
+
+	paramTypes := []string{}
+	for _, paramType := range t.ParameterTypes {
+		paramTypes = append(paramTypes, typeString(paramType))
+	}
+	return "function(" + strings.Join(paramTypes, ", ") + "): " + typeString(t.ReturnType)
+}
+
+// varDecls formats the variables declared in a globals or meta block.
+func (f *formatter) varDecls(vars []*ast.VarDecl) {
+	f.indent++
+	f.blockStart = true
+	for _, v := range vars {
+		f.beginLine(v.Span().Start)
+		f.varDecl(v)
+		f.endLine(v.Span().End)
+	}
+}
+
+// varDecl formats a variable declaration, without the var keyword (which is
+// not used in globals and meta blocks).
+func (f *formatter) varDecl(n *ast.VarDecl) {
+	f.write(n.Name + ": " + typeString(n.Type()) + " = ")
+	f.expression(n.Initializer)
+}
+
+// body formats the statements in block, which is a function or Passage body or
+// any other block closed by an "end".
+func (f *formatter) body(block *ast.Block) {
+	f.indent++
+	f.blockStart = true
+	f.statements(block.Statements)
+	f.closeBlock(block.Span())
+}
+
+// closeBlock outputs the "end" closing the block that spans span. The block
+// contents must have been output at the indentation level one deeper than
+// the "end".
+func (f *formatter) closeBlock(span ast.Span) {
+	end := span.End
+	end.Offset -= len("end")
+	end.Column -= len("end")
+
+	f.flushComments(end)
+	f.indent--
+	f.write("end")
+	f.endLine(end)
+	f.blockStart = false
+}
+
+// statements formats a sequence of statements.
+func (f *formatter) statements(stmts []ast.Node) {
+	for _, stmt := range stmts {
+		f.beginLine(stmt.Span().Start)
+
+		switch n := stmt.(type) {
+		case *ast.IfStmt:
+			f.ifStmt(n, "if")
+			continue
+
+		case *ast.WhileStmt:
+			f.write("while ")
+			f.condition(n.Condition, " do")
+			f.endLine(n.Body.Span().Start)
+			f.body(n.Body)
+			continue
+
+		case *ast.Block:
+			f.write("do")
+			f.endLine(n.Span().Start)
+			f.body(n)
+			continue
+
+		case *ast.VarDecl:
+			f.write("var ")
+			f.varDecl(n)
+
+		case *ast.ReturnStmt:
+			f.write("return")
+			if n.ReturnValue != nil {
+				f.write(" ")
+				f.expression(n.ReturnValue)
+			}
+
+		case *ast.SayStmt:
+			f.write("say")
+			f.attributes(n.Attributes, n.Span())
+
+		case *ast.GotoStmt:
+			f.write("goto ")
+			f.call(n.Passage.Name, n.Arguments)
+
+		case *ast.ExpressionStmt:
+			f.expression(n.Expr)
+
+		default:
+			panic(fmt.Sprintf("Unexpected statement type: %T", stmt))
+		}
+
+		f.endLine(stmt.Span().End)
+	}
+}
+
+// ifStmt formats an if statement. keyword is either "if" or, for the if
+// statements representing an elseif, "elseif".
+func (f *formatter) ifStmt(n *ast.IfStmt, keyword string) {
+	f.write(keyword + " ")
+	f.condition(n.Condition, " then")
+	f.endLine(n.Then.Span().Start) // The Then block starts at the "then".
+
+	f.indent++
+	f.blockStart = true
+	f.statements(n.Then.Statements)
+
+	switch e := n.Else.(type) {
+	case nil:
+		// No else part.
+
+	case *ast.IfStmt:
+		f.flushComments(e.Span().Start)
+		f.indent--
+		f.ifStmt(e, "elseif")
+		return
+
+	case *ast.Block:
+		f.flushComments(e.Span().Start) // The Else block starts at the "else".
+		f.indent--
+		f.write("else")
+		f.endLine(e.Span().Start)
+		f.indent++
+		f.blockStart = true
+		f.statements(e.Statements)
+
+	default:
+		panic(fmt.Sprintf("Unexpected else type: %T", n.Else))
+	}
+
+	f.closeBlock(n.Span())
+}
+
+// attributes formats the attributes of a say statement or listen expression
+// spanning span. The single-attribute form (`say "text"`) is kept. The form
+// with braces is formatted with all attributes in a single line or with one
+// attribute per line, depending on whether the original code spans multiple
+// lines or not.
+func (f *formatter) attributes(attrs []*ast.Attribute, span ast.Span) {
+	if isSingleAttributeForm(attrs) {
+		f.write(" ")
+		f.expression(attrs[0].Value)
+		return
+	}
+
+	if len(attrs) == 0 {
+		f.write(" {}")
+		return
+	}
+
+	if span.Start.Line == span.End.Line {
+		f.write(" { ")
+		for i, attr := range attrs {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.write(attr.Name + " = ")
+			f.expression(attr.Value)
+		}
+		f.write(" }")
+		return
+	}
+
+	f.write(" {")
+	f.newline()
+	f.indent++
+	f.blockStart = true
+	for _, attr := range attrs {
+		f.beginLine(attr.Span().Start)
+		f.write(attr.Name + " = ")
+		f.expression(attr.Value)
+		f.write(",")
+		f.endLine(attr.Span().End)
+	}
+
+	closingBrace := span.End
+	closingBrace.Offset--
+	f.flushComments(closingBrace)
+	f.indent--
+	f.write("}")
+	f.blockStart = false
+}
+
+// isSingleAttributeForm checks if attrs are the attributes of a say statement
+// or listen expression using the single-attribute form, without braces. In
+// this form, the attribute node starts at the value, since there is no
+// attribute name in the source code.
+func isSingleAttributeForm(attrs []*ast.Attribute) bool {
+	return len(attrs) == 1 &&
+		attrs[0].Span().Start.Offset == attrs[0].Value.Span().Start.Offset
+}
+
+// expression formats an expression.
+func (f *formatter) expression(node ast.Node) { // nolint:funlen,gocyclo
+	switch n := node.(type) {
+	case *ast.IntLiteral, *ast.FloatLiteral, *ast.BNumLiteral, *ast.BoolLiteral, *ast.StringLiteral, *ast.VarRef:
+		// Output these exactly as they appear in the source code. For numbers,
+		// this keeps things like the number of decimal places.
+		span := node.Span()
+		f.write(f.source[span.Start.Offset:span.End.Offset])
+
+	case *ast.Assignment:
+		f.write(n.VarName + " = ")
+		f.expression(n.Value)
+
+	case *ast.Unary:
+		f.write(n.Operator)
+		if n.Operator == "not" {
+			f.write(" ")
+		}
+		f.subexpression(n.Operand, precedenceOf(n.Operand) < PrecUnary)
+
+	case *ast.Binary, *ast.And, *ast.Or:
+		f.operatorChain(node)
+
+	case *ast.Blend:
+		f.subexpression(n.X, precedenceOf(n.X) < precBlend)
+		f.write(" ~ ")
+		f.rightOperand(n.Y, precedenceOf(n.Y) <= precBlend)
+		f.write(" ~ ")
+		f.rightOperand(n.Weight, precedenceOf(n.Weight) <= precBlend)
+
+	case *ast.TypeConversion:
+		f.write(n.Operator + "(")
+		f.expression(n.Value)
+		// Default values not present in the source code are attributed to the
+		// conversion operator.
+		if n.Operator != "string" && n.Default.Span().Start.Offset != n.Span().Start.Offset {
+			f.write(", ")
+			f.expression(n.Default)
+		}
+		f.write(")")
+
+	case *ast.FunctionCall:
+		f.call(n.Function.Name, n.Arguments)
+
+	case *ast.BuiltInFunction:
+		f.call("."+n.Function, n.Args)
+
+	case *ast.NativeCall:
+		f.call("."+n.Function, n.Arguments)
+
+	case *ast.GosubExpr:
+		f.write("gosub ")
+		f.call(n.Passage.Name, n.Arguments)
+
+	case *ast.ListenExpr:
+		f.write("listen")
+		f.attributes(n.Attributes, n.Span())
+
+	default:
+		panic(fmt.Sprintf("Unexpected expression type: %T", node))
+	}
+}
+
+// condition formats the condition of an if or while statement, followed by
+// keyword. If the condition is wrapped, its continuation lines are indented two
+// levels deeper, so that they don't look like the first statement of the
+// block.
+func (f *formatter) condition(node ast.Node, keyword string) {
+	f.indent++
+	f.reserved = len(keyword)
+	f.expression(node)
+	f.reserved = 0
+	f.indent--
+	f.write(keyword)
+}
+
+// chainLink is one of the operands in a chain of binary operators with the
+// same precedence, like "a + b - c".
+type chainLink struct {
+	// operator is the operator before the operand, or an empty string for
+	// the first operand.
+	operator string
+
+	// operand is the operand itself.
+	operand ast.Node
+
+	// needsParens tells if the operand needs parentheses around it.
+	needsParens bool
+}
+
+// operatorChain formats node, which must be a binary operator (including and
+// and or), along with any other operators of the same precedence chained to
+// it. The chain is output in a single line if it fits, or wrapped before the
+// operators otherwise. Comments in the middle of the chain are output where
+// they are, and force it to be wrapped.
+func (f *formatter) operatorChain(node ast.Node) {
+	links := chainLinks(node)
+	wrap := !f.flat && (!f.fits(node, false) || f.hasCommentsIn(node.Span()))
+
+	// Only the last operand is followed by whatever the columns are reserved
+	// for.
+	reserved := f.reserved
+	f.reserved = 0
+	defer func() { f.reserved = reserved }()
+
+	f.subexpression(links[0].operand, links[0].needsParens)
+	if !wrap {
+		for _, link := range links[1:] {
+			f.write(" " + link.operator + " ")
+			f.subexpression(link.operand, link.needsParens)
+		}
+		return
+	}
+
+	// Wrapped lines are indented one level deeper.
+	f.indent++
+	for i, link := range links[1:] {
+		broken := f.innerComments(link.operand.Span().Start, links[i].operand.Span().End)
+		if !broken {
+			width := 1 + len(link.operator) + 1 + textWidth(f.flatString(link.operand, link.needsParens))
+			if i == len(links)-2 {
+				width += reserved
+			}
+			if f.column()+width > maxLineWidth {
+				f.newline()
+				broken = true
+			}
+		}
+		if !broken {
+			f.write(" ")
+		}
+		f.write(link.operator + " ")
+		if i == len(links)-2 {
+			f.reserved = reserved
+		}
+		f.subexpression(link.operand, link.needsParens)
+	}
+	f.indent--
+}
+
+// chainLinks returns the operands (and operators) in the chain of binary
+// operators with the same precedence that starts at node. The parser builds
+// left-associative operators with the chain on the left-hand side, and
+// right-associative ones with the chain on the right-hand side.
+func chainLinks(node ast.Node) []chainLink {
+	var lhs, rhs ast.Node
+	var operator string
+	var rightAssociative bool
+	switch n := node.(type) {
+	case *ast.Binary:
+		lhs, rhs, operator, rightAssociative = n.LHS, n.RHS, n.Operator, n.Operator == "^"
+	case *ast.And:
+		lhs, rhs, operator, rightAssociative = n.LHS, n.RHS, "and", true
+	case *ast.Or:
+		lhs, rhs, operator, rightAssociative = n.LHS, n.RHS, "or", false
+	}
+
+	prec := precedenceOf(node)
+	_, isUnary := rhs.(*ast.Unary)
+	if rightAssociative {
+		links := []chainLink{{operand: lhs, needsParens: precedenceOf(lhs) <= prec}}
+		if precedenceOf(rhs) != prec || isUnary {
+			return append(links, chainLink{operator: operator, operand: rhs})
+		}
+		rest := chainLinks(rhs)
+		rest[0].operator = operator
+		return append(links, rest...)
+	}
+
+	var links []chainLink
+	if precedenceOf(lhs) == prec {
+		links = chainLinks(lhs)
+	} else {
+		links = []chainLink{{operand: lhs, needsParens: precedenceOf(lhs) < prec}}
+	}
+	return append(links, chainLink{
+		operator:    operator,
+		operand:     rhs,
+		needsParens: precedenceOf(rhs) <= prec && !isUnary,
+	})
+}
+
+// subexpression formats an expression that is part of a larger one, adding
+// parentheses around it if needed.
+func (f *formatter) subexpression(node ast.Node, needsParens bool) {
+	if needsParens {
+		f.write("(")
+	}
+	f.expression(node)
+	if needsParens {
+		f.write(")")
+	}
+}
+
+// rightOperand formats an operand on the right side of an operator. It is
+// just like subexpression, except that unary expressions never need
+// parentheses here: the parser always parses them as a unit when they appear
+// after an operator.
+func (f *formatter) rightOperand(node ast.Node, needsParens bool) {
+	_, isUnary := node.(*ast.Unary)
+	f.subexpression(node, needsParens && !isUnary)
+}
+
+// call formats a call-like thing: the name of the thing being called followed
+// by the parenthesized arguments. Comments between the arguments are output
+// where they are, and the arguments after them go in the next lines, indented
+// one level deeper.
+func (f *formatter) call(name string, args []ast.Node) {
+	f.write(name + "(")
+	wrapped := false
+	for i, arg := range args {
+		if i > 0 {
+			f.write(",")
+			if !f.flat && f.innerComments(arg.Span().Start, args[i-1].Span().End) {
+				if !wrapped {
+					f.indent++
+					wrapped = true
+				}
+			} else {
+				f.write(" ")
+			}
+		}
+		f.expression(arg)
+	}
+	f.write(")")
+	if wrapped {
+		f.indent--
+	}
+}
+
+// fits checks if node fits in the current line, along with the reserved
+// columns. needsParens tells if node will be output in parentheses.
+func (f *formatter) fits(node ast.Node, needsParens bool) bool {
+	return f.column()+textWidth(f.flatString(node, needsParens))+f.reserved <= maxLineWidth
+}
+
+// flatString returns node formatted in a single line, with parentheses around
+// it if needsParens is true. Comments are not included.
+func (f *formatter) flatString(node ast.Node, needsParens bool) string {
+	flat := &formatter{source: f.source, flat: true}
+	flat.subexpression(node, needsParens)
+	return flat.out.String()
+}
+
+// hasCommentsIn checks if any of the pending comments is inside span.
+func (f *formatter) hasCommentsIn(span ast.Span) bool {
+	for _, c := range f.comments {
+		if c.span.Start.Offset >= span.End.Offset {
+			break
+		}
+		if c.span.Start.Offset > span.Start.Offset {
+			return true
+		}
+	}
+	return false
+}
+
+// innerComments outputs the pending comments that come before pos in the
+// source code, which are inside an expression that ends at the position prev.
+// A comment in the same source code line as prev is output at the end of the
+// current line, and the others in their own lines. Returns true if any comment
+// was output, in which case the current line was ended.
+func (f *formatter) innerComments(pos, prev ast.Position) bool {
+	if len(f.comments) == 0 || f.comments[0].span.Start.Offset >= pos.Offset {
+		return false
+	}
+
+	if f.comments[0].span.Start.Line == prev.Line {
+		f.endLine(prev)
+	} else {
+		f.newline()
+	}
+	for len(f.comments) > 0 && f.comments[0].span.Start.Offset < pos.Offset {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+		f.write(trimComment(c.text))
+		f.newline()
+		f.lastLine = c.span.Start.Line
+	}
+	return true
+}
+
+// precedenceOf returns the precedence of the expression node, as far as the
+// need of parentheses is concerned.
+func precedenceOf(node ast.Node) precedence {
+	switch n := node.(type) {
+	case *ast.Assignment:
+		return precAssignment
+	case *ast.Or:
+		return precOr
+	case *ast.And:
+		return precAnd
+	case *ast.Binary:
+		return operatorPrecedence(n.Operator)
+	case *ast.Blend:
+		return precBlend
+	case *ast.Unary:
+		return PrecUnary
+	case *ast.ListenExpr:
+		// Without braces, the attribute extends as far to the right as
+		// possible, so it must always be parenthesized when used as an operand.
+		if isSingleAttributeForm(n.Attributes) {
+			return precAssignment
+		}
+		return precPrimary
+	default:
+		return precPrimary
+	}
+}
+
+// operatorPrecedence returns the precedence of the binary operator op. This
+// comes from the very same table the parser uses.
+func operatorPrecedence(op string) precedence {
+	return rules[newScanner("", op).token().kind].precedence
+}
+
+// write outputs s, preceded by the indentation if at the start of a line.
+func (f *formatter) write(s string) {
+	if f.atLineStart {
+		f.out.WriteString(strings.Repeat(indentation, f.indent))
+		f.atLineStart = false
+	}
+	f.out.WriteString(s)
+}
+
+// column returns the number of columns already used in the current output
+// line, including the indentation.
+func (f *formatter) column() int {
+	if f.atLineStart {
+		return f.indent * len(indentation)
+	}
+	out := f.out.Bytes()
+	return textWidth(string(out[bytes.LastIndexByte(out, '\n')+1:]))
+}
+
+// textWidth returns the number of columns taken by the first line of text.
+func textWidth(text string) int {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return utf8.RuneCountInString(text)
+}
+
+// newline ends the current output line.
+func (f *formatter) newline() {
+	f.out.WriteString("\n")
+	f.atLineStart = true
+}
+
+// blankLine outputs a blank line, unless we are at the very beginning of the
+// output or a blank line has just been output.
+func (f *formatter) blankLine() {
+	if f.out.Len() > 0 && !bytes.HasSuffix(f.out.Bytes(), []byte("\n\n")) {
+		f.newline()
+	}
+}
+
+// beginLine must be called before starting an output line with code that
+// starts at start in the source code. It outputs the comments that come
+// before it, and a blank line if there was one in the source code.
+func (f *formatter) beginLine(start ast.Position) {
+	f.flushComments(start)
+	f.separate(start.Line)
+}
+
+// endLine ends an output line. anchor is the position of the last thing output
+// in the line; a comment after it in the same source code line is output at
+// the end of the line.
+func (f *formatter) endLine(anchor ast.Position) {
+	// Comments before the anchor, if any, are inside the code we just output
+	// (like inside a multi-line expression). These will be output later, in
+	// their own lines.
+	for i, c := range f.comments {
+		if c.span.Start.Offset < anchor.Offset {
+			continue
+		}
+		if c.span.Start.Line == anchor.Line {
+			f.write(" " + trimComment(c.text))
+			f.comments = append(f.comments[:i], f.comments[i+1:]...)
+		}
+		break
+	}
+
+	f.newline()
+	f.lastLine = anchor.Line
+}
+
+// flushComments outputs, each in its own line, all pending comments that come
+// before the position pos in the source code.
+func (f *formatter) flushComments(pos ast.Position) {
+	for len(f.comments) > 0 && f.comments[0].span.Start.Offset < pos.Offset {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+		f.separate(c.span.Start.Line)
+		f.write(trimComment(c.text))
+		f.newline()
+		if c.span.Start.Line > f.lastLine {
+			f.lastLine = c.span.Start.Line
+		}
+	}
+}
+
+// separate outputs a blank line if the source code line line is not right
+// after the last one output, unless we are at the start of a block.
+func (f *formatter) separate(line int) {
+	if !f.blockStart && line > f.lastLine+1 {
+		f.blankLine()
+	}
+	f.blockStart = false
+}
+
+// trimComment removes the trailing whitespace from a comment.
+func trimComment(text string) string {
+	return strings.TrimRightFunc(text, unicode.IsSpace)
+}
@@ -0,0 +1,320 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+)
+
+// formatterTestCases are pairs of unformatted and formatted code.
+var formatterTestCases = []struct {
+	name   string
+	source string
+	want   string
+}{
+	{
+		name: "indentation and spacing",
+		source: "globals@1\n" +
+			"  X:int=1\n" +
+			"end\n" +
+			"function f(a:int,b:function(int,string):bool):int\n" +
+			"if a<0 then return -a elseif a==0 then return  0 else\n" +
+			"while a>10 do a=a-1 end\n" +
+			"  do var b:int=a*2 return b end\n" +
+			"end end\n",
+		want: "globals@1\n" +
+			"    X: int = 1\n" +
+			"end\n" +
+			"\n" +
+			"function f(a: int, b: function(int, string): bool): int\n" +
+			"    if a < 0 then\n" +
+			"        return -a\n" +
+			"    elseif a == 0 then\n" +
+			"        return 0\n" +
+			"    else\n" +
+			"        while a > 10 do\n" +
+			"            a = a - 1\n" +
+			"        end\n" +
+			"        do\n" +
+			"            var b: int = a * 2\n" +
+			"            return b\n" +
+			"        end\n" +
+			"    end\n" +
+			"end\n",
+	},
+	{
+		name: "parentheses",
+		source: "passage Main@1(): void\n" +
+			".print(((1 + 2)) * 3 - (4 - 5) - (-6))\n" +
+			".print((2 ^ 3) ^ 4 ^ (5) + -2 ^ 2 + (-2) ^ 2)\n" +
+			".print(not (true and false) or (a or b) and (c and d) and e)\n" +
+			".print((0.2b ~ 0.3b ~ 0.4b) ~ (0.5b ~ 0.6b ~ 0.7b) ~ 0.1b)\n" +
+			"x = (listen \"a\") + (listen { text = \"b\" }) + int(y = 1, 0)\n" +
+			"end\n",
+		want: "passage Main@1(): void\n" +
+			"    .print((1 + 2) * 3 - (4 - 5) - -6)\n" +
+			"    .print((2 ^ 3) ^ 4 ^ 5 + -2 ^ 2 + (-2) ^ 2)\n" +
+			"    .print(not (true and false) or (a or b) and (c and d) and e)\n" +
+			"    .print(0.2b ~ 0.3b ~ 0.4b ~ (0.5b ~ 0.6b ~ 0.7b) ~ 0.1b)\n" +
+			"    x = (listen \"a\") + listen { text = \"b\" } + int(y = 1, 0)\n" +
+			"end\n",
+	},
+	{
+		name: "comments and blank lines",
+		source: "# Header comment.\n" +
+			"\n" +
+			"\n" +
+			"passage Main@1(): void # after header\n" +
+			"meta    # after meta\n" +
+			"  # before meta var\n" +
+			"  m: int = 0 # after meta var\n" +
+			"end\n" +
+			"\n" +
+			"\n" +
+			"  say \"a\"   # after say\n" +
+			"\n" +
+			"\n" +
+			"\n" +
+			"   # before if\n" +
+			"  if true then # after then\n" +
+			"    # first in then\n" +
+			"    say \"b\"\n" +
+			"    # last in then\n" +
+			"  else # after else\n" +
+			"    say \"c\" + # inside expression\n" +
+			"      \"d\"\n" +
+			"    # last in else\n" +
+			"  end # after end\n" +
+			"end\n" +
+			"# before function\n" +
+			"function f(): void\n" +
+			"end\n" +
+			"# Last comment.   \n",
+		want: "# Header comment.\n" +
+			"\n" +
+			"passage Main@1(): void # after header\n" +
+			"meta # after meta\n" +
+			"    # before meta var\n" +
+			"    m: int = 0 # after meta var\n" +
+			"end\n" +
+			"    say \"a\" # after say\n" +
+			"\n" +
+			"    # before if\n" +
+			"    if true then # after then\n" +
+			"        # first in then\n" +
+			"        say \"b\"\n" +
+			"        # last in then\n" +
+			"    else # after else\n" +
+			"        say \"c\" # inside expression\n" +
+			"            + \"d\"\n" +
+			"        # last in else\n" +
+			"    end # after end\n" +
+			"end\n" +
+			"\n" +
+			"# before function\n" +
+			"function f(): void\n" +
+			"end\n" +
+			"# Last comment.\n",
+	},
+	{
+		name: "attributes",
+		source: "passage Main@1(): void\n" +
+			"say{text=\"a\",who=\"b\"}\n" +
+			"say {}\n" +
+			"x = listen {\n" +
+			"# a comment\n" +
+			"a = \"North\", # north\n" +
+			"\n" +
+			"b = \"South\" }\n" +
+			"goto Other(1,2)\n" +
+			"end\n",
+		want: "passage Main@1(): void\n" +
+			"    say { text = \"a\", who = \"b\" }\n" +
+			"    say {}\n" +
+			"    x = listen {\n" +
+			"        # a comment\n" +
+			"        a = \"North\", # north\n" +
+			"\n" +
+			"        b = \"South\",\n" +
+			"    }\n" +
+			"    goto Other(1, 2)\n" +
+			"end\n",
+	},
+	{
+		name: "calls and literals",
+		source: "passage Main@1(): void\n" +
+			".print( gosub Other( 1.50 , 0.10b ) )\n" +
+			".native()\n" +
+			"x = f(int(\"1\"), string(2), bnum(\"x\", 0.5b))\n" +
+			"return\n" +
+			"end\n",
+		want: "passage Main@1(): void\n" +
+			"    .print(gosub Other(1.50, 0.10b))\n" +
+			"    .native()\n" +
+			"    x = f(int(\"1\"), string(2), bnum(\"x\", 0.5b))\n" +
+			"    return\n" +
+			"end\n",
+	},
+	{
+		name: "long lines",
+		source: "passage Main@1(): void\n" +
+			"if someVeryLongVariableName > 10 and anotherVeryLongVariableName < 20 and yetAnotherOne then\n" +
+			".print(\"one\")\n" +
+			"elseif someVeryLongVariableName == 10 or anotherVeryLongVariableName == 20 or yetAnotherOne then\n" +
+			".print(\"two\")\n" +
+			"else\n" +
+			"total = 1000000 + 2000000 + 3000000 + 4000000 + 5000000 + 6000000 + 7000000 + 8000000 + 9000000\n" +
+			"end\n" +
+			"while someVeryLongVariableName + anotherVeryLongVariableName < yetAnotherOne * 12345 do\n" +
+			"x = (aaaaaaaaaaaaaaaaaaaa + bbbbbbbbbbbbbbbbbbbbbbbb) * (cccccccccccccccccccccc + ddddddddddddddddddd)\n" +
+			"end\n" +
+			"end\n",
+		want: "passage Main@1(): void\n" +
+			"    if someVeryLongVariableName > 10 and anotherVeryLongVariableName < 20\n" +
+			"            and yetAnotherOne then\n" +
+			"        .print(\"one\")\n" +
+			"    elseif someVeryLongVariableName == 10 or anotherVeryLongVariableName == 20\n" +
+			"            or yetAnotherOne then\n" +
+			"        .print(\"two\")\n" +
+			"    else\n" +
+			"        total = 1000000 + 2000000 + 3000000 + 4000000 + 5000000 + 6000000\n" +
+			"            + 7000000 + 8000000 + 9000000\n" +
+			"    end\n" +
+			"    while someVeryLongVariableName + anotherVeryLongVariableName\n" +
+			"            < yetAnotherOne * 12345 do\n" +
+			"        x = (aaaaaaaaaaaaaaaaaaaa + bbbbbbbbbbbbbbbbbbbbbbbb)\n" +
+			"            * (cccccccccccccccccccccc + ddddddddddddddddddd)\n" +
+			"    end\n" +
+			"end\n",
+	},
+	{
+		name: "comments inside expressions",
+		source: "passage Main@1(): void\n" +
+			"x = 1 # one\n" +
+			"  + 2\n" +
+			"  # before three\n" +
+			"  + 3\n" +
+			".print(f(1, # first argument\n" +
+			"2, g(3, # inner\n" +
+			"4)))\n" +
+			"y = a and # a\n" +
+			"  b and c\n" +
+			"end\n",
+		want: "passage Main@1(): void\n" +
+			"    x = 1 # one\n" +
+			"        + 2\n" +
+			"        # before three\n" +
+			"        + 3\n" +
+			"    .print(f(1, # first argument\n" +
+			"        2, g(3, # inner\n" +
+			"            4)))\n" +
+			"    y = a # a\n" +
+			"        and b and c\n" +
+			"end\n",
+	},
+	{
+		name:   "empty",
+		source: "\n\n",
+		want:   "",
+	},
+}
+
+// Tests that Format formats code as expected.
+func TestFormat(t *testing.T) {
+	for _, tc := range formatterTestCases {
+		got, diags := Format("", tc.source)
+		assert.Empty(t, diags, tc.name)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+// Tests that formatting formatted code doesn't change it.
+func TestFormatIsIdempotent(t *testing.T) {
+	sources := []string{}
+	for _, tc := range formatterTestCases {
+		sources = append(sources, tc.source)
+	}
+	for _, path := range testSourceFiles(t) {
+		source, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		sources = append(sources, string(source))
+	}
+
+	for _, source := range sources {
+		once, diags := Format("", source)
+		if diags.HasErrors() {
+			continue // Some of the test files have syntax errors on purpose.
+		}
+		twice, diags := Format("", once)
+		assert.Empty(t, diags)
+		assert.Equal(t, once, twice)
+	}
+}
+
+// Tests that formatting doesn't change the meaning of the code: the formatted
+// code must compile to the very same bytecode.
+func TestFormatPreservesMeaning(t *testing.T) {
+	for _, path := range testSourceFiles(t) {
+		source, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+
+		formatted, diags := Format(path, string(source))
+		if diags.HasErrors() {
+			continue
+		}
+
+		original := compileForFormatterTest(string(source))
+		if original == nil {
+			continue // Some of the test files have semantic errors on purpose.
+		}
+		assert.Equal(t, original, compileForFormatterTest(formatted), path)
+	}
+}
+
+// Tests that Format reports syntax errors.
+func TestFormatSyntaxError(t *testing.T) {
+	formatted, diags := Format("bad.romulang", "passage Main@1(): void\n")
+	assert.Equal(t, "", formatted)
+	assert.True(t, diags.HasErrors())
+	assert.Equal(t, "bad.romulang", diags[0].File)
+	assert.Equal(t, diagnostic.CodeUnexpectedToken, diags[0].Code)
+}
+
+// testSourceFiles returns the paths to all the test storyworlds source files.
+func testSourceFiles(t *testing.T) []string {
+	singleFile, err := filepath.Glob("../../tests/*/*.romulang")
+	assert.Nil(t, err)
+	multiFile, err := filepath.Glob("../../tests/multi/*/*.romulang")
+	assert.Nil(t, err)
+	return append(singleFile, multiFile...)
+}
+
+// compileForFormatterTest compiles source and returns the serialized compiled
+// storyworld, or nil in case of errors.
+func compileForFormatterTest(source string) []byte {
+	root, diags := Parse(source)
+	if diags.HasErrors() {
+		return nil
+	}
+	csw, _, err := backend.GenerateCode(root)
+	if err != nil {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	if _, err := csw.WriteTo(buf); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -9,53 +9,164 @@ package frontend
 
 import (
 	"fmt"
-	"os"
 
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // Parse parses and type checks a given Romualdo Language source code and
-// returns its AST (Abstract Syntax Tree).
-func Parse(source string) ast.Node {
-	p := newParser(source)
+// returns its AST (Abstract Syntax Tree) and the list of errors found.
+//
+// The work is done in stages (parsing, semantic checks, name resolution, type
+// checking), and each stage runs only if the previous ones didn't find errors
+// that would make its results meaningless. So, a single call reports as many
+// errors as possible, without reporting errors that are just consequences of
+// previous ones.
+//
+// The AST is returned even if there are errors, in which case it may be
+// incomplete (declarations with syntax errors are left out) and not fully
+// checked. It is useful for things like editor integration, but must not be
+// passed to the code generator.
+func Parse(source string) (ast.Node, diagnostic.List) {
+	return ParseWithNatives(source, nil)
+}
+
+// ParseWithNatives is like Parse, but the source code can call the native
+// functions in natives. This is typically what the VM that will run the
+// Storyworld returns from VM.NativeFunctions().
+func ParseWithNatives(source string, natives []*ast.NativeFunction) (ast.Node, diagnostic.List) {
+	fs := NewFileSet()
+	fs.AddSource("", source)
+	return ParseFileSet(fs, natives)
+}
+
+// ParseFileSet is like ParseWithNatives, but parses a Storyworld split over all
+// the files in fs. Each file is parsed separately, and their declarations are
+// merged into a single Storyworld, in the order the files appear in fs.
+// Private names (those not starting with an upper case letter) are visible
+// only in the file where they are declared.
+func ParseFileSet(fs *FileSet, natives []*ast.NativeFunction) (ast.Node, diagnostic.List) {
+	var diags diagnostic.List
+
+	// Syntax errors leave holes in the AST, so we stop if there are any. We
+	// parse all files anyway, to report the syntax errors of all of them.
+	root := &ast.Storyworld{FileIDs: fs.fileIDs()}
+	for _, file := range fs.Files() {
+		p := newParser(file.Name, file.Source)
+		sw := p.parse()
+		diags = append(diags, p.diagnostics...)
+		root.Files = append(root.Files, file.Name)
+		root.Declarations = append(root.Declarations, sw.Declarations...)
+		if len(fs.Files()) == 1 {
+			root.SourceSpan = sw.SourceSpan
+		}
+	}
+	if diags.HasErrors() {
+		return root, diags
+	}
+
+	diags = append(diags, check(root, nil, natives, false)...)
+	return root, diags
+}
+
+// ParseIncrement is like ParseWithNatives, but parses declarations meant to be
+// added to a Storyworld compiled before, like the inputs of an interactive
+// session. globals maps the keys of the names already declared to their types
+// (see GlobalTypes()); the declarations in source can use them, and can
+// declare them again, replacing them. The Storyworld parsed from source
+// doesn't need to be complete: it may lack the entry Passage and the older
+// globals blocks.
+func ParseIncrement(source string, globals map[ast.GlobalKey]*ast.Type, natives []*ast.NativeFunction) (
+	ast.Node, diagnostic.List) {
+
+	p := newParser("", source)
 	root := p.parse()
-	if root == nil {
-		return nil
+	if p.diagnostics.HasErrors() {
+		return root, p.diagnostics
 	}
 
-	// Assorted semantic checks (but no type checks)
-	sc := &semanticChecker{}
+	return root, append(p.diagnostics, CheckIncrement(root, globals, natives)...)
+}
+
+// ParseStatements parses source as a sequence of statements, like the body of
+// a void function, and returns the Block containing them. Only syntax errors are
+// reported: the statements make sense only after they are put into a function
+// or Passage, which can then be checked with CheckIncrement().
+func ParseStatements(source string) (*ast.Block, diagnostic.List) {
+	p := newParser("", source)
+	block := p.parseStatements()
+	return block, p.diagnostics
+}
+
+// CheckIncrement runs all the checks done by ParseIncrement() on root, which
+// may have been created (or changed) by hand.
+func CheckIncrement(root *ast.Storyworld, globals map[ast.GlobalKey]*ast.Type, natives []*ast.NativeFunction) diagnostic.List {
+	return check(root, globals, natives, true)
+}
+
+// check runs the stages that follow the parsing on root. globals holds the
+// types of the global names declared elsewhere, and incremental tells if root
+// is just an increment to some Storyworld (see ParseIncrement()).
+func check(root *ast.Storyworld, globals map[ast.GlobalKey]*ast.Type, natives []*ast.NativeFunction,
+	incremental bool) diagnostic.List {
+
+	var diags diagnostic.List
+
+	// Assorted semantic checks (but no type checks). The AST is still well
+	// formed after these errors, so we keep going.
+	sc := &semanticChecker{incremental: incremental}
 	root.Walk(sc)
-	if len(sc.errors) > 0 {
-		for _, e := range sc.errors {
-			fmt.Fprintf(os.Stderr, "%v\n", e)
-		}
-		return nil
-	}
+	diags = append(diags, sc.errors...)
 
 	// Look for undeclared variables, set types of global variables references
-	// (including function calls!)
-	globalTypes := extractGlobalTypes(root)
+	// (including function calls!). Names that cannot be resolved get an
+	// invalid type, which the type checker accepts silently.
+	globalTypes := map[ast.GlobalKey]*ast.Type{}
+	for key, t := range globals {
+		globalTypes[key] = t
+	}
+	for key, t := range GlobalTypes(root) {
+		globalTypes[key] = t
+	}
+	nativeTypes := map[string]*ast.Type{}
+	for _, native := range natives {
+		nativeTypes[native.Name] = native.Type
+	}
 	vts := &variableTypeSetter{
 		globalTypes: globalTypes,
+		nativeTypes: nativeTypes,
 	}
 	root.Walk(vts)
-	if len(vts.errors) > 0 {
-		for _, e := range vts.errors {
-			fmt.Fprintf(os.Stderr, "%v\n", e)
-		}
-		return nil
-	}
+	diags = append(diags, vts.errors...)
 
 	// Type checking
 	tc := &typeChecker{}
 	root.Walk(tc)
-	if len(tc.errors) > 0 {
-		for _, e := range tc.errors {
-			fmt.Fprintf(os.Stderr, "%v\n", e)
-		}
-		return nil
+	diags = append(diags, tc.errors...)
+
+	return diags
+}
+
+// describePosition converts pos to a string suitable for error messages, like
+// "line 3" or "line 3 of intro.romulang".
+func describePosition(pos ast.Position) string {
+	if pos.File == "" {
+		return fmt.Sprintf("line %v", pos.Line)
 	}
+	return fmt.Sprintf("line %v of %v", pos.Line, pos.File)
+}
 
-	return root
+// newError creates a new Diagnostic reporting an error with a given code at a
+// given span. The message is created from format and a, like in fmt.Sprintf().
+func newError(code diagnostic.Code, span ast.Span, format string, a ...interface{}) *diagnostic.Diagnostic {
+	return &diagnostic.Diagnostic{
+		Code:      code,
+		Severity:  diagnostic.SeverityError,
+		File:      span.Start.File,
+		Line:      span.Start.Line,
+		Column:    span.Start.Column,
+		EndLine:   span.End.Line,
+		EndColumn: span.End.Column,
+		Message:   fmt.Sprintf(format, a...),
+	}
 }
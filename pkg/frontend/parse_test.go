@@ -0,0 +1,264 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package frontend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+)
+
+// Tests that AST nodes get the right spans.
+func TestParseSpans(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var ação: int = 1\n" +
+		"    ação = -ação + 2 *\n" +
+		"        3\n" +
+		"end\n"
+	root, diags := Parse(source)
+	assert.Empty(t, diags)
+
+	sw := root.(*ast.Storyworld)
+	assert.Equal(t, "1:1-6:1", sw.Span().String())
+
+	passage := sw.Declarations[0].(*ast.PassageDecl)
+	assert.Equal(t, "1:1-5:4", passage.Span().String())
+
+	varDecl := passage.Body.Statements[0].(*ast.VarDecl)
+	assert.Equal(t, "2:9-2:22", varDecl.Span().String())
+
+	stmt := passage.Body.Statements[1].(*ast.ExpressionStmt)
+	assert.Equal(t, "3:5-4:10", stmt.Span().String())
+
+	assignment := stmt.Expr.(*ast.Assignment)
+	assert.Equal(t, "3:5-4:10", assignment.Span().String())
+
+	sum := assignment.Value.(*ast.Binary)
+	assert.Equal(t, "3:12-4:10", sum.Span().String())
+	assert.Equal(t, "3:12-3:17", sum.LHS.Span().String())
+	assert.Equal(t, "3:20-4:10", sum.RHS.Span().String())
+
+	// Offsets count bytes, not runes.
+	assert.Equal(t, len("passage Main@1(): void\n    var ação: int = 1\n    ação = -"), sum.LHS.(*ast.Unary).Operand.Span().Start.Offset)
+}
+
+// Tests that errors found after parsing point to the offending node.
+func TestParseErrorSpans(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var ação: int = 1\n" +
+		"    say \"não\" + ação\n" +
+		"end\n"
+	_, diags := Parse(source)
+
+	assert.Equal(t, 1, len(diags))
+	assert.Equal(t, 3, diags[0].Line)
+	assert.Equal(t, 9, diags[0].Column)
+	assert.Equal(t, 3, diags[0].EndLine)
+	assert.Equal(t, 21, diags[0].EndColumn)
+}
+
+// Tests that a missing entry Passage is reported at the first declaration,
+// not at whatever comes first in the source.
+func TestParseMissingEntryPassage(t *testing.T) {
+	source := "# A leading comment.\n" +
+		"\n" +
+		"  passage Start@1(): void\n" +
+		"end\n"
+	_, diags := Parse(source)
+
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeEntryPassageNotFound}, diags.Codes())
+	assert.Equal(t, 3, diags[0].Line)
+	assert.Equal(t, 3, diags[0].Column)
+
+	_, diags = Parse("# Nothing but a comment.\n")
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeEntryPassageNotFound}, diags.Codes())
+	assert.Equal(t, 0, diags[0].Line)
+}
+
+// Tests that syntax errors don't stop the parser: we get all of them, plus the
+// declarations that could be parsed.
+func TestParseSyntaxErrorRecovery(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    say 1 +\n" +
+		"end\n" +
+		"function f(): int\n" +
+		"    return 1\n" +
+		"end\n" +
+		"passage Other@1(): void\n" +
+		"    say (\"missing end\"\n" +
+		"passage Last@1(): void\n" +
+		"    gosub Other()\n" +
+		"end\n"
+	root, diags := Parse(source)
+
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeUnexpectedToken, diagnostic.CodeUnexpectedToken}, diags.Codes())
+	assert.Equal(t, 3, diags[0].Line)
+	assert.Equal(t, 9, diags[1].Line)
+
+	sw := root.(*ast.Storyworld)
+	assert.Equal(t, 2, len(sw.Declarations))
+	assert.Equal(t, "f", sw.Declarations[0].(*ast.FunctionDecl).Name)
+	assert.Equal(t, "Last", sw.Declarations[1].(*ast.PassageDecl).Name)
+}
+
+// Tests that errors from different stages after parsing are all reported in a
+// single run, and that undeclared names don't cause a cascade of type errors.
+func TestParseReportsAllStages(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var x: int = 1\n" +
+		"    x = \"oops\"\n" +
+		"    x = y + 1\n" +
+		"    if y then end\n" +
+		"end\n" +
+		"passage Main@1(): void\n" +
+		"end\n"
+	root, diags := Parse(source)
+
+	assert.NotNil(t, root)
+	assert.Equal(t, []diagnostic.Code{
+		diagnostic.CodeDuplicatePassage,
+		diagnostic.CodeUndeclaredName,
+		diagnostic.CodeUndeclaredName,
+		diagnostic.CodeTypeMismatch,
+	}, diags.Codes())
+	assert.Equal(t, []int{7, 4, 5, 3}, []int{diags[0].Line, diags[1].Line, diags[2].Line, diags[3].Line})
+}
+
+// Tests that Storyworlds split over multiple files are merged, and that
+// positions and errors tell which file they refer to.
+func TestParseFileSet(t *testing.T) {
+	fs := NewFileSet()
+	fs.AddSource("main.romulang", "passage Main@1(): void\n"+
+		"    say Greet()\n"+
+		"    say helper()\n"+
+		"end\n")
+	fs.AddSource("greet.romulang", "function Greet(): string\n"+
+		"    return helper()\n"+
+		"end\n"+
+		"function helper(): string\n"+
+		"    return \"Hi\"\n"+
+		"end\n")
+
+	root, diags := ParseFileSet(fs, nil)
+
+	sw := root.(*ast.Storyworld)
+	assert.Equal(t, []string{"main.romulang", "greet.romulang"}, sw.Files)
+	assert.Equal(t, ast.Span{}, sw.Span())
+	assert.Equal(t, 3, len(sw.Declarations))
+	assert.Equal(t, "greet.romulang:4:1-6:4", sw.Declarations[2].Span().String())
+
+	// Greet is public, but helper is private to greet.romulang.
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeNotVisible}, diags.Codes())
+	assert.Equal(t, "main.romulang", diags[0].File)
+	assert.Equal(t, 3, diags[0].Line)
+
+	// Each file can declare its own private names, even if they are spelled
+	// the same. Uses refer to the ones declared in the same file.
+	fs.AddSource("main.romulang", "passage Main@1(): void\n"+
+		"    say Greet()\n"+
+		"    say string(helper() + 1)\n"+
+		"end\n"+
+		"function helper(): int\n"+
+		"    return 1\n"+
+		"end\n")
+	_, diags = ParseFileSet(fs, nil)
+	assert.Empty(t, diags)
+
+	// Within a file, private names must still be unique, and the file names
+	// make the errors clearer.
+	fs.AddSource("main.romulang", "passage Main@1(): void\n"+
+		"end\n"+
+		"function helper(): string\n"+
+		"    return \"Hey\"\n"+
+		"end\n"+
+		"passage helper@1(): void\n"+
+		"end\n")
+	_, diags = ParseFileSet(fs, nil)
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeRedeclaredName}, diags.Codes())
+	assert.Equal(t, "main.romulang", diags[0].File)
+	assert.Contains(t, diags[0].Message, "line 3 of main.romulang")
+}
+
+// Tests that private global variables belong to the file where they were
+// introduced, even if a newer globals block is in another file.
+func TestParseFileSetPrivateGlobals(t *testing.T) {
+	fs := NewFileSet()
+	fs.AddSource("main.romulang", "globals@1\n"+
+		"    count: int = 0\n"+
+		"end\n"+
+		"passage Main@1(): void\n"+
+		"    count = count + Extra\n"+
+		"end\n")
+	fs.AddSource("v2.romulang", "globals@2\n"+
+		"    count: int = 0\n"+
+		"    Extra: int = 1\n"+
+		"end\n")
+	_, diags := ParseFileSet(fs, nil)
+	assert.Empty(t, diags)
+
+	fs.AddSource("other.romulang", "function f(): int\n"+
+		"    return count\n"+
+		"end\n")
+	_, diags = ParseFileSet(fs, nil)
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeNotVisible}, diags.Codes())
+	assert.Equal(t, "other.romulang", diags[0].File)
+	assert.Contains(t, diags[0].Message, "private to file 'main.romulang'")
+}
+
+// Tests that increments to a Storyworld can use and redeclare the names
+// declared before, and don't need to be complete Storyworlds on their own.
+func TestParseIncrement(t *testing.T) {
+	globals := map[ast.GlobalKey]*ast.Type{
+		ast.NewGlobalKey("count", ""): ast.TheTypeInt,
+		ast.NewGlobalKey("twice", ""): {
+			Tag:            ast.TypeFunction,
+			ReturnType:     ast.TheTypeInt,
+			ParameterTypes: []*ast.Type{ast.TheTypeInt},
+		},
+	}
+
+	_, diags := ParseIncrement("globals@2\n"+
+		"    Extra: int = 1\n"+
+		"end\n"+
+		"function twice(x: int): int\n"+
+		"    return x + x + count + Extra\n"+
+		"end\n", globals, nil)
+	assert.Empty(t, diags)
+
+	_, diags = ParseIncrement("function f(): string\n"+
+		"    return twice(count)\n"+
+		"end\n", globals, nil)
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeWrongReturnType}, diags.Codes())
+	assert.Equal(t, 2, diags[0].Line)
+}
+
+// Tests that statements can be parsed on their own, and then checked once put
+// into a Passage.
+func TestParseStatements(t *testing.T) {
+	block, diags := ParseStatements("var x: int = 1\n" +
+		"x = x + 1\n" +
+		"return\n")
+	assert.Empty(t, diags)
+	assert.Equal(t, 3, len(block.Statements))
+	assert.Equal(t, "1:1-3:7", block.Span().String())
+
+	root := &ast.Storyworld{Declarations: []ast.Node{&ast.PassageDecl{
+		BaseNode:   block.BaseNode,
+		Name:       "Statements",
+		Version:    1,
+		ReturnType: ast.TheTypeVoid,
+		Body:       block,
+	}}}
+	assert.Empty(t, CheckIncrement(root, nil, nil))
+
+	_, diags = ParseStatements("if true then\n    say \"hi\"\n")
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeUnexpectedToken}, diags.Codes())
+	assert.Equal(t, 3, diags[0].Line)
+}
@@ -9,10 +9,11 @@ package frontend
 
 import (
 	"fmt"
-	"os"
 	"strconv"
+	"unicode/utf8"
 
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // precedence is the precedence of expressions.
@@ -59,8 +60,8 @@ type parser struct {
 	// previousToken is the previous token we have parsed.
 	previousToken *token
 
-	// hadError indicates whether we found at least one syntax error.
-	hadError bool
+	// diagnostics collects the syntax errors found.
+	diagnostics diagnostic.List
 
 	// panicMode indicates whether we are in panic mode. This has nothing to do
 	// with Go panics. Right after finding a syntax error it is hard to generate
@@ -72,21 +73,25 @@ type parser struct {
 	// scanner is the scanner from where we get our tokens.
 	scanner *scanner
 
-	// functions is a stack with the function declarations being parsed. The
-	// current code being parsed is part of the function at the top of this
-	// stack.
-	functions []*ast.FunctionDecl
+	// returnTypes is a stack with the return types of the functions and
+	// Passages being parsed. The current code being parsed is part of the
+	// function or Passage whose return type is at the top of this stack.
+	returnTypes []*ast.Type
 }
 
-// newParser returns a new parser that will parse source.
-func newParser(source string) *parser {
+// newParser returns a new parser that will parse source, which comes from the
+// file named file.
+func newParser(file, source string) *parser {
 	return &parser{
-		scanner: newScanner(source),
+		scanner: newScanner(file, source),
 	}
 }
 
-// parse parses source and returns the root of the resulting AST. Returns nil in
-// case of error.
+// parse parses source and returns the root of the resulting AST. This never
+// returns nil: in case of syntax errors (which are collected in
+// p.diagnostics), we skip to the next declaration and keep parsing, so that we
+// can report as many errors as possible in a single run. The declarations
+// containing syntax errors are left out of the AST.
 func (p *parser) parse() *ast.Storyworld {
 
 	sw := ast.Storyworld{}
@@ -94,23 +99,52 @@ func (p *parser) parse() *ast.Storyworld {
 	p.advance()
 
 	for !p.match(tokenKindEOF) {
+		errorCount := len(p.diagnostics)
 		node := p.declaration()
-		if p.hadError {
-			return nil
+		if len(p.diagnostics) > errorCount {
+			continue
 		}
 		sw.Declarations = append(sw.Declarations, node)
 	}
 
+	// The Storyworld spans the whole source code.
+	sw.SourceSpan = ast.Span{
+		Start: ast.Position{File: p.scanner.file, Offset: 0, Line: 1, Column: 1},
+		End:   p.previousToken.end,
+	}
+
 	return &sw
 }
 
+// parseStatements parses source as a sequence of statements, like the body of
+// a void function, and returns the Block containing them. Unlike parse(), this
+// stops at the first syntax error, as there are no declarations to
+// synchronize to.
+func (p *parser) parseStatements() *ast.Block {
+	p.advance()
+	p.returnTypes = append(p.returnTypes, ast.TheTypeVoid)
+
+	start := p.currentToken.position()
+	block := &ast.Block{
+		BaseNode: ast.BaseNode{SourceSpan: ast.Span{Start: start, End: start}},
+	}
+	for !p.check(tokenKindEOF) && !p.panicMode {
+		block.Statements = append(block.Statements, p.statement())
+	}
+	if len(block.Statements) > 0 {
+		p.finishNode(&block.BaseNode)
+	}
+
+	return block
+}
+
 // parsePrecedence parses and generates the AST for expressions with a
 // precedence level equal to or greater than prec.
 func (p *parser) parsePrecedence(prec precedence) ast.Node {
 	p.advance()
 	prefixRule := rules[p.previousToken.kind].prefix
 	if prefixRule == nil {
-		p.error("Expect expression.")
+		p.error(diagnostic.CodeUnexpectedToken, "Expect expression.")
 		return nil
 	}
 
@@ -124,7 +158,7 @@ func (p *parser) parsePrecedence(prec precedence) ast.Node {
 	}
 
 	if canAssign && p.match(tokenKindEqual) {
-		p.error("Invalid assignment target.")
+		p.error(diagnostic.CodeInvalidAssignmentTarget, "Invalid assignment target.")
 	}
 
 	return node
@@ -146,8 +180,10 @@ func (p *parser) declaration() ast.Node {
 		n = p.globalsDeclaration()
 	case p.match(tokenKindFunction):
 		n = p.functionDeclaration()
+	case p.match(tokenKindPassage):
+		n = p.passageDeclaration()
 	default:
-		p.errorAtCurrent("Expect a declaration")
+		p.errorAtCurrent(diagnostic.CodeUnexpectedToken, "Expect a declaration")
 	}
 
 	if p.panicMode {
@@ -160,15 +196,6 @@ func (p *parser) declaration() ast.Node {
 // statement parses a statement.
 func (p *parser) statement() ast.Node {
 	switch {
-	// For now at least, built-in functions are called with a leading dot, like
-	// this: .funcName(args).
-	case p.match(tokenKindDot):
-		if p.match(tokenKindIdentifier) {
-			funcName := p.previousToken.lexeme
-			return p.builtInFunction(funcName)
-		}
-		p.errorAtCurrent("Expect built-in function name.")
-
 	case p.match(tokenKindIf):
 		return p.ifStatement()
 
@@ -184,68 +211,45 @@ func (p *parser) statement() ast.Node {
 	case p.match(tokenKindVar):
 		return p.varDeclaration()
 
+	case p.match(tokenKindSay):
+		return p.sayStatement()
+
+	case p.match(tokenKindGoto):
+		return p.gotoStatement()
+
 	default:
 		expr := p.expression()
 		return &ast.ExpressionStmt{
-			BaseNode: ast.BaseNode{
-				LineNumber: p.previousToken.line,
-			},
-			Expr: expr,
+			BaseNode: p.nodeFrom(p.startOf(expr)),
+			Expr:     expr,
 		}
 	}
-
-	panic("Can't happen")
-}
-
-// builtInFunction parses a built-in function named funcName. The current token
-// should be the opening parenthesis after the function name.
-func (p *parser) builtInFunction(funcName string) ast.Node {
-	if funcName != "print" {
-		p.errorAt(p.previousToken, "Unknown built-in function.")
-	}
-
-	p.consume(tokenKindLeftParen, "Expect '(' after function name.")
-
-	bif := &ast.BuiltInFunction{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
-		Function: funcName,
-		Args:     []ast.Node{p.expression()}, // For now, support only funcs with arity 1
-	}
-
-	p.consume(tokenKindRightParen, "Expect ')' after expression.")
-
-	return bif
 }
 
-// synchronize skips tokens until we find something that looks like a statement
-// boundary. This is used to recover from panic mode.
+// synchronize skips tokens until we find something that looks like the start of
+// a declaration. This is used to recover from panic mode.
 func (p *parser) synchronize() {
 	p.panicMode = false
 
-	// TODO: This is basically the same as in Lox. Must adapt to Romualdo
-	// more properly.
-	for p.currentToken.kind != tokenKindEOF {
-		switch p.currentToken.kind {
-		case tokenKindClass:
-		case tokenKindFunction:
-		case tokenKindGlobals:
-		case tokenKindPassage:
-		case tokenKindFor:
-		case tokenKindIf:
-		case tokenKindWhile:
-		case tokenKindReturn:
-			return
-
-		default:
-			// Do nothing.
-		}
-
+	for !p.atDeclarationBoundary() {
 		p.advance()
 	}
 }
 
+// atDeclarationBoundary checks if the current token is the start of a
+// declaration or the end of the source code. Statement-parsing loops stop at
+// these tokens, because they can't appear inside a statement. Without this, a
+// missing "end" would make us parse the next declaration as part of the
+// current one.
+func (p *parser) atDeclarationBoundary() bool {
+	switch p.currentToken.kind {
+	case tokenKindGlobals, tokenKindFunction, tokenKindPassage, tokenKindEOF:
+		return true
+	default:
+		return false
+	}
+}
+
 // expression parses an expression.
 func (p *parser) expression() ast.Node {
 	return p.parsePrecedence(precAssignment)
@@ -255,34 +259,40 @@ func (p *parser) expression() ast.Node {
 // This is a compiler! (My comments are usually more polite than this.)
 func (p *parser) block() *ast.Block {
 	block := &ast.Block{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
-	for !p.check(tokenKindEnd) && !p.check(tokenKindEOF) {
+	for !p.check(tokenKindEnd) && !p.atDeclarationBoundary() {
 		stmt := p.statement()
 		block.Statements = append(block.Statements, stmt)
 	}
-	p.consume(tokenKindEnd, fmt.Sprintf("Expect 'end' to block started at line %v.", block.LineNumber))
+	p.consume(tokenKindEnd, fmt.Sprintf("Expect 'end' to block started at line %v.", block.Line()))
+	p.finishNode(&block.BaseNode)
 	return block
 }
 
 // globalsDeclaration parses a globals block.
 func (p *parser) globalsDeclaration() ast.Node {
 	globals := &ast.GlobalsBlock{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
-	for p.currentToken.kind != tokenKindEnd {
+	p.consume(tokenKindAt, "Expect '@' after 'globals'.")
+	p.consume(tokenKindIntLiteral, "Expect globals block version after '@'.")
+	version, err := strconv.Atoi(p.previousToken.lexeme)
+	if err != nil || version < 1 {
+		p.error(diagnostic.CodeInvalidVersion, "Globals block version must be a positive integer.")
+	}
+	globals.Version = version
+
+	for !p.check(tokenKindEnd) && !p.atDeclarationBoundary() {
 		v := p.varDeclaration()
 		globals.Vars = append(globals.Vars, v)
 	}
 
 	// TODO: A kind compiler would tell the line where the block started.
 	p.consume(tokenKindEnd, "Expect 'end' to close 'globals' block")
+	p.finishNode(&globals.BaseNode)
 
 	return globals
 }
@@ -315,7 +325,7 @@ func (p *parser) parseType() *ast.Type {
 			ReturnType:     retType,
 		}
 	default:
-		p.errorAtCurrent("Expect type.")
+		p.errorAtCurrent(diagnostic.CodeUnexpectedToken, "Expect type.")
 	}
 	return ast.TheTypeInvalid
 }
@@ -332,13 +342,14 @@ func (p *parser) parseParameterList() []ast.Parameter {
 	for ok := true; ok; ok = p.match(tokenKindComma) {
 		p.consume(tokenKindIdentifier, "Expect identifier (the parameter name) or a right parenthesis")
 		n := p.previousToken.lexeme
+		nameSpan := p.previousToken.span()
 		p.consume(tokenKindColon, "Expect ':' after parameter name")
 		p.advance()
 		t := p.parseType()
 		if t.Tag == ast.TypeVoid {
-			p.errorAt(p.previousToken, "Cannot use 'void' as a parameter type")
+			p.errorAt(p.previousToken, diagnostic.CodeVoidParameter, "Cannot use 'void' as a parameter type")
 		}
-		params = append(params, ast.Parameter{Name: n, Type: t})
+		params = append(params, ast.Parameter{Name: n, NameSpan: nameSpan, Type: t})
 	}
 
 	p.consume(tokenKindRightParen, "Expect ')' to close parameter list")
@@ -359,7 +370,7 @@ func (p *parser) parseTypeList() []*ast.Type {
 		p.advance()
 		t := p.parseType()
 		if t.Tag == ast.TypeVoid {
-			p.errorAt(p.previousToken, "Cannot use 'void' as a parameter type")
+			p.errorAt(p.previousToken, diagnostic.CodeVoidParameter, "Cannot use 'void' as a parameter type")
 		}
 		types = append(types, t)
 	}
@@ -374,10 +385,7 @@ func (p *parser) parseTypeList() []*ast.Type {
 func (p *parser) varDeclaration() *ast.VarDecl {
 	p.consume(tokenKindIdentifier, "Expect identifier (the variable name).")
 	name := p.previousToken.lexeme
-
-	baseNode := ast.BaseNode{
-		LineNumber: p.previousToken.line,
-	}
+	nameSpan := p.previousToken.span()
 
 	// TODO: Make type optional if initializer is present.
 	p.consume(tokenKindColon, "Expect ':' after variable name.")
@@ -390,25 +398,21 @@ func (p *parser) varDeclaration() *ast.VarDecl {
 
 	initializer := p.expression()
 
-	v := ast.NewVarDecl(baseNode, name, varType, initializer)
-	v.BaseNode = ast.BaseNode{
-		LineNumber: p.previousToken.line,
-	}
-
-	return v
+	n := ast.NewVarDecl(p.nodeFrom(nameSpan.Start), name, varType, initializer)
+	n.NameSpan = nameSpan
+	return n
 }
 
 // functionDeclaration parses a function declaration. The function keyword is
 // expected to have just been consumed.
 func (p *parser) functionDeclaration() *ast.FunctionDecl {
 	f := &ast.FunctionDecl{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
 	p.consume(tokenKindIdentifier, "Expect identifier (the function name).")
 	f.Name = p.previousToken.lexeme
+	f.NameSpan = p.previousToken.span()
 
 	p.consume(tokenKindLeftParen, "Expect '(' after function name.")
 	f.Parameters = p.parseParameterList()
@@ -417,35 +421,89 @@ func (p *parser) functionDeclaration() *ast.FunctionDecl {
 	p.advance()
 	f.ReturnType = p.parseType()
 
-	p.functions = append(p.functions, f)
+	p.returnTypes = append(p.returnTypes, f.ReturnType)
 	f.Body = p.block()
-	p.functions = p.functions[:len(p.functions)-1]
+	p.returnTypes = p.returnTypes[:len(p.returnTypes)-1]
+	p.finishNode(&f.BaseNode)
 
 	return f
 }
 
+// passageDeclaration parses a Passage declaration. The passage keyword is
+// expected to have just been consumed.
+func (p *parser) passageDeclaration() *ast.PassageDecl {
+	n := &ast.PassageDecl{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	p.consume(tokenKindIdentifier, "Expect identifier (the Passage name).")
+	n.Name = p.previousToken.lexeme
+	n.NameSpan = p.previousToken.span()
+
+	p.consume(tokenKindAt, "Expect '@' after Passage name.")
+	p.consume(tokenKindIntLiteral, "Expect Passage version after '@'.")
+	version, err := strconv.Atoi(p.previousToken.lexeme)
+	if err != nil || version < 1 {
+		p.error(diagnostic.CodeInvalidVersion, "Passage version must be a positive integer.")
+	}
+	n.Version = version
+
+	p.consume(tokenKindLeftParen, "Expect '(' after Passage version.")
+	n.Parameters = p.parseParameterList()
+
+	p.consume(tokenKindColon, "Expect ':' after parameter list.")
+	p.advance()
+	n.ReturnType = p.parseType()
+
+	if p.match(tokenKindMeta) {
+		n.Meta = p.metaBlock()
+	}
+
+	p.returnTypes = append(p.returnTypes, n.ReturnType)
+	n.Body = p.block()
+	p.returnTypes = p.returnTypes[:len(p.returnTypes)-1]
+	p.finishNode(&n.BaseNode)
+
+	return n
+}
+
+// metaBlock parses the meta block of a Passage. The meta keyword is expected
+// to have just been consumed.
+func (p *parser) metaBlock() *ast.MetaBlock {
+	meta := &ast.MetaBlock{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	for !p.check(tokenKindEnd) && !p.atDeclarationBoundary() {
+		v := p.varDeclaration()
+		meta.Vars = append(meta.Vars, v)
+	}
+
+	p.consume(tokenKindEnd, fmt.Sprintf("Expect 'end' to close 'meta' block started at line %v.", meta.Line()))
+	p.finishNode(&meta.BaseNode)
+
+	return meta
+}
+
 // ifStatement parses an if statement. The if keyword is expected to have just
 // been consumed.
 func (p *parser) ifStatement() ast.Node {
 	n := &ast.IfStmt{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
 	n.Condition = p.expression()
 	p.consume(tokenKindThen, "Expect 'then' after condition.")
 
 	thenBlock := &ast.Block{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
-	for !(p.check(tokenKindEnd) || p.check(tokenKindElse) || p.check(tokenKindElseif)) && !p.check(tokenKindEOF) {
+	for !(p.check(tokenKindEnd) || p.check(tokenKindElse) || p.check(tokenKindElseif)) && !p.atDeclarationBoundary() {
 		stmt := p.statement()
 		thenBlock.Statements = append(thenBlock.Statements, stmt)
 	}
+	p.finishNode(&thenBlock.BaseNode)
 	n.Then = thenBlock
 
 	switch {
@@ -454,23 +512,25 @@ func (p *parser) ifStatement() ast.Node {
 
 	case p.match(tokenKindElse):
 		elseBlock := &ast.Block{
-			BaseNode: ast.BaseNode{
-				LineNumber: p.previousToken.line,
-			},
+			BaseNode: p.nodeFrom(p.previousToken.position()),
 		}
-		for !p.check(tokenKindEnd) && !p.check(tokenKindEOF) {
+		for !p.check(tokenKindEnd) && !p.atDeclarationBoundary() {
 			stmt := p.statement()
 			elseBlock.Statements = append(elseBlock.Statements, stmt)
 		}
-		p.consume(tokenKindEnd, fmt.Sprintf("Expect: 'end' to close 'if' statement started at line %v'.", n.LineNumber))
+		p.finishNode(&elseBlock.BaseNode)
+		p.consume(tokenKindEnd, fmt.Sprintf("Expect: 'end' to close 'if' statement started at line %v'.", n.Line()))
 		n.Else = elseBlock
 
 	case p.match(tokenKindElseif):
 		n.Else = p.ifStatement()
 
 	default:
-		p.error(fmt.Sprintf("Unterminated 'if' statement at line %v.", n.LineNumber))
+		// We stopped at a declaration or at the end of the source code, which
+		// is where the missing 'end' was expected.
+		p.errorAtCurrent(diagnostic.CodeUnexpectedToken, fmt.Sprintf("Unterminated 'if' statement at line %v.", n.Line()))
 	}
+	p.finishNode(&n.BaseNode)
 	return n
 }
 
@@ -478,20 +538,20 @@ func (p *parser) ifStatement() ast.Node {
 // have just been consumed.
 func (p *parser) returnStatement() ast.Node {
 	n := &ast.ReturnStmt{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
-	currentFunction := p.functions[len(p.functions)-1]
-	if currentFunction.ReturnType.Tag == ast.TypeVoid {
-		// We are inside a void function, don't need to parse the return value.
+	returnType := p.returnTypes[len(p.returnTypes)-1]
+	if returnType.Tag == ast.TypeVoid {
+		// We are inside a void function or Passage, don't need to parse the
+		// return value.
 		return n
 	}
 
-	// Not inside a void function, parse the expression required as the return
-	// value.
+	// Not inside a void function or Passage, parse the expression required as
+	// the return value.
 	n.ReturnValue = p.expression()
+	p.finishNode(&n.BaseNode)
 	return n
 }
 
@@ -499,25 +559,153 @@ func (p *parser) returnStatement() ast.Node {
 // have just been consumed.
 func (p *parser) whileStatement() ast.Node {
 	n := &ast.WhileStmt{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.previousToken.position()),
 	}
 
 	n.Condition = p.expression()
-	p.consume(tokenKindDo, fmt.Sprintf("Expect: 'do' after 'while' condition ar line %v'.", n.LineNumber))
+	p.consume(tokenKindDo, fmt.Sprintf("Expect: 'do' after 'while' condition ar line %v'.", n.Line()))
 
 	n.Body = p.block()
+	p.finishNode(&n.BaseNode)
 
 	return n
 }
 
+// sayStatement parses a say statement. The say keyword is expected to have just
+// been consumed. There are two forms: `say expression`, which says a single
+// attribute named "text", and `say { name1 = expr1, name2 = expr2 }`, which says
+// any number of named attributes.
+func (p *parser) sayStatement() ast.Node {
+	n := &ast.SayStmt{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	n.Attributes = p.attributes("say", n.Line())
+	p.finishNode(&n.BaseNode)
+	return n
+}
+
+// gotoStatement parses a goto statement. The goto keyword is expected to have
+// just been consumed.
+func (p *parser) gotoStatement() ast.Node {
+	n := &ast.GotoStmt{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	n.Passage, n.Arguments = p.passageTarget("goto")
+	p.finishNode(&n.BaseNode)
+	return n
+}
+
+// gosub parses a gosub expression. The gosub keyword is expected to have just
+// been consumed.
+func (p *parser) gosub(canAssign bool) ast.Node {
+	n := &ast.GosubExpr{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	n.Passage, n.Arguments = p.passageTarget("gosub")
+	p.finishNode(&n.BaseNode)
+	return n
+}
+
+// passageTarget parses the target Passage and arguments of a goto statement or
+// gosub expression. keyword is the keyword that was just consumed, used in
+// error messages.
+func (p *parser) passageTarget(keyword string) (*ast.VarRef, []ast.Node) {
+	p.consume(tokenKindIdentifier, fmt.Sprintf("Expect Passage name after '%v'.", keyword))
+	passage := &ast.VarRef{
+		BaseNode: ast.BaseNode{SourceSpan: p.previousToken.span()},
+		Name:     p.previousToken.lexeme,
+		VarType:  ast.TheTypeInvalid, // Filled in a later pass
+	}
+
+	p.consume(tokenKindLeftParen, "Expect '(' after Passage name.")
+	return passage, p.parseArgumentList()
+}
+
+// builtInCall parses a call to a built-in or native function. For now at
+// least, these are called with a leading dot, like this: .funcName(args). The
+// dot is expected to have just been consumed. Whether a name other than the
+// built-in "print" refers to an existing native function is checked later.
+func (p *parser) builtInCall(canAssign bool) ast.Node {
+	start := p.previousToken.position()
+	p.consume(tokenKindIdentifier, "Expect built-in or native function name after '.'.")
+	nameToken := p.previousToken
+	p.consume(tokenKindLeftParen, "Expect '(' after function name.")
+	args := p.parseArgumentList()
+
+	if nameToken.lexeme == "print" {
+		if len(args) != 1 {
+			p.errorAt(nameToken, diagnostic.CodeWrongBuiltInArity, "Built-in function 'print' expects exactly one argument.")
+		}
+		return &ast.BuiltInFunction{
+			BaseNode: p.nodeFrom(start),
+			Function: nameToken.lexeme,
+			Args:     args,
+		}
+	}
+
+	return &ast.NativeCall{
+		BaseNode:  p.nodeFrom(start),
+		Function:  nameToken.lexeme,
+		Arguments: args,
+	}
+}
+
+// listen parses a listen expression. The listen keyword is expected to have
+// just been consumed. Accepts the same two forms as the say statement.
+func (p *parser) listen(canAssign bool) ast.Node {
+	n := &ast.ListenExpr{
+		BaseNode: p.nodeFrom(p.previousToken.position()),
+	}
+
+	n.Attributes = p.attributes("listen", n.Line())
+	p.finishNode(&n.BaseNode)
+	return n
+}
+
+// attributes parses the attributes of a say statement or listen expression.
+// keyword is the keyword that introduced the attributes and line is the line
+// where it was found, both used in error messages.
+func (p *parser) attributes(keyword string, line int) []*ast.Attribute {
+	if !p.match(tokenKindLeftBrace) {
+		value := p.expression()
+		return []*ast.Attribute{
+			{
+				BaseNode: p.nodeFrom(p.startOf(value)),
+				Name:     "text",
+				Value:    value,
+			},
+		}
+	}
+
+	attrs := []*ast.Attribute{}
+	for !p.check(tokenKindRightBrace) && !p.check(tokenKindEOF) {
+		p.consume(tokenKindIdentifier, "Expect identifier (the attribute name).")
+		attr := &ast.Attribute{
+			BaseNode: p.nodeFrom(p.previousToken.position()),
+			Name:     p.previousToken.lexeme,
+		}
+		p.consume(tokenKindEqual, "Expect '=' after attribute name.")
+		attr.Value = p.expression()
+		p.finishNode(&attr.BaseNode)
+		attrs = append(attrs, attr)
+
+		if !p.match(tokenKindComma) {
+			break
+		}
+	}
+
+	p.consume(tokenKindRightBrace, fmt.Sprintf("Expect '}' to close '%v' attributes started at line %v.", keyword, line))
+
+	return attrs
+}
+
 // numberLiteral parses a number literal (int, float, or bnum). The number
 // literal token is expected to have been just consumed.
 func (p *parser) numberLiteral(canAssign bool) ast.Node {
-	baseNode := ast.BaseNode{
-		LineNumber: p.previousToken.line,
-	}
+	baseNode := ast.BaseNode{SourceSpan: p.previousToken.span()}
 
 	switch p.previousToken.kind {
 	case tokenKindFloatLiteral:
@@ -548,7 +736,7 @@ func (p *parser) numberLiteral(canAssign bool) ast.Node {
 			panic("Compiler got invalid bnum lexeme: " + p.previousToken.lexeme)
 		}
 		if value <= 0.0 || value >= 1.0 {
-			p.error(fmt.Sprintf(
+			p.error(diagnostic.CodeBNumOutOfRange, fmt.Sprintf(
 				"BNum must be greater than 0.0 and less than 1.0; got %v", value))
 		}
 		return &ast.BNumLiteral{
@@ -568,10 +756,8 @@ func (p *parser) stringLiteral(canAssign bool) ast.Node {
 	value := p.previousToken.lexeme[1 : len(p.previousToken.lexeme)-1] // remove the quotes
 
 	return &ast.StringLiteral{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
-		Value: value,
+		BaseNode: ast.BaseNode{SourceSpan: p.previousToken.span()},
+		Value:    value,
 	}
 }
 
@@ -583,25 +769,23 @@ func (p *parser) stringLiteral(canAssign bool) ast.Node {
 // actual work. I skipped this intermediary call that is useless for now, but I
 // might need to add it later on, when it will start to be useful somehow.
 func (p *parser) variable(canAssign bool) ast.Node {
-	varName := p.previousToken.lexeme
+	nameToken := p.previousToken
+	varName := nameToken.lexeme
 
 	if canAssign && p.match(tokenKindEqual) {
 		rhs := p.expression()
 		return &ast.Assignment{
-			BaseNode: ast.BaseNode{
-				LineNumber: p.previousToken.line,
-			},
-			VarName: varName,
-			Value:   rhs,
+			BaseNode: p.nodeFrom(nameToken.position()),
+			VarName:  varName,
+			NameSpan: nameToken.span(),
+			Value:    rhs,
 		}
 	}
 
 	return &ast.VarRef{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
-		Name:    varName,
-		VarType: ast.TheTypeInvalid, // Filled in a later pass
+		BaseNode: ast.BaseNode{SourceSpan: nameToken.span()},
+		Name:     varName,
+		VarType:  ast.TheTypeInvalid, // Filled in a later pass
 	}
 }
 
@@ -618,7 +802,7 @@ func (p *parser) grouping(canAssign bool) ast.Node {
 func (p *parser) unary(canAssign bool) ast.Node {
 	operatorKind := p.previousToken.kind
 	operatorLexeme := p.previousToken.lexeme
-	operatorLine := p.previousToken.line
+	start := p.previousToken.position()
 
 	// Parse the operand.
 	operand := p.parsePrecedence(PrecUnary)
@@ -627,9 +811,7 @@ func (p *parser) unary(canAssign bool) ast.Node {
 	switch operatorKind {
 	case tokenKindNot, tokenKindMinus, tokenKindPlus:
 		return &ast.Unary{
-			BaseNode: ast.BaseNode{
-				LineNumber: operatorLine,
-			},
+			BaseNode: p.nodeFrom(start),
 			Operator: operatorLexeme,
 			Operand:  operand,
 		}
@@ -644,7 +826,6 @@ func (p *parser) binary(lhs ast.Node, canAssign bool) ast.Node {
 	// Remember the operator.
 	operatorKind := p.previousToken.kind
 	operatorLexeme := p.previousToken.lexeme
-	operatorLine := p.previousToken.line
 
 	// Parse the right operand.
 	var rhs ast.Node
@@ -656,9 +837,7 @@ func (p *parser) binary(lhs ast.Node, canAssign bool) ast.Node {
 	}
 
 	return &ast.Binary{
-		BaseNode: ast.BaseNode{
-			LineNumber: operatorLine,
-		},
+		BaseNode: p.nodeFrom(p.startOf(lhs)),
 		Operator: operatorLexeme,
 		LHS:      lhs,
 		RHS:      rhs,
@@ -676,7 +855,7 @@ func (p *parser) parseArgumentList() []ast.Node {
 		arg := p.expression()
 		args = append(args, arg)
 		if len(args) > 255 {
-			p.errorAtCurrent("Can't have more than 255 arguments.")
+			p.errorAtCurrent(diagnostic.CodeTooManyArguments, "Can't have more than 255 arguments.")
 		}
 	}
 
@@ -690,9 +869,7 @@ func (p *parser) parseArgumentList() []ast.Node {
 // parenthesis are expected to have been just consumed.
 func (p *parser) call(lhs ast.Node, canAssign bool) ast.Node {
 	n := &ast.FunctionCall{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(p.startOf(lhs)),
 	}
 
 	functionVar, ok := lhs.(*ast.VarRef)
@@ -701,12 +878,13 @@ func (p *parser) call(lhs ast.Node, canAssign bool) ast.Node {
 		// if lhs evaluates to a callable thing. Also: the error message should
 		// point to the token before the previous token, right? Or, really, to
 		// the whole expression before it.
-		p.errorAt(p.previousToken, "This doesn't look like a callable thing.")
+		p.errorAt(p.previousToken, diagnostic.CodeNotCallable, "This doesn't look like a callable thing.")
 		return n
 	}
 
 	n.Function = functionVar
 	n.Arguments = p.parseArgumentList()
+	p.finishNode(&n.BaseNode)
 
 	return n
 }
@@ -716,11 +894,9 @@ func (p *parser) call(lhs ast.Node, canAssign bool) ast.Node {
 func (p *parser) and(lhs ast.Node, canAssign bool) ast.Node {
 	rhs := p.parsePrecedence(precAnd)
 	return &ast.And{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
-		LHS: lhs,
-		RHS: rhs,
+		BaseNode: p.nodeFrom(p.startOf(lhs)),
+		LHS:      lhs,
+		RHS:      rhs,
 	}
 }
 
@@ -729,11 +905,9 @@ func (p *parser) and(lhs ast.Node, canAssign bool) ast.Node {
 func (p *parser) or(lhs ast.Node, canAssign bool) ast.Node {
 	rhs := p.parsePrecedence(precAnd)
 	return &ast.Or{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
-		LHS: lhs,
-		RHS: rhs,
+		BaseNode: p.nodeFrom(p.startOf(lhs)),
+		LHS:      lhs,
+		RHS:      rhs,
 	}
 }
 
@@ -742,7 +916,6 @@ func (p *parser) or(lhs ast.Node, canAssign bool) ast.Node {
 func (p *parser) blend(x ast.Node, canAssign bool) ast.Node {
 	// Remember the operator
 	operatorKind := p.previousToken.kind // always a ast.tokenKindTilde
-	operatorLine := p.previousToken.line
 	rule := rules[operatorKind]
 
 	// Parse the second operand (y), the second tilde, and the third operand (weight)
@@ -751,12 +924,10 @@ func (p *parser) blend(x ast.Node, canAssign bool) ast.Node {
 	weight := p.parsePrecedence(rule.precedence + 1)
 
 	return &ast.Blend{
-		BaseNode: ast.BaseNode{
-			LineNumber: operatorLine,
-		},
-		X:      x,
-		Y:      y,
-		Weight: weight,
+		BaseNode: p.nodeFrom(p.startOf(x)),
+		X:        x,
+		Y:        y,
+		Weight:   weight,
 	}
 }
 
@@ -766,17 +937,13 @@ func (p *parser) boolLiteral(canAssign bool) ast.Node {
 	switch p.previousToken.kind {
 	case tokenKindTrue:
 		return &ast.BoolLiteral{
-			BaseNode: ast.BaseNode{
-				LineNumber: p.previousToken.line,
-			},
-			Value: true,
+			BaseNode: ast.BaseNode{SourceSpan: p.previousToken.span()},
+			Value:    true,
 		}
 	case tokenKindFalse:
 		return &ast.BoolLiteral{
-			BaseNode: ast.BaseNode{
-				LineNumber: p.previousToken.line,
-			},
-			Value: false,
+			BaseNode: ast.BaseNode{SourceSpan: p.previousToken.span()},
+			Value:    false,
 		}
 	default:
 		panic(fmt.Sprintf("Unexpected token type on boolLiteral: %v", p.previousToken.kind))
@@ -786,16 +953,17 @@ func (p *parser) boolLiteral(canAssign bool) ast.Node {
 // typeConversion parses a type conversion expression. The corresponding keyword
 // is expected to have been just consumed.
 func (p *parser) typeConversion(canAssign bool) ast.Node {
-	conversionLexeme := p.previousToken.lexeme
+	conversionToken := p.previousToken
+	conversionLexeme := conversionToken.lexeme
 
 	// Consume the open paren and parse the expression to be converted
 	p.consume(tokenKindLeftParen, "Expect '(' after conversion operator.")
 	v := p.parsePrecedence(precAssignment)
 
+	// Default values not present in the source code are attributed to the
+	// conversion operator.
 	var d ast.Node
-	bn := ast.BaseNode{
-		LineNumber: p.previousToken.line,
-	}
+	bn := ast.BaseNode{SourceSpan: conversionToken.span()}
 
 	// If we have a comma, consume it and parse the expression with the default
 	// value; otherwise, use a, er, default default value.
@@ -825,9 +993,7 @@ func (p *parser) typeConversion(canAssign bool) ast.Node {
 
 	// Voilà, return the node
 	return &ast.TypeConversion{
-		BaseNode: ast.BaseNode{
-			LineNumber: p.previousToken.line,
-		},
+		BaseNode: p.nodeFrom(conversionToken.position()),
 		Operator: conversionLexeme,
 		Value:    v,
 		Default:  d,
@@ -845,7 +1011,7 @@ func (p *parser) advance() {
 			break
 		}
 
-		p.errorAtCurrent(p.currentToken.lexeme)
+		p.errorAtCurrent(diagnostic.CodeInvalidToken, p.currentToken.lexeme)
 	}
 }
 
@@ -858,7 +1024,7 @@ func (p *parser) consume(kind tokenKind, message string) {
 		return
 	}
 
-	p.errorAtCurrent(message)
+	p.errorAtCurrent(diagnostic.CodeUnexpectedToken, message)
 }
 
 // check checks if the current token is of a given kind.
@@ -876,37 +1042,74 @@ func (p *parser) match(kind tokenKind) bool {
 	return true
 }
 
+// nodeFrom returns a BaseNode whose span goes from start to the end of the
+// token we just consumed (p.previousToken).
+func (p *parser) nodeFrom(start ast.Position) ast.BaseNode {
+	return ast.BaseNode{
+		SourceSpan: ast.Span{
+			Start: start,
+			End:   p.previousToken.end,
+		},
+	}
+}
+
+// finishNode makes the span of node end at the end of the token we just
+// consumed (p.previousToken). This is used for nodes that are created before
+// all their subnodes have been parsed.
+func (p *parser) finishNode(node *ast.BaseNode) {
+	node.SourceSpan.End = p.previousToken.end
+}
+
+// startOf returns the position where node starts. After syntax errors we may
+// get a nil node; in this case, returns the position of the token we just
+// consumed.
+func (p *parser) startOf(node ast.Node) ast.Position {
+	if node == nil {
+		return p.previousToken.position()
+	}
+	return node.Span().Start
+}
+
 // errorAtCurrent reports an error at the current (c.currentToken) token.
-func (p *parser) errorAtCurrent(message string) {
-	p.errorAt(p.currentToken, message)
+func (p *parser) errorAtCurrent(code diagnostic.Code, message string) {
+	p.errorAt(p.currentToken, code, message)
 }
 
 // error reports an error at the token we just consumed (c.previousToken).
-func (p *parser) error(message string) {
-	p.errorAt(p.previousToken, message)
+func (p *parser) error(code diagnostic.Code, message string) {
+	p.errorAt(p.previousToken, code, message)
 }
 
-// errorAt reports an error at a given token, with a given error message.
-func (p *parser) errorAt(tok *token, message string) {
+// errorAt reports an error at a given token, with a given error code and
+// message.
+func (p *parser) errorAt(tok *token, code diagnostic.Code, message string) {
 	if p.panicMode {
 		return
 	}
 
 	p.panicMode = true
 
-	fmt.Fprintf(os.Stderr, "[line %v] Error", tok.line)
+	d := &diagnostic.Diagnostic{
+		Code:     code,
+		Severity: diagnostic.SeverityError,
+		File:     p.scanner.file,
+		Line:     tok.line,
+		Column:   tok.column,
+	}
 
 	switch tok.kind {
 	case tokenKindEOF:
-		fmt.Fprintf(os.Stderr, " at end")
+		d.Message = fmt.Sprintf("at end: %v", message)
+		d.EndColumn = tok.column + 1
 	case tokenKindError:
-		// Nothing.
+		d.Message = message
+		d.EndColumn = tok.column + 1
 	default:
-		fmt.Fprintf(os.Stderr, " at '%v'", tok.lexeme)
+		d.Message = fmt.Sprintf("at '%v': %v", tok.lexeme, message)
+		d.EndColumn = tok.column + utf8.RuneCountInString(tok.lexeme)
 	}
 
-	fmt.Fprintf(os.Stderr, ": %v\n", message)
-	p.hadError = true
+	p.diagnostics = append(p.diagnostics, d)
 }
 
 func init() {
@@ -929,7 +1132,7 @@ func initRules() { // nolint:funlen
 	rules[tokenKindLeftBracket] = /*   */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindRightBracket] = /*  */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindComma] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
-	rules[tokenKindDot] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[tokenKindDot] = /*           */ parseRule{(*parser).builtInCall /*      */, nil /*                     */, precNone}
 	rules[tokenKindMinus] = /*         */ parseRule{(*parser).unary /*            */, (*parser).binary /*        */, precTerm}
 	rules[tokenKindPlus] = /*          */ parseRule{(*parser).unary /*            */, (*parser).binary /*        */, precTerm}
 	rules[tokenKindSlash] = /*         */ parseRule{nil /*                        */, (*parser).binary /*        */, precFactor}
@@ -967,13 +1170,13 @@ func initRules() { // nolint:funlen
 	rules[tokenKindFor] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindFunction] = /*      */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindGlobals] = /*       */ parseRule{nil /*                        */, nil /*                     */, precNone}
-	rules[tokenKindGosub] = /*         */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[tokenKindGosub] = /*         */ parseRule{(*parser).gosub /*            */, nil /*                     */, precNone}
 	rules[tokenKindGoto] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindIf] = /*            */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindIn] = /*            */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindInt] = /*           */ parseRule{(*parser).typeConversion /*   */, nil /*                     */, precNone}
 	rules[tokenKindIntLiteral] = /*    */ parseRule{(*parser).numberLiteral /*    */, nil /*                     */, precNone}
-	rules[tokenKindListen] = /*        */ parseRule{nil /*                        */, nil /*                     */, precNone}
+	rules[tokenKindListen] = /*        */ parseRule{(*parser).listen /*           */, nil /*                     */, precNone}
 	rules[tokenKindMap] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindMeta] = /*          */ parseRule{nil /*                        */, nil /*                     */, precNone}
 	rules[tokenKindNil] = /*           */ parseRule{nil /*                        */, nil /*                     */, precNone}
@@ -10,10 +10,16 @@ package frontend
 import (
 	"unicode"
 	"unicode/utf8"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
 )
 
 // A scanner is used to scan (tokenize) the Romualdo code.
 type scanner struct {
+	// file is the name of the file being scanned. Used only to fill in the
+	// positions of the tokens, can be empty.
+	file string
+
 	// source is the source code being scanned.
 	source string
 
@@ -27,11 +33,36 @@ type scanner struct {
 
 	// line holds the line number we are currently looking at.
 	line int
+
+	// lineStart points to the start of the line we are currently looking at.
+	// It points into source.
+	lineStart int
+
+	// startPosition is the position of the token being currently scanned.
+	// (Its Offset is always equal to start.)
+	startPosition ast.Position
+
+	// comments contains all comments found so far, in the order they appear in
+	// the source code. Comments are not tokens (the parser never sees them),
+	// but tools like the formatter need to preserve them.
+	comments []*comment
+}
+
+// comment is a comment found in the source code.
+type comment struct {
+	// text is the comment text, including the leading "#" but not the line
+	// break that ends it.
+	text string
+
+	// span is the region of the source code covered by the comment.
+	span ast.Span
 }
 
-// newScanner returns a new scanner that will scan source.
-func newScanner(source string) *scanner {
+// newScanner returns a new scanner that will scan source, which comes from the
+// file named file.
+func newScanner(file, source string) *scanner {
 	return &scanner{
+		file:   file,
 		source: source,
 		line:   1,
 	}
@@ -42,6 +73,7 @@ func (s *scanner) token() *token { // nolint:funlen,gocyclo
 	s.skipWhitespace()
 
 	s.start = s.current
+	s.startPosition = s.position()
 
 	if s.isAtEnd() {
 		return s.makeToken(tokenKindEOF)
@@ -130,7 +162,10 @@ func (s *scanner) makeToken(kind tokenKind) *token {
 	return &token{
 		kind:   kind,
 		lexeme: s.source[s.start:s.current],
-		line:   s.line,
+		line:   s.startPosition.Line,
+		column: s.startPosition.Column,
+		offset: s.start,
+		end:    s.position(),
 	}
 }
 
@@ -140,10 +175,30 @@ func (s *scanner) errorToken(message string) *token {
 	return &token{
 		kind:   tokenKindError,
 		lexeme: message,
-		line:   s.line,
+		line:   s.startPosition.Line,
+		column: s.startPosition.Column,
+		offset: s.start,
+		end:    s.position(),
+	}
+}
+
+// position returns the position the scanner is currently looking at (that is,
+// the position of s.current).
+func (s *scanner) position() ast.Position {
+	return ast.Position{
+		File:   s.file,
+		Offset: s.current,
+		Line:   s.line,
+		Column: utf8.RuneCountInString(s.source[s.lineStart:s.current]) + 1,
 	}
 }
 
+// newLine updates the scanner state after consuming a line break.
+func (s *scanner) newLine() {
+	s.line++
+	s.lineStart = s.current
+}
+
 // advance returns the next rune in the input source and advance the s.current
 // index so that it points to the start of the next rune.
 func (s *scanner) advance() rune {
@@ -172,19 +227,25 @@ func (s *scanner) match(expected rune) bool {
 }
 
 // skipWhitespace skips all whitespace and comments, leaving s.current pointing
-// to the start of a non-space, non-comment rune.
+// to the start of a non-space, non-comment rune. Comments are recorded in
+// s.comments.
 func (s *scanner) skipWhitespace() {
 	for {
 		r, width := utf8.DecodeRuneInString(s.source[s.current:])
 
 		switch {
 		case r == '#':
+			start := s.position()
 			for s.peek() != '\n' && !s.isAtEnd() {
 				s.advance()
 			}
+			s.comments = append(s.comments, &comment{
+				text: s.source[start.Offset:s.current],
+				span: ast.Span{Start: start, End: s.position()},
+			})
 		case r == '\n':
-			s.line++
 			s.current += width
+			s.newLine()
 		case unicode.IsSpace(r):
 			s.current += width
 		default:
@@ -215,7 +276,9 @@ func (s *scanner) peekNext() rune {
 func (s *scanner) scanString() *token {
 	for s.peek() != '"' && !s.isAtEnd() {
 		if s.peek() == '\n' {
-			s.line++
+			s.advance()
+			s.newLine()
+			continue
 		}
 		s.advance()
 	}
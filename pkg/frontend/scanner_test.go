@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
 )
 
 // Tests Scanner.Token() with simple cases (zero or one-token only).
@@ -135,7 +136,8 @@ and continues" [ elseif # now this is a comment
 		tokenKinds(tokens))
 	assert.Equal(t, []string{"break", "\"starts # goes on\nand continues\"",
 		"[", "elseif", "int", "inti", "^", ""}, tokenLexemes(tokens))
-	assert.Equal(t, []int{1, 2, 2, 2, 3, 3, 3, 3}, tokenLines(tokens))
+	assert.Equal(t, []int{1, 1, 2, 2, 3, 3, 3, 3}, tokenLines(tokens))
+	assert.Equal(t, ast.Position{Offset: 38, Line: 2, Column: 15}, tokens[1].end)
 
 	tokens = tokenizeString(
 		`goto continue conti
@@ -277,6 +279,48 @@ func TestScannerTokenStrings(t *testing.T) {
 	assert.Equal(t, []tokenKind{tokenKindError}, tokenKinds(tokens))
 }
 
+// Tests that tokens get the right columns, counted in runes.
+func TestScannerTokenColumns(t *testing.T) {
+	tokens := tokenizeString("foo bar\n  ação = \"ê\" + 1\n# comment\n\tx")
+	assert.Equal(t, []string{"foo", "bar", "ação", "=", "\"ê\"", "+", "1", "x", ""}, tokenLexemes(tokens))
+	assert.Equal(t, []int{1, 1, 2, 2, 2, 2, 2, 4, 4}, tokenLines(tokens))
+	assert.Equal(t, []int{1, 5, 3, 8, 10, 14, 16, 2, 3}, tokenColumns(tokens))
+}
+
+// Tests that tokens get the right spans, with byte offsets and rune columns.
+func TestScannerTokenSpans(t *testing.T) {
+	tokens := tokenizeString("ação = \"ê\"\n  x")
+	assert.Equal(t, []ast.Span{
+		{Start: ast.Position{Offset: 0, Line: 1, Column: 1}, End: ast.Position{Offset: 6, Line: 1, Column: 5}},
+		{Start: ast.Position{Offset: 7, Line: 1, Column: 6}, End: ast.Position{Offset: 8, Line: 1, Column: 7}},
+		{Start: ast.Position{Offset: 9, Line: 1, Column: 8}, End: ast.Position{Offset: 13, Line: 1, Column: 11}},
+		{Start: ast.Position{Offset: 16, Line: 2, Column: 3}, End: ast.Position{Offset: 17, Line: 2, Column: 4}},
+		{Start: ast.Position{Offset: 17, Line: 2, Column: 4}, End: ast.Position{Offset: 17, Line: 2, Column: 4}},
+	}, tokenSpans(tokens))
+}
+
+// Tests that comments are skipped, but recorded along with their spans.
+func TestScannerComments(t *testing.T) {
+	s := newScanner("", "# ação\nfoo # bar\n#\nbaz#")
+	for tok := s.token(); tok.kind != tokenKindEOF; tok = s.token() {
+		assert.NotEqual(t, tokenKindError, tok.kind)
+	}
+
+	texts := []string{}
+	spans := []ast.Span{}
+	for _, c := range s.comments {
+		texts = append(texts, c.text)
+		spans = append(spans, c.span)
+	}
+	assert.Equal(t, []string{"# ação", "# bar", "#", "#"}, texts)
+	assert.Equal(t, []ast.Span{
+		{Start: ast.Position{Offset: 0, Line: 1, Column: 1}, End: ast.Position{Offset: 8, Line: 1, Column: 7}},
+		{Start: ast.Position{Offset: 13, Line: 2, Column: 5}, End: ast.Position{Offset: 18, Line: 2, Column: 10}},
+		{Start: ast.Position{Offset: 19, Line: 3, Column: 1}, End: ast.Position{Offset: 20, Line: 3, Column: 2}},
+		{Start: ast.Position{Offset: 24, Line: 4, Column: 4}, End: ast.Position{Offset: 25, Line: 4, Column: 5}},
+	}, spans)
+}
+
 // tokenKinds extract the token kinds from a slice of tokens.
 func tokenKinds(tokens []*token) []tokenKind {
 	result := make([]tokenKind, 0, len(tokens))
@@ -310,10 +354,32 @@ func tokenLines(tokens []*token) []int {
 	return result
 }
 
+// tokenColumns extract the columns from a slice of tokens.
+func tokenColumns(tokens []*token) []int {
+	result := make([]int, 0, len(tokens))
+
+	for _, tok := range tokens {
+		result = append(result, tok.column)
+	}
+
+	return result
+}
+
+// tokenSpans extract the spans from a slice of tokens.
+func tokenSpans(tokens []*token) []ast.Span {
+	result := make([]ast.Span, 0, len(tokens))
+
+	for _, tok := range tokens {
+		result = append(result, tok.span())
+	}
+
+	return result
+}
+
 // tokenizeString creates a Scanner and calls Token() on it until getting an
 // EOF or error. Then it returns a slice with the resulting Tokens.
 func tokenizeString(source string) []*token {
-	s := newScanner(source)
+	s := newScanner("", source)
 	result := make([]*token, 0, 16)
 
 	tok := s.token()
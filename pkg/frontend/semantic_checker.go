@@ -8,33 +8,57 @@
 package frontend
 
 import (
-	"fmt"
-
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // semanticChecker is a node visitor that implements assorted semantic checks.
 type semanticChecker struct {
 	// errors collects all type errors detected.
-	errors []string
+	errors diagnostic.List
 
 	// nodeStack is used to keep track of the nodes being processed. The current
 	// on is on the top.
 	nodeStack []ast.Node
 
-	// firstGlobalsBlock contains the first globals block found. This is used to
-	// detect multiple of these blocks (which is forbidden).
-	firstGlobalsBlock *ast.GlobalsBlock
+	// globalsBlocks maps the version of each globals block found so far to the
+	// block itself.
+	globalsBlocks map[int]*ast.GlobalsBlock
+
+	// latestGlobalsBlock is the globals block with the highest version in the
+	// Storyworld. Its variables are the actual globals.
+	latestGlobalsBlock *ast.GlobalsBlock
+
+	// globalVariables maps the keys of the global names already declared to
+	// the position where they were declared. Used to detect duplicates.
+	globalVariables map[ast.GlobalKey]ast.Position
+
+	// globalVarsFiles maps the names of the global variables to the files
+	// where they were declared.
+	globalVarsFiles map[string]string
+
+	// passageNames contains the keys of all Passages declared so far. (Just
+	// the names, without versions.)
+	passageNames map[ast.GlobalKey]bool
 
-	// globalVariables maps the global variable names already declared to the
-	// line where they were declared. Used to detect duplicates.
-	globalVariables map[string]int
+	// passageVersions maps the keys of the versioned names of the Passages
+	// already declared to the position where they were declared. Used to
+	// detect duplicates.
+	passageVersions map[ast.GlobalKey]ast.Position
 
-	// mainFunctionLine contains the line number where the main function was
-	// found. A value of 0 means that main wasn't found yet.
-	mainFunctionLine int
+	// foundEntryPassage tells if we found the entry Passage.
+	foundEntryPassage bool
+
+	// incremental tells if we are checking just an increment to a Storyworld
+	// (see ParseIncrement()), in which case checks that concern the
+	// Storyworld as a whole are skipped.
+	incremental bool
 }
 
+// entryPassageName is the name of the Passage from where the execution of a
+// Storyworld starts.
+const entryPassageName = "Main"
+
 //
 // The Visitor interface
 //
@@ -43,45 +67,61 @@ func (sc *semanticChecker) Enter(node ast.Node) {
 
 	switch n := node.(type) {
 	case *ast.Storyworld:
-		sc.globalVariables = map[string]int{}
+		sc.globalVariables = map[ast.GlobalKey]ast.Position{}
+		sc.globalVarsFiles = n.GlobalVarsFiles()
+		sc.passageNames = map[ast.GlobalKey]bool{}
+		sc.passageVersions = map[ast.GlobalKey]ast.Position{}
+		sc.globalsBlocks = map[int]*ast.GlobalsBlock{}
+		sc.latestGlobalsBlock = n.LatestGlobalsBlock()
 
 	case *ast.GlobalsBlock:
 		// At the base of the stack we have the Storyworld itself, so a globals
 		// block would be the second node on the stack.
 		if len(sc.nodeStack) == 2 {
-			sc.checkDuplicateGlobalsBlock(n)
+			sc.checkGlobalsBlock(n)
 		}
 
 	case *ast.VarDecl:
 		sc.checkVarInitializer(n)
 
-		if sc.isInsideGlobalsBlock() {
-			sc.checkDuplicateGlobalName(n.Name, n.BaseNode)
+		// Only the latest globals block declares the actual global variables;
+		// older versions are there just to check compatibility.
+		if g := sc.enclosingGlobalsBlock(); g != nil && g == sc.latestGlobalsBlock {
+			sc.checkDuplicateGlobalName(n.Name, sc.globalVarsFiles[n.Name], n.BaseNode)
 		}
 
 	case *ast.FunctionDecl:
-		sc.checkDuplicateGlobalName(n.Name, n.BaseNode)
+		sc.checkDuplicateGlobalName(n.Name, n.Span().Start.File, n.BaseNode)
 
-		if n.Name != "main" {
-			break
-		}
-		if sc.mainFunctionLine != 0 {
-			sc.error("Duplicate function main at line %v. The first one was at line %v.",
-				n.LineNumber, sc.mainFunctionLine)
-			break
-		}
-		sc.mainFunctionLine = n.LineNumber
+	case *ast.PassageDecl:
+		sc.checkPassageDecl(n)
+
+	case *ast.MetaBlock:
+		sc.checkDuplicateMetaVars(n)
+
+	case *ast.SayStmt:
+		sc.checkInteraction("say", n.Attributes)
+
+	case *ast.ListenExpr:
+		sc.checkInteraction("listen", n.Attributes)
+
+	case *ast.GotoStmt:
+		sc.checkInsidePassage("goto")
+
+	case *ast.GosubExpr:
+		sc.checkInsidePassage("gosub")
 	}
 }
 
 func (sc *semanticChecker) Leave(n ast.Node) {
-	sc.nodeStack = sc.nodeStack[:len(sc.nodeStack)-1]
-
-	if _, ok := n.(*ast.Storyworld); ok {
-		if sc.mainFunctionLine == 0 {
-			sc.error("Function 'main' not found.")
+	if sw, ok := n.(*ast.Storyworld); ok && !sc.incremental {
+		if !sc.foundEntryPassage {
+			sc.reportMissingEntryPassage(sw)
 		}
+		sc.checkGlobalsVersionsSequence()
 	}
+
+	sc.nodeStack = sc.nodeStack[:len(sc.nodeStack)-1]
 }
 
 func (sc *semanticChecker) Event(node ast.Node, event int) {
@@ -91,17 +131,75 @@ func (sc *semanticChecker) Event(node ast.Node, event int) {
 // Semantic checking
 //
 
-// checkDuplicateGlobalsBlock checks if another globals block was already
-// declared (which is forbidden).
-func (sc *semanticChecker) checkDuplicateGlobalsBlock(node *ast.GlobalsBlock) {
-	if sc.firstGlobalsBlock != nil {
-		sc.error(
-			"Only one 'globals' block is allowed. Found another one at line %v.",
-			sc.firstGlobalsBlock.Line())
+// checkGlobalsBlock checks a globals block. There cannot be two blocks with the
+// same version, nor duplicate variables within a block. Also checks if the
+// block is compatible with the previous and next versions, if they were already
+// found.
+func (sc *semanticChecker) checkGlobalsBlock(node *ast.GlobalsBlock) {
+	if other, found := sc.globalsBlocks[node.Version]; found {
+		sc.error(diagnostic.CodeDuplicateGlobalsBlock, "Duplicate 'globals@%v' block. The first one was at %v.",
+			node.Version, describePosition(other.Span().Start))
 		return
 	}
+	sc.globalsBlocks[node.Version] = node
+
+	// Duplicates in the latest block are caught as duplicate global names.
+	if node != sc.latestGlobalsBlock {
+		lines := map[string]int{}
+		for _, v := range node.Vars {
+			if line, found := lines[v.Name]; found {
+				sc.error(diagnostic.CodeDuplicateGlobal, "Duplicate variable '%v' in 'globals@%v' block. The first one was at line %v.",
+					v.Name, node.Version, line)
+				continue
+			}
+			lines[v.Name] = v.Line()
+		}
+	}
+
+	if prev, found := sc.globalsBlocks[node.Version-1]; found {
+		sc.checkGlobalsCompatibility(prev, node)
+	}
+	if next, found := sc.globalsBlocks[node.Version+1]; found {
+		sc.checkGlobalsCompatibility(node, next)
+	}
+}
+
+// checkGlobalsCompatibility checks if the globals block next can be used as an
+// upgrade of the globals block prev. It can add new variables, and can change
+// the initializers of existing variables, but cannot remove variables or change
+// their types. This is what allows a game saved with an older version of the
+// Storyworld to be loaded by a newer version.
+func (sc *semanticChecker) checkGlobalsCompatibility(prev, next *ast.GlobalsBlock) {
+	nextVars := map[string]*ast.VarDecl{}
+	for _, v := range next.Vars {
+		nextVars[v.Name] = v
+	}
+
+	for _, prevVar := range prev.Vars {
+		nextVar, found := nextVars[prevVar.Name]
+		if !found {
+			sc.error(diagnostic.CodeGlobalRemoved, "'globals@%v' removes variable '%v', declared in 'globals@%v' at %v. Variables cannot be removed.",
+				next.Version, prevVar.Name, prev.Version, describePosition(prevVar.Span().Start))
+			continue
+		}
+		if nextVar.Type() != prevVar.Type() {
+			sc.error(diagnostic.CodeGlobalTypeChanged, "'globals@%v' changes the type of variable '%v' from %v to %v. Types cannot be changed.",
+				next.Version, prevVar.Name, prevVar.Type(), nextVar.Type())
+		}
+	}
+}
 
-	sc.firstGlobalsBlock = node
+// checkGlobalsVersionsSequence checks if the versions of the globals blocks
+// start at 1 and are consecutive.
+func (sc *semanticChecker) checkGlobalsVersionsSequence() {
+	if sc.latestGlobalsBlock == nil {
+		return
+	}
+	for v := 1; v <= sc.latestGlobalsBlock.Version; v++ {
+		if _, found := sc.globalsBlocks[v]; !found {
+			sc.error(diagnostic.CodeMissingGlobalsBlock, "Missing 'globals@%v' block. Globals versions must be consecutive, starting at 1.", v)
+		}
+	}
 }
 
 // checkVarInitializer checks if the variable initializer is some literal value.
@@ -111,39 +209,132 @@ func (sc *semanticChecker) checkVarInitializer(node *ast.VarDecl) {
 		*ast.FloatLiteral, *ast.BNumLiteral:
 		break
 	default:
-		sc.error("Currently variables must be initialized with a literal value.")
+		sc.error(diagnostic.CodeNonLiteralInitializer, "Currently variables must be initialized with a literal value.")
 	}
 }
 
 // checkDuplicateGlobalName checks if something with the same name was already
-// declared at the global scope. If this is a new globa, it also adds the name
-// to the list of known globals, taking the corresponding line number from node.
-func (sc *semanticChecker) checkDuplicateGlobalName(name string, node ast.BaseNode) {
-	line, found := sc.globalVariables[name]
+// declared at the global scope. file is the name of the file the name belongs
+// to. If this is a new global, it also adds the name to the list of known
+// globals, taking the corresponding position from node.
+//
+// Private (file-local) names are not visible from other files, so they only
+// clash with names declared in the same file.
+func (sc *semanticChecker) checkDuplicateGlobalName(name, file string, node ast.BaseNode) {
+	key := ast.NewGlobalKey(name, file)
+	pos, found := sc.globalVariables[key]
 	if found {
-		sc.error("The name '%v' was already globally declared at at line %v.", name, line)
+		sc.error(diagnostic.CodeRedeclaredName, "The name '%v' was already globally declared at %v.", name, describePosition(pos))
 		return
 	}
 
-	sc.globalVariables[name] = node.LineNumber
+	sc.globalVariables[key] = node.Span().Start
 }
 
-// error reports an error.
-func (sc *semanticChecker) error(format string, a ...interface{}) {
-	sc.errors = append(sc.errors,
-		fmt.Sprintf("[line %v]: %v", sc.currentLine(), fmt.Sprintf(format, a...)))
+// checkPassageDecl checks a Passage declaration. Different versions of a
+// Passage can coexist, but there cannot be two Passages with the same name and
+// version. Passages share the global namespace with everything else. Also
+// checks the constraints of the entry Passage.
+func (sc *semanticChecker) checkPassageDecl(node *ast.PassageDecl) {
+	file := node.Span().Start.File
+	versionKey := ast.NewGlobalKey(node.VersionedName(), file)
+	if pos, found := sc.passageVersions[versionKey]; found {
+		sc.error(diagnostic.CodeDuplicatePassage, "Duplicate Passage '%v'. The first one was at %v.", node.VersionedName(), describePosition(pos))
+		return
+	}
+	sc.passageVersions[versionKey] = node.Span().Start
+
+	if key := ast.NewGlobalKey(node.Name, file); !sc.passageNames[key] {
+		sc.checkDuplicateGlobalName(node.Name, file, node.BaseNode)
+		sc.passageNames[key] = true
+	}
+
+	if node.Name == entryPassageName {
+		sc.foundEntryPassage = true
+		if len(node.Parameters) != 0 || node.ReturnType.Tag != ast.TypeVoid {
+			sc.error(diagnostic.CodeBadEntryPassage, "Passage '%v' must take no parameters and return void.", entryPassageName)
+		}
+	}
+}
+
+// checkDuplicateMetaVars checks if a meta block declares the same variable more
+// than once.
+func (sc *semanticChecker) checkDuplicateMetaVars(node *ast.MetaBlock) {
+	lines := map[string]int{}
+	for _, v := range node.Vars {
+		if line, found := lines[v.Name]; found {
+			sc.error(diagnostic.CodeDuplicateMetaVar, "Duplicate meta variable '%v'. The first one was at line %v.", v.Name, line)
+			continue
+		}
+		lines[v.Name] = v.Line()
+	}
 }
 
-// currentLine returns the source code line corresponding to whatever we are
-// currently analyzing.
-func (sc *semanticChecker) currentLine() int {
-	return sc.nodeStack[len(sc.nodeStack)-1].Line()
+// checkInteraction checks a say statement or listen expression (as told by
+// keyword): it must be inside a Passage and cannot have the same attribute more
+// than once.
+func (sc *semanticChecker) checkInteraction(keyword string, attrs []*ast.Attribute) {
+	sc.checkInsidePassage(keyword)
+
+	lines := map[string]int{}
+	for _, attr := range attrs {
+		if line, found := lines[attr.Name]; found {
+			sc.error(diagnostic.CodeDuplicateAttribute, "Duplicate '%v' attribute '%v'. The first one was at line %v.", keyword, attr.Name, line)
+			continue
+		}
+		lines[attr.Name] = attr.Line()
+	}
+}
+
+// checkInsidePassage checks if we are inside a Passage. keyword is the keyword
+// that is allowed only inside Passages, used in the error message.
+func (sc *semanticChecker) checkInsidePassage(keyword string) {
+	if !sc.isInsidePassage() {
+		sc.error(diagnostic.CodeOutsidePassage, "'%v' can only be used inside Passages.", keyword)
+	}
+}
+
+// error reports an error with a given code.
+func (sc *semanticChecker) error(code diagnostic.Code, format string, a ...interface{}) {
+	sc.errors = append(sc.errors, newError(code, sc.currentSpan(), format, a...))
+}
+
+// currentSpan returns the region of the source code corresponding to whatever
+// we are currently analyzing.
+func (sc *semanticChecker) currentSpan() ast.Span {
+	return sc.nodeStack[len(sc.nodeStack)-1].Span()
+}
+
+// reportMissingEntryPassage reports that the entry Passage was not found in
+// sw. This is a problem with the Storyworld as a whole, not with any specific
+// piece of code, so we point at the start of the first declaration (the
+// Storyworld span would usually start at some unrelated leading comment). If
+// there are no declarations, the error has no location at all.
+func (sc *semanticChecker) reportMissingEntryPassage(sw *ast.Storyworld) {
+	span := ast.Span{}
+	if len(sw.Declarations) > 0 {
+		span.Start = sw.Declarations[0].Span().Start
+		span.End = span.Start
+	}
+	sc.errors = append(sc.errors, newError(diagnostic.CodeEntryPassageNotFound, span,
+		"Passage '%v' not found.", entryPassageName))
+}
+
+// enclosingGlobalsBlock returns the globals block we are currently in, or nil
+// if we are not inside a globals block.
+func (sc *semanticChecker) enclosingGlobalsBlock() *ast.GlobalsBlock {
+	for _, node := range sc.nodeStack {
+		if g, ok := node.(*ast.GlobalsBlock); ok {
+			return g
+		}
+	}
+	return nil
 }
 
-// isInsideGlobalsBlock checks if we are currently inside a globals block.
-func (sc *semanticChecker) isInsideGlobalsBlock() bool {
+// isInsidePassage checks if we are currently inside a Passage.
+func (sc *semanticChecker) isInsidePassage() bool {
 	for _, node := range sc.nodeStack {
-		_, ok := node.(*ast.GlobalsBlock)
+		_, ok := node.(*ast.PassageDecl)
 		if ok {
 			return true
 		}
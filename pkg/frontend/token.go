@@ -7,6 +7,8 @@
 
 package frontend
 
+import "gitlab.com/stackedboxes/romulang/pkg/ast"
+
 // tokenKind represents the type of a token. I would call this tokenType if
 // "type" wasn't a reserved word in Go. So, there we have it, "tokenKind".
 type tokenKind int
@@ -97,6 +99,18 @@ const (
 	numberOfTokenKinds
 )
 
+// Keywords returns the keywords used by the Romualdo Language, sorted
+// alphabetically. Keywords reserved for future use are not included. This is
+// useful for things like code completion.
+func Keywords() []string {
+	return []string{
+		"and", "bnum", "bool", "do", "else", "elseif", "end", "false", "float",
+		"function", "globals", "gosub", "goto", "if", "int", "listen", "meta",
+		"not", "or", "passage", "return", "say", "string", "then", "true",
+		"var", "void", "while",
+	}
+}
+
 // String converts a tokenKind to its string representation. Returns an empty
 // string if an invalid kind value is passed.
 func (kind tokenKind) String() string { // nolint:funlen,gocyclo
@@ -259,6 +273,34 @@ type token struct {
 	// error message as new string.
 	lexeme string
 
-	// The line number where the token came from.
+	// The line number where the token came from. For tokens spanning multiple
+	// lines (like some string literals), this is the line where it starts.
 	line int
+
+	// column is the (1-based) column where the token starts, counted in runes.
+	column int
+
+	// offset is the (0-based) byte offset where the token starts.
+	offset int
+
+	// end is the position just past the last character of the token.
+	end ast.Position
+}
+
+// position returns the position where the token starts.
+func (t *token) position() ast.Position {
+	return ast.Position{
+		File:   t.end.File,
+		Offset: t.offset,
+		Line:   t.line,
+		Column: t.column,
+	}
+}
+
+// span returns the region of the source code occupied by the token.
+func (t *token) span() ast.Span {
+	return ast.Span{
+		Start: t.position(),
+		End:   t.end,
+	}
 }
@@ -90,3 +90,13 @@ func TestKindString(t *testing.T) { // nolint:funlen
 	assert.Equal(t, "tokenKindError", tokenKindError.String())
 	assert.Equal(t, "tokenKindEOF", tokenKindEOF.String())
 }
+
+// Tests that all keywords returned by Keywords() are actually scanned as
+// keywords.
+func TestKeywords(t *testing.T) {
+	for _, keyword := range Keywords() {
+		tokens := tokenizeString(keyword)
+		assert.NotEqual(t, tokenKindIdentifier, tokens[0].kind, keyword)
+		assert.Equal(t, keyword, tokens[0].lexeme)
+	}
+}
@@ -8,15 +8,14 @@
 package frontend
 
 import (
-	"fmt"
-
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // typeChecker is a node visitor that implements type checking.
 type typeChecker struct {
 	// errors collects all type errors detected.
-	errors []string
+	errors diagnostic.List
 
 	// nodeStack is used to keep track of the nodes being processed. The current
 	// one is on the top.
@@ -40,6 +39,11 @@ func (tc *typeChecker) Enter(node ast.Node) {
 		tc.checkBlend(n)
 	case *ast.FunctionCall:
 		tc.checkFunctionCall(n)
+	case *ast.NativeCall:
+		// Unknown native functions were already reported.
+		if n.FunctionType != nil {
+			tc.checkArguments("Native function", n.Function, n.FunctionType.ParameterTypes, n.Arguments)
+		}
 	case *ast.ReturnStmt:
 		tc.checkReturnStmt(n)
 	case *ast.TypeConversion:
@@ -52,6 +56,14 @@ func (tc *typeChecker) Enter(node ast.Node) {
 		tc.checkIf(n)
 	case *ast.WhileStmt:
 		tc.checkWhile(n)
+	case *ast.SayStmt:
+		tc.checkAttributes("say", n.Attributes)
+	case *ast.ListenExpr:
+		tc.checkAttributes("listen", n.Attributes)
+	case *ast.GotoStmt:
+		tc.checkGoto(n)
+	case *ast.GosubExpr:
+		tc.checkPassageTarget(n.Passage.Name, n.PassageType, n.Arguments)
 	}
 
 }
@@ -69,22 +81,33 @@ func (tc *typeChecker) Event(node ast.Node, event int) {
 
 // checkAssignment type checks an assignment operator.
 func (tc *typeChecker) checkAssignment(node *ast.Assignment) {
+	if anyInvalid(node.VarType, node.Value.Type()) {
+		return
+	}
 	if node.VarType != node.Value.Type() {
-		tc.error("Variable '%v' is of type %v, cannot assign a %v value to it.", node.VarName, node.VarType, node.Value.Type())
+		tc.error(diagnostic.CodeTypeMismatch, "Variable '%v' is of type %v, cannot assign a %v value to it.", node.VarName, node.VarType, node.Value.Type())
 	}
 }
 
 // checkBinary type checks a binary operator.
 func (tc *typeChecker) checkBinary(node *ast.Binary) {
+	if anyInvalid(node.LHS.Type(), node.RHS.Type()) {
+		return
+	}
+
 	switch node.Operator {
 	case "<", "<=", ">", ">=":
-		// TODO: Why only unbounded? We should be able to compare BNums, right?
+		// It is OK to compare two bounded numbers
+		if node.LHS.Type().Tag == ast.TypeBNum && node.RHS.Type().Tag == ast.TypeBNum {
+			return
+		}
+
 		if !node.LHS.Type().IsUnboundedNumeric() {
-			tc.error("Operator %v expects numeric operands; got a %v on the left-hand side",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects numeric operands; got a %v on the left-hand side",
 				node.Operator, node.LHS.Type())
 		}
 		if !node.RHS.Type().IsUnboundedNumeric() {
-			tc.error("Operator %v expects numeric operands; got a %v on the right-hand side",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects numeric operands; got a %v on the right-hand side",
 				node.Operator, node.RHS.Type())
 		}
 
@@ -100,7 +123,7 @@ func (tc *typeChecker) checkBinary(node *ast.Binary) {
 		}
 
 		// Nothing else can be compared
-		tc.error("Operator %v expects operands of same type or two unbounded numeric values; got a %v and a %v",
+		tc.error(diagnostic.CodeBadOperandType, "Operator %v expects operands of same type or two unbounded numeric values; got a %v and a %v",
 			node.Operator, node.LHS.Type(), node.RHS.Type())
 
 	case "+":
@@ -120,7 +143,7 @@ func (tc *typeChecker) checkBinary(node *ast.Binary) {
 		}
 
 		// Nothing else can be added
-		tc.error("Operator %v cannot work with values of type %v and %v",
+		tc.error(diagnostic.CodeBadOperandType, "Operator %v cannot work with values of type %v and %v",
 			node.Operator, node.LHS.Type(), node.RHS.Type())
 
 	case "-":
@@ -135,16 +158,16 @@ func (tc *typeChecker) checkBinary(node *ast.Binary) {
 		}
 
 		// Nothing else can be subtracted
-		tc.error("Operator %v cannot work with values of type %v and %v",
+		tc.error(diagnostic.CodeBadOperandType, "Operator %v cannot work with values of type %v and %v",
 			node.Operator, node.LHS.Type(), node.LHS.Type())
 
 	default:
 		if !node.LHS.Type().IsUnboundedNumeric() {
-			tc.error("Operator %v expects unbounded numeric operands; got a %v on the left-hand side",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects unbounded numeric operands; got a %v on the left-hand side",
 				node.Operator, node.LHS.Type())
 		}
 		if !node.RHS.Type().IsUnboundedNumeric() {
-			tc.error("Operator %v expects unbounded numeric operands; got a %v on the left-hand side",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects unbounded numeric operands; got a %v on the left-hand side",
 				node.Operator, node.RHS.Type())
 		}
 	}
@@ -152,42 +175,63 @@ func (tc *typeChecker) checkBinary(node *ast.Binary) {
 
 // checkAnd type checks an "and" operator.
 func (tc *typeChecker) checkAnd(node *ast.And) {
+	if anyInvalid(node.LHS.Type(), node.RHS.Type()) {
+		return
+	}
 	if node.LHS.Type().Tag != ast.TypeBool {
-		tc.error("Operator 'and' expects Boolean operands; got a %v on the left-hand side",
+		tc.error(diagnostic.CodeBadOperandType, "Operator 'and' expects Boolean operands; got a %v on the left-hand side",
 			node.LHS.Type())
 	}
 	if node.RHS.Type().Tag != ast.TypeBool {
-		tc.error("Operator 'and' expects Boolean operands; got a %v on the right-hand side",
+		tc.error(diagnostic.CodeBadOperandType, "Operator 'and' expects Boolean operands; got a %v on the right-hand side",
 			node.RHS.Type())
 	}
 }
 
 // checkIf checks an if statement.
 func (tc *typeChecker) checkIf(node *ast.IfStmt) {
-	if node.Condition.Type().Tag != ast.TypeBool {
-		tc.error("The condition of an 'if' must be Boolean.")
+	if !anyInvalid(node.Condition.Type()) && node.Condition.Type().Tag != ast.TypeBool {
+		tc.error(diagnostic.CodeNonBoolCondition, "The condition of an 'if' must be Boolean.")
 	}
 }
 
 // checkWhile checks a while statement.
 func (tc *typeChecker) checkWhile(node *ast.WhileStmt) {
-	if node.Condition.Type().Tag != ast.TypeBool {
-		tc.error("The condition of a 'while' must be Boolean.")
+	if !anyInvalid(node.Condition.Type()) && node.Condition.Type().Tag != ast.TypeBool {
+		tc.error(diagnostic.CodeNonBoolCondition, "The condition of a 'while' must be Boolean.")
+	}
+}
+
+// checkAttributes type checks the attributes of a say statement or listen
+// expression (as told by keyword). Only values of the basic types can be passed
+// as attributes.
+func (tc *typeChecker) checkAttributes(keyword string, attrs []*ast.Attribute) {
+	for _, attr := range attrs {
+		switch attr.Type().Tag {
+		case ast.TypeInt, ast.TypeFloat, ast.TypeBNum, ast.TypeBool, ast.TypeString, ast.TypeInvalid:
+			break
+		default:
+			tc.error(diagnostic.CodeBadAttributeType, "Cannot '%v' attribute '%v' of type %v.", keyword, attr.Name, attr.Type())
+		}
 	}
 }
 
 // checkUnary type checks a unary operator.
 func (tc *typeChecker) checkUnary(node *ast.Unary) {
+	if anyInvalid(node.Operand.Type()) {
+		return
+	}
+
 	switch node.Operator {
 	case "not":
 		if node.Operand.Type().Tag != ast.TypeBool {
-			tc.error("Operator %v expects a bool operand; got a %v",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects a bool operand; got a %v",
 				node.Operator, node.Operand.Type())
 		}
 
 	case "-", "+":
 		if !node.Operand.Type().IsNumeric() {
-			tc.error("Operator %v expects a float operand; got a %v",
+			tc.error(diagnostic.CodeBadOperandType, "Operator %v expects a float operand; got a %v",
 				node.Operator, node.Operand.Type())
 		}
 	}
@@ -195,17 +239,21 @@ func (tc *typeChecker) checkUnary(node *ast.Unary) {
 
 // checkBlend type checks a blend operator.
 func (tc *typeChecker) checkBlend(node *ast.Blend) {
+	if anyInvalid(node.X.Type(), node.Y.Type(), node.Weight.Type()) {
+		return
+	}
+
 	if node.X.Type().Tag != ast.TypeBNum {
-		tc.error("The blend Operator expects bnum operands; got a %v as the first one",
+		tc.error(diagnostic.CodeBadOperandType, "The blend Operator expects bnum operands; got a %v as the first one",
 			node.X.Type())
 	}
 
 	if node.Y.Type().Tag != ast.TypeBNum {
-		tc.error("The blend Operator expects bnum operands; got a %v as the second one",
+		tc.error(diagnostic.CodeBadOperandType, "The blend Operator expects bnum operands; got a %v as the second one",
 			node.Y.Type())
 	}
 	if node.Weight.Type().Tag != ast.TypeBNum {
-		tc.error("The blend Operator expects bnum operands; got a %v as the third one",
+		tc.error(diagnostic.CodeBadOperandType, "The blend Operator expects bnum operands; got a %v as the third one",
 			node.Weight.Type())
 	}
 }
@@ -213,79 +261,145 @@ func (tc *typeChecker) checkBlend(node *ast.Blend) {
 // checkFunctionCall type checks a function call. As a bonus, it also checks the
 // arity.
 func (tc *typeChecker) checkFunctionCall(node *ast.FunctionCall) {
-	numArgs := len(node.Arguments)
-	numParams := len(node.FunctionType.ParameterTypes)
+	if node.FunctionType == nil {
+		return
+	}
+
+	if node.FunctionType.Tag == ast.TypePassage {
+		tc.error(diagnostic.CodeCallingPassage, "'%v' is a Passage; Passages cannot be called like functions.", node.Function.Name)
+		return
+	}
+
+	tc.checkArguments("Function", node.Function.Name, node.FunctionType.ParameterTypes, node.Arguments)
+}
+
+// checkGoto type checks a goto statement. Besides the usual checks on the
+// target Passage, checks if its return type is the same as the current
+// Passage's: the target Passage will return to whoever called the current
+// one, and the caller expects a certain return type.
+func (tc *typeChecker) checkGoto(node *ast.GotoStmt) {
+	if !tc.checkPassageTarget(node.Passage.Name, node.PassageType, node.Arguments) {
+		return
+	}
+
+	thisPassage, ok := tc.innermostFunctionOrPassageDecl().(*ast.PassageDecl)
+	if !ok {
+		return // Not inside a Passage; the semantic checker reported that.
+	}
+
+	// TODO: Will fail with function types. Need to implement a `TypesEqual()`
+	// function.
+	if node.PassageType.ReturnType != thisPassage.ReturnType {
+		tc.error(diagnostic.CodeGotoReturnTypeMismatch, "Cannot goto '%v' from '%v': return types differ (%v versus %v).",
+			node.Passage.Name, thisPassage.VersionedName(), node.PassageType.ReturnType,
+			thisPassage.ReturnType)
+	}
+}
+
+// checkPassageTarget type checks the target of a goto statement or gosub
+// expression. name is the target name and passageType is its type. Checks that
+// the target is really a Passage, and that the arguments args are OK. Returns
+// true if the target is indeed a Passage.
+func (tc *typeChecker) checkPassageTarget(name string, passageType *ast.Type, args []ast.Node) bool {
+	if anyInvalid(passageType) {
+		return false
+	}
+	if passageType == nil || passageType.Tag != ast.TypePassage {
+		tc.error(diagnostic.CodeNotAPassage, "'%v' is not a Passage.", name)
+		return false
+	}
+
+	tc.checkArguments("Passage", name, passageType.ParameterTypes, args)
+	return true
+}
+
+// checkArguments checks if the arguments args match the parameter types
+// paramTypes, both in number and in type. what and name describe the thing
+// being called (like "Function" and "foo"), used in error messages.
+func (tc *typeChecker) checkArguments(what, name string, paramTypes []*ast.Type, args []ast.Node) {
+	numArgs := len(args)
+	numParams := len(paramTypes)
 	if numArgs != numParams {
-		tc.error("Function '%v' expects %v arguments, but got %v.", node.Function.Name, numParams, numArgs)
+		tc.error(diagnostic.CodeWrongArgumentCount, "%v '%v' expects %v arguments, but got %v.", what, name, numParams, numArgs)
 		return
 	}
 
-	for i, paramType := range node.FunctionType.ParameterTypes {
+	for i, paramType := range paramTypes {
 		// TODO: Will fail with function types. Need to implement a
 		// `TypesEqual()` function.
-		argType := node.Arguments[i].Type()
-		if paramType != argType {
-			tc.error("Function '%v' expects a %v as argument %v, but got a %v.",
-				node.Function.Name, paramType, i+1, argType)
+		argType := args[i].Type()
+		if !anyInvalid(argType) && paramType != argType {
+			tc.error(diagnostic.CodeWrongArgumentType, "%v '%v' expects a %v as argument %v, but got a %v.",
+				what, name, paramType, i+1, argType)
 		}
 	}
 }
 
 // checkReturnStmt type checks a return statement.
 func (tc *typeChecker) checkReturnStmt(node *ast.ReturnStmt) {
-	thisFunc := tc.innermostFunctionDecl()
-	funcName := thisFunc.Name
-	funcType := thisFunc.ReturnType
+	var what, name string
+	var funcType *ast.Type
+
+	switch n := tc.innermostFunctionOrPassageDecl().(type) {
+	case *ast.FunctionDecl:
+		what, name, funcType = "Function", n.Name, n.ReturnType
+	case *ast.PassageDecl:
+		what, name, funcType = "Passage", n.VersionedName(), n.ReturnType
+	}
 
 	if node.ReturnValue == nil {
-		if thisFunc.ReturnType.Tag != ast.TypeVoid {
-			tc.error("Function '%v' expects a return value of type  %v.", funcName, funcType)
+		if funcType.Tag != ast.TypeVoid {
+			tc.error(diagnostic.CodeWrongReturnType, "%v '%v' expects a return value of type  %v.", what, name, funcType)
 		}
 		return
 	}
 
 	returnType := node.ReturnValue.Type()
 
-	if returnType != funcType {
-		tc.error("Function '%v' expects a return value of type %v, got a %v.",
-			funcName, funcType, returnType)
+	if !anyInvalid(returnType) && returnType != funcType {
+		tc.error(diagnostic.CodeWrongReturnType, "%v '%v' expects a return value of type %v, got a %v.",
+			what, name, funcType, returnType)
 	}
 }
 
 // checkTypeConversion type checks type conversion operator.
 func (tc *typeChecker) checkTypeConversion(node *ast.TypeConversion) {
+	if anyInvalid(node.Value.Type(), node.Default.Type()) {
+		return
+	}
+
 	switch node.Operator {
 	case "int":
 		if node.Value.Type().Tag == ast.TypeBNum {
-			tc.error("Cannot convert a bnum to an int")
+			tc.error(diagnostic.CodeBadConversion, "Cannot convert a bnum to an int")
 		}
 
 		if node.Default.Type().Tag != ast.TypeInt {
-			tc.error("The default value for a conversion to int must be an int; got a %v",
+			tc.error(diagnostic.CodeBadConversion, "The default value for a conversion to int must be an int; got a %v",
 				node.Default.Type())
 		}
 	case "float":
 		if node.Default.Type().Tag != ast.TypeFloat {
-			tc.error("The default value for a conversion to float must be a float; got a %v",
+			tc.error(diagnostic.CodeBadConversion, "The default value for a conversion to float must be a float; got a %v",
 				node.Default.Type())
 		}
 	case "bnum":
 		if node.Value.Type().Tag == ast.TypeBool {
-			tc.error("Cannot convert a bool to a bnum")
+			tc.error(diagnostic.CodeBadConversion, "Cannot convert a bool to a bnum")
 		}
 
 		if node.Value.Type().Tag == ast.TypeInt {
-			tc.error("Cannot convert an int to a bnum")
+			tc.error(diagnostic.CodeBadConversion, "Cannot convert an int to a bnum")
 		}
 
 		if node.Default.Type().Tag != ast.TypeBNum {
-			tc.error("The default value for a conversion to bnum must be a bnum; got a %v",
+			tc.error(diagnostic.CodeBadConversion, "The default value for a conversion to bnum must be a bnum; got a %v",
 				node.Default.Type())
 		}
 
 	case "string":
 		if node.Default.Type().Tag != ast.TypeString {
-			tc.error("The default value for a conversion to string must be a string; got a %v",
+			tc.error(diagnostic.CodeBadConversion, "The default value for a conversion to string must be a string; got a %v",
 				node.Default.Type())
 		}
 	}
@@ -294,35 +408,47 @@ func (tc *typeChecker) checkTypeConversion(node *ast.TypeConversion) {
 // checkVarType type checks a variable declaration.
 func (tc *typeChecker) checkVarType(node *ast.VarDecl) {
 	if node.Type().Tag == ast.TypeVoid {
-		tc.error("Cannot create a variable of type 'void'.")
+		tc.error(diagnostic.CodeVoidVariable, "Cannot create a variable of type 'void'.")
 		return
 	}
-	if node.Type().Tag != node.Initializer.Type().Tag {
-		tc.error("Cannot initialize variable of type '%v' with a value of type '%v'.",
+	if !anyInvalid(node.Initializer.Type()) && node.Type().Tag != node.Initializer.Type().Tag {
+		tc.error(diagnostic.CodeTypeMismatch, "Cannot initialize variable of type '%v' with a value of type '%v'.",
 			node.Type(),
 			node.Initializer.Type())
 	}
 }
 
-// innermostFunctionDecl returns the innermost function declaration we are
-// currently in.
-func (tc *typeChecker) innermostFunctionDecl() *ast.FunctionDecl {
+// innermostFunctionOrPassageDecl returns the innermost function or Passage
+// declaration we are currently in.
+func (tc *typeChecker) innermostFunctionOrPassageDecl() ast.Node {
 	for i := len(tc.nodeStack) - 1; i >= 0; i-- {
-		if functionDecl, ok := tc.nodeStack[i].(*ast.FunctionDecl); ok {
-			return functionDecl
+		switch n := tc.nodeStack[i].(type) {
+		case *ast.FunctionDecl, *ast.PassageDecl:
+			return n
 		}
 	}
 	return nil // Can't happen
 }
 
-// error reports an error.
-func (tc *typeChecker) error(format string, a ...interface{}) {
-	tc.errors = append(tc.errors,
-		fmt.Sprintf("[line %v]: %v", tc.currentLine(), fmt.Sprintf(format, a...)))
+// error reports an error with a given code.
+func (tc *typeChecker) error(code diagnostic.Code, format string, a ...interface{}) {
+	tc.errors = append(tc.errors, newError(code, tc.currentSpan(), format, a...))
+}
+
+// currentSpan returns the region of the source code corresponding to whatever
+// we are currently analyzing.
+func (tc *typeChecker) currentSpan() ast.Span {
+	return tc.nodeStack[len(tc.nodeStack)-1].Span()
 }
 
-// currentLine returns the source code line corresponding to whatever we are
-// currently analyzing.
-func (tc *typeChecker) currentLine() int {
-	return tc.nodeStack[len(tc.nodeStack)-1].Line()
+// anyInvalid checks if any of types is invalid. Invalid types come from names
+// that could not be resolved, which were already reported as errors. Type
+// errors involving them would be just noise, so we don't report them.
+func anyInvalid(types ...*ast.Type) bool {
+	for _, t := range types {
+		if t == nil || t.Tag == ast.TypeInvalid {
+			return true
+		}
+	}
+	return false
 }
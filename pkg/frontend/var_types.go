@@ -8,35 +8,61 @@
 package frontend
 
 import (
-	"fmt"
-
 	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
-// extractGlobalTypes extract the types of all globally-declared variable in the
-// sw Storyworld.
+// GlobalTypes returns the types of all globally-declared names in the sw
+// Storyworld. They are indexed by their GlobalKeys, so that private names
+// declared in different files are kept apart.
 //
 // We need to do this on a separate step because the globals block can appear
-// after the code that uses it.
-func extractGlobalTypes(sw *ast.Storyworld) map[string]*ast.Type {
-	types := map[string]*ast.Type{}
+// after the code that uses it. Only the latest version of the globals block is
+// considered, as it contains all the global variables. Each variable belongs to
+// the file where it was introduced, though, which may be the file of an older
+// globals block.
+//
+// Passages are referred to by their names, without the version. The name
+// always refers to the latest version of the Passage, so this is the one whose
+// type we use.
+func GlobalTypes(sw *ast.Storyworld) map[ast.GlobalKey]*ast.Type {
+	types := map[ast.GlobalKey]*ast.Type{}
+	if g := sw.LatestGlobalsBlock(); g != nil {
+		files := sw.GlobalVarsFiles()
+		for _, v := range g.Vars {
+			types[ast.NewGlobalKey(v.Name, files[v.Name])] = v.Type()
+		}
+	}
+
+	passageVersions := map[ast.GlobalKey]int{}
 	for _, decl := range sw.Declarations {
 		switch n := decl.(type) {
-		case *ast.GlobalsBlock:
-			for _, v := range n.Vars {
-				types[v.Name] = v.Type()
-			}
-
 		case *ast.FunctionDecl:
 			paramTypes := []*ast.Type{}
 			for _, t := range n.Parameters {
 				paramTypes = append(paramTypes, t.Type)
 			}
-			types[n.Name] = &ast.Type{
+			types[ast.NewGlobalKey(n.Name, n.Span().Start.File)] = &ast.Type{
 				Tag:            ast.TypeFunction,
 				ReturnType:     n.ReturnType,
 				ParameterTypes: paramTypes,
 			}
+
+		case *ast.PassageDecl:
+			key := ast.NewGlobalKey(n.Name, n.Span().Start.File)
+			if n.Version < passageVersions[key] {
+				break
+			}
+			passageVersions[key] = n.Version
+			paramTypes := []*ast.Type{}
+			for _, t := range n.Parameters {
+				paramTypes = append(paramTypes, t.Type)
+			}
+			types[key] = &ast.Type{
+				Tag:            ast.TypePassage,
+				ReturnType:     n.ReturnType,
+				ParameterTypes: paramTypes,
+			}
 		}
 	}
 	return types
@@ -58,15 +84,19 @@ type local struct {
 // VarRef, FunctionCall and Assignment.
 type variableTypeSetter struct {
 	// errors collects all type errors detected.
-	errors []string
+	errors diagnostic.List
 
 	// nodeStack is used to keep track of the nodes being processed. The current
 	// one is on the top.
 	nodeStack []ast.Node
 
-	// globalTypes maps global variables names to their types. Must be set
+	// globalTypes maps the keys of global variables to their types. Must be
+	// set before using the visitor.
+	globalTypes map[ast.GlobalKey]*ast.Type
+
+	// nativeTypes maps native function names to their types. Must be set
 	// before using the visitor.
-	globalTypes map[string]*ast.Type
+	nativeTypes map[string]*ast.Type
 
 	// localTypes contains all local variables currently in scope. The visitor
 	// keeps this up-to-date as it traverses the parse tree.
@@ -75,6 +105,13 @@ type variableTypeSetter struct {
 	// inGlobals tells if we are we inside a globals block.
 	inGlobals bool
 
+	// inMeta tells if we are we inside a meta block.
+	inMeta bool
+
+	// metaTypes maps the names of the meta variables of the Passage we are
+	// currently in to their types.
+	metaTypes map[string]*ast.Type
+
 	// scopeDepth tells our current scope depth (AKA levels of nesting).
 	scopeDepth int
 }
@@ -93,13 +130,30 @@ func (ts *variableTypeSetter) Enter(node ast.Node) {
 	case *ast.FunctionCall:
 		// FIXME: Using n.Function.Name for the function name is wrong: what if
 		// we assign the function to a variable with a different name?
-		n.FunctionType = ts.globalTypes[n.Function.Name]
+		n.FunctionType = ts.globalTypes[ast.NewGlobalKey(n.Function.Name, ts.currentSpan().Start.File)]
+
+	case *ast.NativeCall:
+		n.FunctionType = ts.nativeTypes[n.Function]
+		if n.FunctionType == nil {
+			ts.error(diagnostic.CodeUnknownNativeFunction, "Unknown native function '%v'.", n.Function)
+		}
 
 	case *ast.FunctionDecl:
 		for _, param := range n.Parameters {
 			ts.localTypes = append(ts.localTypes, local{name: param.Name, depth: ts.scopeDepth, varType: param.Type})
 		}
 
+	case *ast.PassageDecl:
+		for _, param := range n.Parameters {
+			ts.localTypes = append(ts.localTypes, local{name: param.Name, depth: ts.scopeDepth, varType: param.Type})
+		}
+		ts.metaTypes = map[string]*ast.Type{}
+		if n.Meta != nil {
+			for _, v := range n.Meta.Vars {
+				ts.metaTypes[v.Name] = v.Type()
+			}
+		}
+
 	case *ast.Assignment:
 		n.VarType = ts.resolveType(n.VarName)
 
@@ -109,8 +163,11 @@ func (ts *variableTypeSetter) Enter(node ast.Node) {
 	case *ast.GlobalsBlock:
 		ts.inGlobals = true
 
+	case *ast.MetaBlock:
+		ts.inMeta = true
+
 	case *ast.VarDecl:
-		if ts.inGlobals {
+		if ts.inGlobals || ts.inMeta {
 			break
 		}
 		ts.localTypes = append(ts.localTypes, local{name: n.Name, depth: ts.scopeDepth, varType: n.Type()})
@@ -118,10 +175,29 @@ func (ts *variableTypeSetter) Enter(node ast.Node) {
 }
 
 func (ts *variableTypeSetter) Leave(node ast.Node) {
-	switch node.(type) {
+	switch n := node.(type) {
 	case *ast.GlobalsBlock:
 		ts.inGlobals = false
 
+	case *ast.MetaBlock:
+		ts.inMeta = false
+
+	case *ast.GotoStmt:
+		// The Passage VarRef was already visited, so it knows its type.
+		n.PassageType = n.Passage.VarType
+
+	case *ast.GosubExpr:
+		n.PassageType = n.Passage.VarType
+
+	case *ast.FunctionDecl:
+		// Parameters are declared at the same scope depth as the function
+		// itself, so they are not removed when leaving the body block.
+		ts.localTypes = ts.localTypes[:0]
+
+	case *ast.PassageDecl:
+		ts.localTypes = ts.localTypes[:0]
+		ts.metaTypes = nil
+
 	case *ast.Block:
 		for i, lv := range ts.localTypes {
 			if lv.depth == ts.scopeDepth {
@@ -138,16 +214,15 @@ func (ts *variableTypeSetter) Leave(node ast.Node) {
 func (ts *variableTypeSetter) Event(node ast.Node, event int) {
 }
 
-// error reports an error.
-func (ts *variableTypeSetter) error(format string, a ...interface{}) {
-	ts.errors = append(ts.errors,
-		fmt.Sprintf("[line %v]: %v", ts.currentLine(), fmt.Sprintf(format, a...)))
+// error reports an error with a given code.
+func (ts *variableTypeSetter) error(code diagnostic.Code, format string, a ...interface{}) {
+	ts.errors = append(ts.errors, newError(code, ts.currentSpan(), format, a...))
 }
 
-// currentLine returns the source code line corresponding to whatever we are
-// currently analyzing.
-func (ts *variableTypeSetter) currentLine() int {
-	return ts.nodeStack[len(ts.nodeStack)-1].Line()
+// currentSpan returns the region of the source code corresponding to whatever
+// we are currently analyzing.
+func (ts *variableTypeSetter) currentSpan() ast.Span {
+	return ts.nodeStack[len(ts.nodeStack)-1].Span()
 }
 
 // resolveLocal returns the index into ts.localTypes of the local variable
@@ -162,18 +237,39 @@ func (ts *variableTypeSetter) resolveLocal(name string) int {
 }
 
 // resolveType returns the type associated with name in the current scope. If not
-// found, returns nil.
+// found (or not visible from here), reports an error and returns the invalid
+// type. Local variables are looked up first, then the meta variables of the
+// current Passage, then the global variables.
 func (ts *variableTypeSetter) resolveType(name string) *ast.Type {
 	localIndex := ts.resolveLocal(name)
 	if localIndex < 0 {
-		t, ok := ts.globalTypes[name]
-		if !ok {
-			ts.error("Undeclared name '%v'.", name)
-			return nil
+		if t, ok := ts.metaTypes[name]; ok {
+			return t
 		}
-		return t
+		if t, ok := ts.globalTypes[ast.NewGlobalKey(name, ts.currentSpan().Start.File)]; ok {
+			return t
+		}
+		if file := ts.privateFile(name); file != "" {
+			ts.error(diagnostic.CodeNotVisible, "'%v' is private to file '%v'. Only names starting with an upper case letter are visible in other files.", name, file)
+			return ast.TheTypeInvalid
+		}
+		ts.error(diagnostic.CodeUndeclaredName, "Undeclared name '%v'.", name)
+		return ast.TheTypeInvalid
 	} else {
 		t := ts.localTypes[localIndex].varType
 		return t
 	}
 }
+
+// privateFile returns the name of a file declaring a private global named name.
+// If more than one file does, returns the first one in alphabetical order. If
+// none does, returns an empty string.
+func (ts *variableTypeSetter) privateFile(name string) string {
+	file := ""
+	for key := range ts.globalTypes {
+		if key.Name == name && key.File != "" && (file == "" || key.File < file) {
+			file = key.File
+		}
+	}
+	return file
+}
@@ -0,0 +1,13 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The lsp package implements a Language Server Protocol server for the
+// Romualdo Language, providing editors with diagnostics, go-to-definition,
+// find-references, hover and code completion. All the language knowledge comes
+// from the frontend package; this package just exposes it through the
+// protocol.
+package lsp
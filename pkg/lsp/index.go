@@ -0,0 +1,372 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+)
+
+// symbolKind identifies the kind of thing a symbol is.
+type symbolKind int
+
+const (
+	symbolKindGlobal symbolKind = iota
+	symbolKindFunction
+	symbolKindPassage
+	symbolKindParameter
+	symbolKindMeta
+	symbolKindLocal
+)
+
+// String converts the symbolKind to the string used when describing symbols
+// to the user.
+func (k symbolKind) String() string {
+	switch k {
+	case symbolKindGlobal:
+		return "global"
+	case symbolKindFunction:
+		return "function"
+	case symbolKindPassage:
+		return "passage"
+	case symbolKindParameter:
+		return "parameter"
+	case symbolKindMeta:
+		return "meta"
+	case symbolKindLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
+// symbol is something declared in a Storyworld and that can be referred to by
+// its name: a global variable, a function, a Passage, a parameter, a meta
+// variable or a local variable.
+type symbol struct {
+	// name is the symbol name.
+	name string
+
+	// kind is the kind of symbol.
+	kind symbolKind
+
+	// declaration is the span of the name in the declaration of the symbol.
+	// For Passages, this is the declaration of the latest version; for
+	// global variables, the declaration in the latest globals block.
+	declaration ast.Span
+
+	// symbolType is the type of the symbol.
+	symbolType *ast.Type
+}
+
+// occurrence is an occurrence of a symbol name in the source code.
+type occurrence struct {
+	// span is the span of the name.
+	span ast.Span
+
+	// symbol is the symbol the name refers to.
+	symbol *symbol
+
+	// isDeclaration tells if this occurrence is in a declaration of the symbol
+	// (as opposed to a use of it). Passages and global variables can be
+	// declared multiple times, once in each version.
+	isDeclaration bool
+}
+
+// scope is a region of the source code in which some local symbols are
+// visible.
+type scope struct {
+	// span is the region of the source code covered by the scope.
+	span ast.Span
+
+	// symbols contains the symbols declared in the scope, in the order they
+	// were declared.
+	symbols []*symbol
+}
+
+// index contains information about all symbols in a Storyworld and the places
+// they are used. It is created by walking the AST, and is what allows the
+// server to answer questions like "where is this declared?"
+type index struct {
+	// globals maps the keys of all global symbols (global variables,
+	// functions and Passages) to the symbols themselves.
+	globals map[ast.GlobalKey]*symbol
+
+	// occurrences contains all the occurrences of symbols names, declarations
+	// included, in no particular order.
+	occurrences []*occurrence
+
+	// scopes contains all local scopes in the Storyworld.
+	scopes []*scope
+}
+
+// newIndex creates the index for the Storyworld whose AST is root.
+func newIndex(root ast.Node) *index {
+	idx := &index{
+		globals: map[ast.GlobalKey]*symbol{},
+	}
+
+	sw, ok := root.(*ast.Storyworld)
+	if !ok {
+		return idx
+	}
+
+	idx.addGlobals(sw)
+	sw.Walk(&indexer{index: idx, globalVarsFiles: sw.GlobalVarsFiles()})
+
+	return idx
+}
+
+// addGlobals adds the global symbols of sw to the index.
+func (idx *index) addGlobals(sw *ast.Storyworld) {
+	if g := sw.LatestGlobalsBlock(); g != nil {
+		globalVarsFiles := sw.GlobalVarsFiles()
+		for _, v := range g.Vars {
+			idx.globals[ast.NewGlobalKey(v.Name, globalVarsFiles[v.Name])] = &symbol{
+				name:        v.Name,
+				kind:        symbolKindGlobal,
+				declaration: v.NameSpan,
+				symbolType:  v.Type(),
+			}
+		}
+	}
+
+	passageVersions := map[ast.GlobalKey]int{}
+	for _, decl := range sw.Declarations {
+		switch n := decl.(type) {
+		case *ast.FunctionDecl:
+			idx.globals[ast.NewGlobalKey(n.Name, n.NameSpan.Start.File)] = &symbol{
+				name:        n.Name,
+				kind:        symbolKindFunction,
+				declaration: n.NameSpan,
+				symbolType:  callableType(ast.TypeFunction, n.Parameters, n.ReturnType),
+			}
+
+		case *ast.PassageDecl:
+			key := ast.NewGlobalKey(n.Name, n.NameSpan.Start.File)
+			if n.Version < passageVersions[key] {
+				break
+			}
+			passageVersions[key] = n.Version
+			idx.globals[key] = &symbol{
+				name:        n.Name,
+				kind:        symbolKindPassage,
+				declaration: n.NameSpan,
+				symbolType:  callableType(ast.TypePassage, n.Parameters, n.ReturnType),
+			}
+		}
+	}
+}
+
+// callableType returns the type of a function or Passage (depending on tag)
+// with the given parameters and return type.
+func callableType(tag ast.TypeTag, params []ast.Parameter, returnType *ast.Type) *ast.Type {
+	paramTypes := []*ast.Type{}
+	for _, param := range params {
+		paramTypes = append(paramTypes, param.Type)
+	}
+	return &ast.Type{
+		Tag:            tag,
+		ReturnType:     returnType,
+		ParameterTypes: paramTypes,
+	}
+}
+
+// occurrenceAt returns the occurrence of a symbol name at the position pos, or
+// nil if there is none.
+func (idx *index) occurrenceAt(pos ast.Position) *occurrence {
+	for _, occ := range idx.occurrences {
+		if spanContains(occ.span, pos) {
+			return occ
+		}
+	}
+	return nil
+}
+
+// occurrencesOf returns all occurrences of sym.
+func (idx *index) occurrencesOf(sym *symbol) []*occurrence {
+	result := []*occurrence{}
+	for _, occ := range idx.occurrences {
+		if occ.symbol == sym {
+			result = append(result, occ)
+		}
+	}
+	return result
+}
+
+// visibleAt returns all symbols visible at the position pos: the local ones
+// whose scope contains pos and which were declared before it, plus the global
+// ones visible from the file of pos.
+func (idx *index) visibleAt(pos ast.Position) []*symbol {
+	result := []*symbol{}
+	for _, s := range idx.scopes {
+		if !spanContains(s.span, pos) {
+			continue
+		}
+		for _, sym := range s.symbols {
+			if !positionBefore(pos, sym.declaration.End) {
+				result = append(result, sym)
+			}
+		}
+	}
+
+	for key, sym := range idx.globals {
+		if key.File == "" || key.File == pos.File {
+			result = append(result, sym)
+		}
+	}
+
+	return result
+}
+
+// spanContains checks if pos is inside span. The position just past the end
+// of the span counts as inside, so that the cursor right after a name still
+// refers to that name.
+func spanContains(span ast.Span, pos ast.Position) bool {
+	if span.Start.File != pos.File {
+		return false
+	}
+	return !positionBefore(pos, span.Start) && !positionBefore(span.End, pos)
+}
+
+// positionBefore checks if a comes before b. Both must be in the same file.
+func positionBefore(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// indexer is a node visitor that fills in an index with the occurrences of
+// symbols and the local scopes.
+type indexer struct {
+	// index is the index being filled.
+	index *index
+
+	// scopes is the stack of scopes we are currently in. The innermost scope
+	// is on the top.
+	scopes []*scope
+
+	// inGlobals tells if we are inside a globals block.
+	inGlobals bool
+
+	// inMeta tells if we are inside a meta block.
+	inMeta bool
+
+	// globalVarsFiles maps the names of the global variables to the files
+	// where they were declared (see ast.Storyworld.GlobalVarsFiles).
+	globalVarsFiles map[string]string
+}
+
+func (ix *indexer) Enter(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.GlobalsBlock:
+		ix.inGlobals = true
+
+	case *ast.MetaBlock:
+		ix.inMeta = true
+
+	case *ast.FunctionDecl:
+		ix.addOccurrence(n.NameSpan, ix.index.globals[ast.NewGlobalKey(n.Name, n.NameSpan.Start.File)], true)
+		ix.pushScope(n.Span())
+		ix.declareParameters(n.Parameters)
+
+	case *ast.PassageDecl:
+		ix.addOccurrence(n.NameSpan, ix.index.globals[ast.NewGlobalKey(n.Name, n.NameSpan.Start.File)], true)
+		ix.pushScope(n.Span())
+		ix.declareParameters(n.Parameters)
+
+	case *ast.Block:
+		ix.pushScope(n.Span())
+
+	case *ast.VarDecl:
+		switch {
+		case ix.inGlobals:
+			key := ast.NewGlobalKey(n.Name, ix.globalVarsFiles[n.Name])
+			ix.addOccurrence(n.NameSpan, ix.index.globals[key], true)
+		case ix.inMeta:
+			ix.declare(n.Name, symbolKindMeta, n.NameSpan, n.Type())
+		default:
+			ix.declare(n.Name, symbolKindLocal, n.NameSpan, n.Type())
+		}
+
+	case *ast.VarRef:
+		ix.addOccurrence(n.Span(), ix.resolve(n.Name, n.Span().Start.File), false)
+
+	case *ast.Assignment:
+		ix.addOccurrence(n.NameSpan, ix.resolve(n.VarName, n.NameSpan.Start.File), false)
+	}
+}
+
+func (ix *indexer) Leave(node ast.Node) {
+	switch node.(type) {
+	case *ast.GlobalsBlock:
+		ix.inGlobals = false
+
+	case *ast.MetaBlock:
+		ix.inMeta = false
+
+	case *ast.FunctionDecl, *ast.PassageDecl, *ast.Block:
+		ix.scopes = ix.scopes[:len(ix.scopes)-1]
+	}
+}
+
+func (ix *indexer) Event(node ast.Node, event int) {
+}
+
+// pushScope starts a new scope covering span.
+func (ix *indexer) pushScope(span ast.Span) {
+	s := &scope{span: span}
+	ix.scopes = append(ix.scopes, s)
+	ix.index.scopes = append(ix.index.scopes, s)
+}
+
+// declareParameters declares the parameters params in the current scope.
+func (ix *indexer) declareParameters(params []ast.Parameter) {
+	for _, param := range params {
+		ix.declare(param.Name, symbolKindParameter, param.NameSpan, param.Type)
+	}
+}
+
+// declare declares a local symbol in the current scope.
+func (ix *indexer) declare(name string, kind symbolKind, span ast.Span, symbolType *ast.Type) {
+	sym := &symbol{
+		name:        name,
+		kind:        kind,
+		declaration: span,
+		symbolType:  symbolType,
+	}
+	s := ix.scopes[len(ix.scopes)-1]
+	s.symbols = append(s.symbols, sym)
+	ix.addOccurrence(span, sym, true)
+}
+
+// resolve returns the symbol a name used in the file named file refers to, or
+// nil if it cannot be resolved. Inner scopes are looked up first, and the
+// latest declarations in each scope win, just like in the compiler.
+func (ix *indexer) resolve(name, file string) *symbol {
+	for i := len(ix.scopes) - 1; i >= 0; i-- {
+		symbols := ix.scopes[i].symbols
+		for j := len(symbols) - 1; j >= 0; j-- {
+			if symbols[j].name == name {
+				return symbols[j]
+			}
+		}
+	}
+
+	return ix.index.globals[ast.NewGlobalKey(name, file)]
+}
+
+// addOccurrence records an occurrence of sym at span. Does nothing if sym is
+// nil, which happens for names that cannot be resolved.
+func (ix *indexer) addOccurrence(span ast.Span, sym *symbol, isDeclaration bool) {
+	if sym == nil {
+		return
+	}
+	ix.index.occurrences = append(ix.index.occurrences, &occurrence{
+		span:          span,
+		symbol:        sym,
+		isDeclaration: isDeclaration,
+	})
+}
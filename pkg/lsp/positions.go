@@ -0,0 +1,105 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+)
+
+// The compiler and the protocol disagree on pretty much everything about
+// positions: the compiler uses 1-based lines and columns counted in runes,
+// while the protocol uses 0-based lines and characters counted in UTF-16 code
+// units. And the compiler identifies files by their paths, while the protocol
+// uses URIs. The functions here convert between the two worlds.
+
+// uriToFileName converts a document URI to the file name used by the
+// compiler. For "file" URIs, this is the file path; other URIs (like those of
+// unsaved documents) are used as file names as they are.
+func uriToFileName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// fileNameToURI converts a file name used by the compiler to a document URI.
+// This is the inverse of uriToFileName.
+func fileNameToURI(fileName string) string {
+	if !filepath.IsAbs(fileName) {
+		return fileName
+	}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(fileName)}
+	return u.String()
+}
+
+// sourceLine returns line number n (1-based) from source, without the line
+// terminator. Returns an empty string if there is no such line.
+func sourceLine(source string, n int) string {
+	lines := strings.Split(source, "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[n-1], "\r")
+}
+
+// toProtocolPosition converts pos, a position in source, to a protocol
+// Position.
+func toProtocolPosition(source string, pos ast.Position) Position {
+	line := sourceLine(source, pos.Line)
+	character := 0
+	for i := 1; i < pos.Column; i++ {
+		r, size := utf8.DecodeRuneInString(line)
+		if size == 0 {
+			// Past the end of the line. Can happen with positions just past
+			// the last character.
+			character++
+			continue
+		}
+		line = line[size:]
+		character += utf16Len(r)
+	}
+
+	return Position{Line: pos.Line - 1, Character: character}
+}
+
+// toProtocolRange converts span, a region of source, to a protocol Range.
+func toProtocolRange(source string, span ast.Span) Range {
+	return Range{
+		Start: toProtocolPosition(source, span.Start),
+		End:   toProtocolPosition(source, span.End),
+	}
+}
+
+// fromProtocolPosition converts pos, a protocol Position in source (the
+// contents of the file named fileName), to a compiler position. The Offset of
+// the returned position is not set.
+func fromProtocolPosition(source, fileName string, pos Position) ast.Position {
+	line := sourceLine(source, pos.Line+1)
+	column := 1
+	for character := 0; character < pos.Character && line != ""; column++ {
+		r, size := utf8.DecodeRuneInString(line)
+		line = line[size:]
+		character += utf16Len(r)
+	}
+
+	return ast.Position{File: fileName, Line: pos.Line + 1, Column: column}
+}
+
+// utf16Len returns the number of UTF-16 code units needed to encode r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
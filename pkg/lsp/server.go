@@ -0,0 +1,580 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+// errorCodeServerNotInitialized is the LSP-specific error code used when
+// getting a request before the initialize request.
+const errorCodeServerNotInitialized = -32002
+
+// serverName is the server name reported to the client.
+const serverName = "romualdo-lsp"
+
+// Server is a Language Server Protocol server for the Romualdo Language. It
+// reads requests and notifications from an io.Reader and writes responses and
+// notifications to an io.Writer (typically, the standard input and output).
+//
+// The server sees the whole workspace as a single Storyworld: all source files
+// found under the workspace root are loaded when the server is initialized,
+// and the documents open in the editor take precedence over the files on disk.
+// Every change is followed by a full analysis of the Storyworld.
+type Server struct {
+	// Natives are the native functions the Storyworlds can call. Set this
+	// before calling Run() if the program that will run the Storyworlds
+	// provides any; otherwise, calls to native functions are reported as
+	// errors.
+	Natives []*ast.NativeFunction
+
+	// in is where requests and notifications come from.
+	in *bufio.Reader
+
+	// out is where responses and notifications go.
+	out io.Writer
+
+	// initialized tells if the initialize request was already received.
+	initialized bool
+
+	// shutdown tells if the shutdown request was already received.
+	shutdown bool
+
+	// rootDir is the workspace root directory. Empty if there is no workspace.
+	rootDir string
+
+	// files maps the names of all files in the Storyworld to their contents.
+	files map[string]string
+
+	// diagnostics contains the diagnostics found by the latest analysis.
+	diagnostics diagnostic.List
+
+	// diagnosticsPending tells if the diagnostics changed since they were last
+	// published.
+	diagnosticsPending bool
+
+	// published contains the names of the files for which we published
+	// diagnostics.
+	published map[string]bool
+
+	// root is the AST of the Storyworld, as of the latest analysis.
+	root ast.Node
+
+	// index is the symbol index of the Storyworld, as of the latest analysis.
+	index *index
+}
+
+// NewServer creates a new Server that reads from in and writes to out.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		files:     map[string]string{},
+		published: map[string]bool{},
+		index:     newIndex(nil),
+	}
+}
+
+// Run runs the server until the client asks it to exit or closes the
+// connection. Returns nil if the server was properly shut down (that is, if
+// the client sent a shutdown request before exiting), or an error otherwise.
+func (s *Server) Run() error {
+	for {
+		data, err := readMessage(s.in)
+		if err == io.EOF {
+			if s.shutdown {
+				return nil
+			}
+			return errors.New("connection closed without a shutdown request")
+		}
+		if err != nil {
+			return err
+		}
+
+		req := &request{}
+		if err := json.Unmarshal(data, req); err != nil {
+			if err := s.respond(nil, nil, &responseError{errorCodeParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if req.Method == "exit" {
+			if s.shutdown {
+				return nil
+			}
+			return errors.New("exit without a shutdown request")
+		}
+
+		if err := s.handle(req); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles a single request or notification. Errors in the request
+// itself are reported to the client; the returned error is for errors
+// communicating with it. If the request caused a new analysis, the new
+// diagnostics are published after the response.
+func (s *Server) handle(req *request) error {
+	if req.isNotification() {
+		if s.initialized && !s.shutdown {
+			s.handleNotification(req)
+		}
+		return s.publishDiagnostics()
+	}
+
+	var result interface{}
+	var respErr *responseError
+
+	switch {
+	case !s.initialized && req.Method != "initialize":
+		respErr = &responseError{errorCodeServerNotInitialized, "server not initialized"}
+	case s.shutdown:
+		respErr = &responseError{errorCodeInvalidRequest, "server is shutting down"}
+	default:
+		result, respErr = s.handleRequest(req)
+	}
+
+	if err := s.respond(req.ID, result, respErr); err != nil {
+		return err
+	}
+	return s.publishDiagnostics()
+}
+
+// handleRequest handles a request, returning either the result or an error.
+func (s *Server) handleRequest(req *request) (interface{}, *responseError) {
+	switch req.Method {
+	case "initialize":
+		params := &InitializeParams{}
+		if err := decodeParams(req, params); err != nil {
+			return nil, err
+		}
+		return s.initialize(params), nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/definition":
+		params := &TextDocumentPositionParams{}
+		if err := decodeParams(req, params); err != nil {
+			return nil, err
+		}
+		return s.definition(params), nil
+
+	case "textDocument/references":
+		params := &ReferenceParams{}
+		if err := decodeParams(req, params); err != nil {
+			return nil, err
+		}
+		return s.references(params), nil
+
+	case "textDocument/hover":
+		params := &TextDocumentPositionParams{}
+		if err := decodeParams(req, params); err != nil {
+			return nil, err
+		}
+		return s.hover(params), nil
+
+	case "textDocument/completion":
+		params := &TextDocumentPositionParams{}
+		if err := decodeParams(req, params); err != nil {
+			return nil, err
+		}
+		return s.completion(params), nil
+
+	default:
+		return nil, &responseError{errorCodeMethodNotFound, fmt.Sprintf("method not supported: %v", req.Method)}
+	}
+}
+
+// handleNotification handles a notification. Unknown notifications and
+// notifications with invalid parameters are ignored, as the protocol says.
+func (s *Server) handleNotification(req *request) {
+	switch req.Method {
+	case "textDocument/didOpen":
+		params := &DidOpenTextDocumentParams{}
+		if decodeParams(req, params) != nil {
+			return
+		}
+		fileName := uriToFileName(params.TextDocument.URI)
+		s.files[fileName] = params.TextDocument.Text
+		s.analyze()
+
+	case "textDocument/didChange":
+		params := &DidChangeTextDocumentParams{}
+		if decodeParams(req, params) != nil || len(params.ContentChanges) == 0 {
+			return
+		}
+		fileName := uriToFileName(params.TextDocument.URI)
+		s.files[fileName] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		s.analyze()
+
+	case "textDocument/didClose":
+		params := &DidCloseTextDocumentParams{}
+		if decodeParams(req, params) != nil {
+			return
+		}
+		fileName := uriToFileName(params.TextDocument.URI)
+		s.reloadFile(fileName)
+		s.analyze()
+	}
+}
+
+// decodeParams decodes the parameters of req into params.
+func decodeParams(req *request, params interface{}) *responseError {
+	if len(req.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return &responseError{errorCodeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// respond sends a response to the request with the given ID.
+func (s *Server) respond(id *json.RawMessage, result interface{}, respErr *responseError) error {
+	resp := &response{JSONRPC: "2.0", ID: id}
+	if respErr != nil {
+		resp.Error = respErr
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		raw := json.RawMessage(data)
+		resp.Result = &raw
+	}
+	return writeMessage(s.out, resp)
+}
+
+// notify sends a notification to the client.
+func (s *Server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, &notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+//
+// Workspace management and analysis
+//
+
+// initialize initializes the server, loading all source files found in the
+// workspace root (if any).
+func (s *Server) initialize(params *InitializeParams) *InitializeResult {
+	s.initialized = true
+
+	if params.RootURI != "" {
+		s.rootDir = uriToFileName(params.RootURI)
+		fs := frontend.NewFileSet()
+		// No source files in the workspace is fine: they may be created
+		// later.
+		_ = fs.AddDir(s.rootDir)
+		for _, f := range fs.Files() {
+			s.files[f.Name] = f.Source
+		}
+		s.analyze()
+	}
+
+	return &InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:   textDocumentSyncFull,
+			DefinitionProvider: true,
+			ReferencesProvider: true,
+			HoverProvider:      true,
+			CompletionProvider: &CompletionOptions{},
+		},
+		ServerInfo: ServerInfo{Name: serverName},
+	}
+}
+
+// reloadFile reloads the file named fileName from the disk, after it was
+// closed in the editor. If the file is not in the workspace or doesn't exist
+// anymore, it is removed from the Storyworld.
+func (s *Server) reloadFile(fileName string) {
+	delete(s.files, fileName)
+	if s.rootDir == "" || !isInside(fileName, s.rootDir) {
+		return
+	}
+	fs := frontend.NewFileSet()
+	if fs.AddFile(fileName) == nil {
+		s.files[fileName] = fs.Files()[0].Source
+	}
+}
+
+// analyze parses and checks the Storyworld, updating the AST, the index and
+// the diagnostics. The diagnostics are sent later, by publishDiagnostics().
+func (s *Server) analyze() {
+	fs := frontend.NewFileSet()
+	for _, fileName := range s.fileNames() {
+		fs.AddSource(fileName, s.files[fileName])
+	}
+
+	s.root, s.diagnostics = frontend.ParseFileSet(fs, s.Natives)
+	s.index = newIndex(s.root)
+	s.diagnosticsPending = true
+}
+
+// publishDiagnostics sends the diagnostics found by the latest analysis to the
+// client, if they were not sent yet. Every file in the Storyworld gets its
+// list of diagnostics, even if empty (this is how the client knows that
+// previously reported problems are gone). Files that were removed from the
+// Storyworld get a final empty list.
+func (s *Server) publishDiagnostics() error {
+	if !s.diagnosticsPending {
+		return nil
+	}
+	s.diagnosticsPending = false
+
+	byFile := map[string][]Diagnostic{}
+	for _, d := range s.diagnostics {
+		source, ok := s.files[d.File]
+		if !ok {
+			// Problems that are not in any file (like a missing entry
+			// Passage in a Storyworld without declarations) cannot be shown.
+			continue
+		}
+		byFile[d.File] = append(byFile[d.File], toProtocolDiagnostic(source, d))
+	}
+
+	fileNames := s.fileNames()
+	for fileName := range s.published {
+		if _, ok := s.files[fileName]; !ok {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+
+	s.published = map[string]bool{}
+	for _, fileName := range fileNames {
+		diags := byFile[fileName]
+		if diags == nil {
+			diags = []Diagnostic{}
+		}
+		err := s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+			URI:         fileNameToURI(fileName),
+			Diagnostics: diags,
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := s.files[fileName]; ok {
+			s.published[fileName] = true
+		}
+	}
+
+	return nil
+}
+
+// toProtocolDiagnostic converts d, a Diagnostic in source, to a protocol
+// Diagnostic.
+func toProtocolDiagnostic(source string, d *diagnostic.Diagnostic) Diagnostic {
+	span := ast.Span{
+		Start: ast.Position{Line: d.Line, Column: d.Column},
+		End:   ast.Position{Line: d.EndLine, Column: d.EndColumn},
+	}
+	if span.Start.Column <= 0 {
+		// Unknown column: mark the whole line.
+		span.Start.Column = 1
+		span.End.Column = utf8.RuneCountInString(sourceLine(source, d.Line)) + 1
+	}
+	if span.End.Line <= 0 {
+		span.End.Line = d.Line
+	}
+	if span.End.Column <= 0 {
+		span.End.Column = span.Start.Column + 1
+	}
+
+	severity := severityError
+	if d.Severity == diagnostic.SeverityWarning {
+		severity = severityWarning
+	}
+
+	return Diagnostic{
+		Range:    toProtocolRange(source, span),
+		Severity: severity,
+		Code:     string(d.Code),
+		Source:   serverName,
+		Message:  d.Message,
+	}
+}
+
+// fileNames returns the names of all files in the Storyworld, sorted. Sorting
+// makes the analysis results independent of the order files were opened.
+func (s *Server) fileNames() []string {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isInside checks if the file named fileName is inside the directory dir.
+func isInside(fileName, dir string) bool {
+	rel, err := filepath.Rel(dir, fileName)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//
+// Language features
+//
+
+// positionOf converts the protocol position in params to a compiler position.
+func (s *Server) positionOf(params *TextDocumentPositionParams) ast.Position {
+	fileName := uriToFileName(params.TextDocument.URI)
+	return fromProtocolPosition(s.files[fileName], fileName, params.Position)
+}
+
+// locationOf converts span to a protocol Location.
+func (s *Server) locationOf(span ast.Span) Location {
+	fileName := span.Start.File
+	return Location{
+		URI:   fileNameToURI(fileName),
+		Range: toProtocolRange(s.files[fileName], span),
+	}
+}
+
+// definition handles the textDocument/definition request. Returns the location
+// of the declaration of the symbol at the requested position, or nil if there
+// is no symbol there.
+func (s *Server) definition(params *TextDocumentPositionParams) *Location {
+	occ := s.index.occurrenceAt(s.positionOf(params))
+	if occ == nil {
+		return nil
+	}
+	location := s.locationOf(occ.symbol.declaration)
+	return &location
+}
+
+// references handles the textDocument/references request. Returns the
+// locations of all occurrences of the symbol at the requested position.
+func (s *Server) references(params *ReferenceParams) []Location {
+	locations := []Location{}
+	occ := s.index.occurrenceAt(s.positionOf(&params.TextDocumentPositionParams))
+	if occ == nil {
+		return locations
+	}
+
+	for _, ref := range s.index.occurrencesOf(occ.symbol) {
+		if ref.isDeclaration && !params.Context.IncludeDeclaration {
+			continue
+		}
+		locations = append(locations, s.locationOf(ref.span))
+	}
+	return locations
+}
+
+// hover handles the textDocument/hover request. For symbols, shows what they
+// are and their types; for other expressions, shows their types. Returns nil
+// if there is nothing interesting at the requested position.
+func (s *Server) hover(params *TextDocumentPositionParams) *Hover {
+	pos := s.positionOf(params)
+	source := s.files[pos.File]
+
+	if occ := s.index.occurrenceAt(pos); occ != nil {
+		r := toProtocolRange(source, occ.span)
+		return &Hover{
+			Contents: MarkupContent{
+				Kind:  "plaintext",
+				Value: fmt.Sprintf("(%v) %v: %v", occ.symbol.kind, occ.symbol.name, occ.symbol.symbolType),
+			},
+			Range: &r,
+		}
+	}
+
+	node := expressionAt(s.root, pos)
+	if node == nil {
+		return nil
+	}
+	r := toProtocolRange(source, node.Span())
+	return &Hover{
+		Contents: MarkupContent{Kind: "plaintext", Value: node.Type().String()},
+		Range:    &r,
+	}
+}
+
+// completion handles the textDocument/completion request. Offers all keywords
+// and all names visible at the requested position.
+func (s *Server) completion(params *TextDocumentPositionParams) []CompletionItem {
+	items := []CompletionItem{}
+
+	seen := map[string]bool{}
+	for _, sym := range s.index.visibleAt(s.positionOf(params)) {
+		if seen[sym.name] {
+			continue
+		}
+		seen[sym.name] = true
+
+		kind := completionItemKindVariable
+		if sym.kind == symbolKindFunction || sym.kind == symbolKindPassage {
+			kind = completionItemKindFunction
+		}
+		items = append(items, CompletionItem{
+			Label:  sym.name,
+			Kind:   kind,
+			Detail: fmt.Sprintf("(%v) %v", sym.kind, sym.symbolType),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+
+	for _, keyword := range frontend.Keywords() {
+		items = append(items, CompletionItem{Label: keyword, Kind: completionItemKindKeyword})
+	}
+
+	return items
+}
+
+// expressionAt returns the innermost expression node in the AST rooted at root
+// that contains pos, or nil if there is none.
+func expressionAt(root ast.Node, pos ast.Position) ast.Node {
+	if root == nil {
+		return nil
+	}
+	finder := &expressionFinder{pos: pos}
+	root.Walk(finder)
+	return finder.found
+}
+
+// expressionFinder is a node visitor that looks for the innermost expression
+// containing a given position.
+type expressionFinder struct {
+	// pos is the position we are looking for.
+	pos ast.Position
+
+	// found is the innermost expression found so far.
+	found ast.Node
+}
+
+func (f *expressionFinder) Enter(node ast.Node) {
+	switch node.(type) {
+	case *ast.FloatLiteral, *ast.IntLiteral, *ast.BNumLiteral, *ast.BoolLiteral,
+		*ast.StringLiteral, *ast.Unary, *ast.Binary, *ast.Blend,
+		*ast.TypeConversion, *ast.NativeCall, *ast.FunctionCall, *ast.VarRef,
+		*ast.Assignment, *ast.And, *ast.Or, *ast.ListenExpr, *ast.GosubExpr:
+		if spanContains(node.Span(), f.pos) {
+			f.found = node
+		}
+	}
+}
+
+func (f *expressionFinder) Leave(node ast.Node) {
+}
+
+func (f *expressionFinder) Event(node ast.Node, event int) {
+}
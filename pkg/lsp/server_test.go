@@ -0,0 +1,257 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+)
+
+// helpersSource is the source code of a file in the test workspace, which is
+// on disk.
+const helpersSource = "function Greet(who: string): string\n" +
+	"    return prefix() + who\n" +
+	"end\n" +
+	"\n" +
+	"function prefix(): string\n" +
+	"    return \"Olá, \"\n" +
+	"end\n"
+
+// mainSource is the source code of a file in the test workspace, which is
+// opened in the (simulated) editor.
+const mainSource = "passage Main@1(): void\n" +
+	"    var count: int = 1\n" +
+	"    count = count + 2\n" +
+	"    say Greet(\"Ana\")\n" +
+	"end\n"
+
+// Tests a whole session with the server, using a scripted client.
+func TestServerSession(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "romualdo-lsp-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(rootDir)
+	helpersPath := filepath.Join(rootDir, "helpers.romulang")
+	assert.Nil(t, ioutil.WriteFile(helpersPath, []byte(helpersSource), 0644))
+	mainPath := filepath.Join(rootDir, "main.romulang")
+	mainURI := fileNameToURI(mainPath)
+	helpersURI := fileNameToURI(helpersPath)
+
+	c := &testClient{}
+	c.request("initialize", map[string]interface{}{"rootUri": fileNameToURI(rootDir)})
+	c.notify("initialized", map[string]interface{}{})
+
+	// Open with an error, then fix it.
+	brokenSource := mainSource[:len(mainSource)-len("    say Greet(\"Ana\")\nend\n")] + "    say Greet(1)\nend\n"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": mainURI, "languageId": "romualdo", "version": 1, "text": brokenSource},
+	})
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": mainURI, "version": 2},
+		"contentChanges": []interface{}{map[string]interface{}{"text": mainSource}},
+	})
+
+	at := func(uri string, line, character int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri},
+			"position":     map[string]interface{}{"line": line, "character": character},
+		}
+	}
+	definitionID := c.request("textDocument/definition", at(mainURI, 3, 10))
+	localDefinitionID := c.request("textDocument/definition", at(mainURI, 2, 13))
+	referencesParams := at(mainURI, 2, 5)
+	referencesParams["context"] = map[string]interface{}{"includeDeclaration": true}
+	referencesID := c.request("textDocument/references", referencesParams)
+	crossFileReferencesParams := at(helpersURI, 0, 10)
+	crossFileReferencesParams["context"] = map[string]interface{}{"includeDeclaration": false}
+	crossFileReferencesID := c.request("textDocument/references", crossFileReferencesParams)
+	hoverNameID := c.request("textDocument/hover", at(mainURI, 2, 5))
+	hoverExprID := c.request("textDocument/hover", at(mainURI, 2, 18))
+	completionID := c.request("textDocument/completion", at(mainURI, 3, 4))
+	unknownID := c.request("textDocument/formatting", at(mainURI, 0, 0))
+	c.request("shutdown", nil)
+	c.notify("exit", nil)
+
+	responses, notifications := c.run(t)
+
+	// Diagnostics: before main.romulang is opened, the workspace has no Main
+	// Passage; then main.romulang has an error, which is then fixed.
+	diags := map[string][][]Diagnostic{}
+	for _, n := range notifications {
+		assert.Equal(t, "textDocument/publishDiagnostics", n.Method)
+		params := &PublishDiagnosticsParams{}
+		assert.Nil(t, json.Unmarshal(n.Params, params))
+		diags[params.URI] = append(diags[params.URI], params.Diagnostics)
+	}
+	assert.Equal(t, 3, len(diags[helpersURI]))
+	assert.Equal(t, 1, len(diags[helpersURI][0]))
+	assert.Equal(t, "E2001", diags[helpersURI][0][0].Code)
+	assert.Empty(t, diags[helpersURI][1])
+	assert.Empty(t, diags[helpersURI][2])
+
+	assert.Equal(t, 2, len(diags[mainURI]))
+	assert.Equal(t, 1, len(diags[mainURI][0]))
+	assert.Equal(t, "E4009", diags[mainURI][0][0].Code)
+	assert.Equal(t, Range{Position{3, 8}, Position{3, 16}}, diags[mainURI][0][0].Range)
+	assert.Empty(t, diags[mainURI][1])
+
+	// Definition of a function declared in another file, and of a local.
+	location := &Location{}
+	responses.decode(t, definitionID, location)
+	assert.Equal(t, Location{helpersURI, Range{Position{0, 9}, Position{0, 14}}}, *location)
+	responses.decode(t, localDefinitionID, location)
+	assert.Equal(t, Location{mainURI, Range{Position{1, 8}, Position{1, 13}}}, *location)
+
+	// References.
+	locations := []Location{}
+	responses.decode(t, referencesID, &locations)
+	assert.Equal(t, []Location{
+		{mainURI, Range{Position{1, 8}, Position{1, 13}}},
+		{mainURI, Range{Position{2, 4}, Position{2, 9}}},
+		{mainURI, Range{Position{2, 12}, Position{2, 17}}},
+	}, locations)
+	responses.decode(t, crossFileReferencesID, &locations)
+	assert.Equal(t, []Location{{mainURI, Range{Position{3, 8}, Position{3, 13}}}}, locations)
+
+	// Hover over a name and over an expression.
+	hover := &Hover{}
+	responses.decode(t, hoverNameID, hover)
+	assert.Equal(t, "(local) count: int", hover.Contents.Value)
+	responses.decode(t, hoverExprID, hover)
+	assert.Equal(t, "int", hover.Contents.Value)
+	assert.Equal(t, &Range{Position{2, 12}, Position{2, 21}}, hover.Range)
+
+	// Completion offers visible names and keywords, but not private names
+	// from other files.
+	items := []CompletionItem{}
+	responses.decode(t, completionID, &items)
+	labels := map[string]bool{}
+	for _, item := range items {
+		labels[item.Label] = true
+	}
+	assert.True(t, labels["count"])
+	assert.True(t, labels["Greet"])
+	assert.True(t, labels["Main"])
+	assert.True(t, labels["while"])
+	assert.False(t, labels["prefix"])
+
+	// Unknown requests get an error.
+	assert.Equal(t, errorCodeMethodNotFound, responses[unknownID].Error.Code)
+}
+
+// Tests that the server refuses requests before being initialized and reports
+// an exit without shutdown.
+func TestServerLifecycle(t *testing.T) {
+	c := &testClient{}
+	id := c.request("textDocument/hover", nil)
+	c.notify("exit", nil)
+
+	out := &bytes.Buffer{}
+	err := NewServer(&c.in, out).Run()
+	assert.NotNil(t, err)
+
+	responses, _ := parseOutput(t, out)
+	assert.Equal(t, errorCodeServerNotInitialized, responses[id].Error.Code)
+}
+
+// Tests the conversion between compiler and protocol positions, which count
+// characters differently.
+func TestPositionConversion(t *testing.T) {
+	source := "say \"😀 é\" + x\n"
+	pos := ast.Position{File: "f", Line: 1, Column: 12} // the "+"
+	assert.Equal(t, Position{0, 12}, toProtocolPosition(source, pos))
+	assert.Equal(t, pos, fromProtocolPosition(source, "f", Position{0, 12}))
+}
+
+// testClient is a scripted LSP client. Requests and notifications are just
+// recorded, and are sent to a server all at once by run().
+type testClient struct {
+	in     bytes.Buffer
+	nextID int
+}
+
+// request adds a request to the script. Returns the request ID.
+func (c *testClient) request(method string, params interface{}) int {
+	c.nextID++
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	_ = writeMessage(&c.in, msg)
+	return c.nextID
+}
+
+// notify adds a notification to the script.
+func (c *testClient) notify(method string, params interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	_ = writeMessage(&c.in, msg)
+}
+
+// run runs a server with the script, and returns what it sent back.
+func (c *testClient) run(t *testing.T) (testResponses, []*testMessage) {
+	out := &bytes.Buffer{}
+	assert.Nil(t, NewServer(&c.in, out).Run())
+	return parseOutput(t, out)
+}
+
+// testMessage is a message received from the server.
+type testMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+// testResponses maps request IDs to the responses received from the server.
+type testResponses map[int]*testMessage
+
+// decode decodes the result of the response to request id into result.
+func (r testResponses) decode(t *testing.T, id int, result interface{}) {
+	msg, ok := r[id]
+	if !assert.True(t, ok, "no response to request %v", id) {
+		return
+	}
+	assert.Nil(t, msg.Error)
+	assert.Nil(t, json.Unmarshal(msg.Result, result))
+}
+
+// parseOutput parses the messages sent by the server to out, splitting them
+// into responses and notifications.
+func parseOutput(t *testing.T, out *bytes.Buffer) (testResponses, []*testMessage) {
+	responses := testResponses{}
+	notifications := []*testMessage{}
+	r := bufio.NewReader(out)
+	for {
+		data, err := readMessage(r)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+
+		msg := &testMessage{}
+		assert.Nil(t, json.Unmarshal(data, msg))
+		if msg.ID != nil {
+			responses[*msg.ID] = msg
+		} else {
+			notifications = append(notifications, msg)
+		}
+	}
+	return responses, notifications
+}
@@ -0,0 +1,13 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+// The repl package implements the logic behind an interactive Read-Eval-Print
+// Loop for the Romualdo Language: it keeps the declarations and global
+// variables entered so far, and compiles and runs each new input against them.
+// Reading the input and printing the results is up to the user interface (see
+// the repl command of romulangc).
+package repl
@@ -0,0 +1,541 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package repl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+const (
+	// internalPrefix starts the names the Session uses for its own purposes,
+	// which are not shown to the user.
+	internalPrefix = "repl__"
+
+	// inputPassage is the name of the Passage wrapping the statements entered
+	// by the user.
+	inputPassage = internalPrefix + "input"
+
+	// resultVar is the global variable that receives the value of an
+	// expression entered by the user.
+	resultVar = internalPrefix + "result"
+)
+
+// declarationRE matches input starting with a declaration (as opposed to
+// statements), possibly after some comments.
+var declarationRE = regexp.MustCompile(`^(?:\s|#[^\n]*)*(?:globals\s*@|function\s|passage\s)`)
+
+// Session is an interactive session, in which the user enters declarations and
+// statements one at a time.
+//
+// All the code entered is compiled incrementally into a single
+// CompiledStoryworld, which is run by the same VM during the whole session.
+// Each input is compiled on its own, against the global names declared by the
+// previous ones, and its code is added to the CompiledStoryworld as new Chunks.
+// Declarations replace whatever was declared before with the same names.
+// Statements are compiled into a Passage of their own, which is then run.
+// Earlier inputs are never run again (and their side effects, like say
+// statements and native function calls, are not repeated). Global variables
+// keep their values from one input to the next.
+//
+// Top-level variables declared in the statements become global variables of the
+// session, so that they are still around for the next inputs.
+type Session struct {
+	// VM is the Virtual Machine running the code. The same VM is used during
+	// the whole session, so the Sink and native functions need to be set up
+	// just once.
+	VM *vm.VM
+
+	// csw and di are the compiled storyworld and debug info with the code of
+	// all inputs entered so far.
+	csw *bytecode.CompiledStoryworld
+	di  *bytecode.DebugInfo
+
+	// types maps the keys of the global names declared so far to their types.
+	types map[ast.GlobalKey]*ast.Type
+
+	// vars contains the global variables declared so far, either in globals
+	// blocks or by top-level variable declarations, in the order they were
+	// last declared.
+	vars []*sessionVar
+
+	// inputChunk is the index of the Chunk with the code of the latest input,
+	// or -1 if the latest input was not made of statements.
+	inputChunk int
+
+	// resultType is the type of the expression being run, or nil if not
+	// running an expression whose result is to be reported.
+	resultType *ast.Type
+}
+
+// sessionVar is a global variable declared during the session.
+type sessionVar struct {
+	name    string
+	varType *ast.Type
+}
+
+// Result is the outcome of running the code entered by the user.
+type Result struct {
+	// Status is the VM status after running the code. If StatusWaitingForInput,
+	// the code is listening, and the execution must be continued by calling
+	// Session.Resume().
+	Status vm.Status
+
+	// Type is the type of the expression entered by the user, or nil if the
+	// input was not an expression (or if it didn't finish running).
+	Type *ast.Type
+
+	// Value is the value of the expression entered by the user. Valid only if
+	// Type is not nil.
+	Value bytecode.Value
+}
+
+// Global is a global variable, as listed by Session.Globals().
+type Global struct {
+	// Name is the variable name.
+	Name string
+
+	// Type is the variable type.
+	Type *ast.Type
+
+	// Value is the current variable value.
+	Value bytecode.Value
+}
+
+// New creates a new Session, which will run code on theVM.
+func New(theVM *vm.VM) *Session {
+	return &Session{
+		VM:         theVM,
+		csw:        bytecode.NewCompiledStoryworld(),
+		di:         &bytecode.DebugInfo{},
+		types:      map[ast.GlobalKey]*ast.Type{},
+		inputChunk: -1,
+	}
+}
+
+// Eval evaluates input, which can be either some declarations (functions,
+// Passages and globals blocks) or some statements. Declarations are added to
+// the session, replacing any previous declarations of the same things.
+// Statements are run right away; if they are a single expression, its value
+// is returned in the Result.
+//
+// Compilation errors are returned as a diagnostic.List, with positions
+// relative to input. Runtime errors are kept by the VM (see
+// vm.VM.LastError()), and the Result status tells about them.
+func (s *Session) Eval(input string) (*Result, error) {
+	if isDeclaration(input) {
+		return s.declare(input)
+	}
+	return s.execute(input)
+}
+
+// Resume continues running the code entered by the user, which must be
+// waiting for input. choice is the player's choice.
+func (s *Session) Resume(choice string) *Result {
+	return s.finish(s.VM.Resume(choice))
+}
+
+// AST returns the AST of input, as entered, without running it. For
+// declarations, this is a Storyworld containing them; for statements, this is
+// the Block containing them.
+func (s *Session) AST(input string) (ast.Node, error) {
+	if isDeclaration(input) {
+		root, diags := frontend.ParseIncrement(input, s.types, s.VM.NativeFunctions())
+		if diags.HasErrors() {
+			return nil, diags.Err()
+		}
+		return root, nil
+	}
+
+	body, diags := frontend.ParseStatements(input)
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+	root := &ast.Storyworld{Declarations: []ast.Node{inputPassageDecl(body)}}
+	if diags := frontend.CheckIncrement(root, s.types, s.VM.NativeFunctions()); diags.HasErrors() {
+		return nil, diags.Err()
+	}
+	return body, nil
+}
+
+// Storyworld returns the Storyworld with the code compiled so far, along with
+// its debug info.
+func (s *Session) Storyworld() (*bytecode.CompiledStoryworld, *bytecode.DebugInfo) {
+	return s.csw, s.di
+}
+
+// Globals returns the global variables of the session (both those declared in
+// globals blocks and those declared by top-level variable declarations), with
+// their current values.
+func (s *Session) Globals() []Global {
+	globals := []Global{}
+	for _, v := range s.vars {
+		globals = append(globals, Global{
+			Name:  v.name,
+			Type:  v.varType,
+			Value: s.csw.Globals[s.csw.GetGlobalIndex(v.name)].Value,
+		})
+	}
+	return globals
+}
+
+// Disassemble disassembles the code compiled so far. If name is an empty
+// string, this includes the global variables, the statements of the latest
+// input (if it was made of statements) and all functions and Passages;
+// otherwise, only the function or Passage named name is disassembled (all of
+// its versions, in the case of Passages). Internals of the Session and code
+// replaced by later declarations are left out.
+func (s *Session) Disassemble(name string) (string, error) {
+	out := strings.Builder{}
+	if name == "" {
+		out.WriteString("== Globals ==\n")
+		for _, g := range s.csw.Globals {
+			if isHidden(g.Name) {
+				continue
+			}
+			fmt.Fprintf(&out, "Global  %v '%v' (%v)", g.Name, g.Value, g.Value.Kind())
+			if g.Version > 0 {
+				fmt.Fprintf(&out, " @%v", g.Version)
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString("\n\n")
+	}
+
+	live := s.liveChunks()
+	found := false
+	for i, chunk := range s.csw.Chunks {
+		chunkName := s.di.ChunksNames[i]
+		switch {
+		case i == s.inputChunk && name == "":
+			chunkName = "input"
+		case !live[i] || isHidden(chunkName):
+			continue
+		case name != "" && chunkName != name && !strings.HasPrefix(chunkName, name+"@"):
+			continue
+		}
+
+		found = true
+		fmt.Fprintf(&out, "== %v ==\n", chunkName)
+		for offset := 0; offset < len(chunk.Code); {
+			offset = s.csw.DisassembleInstruction(chunk, &out, offset, s.di.ChunksLines[i], s.di.ChunksLocals[i])
+		}
+	}
+
+	if name != "" && !found {
+		return "", fmt.Errorf("Unknown function or Passage: %v", name)
+	}
+	return out.String(), nil
+}
+
+// IsIncomplete checks if input looks like the beginning of some valid code
+// that continues in the next lines, like an if statement without its end.
+// This is meant to allow entering code spanning multiple lines.
+func IsIncomplete(input string) bool {
+	var diags diagnostic.List
+	if isDeclaration(input) {
+		_, diags = frontend.Parse(input)
+	} else {
+		_, diags = frontend.ParseStatements(input)
+	}
+
+	// Incomplete code has a syntax error right at the end of the source code,
+	// where something else was expected.
+	endLine, endColumn := endPosition(strings.TrimRight(input, " \t\r\n"))
+	for _, d := range syntaxErrors(diags) {
+		return d.Line > endLine || d.Line == endLine && d.Column >= endColumn
+	}
+	return false
+}
+
+// declare adds the declarations in input to the session.
+func (s *Session) declare(input string) (*Result, error) {
+	root, diags := frontend.ParseIncrement(input, s.types, s.VM.NativeFunctions())
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+	sw := root.(*ast.Storyworld)
+	if err := backend.AddCode(sw, s.csw, s.di); err != nil {
+		return nil, err
+	}
+
+	s.addDeclarations(sw)
+	s.inputChunk = -1
+	s.resultType = nil
+	return &Result{Status: vm.StatusFinished}, nil
+}
+
+// execute runs the statements in input.
+func (s *Session) execute(input string) (*Result, error) {
+	body, diags := frontend.ParseStatements(input)
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	// Top-level variables become global variables, declared in a globals block
+	// that goes along with the Passage wrapping the statements.
+	globals := &ast.GlobalsBlock{
+		BaseNode: body.BaseNode,
+		Version:  s.csw.GlobalsVersion,
+	}
+	if globals.Version == 0 {
+		globals.Version = 1
+	}
+	globalizeVars(body, globals)
+	root := &ast.Storyworld{Declarations: []ast.Node{inputPassageDecl(body)}}
+	if len(globals.Vars) > 0 {
+		root.Declarations = append(root.Declarations, globals)
+	}
+
+	if diags := frontend.CheckIncrement(root, s.types, s.VM.NativeFunctions()); diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	// The value of an expression is assigned to a global variable, from which
+	// we can read it after running it.
+	resultType := expressionType(body)
+	if resultType != nil {
+		stmt := body.Statements[0].(*ast.ExpressionStmt)
+		stmt.Expr = &ast.Assignment{
+			BaseNode: stmt.BaseNode,
+			VarName:  resultVar,
+			VarType:  resultType,
+			Value:    stmt.Expr,
+		}
+		globals.Vars = append(globals.Vars, ast.NewVarDecl(stmt.BaseNode, resultVar, resultType,
+			zeroValue(resultType, stmt.BaseNode)))
+		if len(root.Declarations) == 1 {
+			root.Declarations = append(root.Declarations, globals)
+		}
+	}
+
+	if err := backend.AddCode(root, s.csw, s.di); err != nil {
+		return nil, err
+	}
+
+	s.addDeclarations(root)
+	s.resultType = resultType
+	s.inputChunk = s.csw.Globals[s.csw.GetGlobalIndex(inputPassage+"@1")].Value.AsPassage().ChunkIndex
+	s.csw.EntryPassage = s.inputChunk
+
+	return s.finish(s.VM.Interpret(s.csw, s.di)), nil
+}
+
+// finish creates the Result for a run that ended with a given status.
+func (s *Session) finish(status vm.Status) *Result {
+	result := &Result{Status: status}
+	if status == vm.StatusFinished && s.resultType != nil {
+		result.Type = s.resultType
+		result.Value = s.csw.Globals[s.csw.GetGlobalIndex(resultVar)].Value
+	}
+	return result
+}
+
+// addDeclarations updates the types and variables of the session with the
+// declarations in root, which were just added to the compiled storyworld.
+func (s *Session) addDeclarations(root *ast.Storyworld) {
+	for key, t := range frontend.GlobalTypes(root) {
+		if !isHidden(key.Name) {
+			s.types[key] = t
+		}
+	}
+
+	for _, decl := range root.Declarations {
+		switch n := decl.(type) {
+		case *ast.GlobalsBlock:
+			if n != root.LatestGlobalsBlock() {
+				break
+			}
+			for _, v := range n.Vars {
+				if !isHidden(v.Name) {
+					s.vars = setVar(s.vars, v.Name, v.Type())
+				}
+			}
+		case *ast.FunctionDecl:
+			s.vars = removeVar(s.vars, n.Name)
+		case *ast.PassageDecl:
+			s.vars = removeVar(s.vars, n.Name)
+		}
+	}
+}
+
+// liveChunks returns the indices of the Chunks of the functions and Passages
+// currently in the globals pool. The others were replaced by later
+// declarations.
+func (s *Session) liveChunks() map[int]bool {
+	live := map[int]bool{}
+	for _, g := range s.csw.Globals {
+		switch {
+		case g.Value.IsFunction():
+			live[g.Value.AsFunction().ChunkIndex] = true
+		case g.Value.IsPassage():
+			live[g.Value.AsPassage().ChunkIndex] = true
+		}
+	}
+	return live
+}
+
+// isHidden checks if the global named name is one of the Session internals,
+// which are not shown to the user.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, internalPrefix)
+}
+
+// inputPassageDecl returns the declaration of the Passage wrapping the
+// statements entered by the user, whose body is body.
+func inputPassageDecl(body *ast.Block) *ast.PassageDecl {
+	return &ast.PassageDecl{
+		BaseNode:   body.BaseNode,
+		Name:       inputPassage,
+		NameSpan:   body.Span(),
+		Version:    1,
+		ReturnType: ast.TheTypeVoid,
+		Body:       body,
+	}
+}
+
+// globalizeVars replaces the top-level variable declarations in body with
+// assignments to global variables, which are declared in globals.
+//
+// Only variables of basic types are turned into global variables, because
+// global variables of other types cannot be initialized. Others are left alone
+// as local variables.
+func globalizeVars(body *ast.Block, globals *ast.GlobalsBlock) {
+	indices := map[string]int{}
+	for i, stmt := range body.Statements {
+		decl, ok := stmt.(*ast.VarDecl)
+		if !ok || !isBasicType(decl.Type()) {
+			continue
+		}
+
+		body.Statements[i] = &ast.ExpressionStmt{
+			BaseNode: decl.BaseNode,
+			Expr: &ast.Assignment{
+				BaseNode: decl.BaseNode,
+				VarName:  decl.Name,
+				NameSpan: decl.NameSpan,
+				Value:    decl.Initializer,
+			},
+		}
+
+		// Declaring the same variable again in the same input is fine, as
+		// in different inputs. The latest declaration wins.
+		global := ast.NewVarDecl(decl.BaseNode, decl.Name, decl.Type(), zeroValue(decl.Type(), decl.BaseNode))
+		if j, ok := indices[decl.Name]; ok {
+			globals.Vars[j] = global
+			continue
+		}
+		indices[decl.Name] = len(globals.Vars)
+		globals.Vars = append(globals.Vars, global)
+	}
+}
+
+// expressionType returns the type of the expression in body, if body consists
+// of a single expression of a basic type whose value is worth reporting.
+// Otherwise, returns nil.
+func expressionType(body *ast.Block) *ast.Type {
+	if len(body.Statements) != 1 {
+		return nil
+	}
+	stmt, ok := body.Statements[0].(*ast.ExpressionStmt)
+	if !ok {
+		return nil
+	}
+	if _, isAssignment := stmt.Expr.(*ast.Assignment); isAssignment {
+		return nil
+	}
+	if t := stmt.Expr.Type(); isBasicType(t) {
+		return t
+	}
+	return nil
+}
+
+// setVar returns vars with the variable name set to type varType, replacing
+// any previous variable with the same name. vars itself is not changed.
+func setVar(vars []*sessionVar, name string, varType *ast.Type) []*sessionVar {
+	return append(removeVar(vars, name), &sessionVar{name: name, varType: varType})
+}
+
+// removeVar returns vars without the variable name. vars itself is not
+// changed.
+func removeVar(vars []*sessionVar, name string) []*sessionVar {
+	result := []*sessionVar{}
+	for _, v := range vars {
+		if v.name != name {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// isBasicType checks if t is one of the basic types: int, float, bnum, bool or
+// string.
+func isBasicType(t *ast.Type) bool {
+	switch t.Tag {
+	case ast.TypeInt, ast.TypeFloat, ast.TypeBNum, ast.TypeBool, ast.TypeString:
+		return true
+	default:
+		return false
+	}
+}
+
+// zeroValue returns a literal with the zero value of the basic type t, located
+// at baseNode. BNums cannot be zero, so their "zero" is the neutral 0.5b.
+func zeroValue(t *ast.Type, baseNode ast.BaseNode) ast.Node {
+	switch t.Tag {
+	case ast.TypeInt:
+		return &ast.IntLiteral{BaseNode: baseNode}
+	case ast.TypeFloat:
+		return &ast.FloatLiteral{BaseNode: baseNode}
+	case ast.TypeBNum:
+		return &ast.BNumLiteral{BaseNode: baseNode, Value: 0.5}
+	case ast.TypeBool:
+		return &ast.BoolLiteral{BaseNode: baseNode}
+	case ast.TypeString:
+		return &ast.StringLiteral{BaseNode: baseNode}
+	default:
+		panic(fmt.Sprintf("no zero value for type %v", t))
+	}
+}
+
+// isDeclaration checks if input contains declarations (as opposed to
+// statements).
+func isDeclaration(input string) bool {
+	return declarationRE.MatchString(input)
+}
+
+// syntaxErrors returns the syntax errors in diags.
+func syntaxErrors(diags diagnostic.List) diagnostic.List {
+	var result diagnostic.List
+	for _, d := range diags {
+		if d.Severity == diagnostic.SeverityError && strings.HasPrefix(string(d.Code), "E1") {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// countLines returns the number of lines in s.
+func countLines(s string) int {
+	return strings.Count(s, "\n") + 1
+}
+
+// endPosition returns the line and column just past the end of source.
+func endPosition(source string) (line, column int) {
+	lastNewline := strings.LastIndex(source, "\n")
+	return countLines(source), utf8.RuneCountInString(source[lastNewline+1:]) + 1
+}
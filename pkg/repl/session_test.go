@@ -0,0 +1,311 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package repl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/vm"
+)
+
+// Tests that expressions are evaluated and their values and types reported.
+func TestEvalExpressions(t *testing.T) {
+	s := New(vm.New())
+
+	assertResult(t, s, "1 + 2 * 3", bytecode.NewValueInt(7), ast.TheTypeInt)
+	assertResult(t, s, "0.5 / 2.0", bytecode.NewValueFloat(0.25), ast.TheTypeFloat)
+	assertResult(t, s, "0.2b ~ 0.8b ~ 0.5b", bytecode.NewValueBNum(0.6500000000000001), ast.TheTypeBNum)
+	assertResult(t, s, "not true", bytecode.NewValueBool(false), ast.TheTypeBool)
+	assertResult(t, s, `"ab" + "cd"`, bytecode.NewValueString("abcd"), ast.TheTypeString)
+}
+
+// Tests that statements run, and that they don't produce values.
+func TestEvalStatements(t *testing.T) {
+	theVM := vm.New()
+	said := []string{}
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		text, _ := event.Attributes.Get("text")
+		said = append(said, text.String())
+	})
+	s := New(theVM)
+
+	r, err := s.Eval("if 1 < 2 then\n    say \"yes\"\nelse\n    say \"no\"\nend")
+	assert.Nil(t, err)
+	assert.Equal(t, vm.StatusFinished, r.Status)
+	assert.Nil(t, r.Type)
+	assert.Equal(t, []string{"yes"}, said)
+}
+
+// Tests that earlier inputs are not run again, so that their side effects are
+// not repeated.
+func TestEvalRunsOnlyLatestInput(t *testing.T) {
+	theVM := vm.New()
+	ticks := 0
+	err := theVM.RegisterNative("tick", nil, ast.TheTypeInt,
+		func(args []bytecode.Value) (bytecode.Value, error) {
+			ticks++
+			return bytecode.NewValueInt(int64(ticks)), nil
+		})
+	assert.Nil(t, err)
+	said := []string{}
+	theVM.Sink = vm.SinkFunc(func(event *vm.SayEvent) {
+		text, _ := event.Attributes.Get("text")
+		said = append(said, text.String())
+	})
+	s := New(theVM)
+
+	_, err = s.Eval(`say "hello"`)
+	assert.Nil(t, err)
+	_, err = s.Eval("var x: int = .tick()")
+	assert.Nil(t, err)
+	_, err = s.Eval("function f(): int\n    return x\nend")
+	assert.Nil(t, err)
+	assertResult(t, s, "f()", bytecode.NewValueInt(1), ast.TheTypeInt)
+
+	assert.Equal(t, []string{"hello"}, said)
+	assert.Equal(t, 1, ticks)
+}
+
+// Tests that top-level variables and globals keep their values between inputs.
+func TestEvalPersistence(t *testing.T) {
+	s := New(vm.New())
+
+	_, err := s.Eval("globals@1\n    Mood: bnum = 0.5b\nend")
+	assert.Nil(t, err)
+	_, err = s.Eval("var count: int = 10\nvar name: string = \"Bob\"")
+	assert.Nil(t, err)
+	_, err = s.Eval("count = count + 1\nMood = Mood + 0.5b")
+	assert.Nil(t, err)
+
+	assertResult(t, s, "count", bytecode.NewValueInt(11), ast.TheTypeInt)
+	assertResult(t, s, "Mood", bytecode.NewValueBNum(0.6666666666666667), ast.TheTypeBNum)
+
+	// Redeclaring changes the type.
+	_, err = s.Eval("var count: string = name + \"!\"")
+	assert.Nil(t, err)
+	assertResult(t, s, "count", bytecode.NewValueString("Bob!"), ast.TheTypeString)
+
+	assert.Equal(t, []Global{
+		{Name: "Mood", Type: ast.TheTypeBNum, Value: bytecode.NewValueBNum(0.6666666666666667)},
+		{Name: "name", Type: ast.TheTypeString, Value: bytecode.NewValueString("Bob")},
+		{Name: "count", Type: ast.TheTypeString, Value: bytecode.NewValueString("Bob!")},
+	}, s.Globals())
+}
+
+// Tests that functions can be declared, used and redeclared.
+func TestEvalDeclarations(t *testing.T) {
+	s := New(vm.New())
+
+	_, err := s.Eval("function twice(x: int): int\n    return 2 * x\nend")
+	assert.Nil(t, err)
+	_, err = s.Eval("function quad(x: int): int\n    return twice(twice(x))\nend")
+	assert.Nil(t, err)
+	assertResult(t, s, "quad(3)", bytecode.NewValueInt(12), ast.TheTypeInt)
+
+	_, err = s.Eval("function twice(x: int): int\n    return x + x + 1\nend")
+	assert.Nil(t, err)
+	assertResult(t, s, "quad(3)", bytecode.NewValueInt(15), ast.TheTypeInt)
+}
+
+// Tests that each input adds its code to the same compiled storyworld, instead
+// of compiling everything again.
+func TestEvalIsIncremental(t *testing.T) {
+	s := New(vm.New())
+	csw, _ := s.Storyworld()
+
+	_, err := s.Eval("function twice(x: int): int\n    return 2 * x\nend")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(csw.Chunks))
+
+	assertResult(t, s, "twice(1)", bytecode.NewValueInt(2), ast.TheTypeInt)
+	assertResult(t, s, "twice(2)", bytecode.NewValueInt(4), ast.TheTypeInt)
+	assert.Equal(t, 3, len(csw.Chunks))
+
+	_, err = s.Eval("function twice(x: int): int\n    return x + x\nend")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(csw.Chunks))
+
+	// Failed inputs add nothing.
+	_, err = s.Eval("twice(true)")
+	asDiagnostics(t, err)
+	assert.Equal(t, 4, len(csw.Chunks))
+
+	sameCSW, _ := s.Storyworld()
+	assert.Same(t, csw, sameCSW)
+}
+
+// Tests that listen expressions suspend the execution until the session is
+// resumed.
+func TestEvalListen(t *testing.T) {
+	s := New(vm.New())
+
+	r, err := s.Eval(`listen "What now?"`)
+	assert.Nil(t, err)
+	assert.Equal(t, vm.StatusWaitingForInput, r.Status)
+
+	r = s.Resume("run")
+	assert.Equal(t, vm.StatusFinished, r.Status)
+	assert.Equal(t, ast.TheTypeString, r.Type)
+	assert.Equal(t, bytecode.NewValueString("run"), r.Value)
+}
+
+// Tests that errors are reported with positions relative to the input.
+func TestEvalErrors(t *testing.T) {
+	theVM := vm.New()
+	err := theVM.RegisterNative("fail", nil, ast.TheTypeInt,
+		func(args []bytecode.Value) (bytecode.Value, error) {
+			return bytecode.Value{}, errors.New("host failure")
+		})
+	assert.Nil(t, err)
+	s := New(theVM)
+
+	_, err = s.Eval("var x: int = 1\nx = \"nope\"")
+	diags := asDiagnostics(t, err)
+	assert.Equal(t, 2, diags[0].Line)
+	assert.Equal(t, 1, diags[0].Column)
+
+	_, err = s.Eval("1 + true")
+	diags = asDiagnostics(t, err)
+	assert.Equal(t, 1, diags[0].Line)
+	assert.Equal(t, 1, diags[0].Column)
+
+	_, err = s.Eval("function f(): int\n    return \"nope\"\nend")
+	diags = asDiagnostics(t, err)
+	assert.Equal(t, 2, diags[0].Line)
+
+	// Failed inputs change nothing.
+	_, err = s.Eval("x")
+	asDiagnostics(t, err)
+	_, err = s.Eval("f()")
+	asDiagnostics(t, err)
+
+	r, err := s.Eval(".fail()")
+	assert.Nil(t, err)
+	assert.Equal(t, vm.StatusRuntimeError, r.Status)
+	assert.Nil(t, r.Type)
+	assert.Equal(t, 1, theVM.LastError().Line)
+	assert.Equal(t, 1, theVM.LastError().Column)
+}
+
+// Tests that Session.AST returns the AST of the input.
+func TestAST(t *testing.T) {
+	s := New(vm.New())
+
+	node, err := s.AST("var x: int = 1")
+	assert.Nil(t, err)
+	block, ok := node.(*ast.Block)
+	assert.True(t, ok)
+	assert.Len(t, block.Statements, 1)
+	assert.IsType(t, &ast.VarDecl{}, block.Statements[0])
+
+	node, err = s.AST("function f(): void\nend")
+	assert.Nil(t, err)
+	sw, ok := node.(*ast.Storyworld)
+	assert.True(t, ok)
+	assert.Len(t, sw.Declarations, 1)
+	assert.IsType(t, &ast.FunctionDecl{}, sw.Declarations[0])
+
+	// Nothing was declared.
+	_, err = s.Eval("f()")
+	asDiagnostics(t, err)
+}
+
+// Tests that Session.Storyworld returns the code compiled so far, even before
+// running any code.
+func TestStoryworld(t *testing.T) {
+	s := New(vm.New())
+	_, err := s.Eval("function f(): int\n    return 1\nend")
+	assert.Nil(t, err)
+
+	csw, di := s.Storyworld()
+	assert.NotNil(t, di)
+	assert.Contains(t, csw.Disassemble(di), "f")
+}
+
+// Tests that Session.Disassemble leaves the Session internals out, and that
+// it can disassemble a single function or Passage.
+func TestDisassemble(t *testing.T) {
+	s := New(vm.New())
+	_, err := s.Eval("function twice(x: int): int\n    return 2 * x\nend")
+	assert.Nil(t, err)
+	_, err = s.Eval("passage intro@1(): void\n    say \"hi\"\nend")
+	assert.Nil(t, err)
+	_, err = s.Eval("twice(21)")
+	assert.Nil(t, err)
+
+	listing, err := s.Disassemble("")
+	assert.Nil(t, err)
+	assert.Contains(t, listing, "== input ==")
+	assert.Contains(t, listing, "== twice ==")
+	assert.Contains(t, listing, "== intro@1 ==")
+	assert.NotContains(t, listing, "Global  repl__")
+	assert.NotContains(t, listing, "== repl__")
+	assert.NotContains(t, listing, "Main")
+
+	listing, err = s.Disassemble("intro")
+	assert.Nil(t, err)
+	assert.Contains(t, listing, "== intro@1 ==")
+	assert.NotContains(t, listing, "Globals")
+	assert.NotContains(t, listing, "twice")
+	assert.NotContains(t, listing, "input")
+
+	_, err = s.Disassemble("nope")
+	assert.NotNil(t, err)
+	_, err = s.Disassemble(inputPassage)
+	assert.NotNil(t, err)
+
+	// A Main Passage declared by the user is shown.
+	_, err = s.Eval("passage Main@1(): void\nend")
+	assert.Nil(t, err)
+	listing, err = s.Disassemble("")
+	assert.Nil(t, err)
+	assert.Contains(t, listing, "== Main@1 ==")
+	assert.NotContains(t, listing, "input")
+}
+
+// Tests that incomplete input is detected.
+func TestIsIncomplete(t *testing.T) {
+	assert.True(t, IsIncomplete("if true then"))
+	assert.True(t, IsIncomplete("while x < 10 do\n    x = x + 1\n"))
+	assert.True(t, IsIncomplete("function f(): void"))
+	assert.True(t, IsIncomplete("globals@1\n    X: int = 1\n"))
+
+	assert.False(t, IsIncomplete(""))
+	assert.False(t, IsIncomplete("1 + 2"))
+	assert.False(t, IsIncomplete("if true then\nend"))
+	assert.False(t, IsIncomplete("function f(): void\nend"))
+	assert.False(t, IsIncomplete("1 + + 2"))
+	assert.False(t, IsIncomplete("end"))
+}
+
+// assertResult asserts that evaluating input in s results in value, of type
+// valueType.
+func assertResult(t *testing.T, s *Session, input string, value bytecode.Value, valueType *ast.Type) {
+	r, err := s.Eval(input)
+	if !assert.Nil(t, err, input) {
+		return
+	}
+	assert.Equal(t, vm.StatusFinished, r.Status, input)
+	assert.Equal(t, valueType, r.Type, input)
+	assert.Equal(t, value.String(), r.Value.String(), input)
+}
+
+// asDiagnostics asserts that err is a non-empty diagnostic.List and returns
+// it.
+func asDiagnostics(t *testing.T, err error) diagnostic.List {
+	var diags diagnostic.List
+	if !assert.True(t, errors.As(err, &diags)) || !assert.NotEmpty(t, diags) {
+		t.FailNow()
+	}
+	return diags
+}
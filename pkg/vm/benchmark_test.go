@@ -0,0 +1,118 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"testing"
+
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+// Benchmarks for the interpreter throughput. Each one runs a small Storyworld
+// that spends pretty much all its time in a tight loop, so that what is being
+// measured is the VM instruction dispatch and the handling of Values.
+//
+// These benchmarks were added to justify making Value a tagged struct instead
+// of a wrapper around an interface{}, which boxed nearly every number and
+// Boolean into a heap allocation. These were the results (go test ./pkg/vm
+// -run XXX -bench . -benchmem), before and after the change:
+//
+//     IntArithmetic     ~3.8ms  474192 B  59243 allocs -> ~1.5ms    552 B     8 allocs
+//     FloatArithmetic   ~3.2ms  398256 B  49751 allocs -> ~1.5ms    552 B     8 allocs
+//     BoolLogic         ~1.8ms   78272 B   9753 allocs -> ~1.2ms    552 B     8 allocs
+//     FunctionCalls     ~350us   81408 B   3963 allocs -> ~350us  81376 B  3960 allocs
+//
+// (Function calls didn't change, because their allocations come from the call
+// frames, not from Values.)
+//
+// To reproduce the "before" numbers, check out the commit right before the one
+// that made Value a tagged struct, copy this file as of that commit into
+// pkg/vm, and run the benchmarks there. Times vary a lot from machine to
+// machine, but the allocation counts should be exactly the same.
+
+// BenchmarkIntArithmetic runs a loop doing integer arithmetic and comparisons.
+func BenchmarkIntArithmetic(b *testing.B) {
+	benchmarkStoryworld(b, `
+passage Main@1(): void
+    var i: int = 0
+    var acc: int = 0
+    while i < 10000 do
+        acc = acc + i * 3 - (i - 1) * 2
+        i = i + 1
+    end
+end
+`)
+}
+
+// BenchmarkFloatArithmetic runs a loop doing floating-point arithmetic.
+func BenchmarkFloatArithmetic(b *testing.B) {
+	benchmarkStoryworld(b, `
+passage Main@1(): void
+    var x: float = 0.0
+    var i: int = 0
+    while i < 10000 do
+        x = x * 0.5 + 1.25 - x / 3.0
+        i = i + 1
+    end
+end
+`)
+}
+
+// BenchmarkBoolLogic runs a loop evaluating Boolean expressions.
+func BenchmarkBoolLogic(b *testing.B) {
+	benchmarkStoryworld(b, `
+passage Main@1(): void
+    var i: int = 0
+    var flag: bool = false
+    while i < 10000 do
+        flag = not flag and (i >= 10 or i == 3) or i != 7
+        i = i + 1
+    end
+end
+`)
+}
+
+// BenchmarkFunctionCalls runs a recursive function, stressing calls and
+// returns.
+func BenchmarkFunctionCalls(b *testing.B) {
+	benchmarkStoryworld(b, `
+function fib(n: int): int
+    if n < 2 then
+        return n
+    end
+    return fib(n - 1) + fib(n - 2)
+end
+
+passage Main@1(): void
+    var r: int = 0
+    r = fib(15)
+end
+`)
+}
+
+// benchmarkStoryworld compiles source and runs it b.N times.
+func benchmarkStoryworld(b *testing.B, source string) {
+	root, diags := frontend.Parse(source)
+	if diags.HasErrors() {
+		b.Fatalf("Compilation failed: %v", diags)
+	}
+
+	csw, _, err := backend.GenerateCode(root)
+	if err != nil {
+		b.Fatalf("Code generation failed: %v", err)
+	}
+
+	theVM := New()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if status := theVM.Interpret(csw, nil); status != StatusFinished {
+			b.Fatalf("Unexpected status: %v", status)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import "gitlab.com/stackedboxes/romulang/pkg/bytecode"
+
+// Debugger is the interface through which a debugger controls the execution of
+// the VM. The VM consults its Debugger before running each instruction, so
+// that the execution can be paused at breakpoints or after stepping. See the
+// debugger package for an actual debugger.
+type Debugger interface {
+	// ShouldPause is called before running each instruction. Returning true
+	// pauses the execution right before the instruction, and makes the VM
+	// return StatusPaused. The execution can be continued with VM.Continue().
+	ShouldPause(vm *VM) bool
+}
+
+// FrameInfo describes a function or Passage in the call stack. This is meant
+// for debuggers and similar tools.
+type FrameInfo struct {
+	// ChunkIndex is the index of the Chunk being run.
+	ChunkIndex int
+
+	// IP is the offset of the next instruction to run. For all but the
+	// innermost frame, this is the instruction right after the call.
+	IP int
+
+	// Slots contains the values in the frame's part of the stack. Slot 0 is the
+	// function or Passage itself, followed by its arguments, local variables
+	// and temporary values.
+	Slots []bytecode.Value
+}
+
+// Continue continues running a Storyworld that was paused by the Debugger. It
+// is an error to call Continue when the VM is not paused.
+func (vm *VM) Continue() Status {
+	if !vm.paused {
+		panic("vm.Continue() called but the VM is not paused")
+	}
+
+	vm.paused = false
+	vm.lastError = nil
+	vm.lastStackTrace = nil
+	return vm.runProtected(func() {})
+}
+
+// Position returns the point where the execution is: the index of the Chunk
+// being run, the offset of the next instruction in it, and the call depth (the
+// number of frames in the call stack).
+func (vm *VM) Position() (chunkIndex, ip, depth int) {
+	if vm.frame == nil {
+		return -1, 0, 0
+	}
+	return vm.frame.chunkIndex, vm.frame.ip, len(vm.frames)
+}
+
+// CallStack returns the call stack, from the outermost frame (the entry
+// Passage) to the innermost one (the function or Passage being run).
+func (vm *VM) CallStack() []FrameInfo {
+	frames := make([]FrameInfo, len(vm.frames))
+	for i, frame := range vm.frames {
+		end := vm.stack.size()
+		if i < len(vm.frames)-1 {
+			end = vm.frames[i+1].stack.base
+		}
+		frames[i] = FrameInfo{
+			ChunkIndex: frame.chunkIndex,
+			IP:         frame.ip,
+			Slots:      append([]bytecode.Value{}, vm.stack.data[frame.stack.base:end]...),
+		}
+	}
+	return frames
+}
+
+// ValueStack returns a copy of the whole VM stack, from the bottom to the top.
+func (vm *VM) ValueStack() []bytecode.Value {
+	return append([]bytecode.Value{}, vm.stack.data...)
+}
@@ -0,0 +1,192 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode"
+
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+)
+
+// NativeFunc is the Go implementation of a native function, that is, a function
+// implemented by the program running the Storyworld (the host), which the
+// Storyworld can call like this: .funcName(args).
+//
+// args contains the arguments passed by the Storyworld. They are guaranteed to
+// match the parameter types the native function was registered with. The
+// returned Value must match the registered return type; if this is void, the
+// returned Value is ignored. Returning a non-nil error aborts the execution of
+// the Storyworld with a runtime error.
+type NativeFunc func(args []bytecode.Value) (bytecode.Value, error)
+
+// nativeFunction is a native function registered with the VM.
+type nativeFunction struct {
+	// decl is the native function declaration, including its type.
+	decl *ast.NativeFunction
+
+	// fn is the Go implementation of the native function.
+	fn NativeFunc
+}
+
+// RegisterNative registers a native function named name, with the given
+// parameter and return types, implemented by fn. Parameter types must be basic
+// types (int, float, bnum, bool or string); the return type can also be void.
+//
+// Native functions must be registered before compiling the Storyworld (so that
+// calls to them can be type-checked, see NativeFunctions()), and before
+// running it.
+func (vm *VM) RegisterNative(name string, paramTypes []*ast.Type, returnType *ast.Type, fn NativeFunc) error {
+	if !isValidNativeName(name) {
+		return fmt.Errorf("invalid native function name: '%v'", name)
+	}
+	if name == "print" {
+		return errors.New("cannot register native function 'print': this is a built-in function")
+	}
+	if _, found := vm.natives[name]; found {
+		return fmt.Errorf("native function '%v' already registered", name)
+	}
+	if fn == nil {
+		return fmt.Errorf("native function '%v' has no implementation", name)
+	}
+
+	for i, t := range paramTypes {
+		if !isBasicType(t) {
+			return fmt.Errorf("native function '%v': parameter %v has unsupported type %v", name, i+1, t)
+		}
+	}
+	if returnType != ast.TheTypeVoid && !isBasicType(returnType) {
+		return fmt.Errorf("native function '%v': unsupported return type %v", name, returnType)
+	}
+
+	vm.natives[name] = &nativeFunction{
+		decl: &ast.NativeFunction{
+			Name: name,
+			Type: &ast.Type{
+				Tag:            ast.TypeFunction,
+				ParameterTypes: append([]*ast.Type{}, paramTypes...),
+				ReturnType:     returnType,
+			},
+		},
+		fn: fn,
+	}
+
+	return nil
+}
+
+// NativeFunctions returns the declarations of all native functions registered
+// with the VM, sorted by name. This is meant to be passed to the compiler, so
+// that it can type-check calls to native functions.
+func (vm *VM) NativeFunctions() []*ast.NativeFunction {
+	result := make([]*ast.NativeFunction, 0, len(vm.natives))
+	for _, native := range vm.natives {
+		result = append(result, native.decl)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// callNative calls a native function. Assumes the native function name and its
+// argCount arguments were pushed into the stack. Pops them all and pushes the
+// return value (if not void).
+func (vm *VM) callNative(argCount int) {
+	nameValue := vm.peek(argCount)
+	if !nameValue.IsString() {
+		vm.runtimeError("Trying to call a native function identified by a non-string value: %v", nameValue)
+	}
+	name := nameValue.AsString()
+
+	native, found := vm.natives[name]
+	if !found {
+		vm.runtimeError("Native function '%v' is not registered.", name)
+	}
+
+	fnType := native.decl.Type
+	if argCount != len(fnType.ParameterTypes) {
+		vm.runtimeError("Native function '%v' expects %v arguments, but got %v.",
+			name, len(fnType.ParameterTypes), argCount)
+	}
+
+	args := make([]bytecode.Value, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = vm.pop()
+		if !valueHasType(args[i], fnType.ParameterTypes[i]) {
+			vm.runtimeError("Native function '%v' expects a %v as argument %v, but got %v.",
+				name, fnType.ParameterTypes[i], i+1, args[i])
+		}
+	}
+	vm.pop() // the name
+
+	result, err := native.fn(args)
+	if err != nil {
+		vm.runtimeError("Native function '%v' failed: %v", name, err)
+	}
+
+	if fnType.ReturnType == ast.TheTypeVoid {
+		return
+	}
+
+	if !valueHasType(result, fnType.ReturnType) {
+		vm.runtimeError("Native function '%v' should return a %v, but returned %v.",
+			name, fnType.ReturnType, result)
+	}
+
+	if result.IsString() {
+		result = vm.NewInternedValueString(result.AsString())
+	}
+	vm.push(result)
+}
+
+// isValidNativeName checks if name can be used as a native function name. The
+// rules are the same used by the scanner for identifiers: a letter followed by
+// any number of letters, digits and underscores.
+func isValidNativeName(name string) bool {
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r):
+			continue
+		case i > 0 && (r == '_' || unicode.IsDigit(r)):
+			continue
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// isBasicType checks if t is one of the basic types: int, float, bnum, bool or
+// string.
+func isBasicType(t *ast.Type) bool {
+	switch t {
+	case ast.TheTypeInt, ast.TheTypeFloat, ast.TheTypeBNum, ast.TheTypeBool, ast.TheTypeString:
+		return true
+	default:
+		return false
+	}
+}
+
+// valueHasType checks if the Value v has the basic type t.
+func valueHasType(v bytecode.Value, t *ast.Type) bool {
+	switch t {
+	case ast.TheTypeInt:
+		return v.IsInt()
+	case ast.TheTypeFloat:
+		return v.IsFloat()
+	case ast.TheTypeBNum:
+		return v.IsBNum()
+	case ast.TheTypeBool:
+		return v.IsBool()
+	case ast.TheTypeString:
+		return v.IsString()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,245 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// WritePprof writes the statistics collected to w, as a gzip-compressed
+// profile in the format used by pprof. This can be explored with the usual
+// tools, for example:
+//
+//	go tool pprof -http=:8080 profile.pb.gz
+//
+// The profile has two sample types: "instructions" (the number of
+// instructions executed) and "wall" (the time spent, the default one).
+// Functions and Passages appear as pprof functions, so flame graphs and call
+// graphs show the Romualdo call stacks.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(p.encodePprof()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// encodePprof encodes the statistics collected as a pprof profile (which is a
+// Protocol Buffers message, as defined in
+// https://github.com/google/pprof/blob/main/proto/profile.proto). We encode it
+// by hand to avoid depending on a Protocol Buffers library.
+func (p *Profiler) encodePprof() []byte {
+	// Field numbers from profile.proto.
+	const (
+		pbProfileSampleType        = 1
+		pbProfileSample            = 2
+		pbProfileLocation          = 4
+		pbProfileFunction          = 5
+		pbProfileStringTable       = 6
+		pbProfileTimeNanos         = 9
+		pbProfileDurationNanos     = 10
+		pbProfilePeriodType        = 11
+		pbProfilePeriod            = 12
+		pbProfileDefaultSampleType = 14
+
+		pbValueTypeType = 1
+		pbValueTypeUnit = 2
+
+		pbSampleLocationID = 1
+		pbSampleValue      = 2
+
+		pbLocationID   = 1
+		pbLocationLine = 4
+
+		pbLineFunctionID = 1
+		pbLineLine       = 2
+
+		pbFunctionID         = 1
+		pbFunctionName       = 2
+		pbFunctionSystemName = 3
+		pbFunctionFilename   = 4
+	)
+
+	stringTable := newPprofStrings()
+	var buf protoBuffer
+
+	valueType := func(field int, typ, unit string) {
+		buf.message(field, func(b *protoBuffer) {
+			b.int64Field(pbValueTypeType, stringTable.index(typ))
+			b.int64Field(pbValueTypeUnit, stringTable.index(unit))
+		})
+	}
+	valueType(pbProfileSampleType, "instructions", "count")
+	valueType(pbProfileSampleType, "wall", "nanoseconds")
+
+	// Samples are sorted by their call stacks just to make the output
+	// deterministic.
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	locations := map[profileLocation]uint64{}
+	locationsOrder := []profileLocation{}
+	var total profileCounters
+	for _, key := range keys {
+		s := p.samples[key]
+		total.add(s.profileCounters)
+
+		ids := make([]uint64, len(s.stack))
+		for i, loc := range s.stack {
+			id, ok := locations[loc]
+			if !ok {
+				id = uint64(len(locations) + 1)
+				locations[loc] = id
+				locationsOrder = append(locationsOrder, loc)
+			}
+			ids[i] = id
+		}
+
+		buf.message(pbProfileSample, func(b *protoBuffer) {
+			b.packedUint64s(pbSampleLocationID, ids)
+			b.packedUint64s(pbSampleValue, []uint64{uint64(s.instructions), uint64(s.time)})
+		})
+	}
+
+	// Each Chunk is a function; ID zero is reserved, so IDs are offset by one.
+	chunksUsed := map[int]bool{}
+	for _, loc := range locationsOrder {
+		chunksUsed[loc.chunkIndex] = true
+		buf.message(pbProfileLocation, func(b *protoBuffer) {
+			b.uint64Field(pbLocationID, locations[loc])
+			b.message(pbLocationLine, func(b *protoBuffer) {
+				b.uint64Field(pbLineFunctionID, uint64(loc.chunkIndex+1))
+				b.int64Field(pbLineLine, int64(loc.line))
+			})
+		})
+	}
+
+	chunks := make([]int, 0, len(chunksUsed))
+	for chunkIndex := range chunksUsed {
+		chunks = append(chunks, chunkIndex)
+	}
+	sort.Ints(chunks)
+	for _, chunkIndex := range chunks {
+		name := stringTable.index(p.chunkName(chunkIndex))
+		buf.message(pbProfileFunction, func(b *protoBuffer) {
+			b.uint64Field(pbFunctionID, uint64(chunkIndex+1))
+			b.int64Field(pbFunctionName, name)
+			b.int64Field(pbFunctionSystemName, name)
+			b.int64Field(pbFunctionFilename, stringTable.index(p.chunkFile(chunkIndex)))
+		})
+	}
+
+	if !p.start.IsZero() {
+		buf.int64Field(pbProfileTimeNanos, p.start.UnixNano())
+	}
+	buf.int64Field(pbProfileDurationNanos, int64(total.time))
+	valueType(pbProfilePeriodType, "instructions", "count")
+	buf.int64Field(pbProfilePeriod, 1)
+	buf.int64Field(pbProfileDefaultSampleType, stringTable.index("wall"))
+
+	// The string table must come last, after all strings have been indexed.
+	for _, s := range stringTable.table {
+		buf.bytesField(pbProfileStringTable, []byte(s))
+	}
+
+	return buf.data
+}
+
+// pprofStrings is the string table of a pprof profile.
+type pprofStrings struct {
+	table   []string
+	indices map[string]int64
+}
+
+// newPprofStrings creates a new pprofStrings. The first entry of the string
+// table must always be the empty string.
+func newPprofStrings() *pprofStrings {
+	return &pprofStrings{
+		table:   []string{""},
+		indices: map[string]int64{"": 0},
+	}
+}
+
+// index returns the index of s in the string table, adding it if needed.
+func (s *pprofStrings) index(str string) int64 {
+	if i, ok := s.indices[str]; ok {
+		return i
+	}
+	i := int64(len(s.table))
+	s.table = append(s.table, str)
+	s.indices[str] = i
+	return i
+}
+
+// protoBuffer is a minimal Protocol Buffers encoder, supporting just what is
+// needed to encode pprof profiles.
+type protoBuffer struct {
+	data []byte
+}
+
+// Protocol Buffers wire types.
+const (
+	protoWireVarint          = 0
+	protoWireLengthDelimited = 2
+)
+
+// varint appends x encoded as a varint.
+func (b *protoBuffer) varint(x uint64) {
+	b.data = appendUvarint(b.data, x)
+}
+
+// key appends the key of a field.
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field<<3 | wireType))
+}
+
+// uint64Field appends an uint64 field. Zeros are omitted, as they are the
+// default value.
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, protoWireVarint)
+	b.varint(x)
+}
+
+// int64Field appends an int64 field. Zeros are omitted, as they are the default
+// value.
+func (b *protoBuffer) int64Field(field int, x int64) {
+	b.uint64Field(field, uint64(x))
+}
+
+// bytesField appends a bytes (or string) field. Unlike the other fields, empty
+// values are written, because they matter in repeated fields.
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, protoWireLengthDelimited)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+// packedUint64s appends a packed repeated uint64 field.
+func (b *protoBuffer) packedUint64s(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.bytesField(field, packed.data)
+}
+
+// message appends an embedded message field, whose contents are written by
+// encode.
+func (b *protoBuffer) message(field int, encode func(b *protoBuffer)) {
+	var msg protoBuffer
+	encode(&msg)
+	b.bytesField(field, msg.data)
+}
@@ -0,0 +1,405 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+)
+
+// Profiler collects statistics about the execution of a Storyworld: how many
+// instructions were executed and how much (wall) time was spent running them,
+// per function or Passage, per source code line and per opcode. Profiling is
+// opt-in: create a Profiler with NewProfiler() and assign it to VM.Profiler.
+//
+// Source code lines and function names are known only when running with debug
+// information. Time spent waiting for the player's input is not counted. A
+// Profiler is meant to be used with a single Storyworld, but it can be used
+// across many runs (and across Resume() calls) to accumulate statistics.
+type Profiler struct {
+	// csw is the compiled storyworld being profiled.
+	csw *bytecode.CompiledStoryworld
+
+	// di is the debug info for csw. May be nil.
+	di *bytecode.DebugInfo
+
+	// samples contains the statistics for each distinct call stack, indexed
+	// by a key computed from the call stack.
+	samples map[string]*profileSample
+
+	// opcodes contains the statistics for each opcode.
+	opcodes [256]profileCounters
+
+	// opcodeNames caches the names of the opcodes seen so far.
+	opcodeNames [256]string
+
+	// current is the sample of the instruction currently running, or nil if
+	// not running.
+	current *profileSample
+
+	// currentOpcode is the opcode of the instruction currently running.
+	currentOpcode byte
+
+	// last is when the instruction currently running started.
+	last time.Time
+
+	// start is when profiling started (when the first instruction was run).
+	start time.Time
+
+	// key is a buffer used to compute sample keys, kept around to avoid
+	// allocations.
+	key []byte
+}
+
+// profileCounters are the statistics collected for something.
+type profileCounters struct {
+	instructions int64
+	time         time.Duration
+}
+
+// add adds other to c.
+func (c *profileCounters) add(other profileCounters) {
+	c.instructions += other.instructions
+	c.time += other.time
+}
+
+// profileLocation is a point in the source code: a line in a function or
+// Passage. Without debug info, lines are zero.
+type profileLocation struct {
+	chunkIndex int
+	line       int
+}
+
+// profileSample contains the statistics for one call stack.
+type profileSample struct {
+	profileCounters
+
+	// stack is the call stack, from the innermost frame to the outermost
+	// one.
+	stack []profileLocation
+}
+
+// ProfileStat is an entry in one of the tables of statistics collected by a
+// Profiler.
+type ProfileStat struct {
+	// Name identifies what the statistics refer to: a function or Passage
+	// name, a source code line or an opcode name.
+	Name string
+
+	// Instructions is the number of instructions executed.
+	Instructions int64
+
+	// Time is the total time spent executing the instructions.
+	Time time.Duration
+
+	// CumInstructions is the number of instructions executed including those
+	// executed by the functions and Passages called (directly or indirectly).
+	// Only set for functions and Passages.
+	CumInstructions int64
+
+	// CumTime is the time spent including the time spent in functions and
+	// Passages called (directly or indirectly). Only set for functions and
+	// Passages.
+	CumTime time.Duration
+}
+
+// NewProfiler creates a new Profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		samples: map[string]*profileSample{},
+	}
+}
+
+// Functions returns the statistics for each function and Passage executed,
+// sorted from the most to the least time-consuming (considering the
+// instructions executed in the function or Passage itself).
+func (p *Profiler) Functions() []ProfileStat {
+	self := map[int]*profileCounters{}
+	cum := map[int]*profileCounters{}
+	for _, s := range p.samples {
+		addCounters(self, s.stack[0].chunkIndex, s.profileCounters)
+
+		// Recursive calls must not be counted more than once.
+		seen := map[int]bool{}
+		for _, loc := range s.stack {
+			if !seen[loc.chunkIndex] {
+				seen[loc.chunkIndex] = true
+				addCounters(cum, loc.chunkIndex, s.profileCounters)
+			}
+		}
+	}
+
+	stats := []ProfileStat{}
+	for chunkIndex, c := range cum {
+		stat := ProfileStat{
+			Name:            p.chunkName(chunkIndex),
+			CumInstructions: c.instructions,
+			CumTime:         c.time,
+		}
+		if s, ok := self[chunkIndex]; ok {
+			stat.Instructions = s.instructions
+			stat.Time = s.time
+		}
+		stats = append(stats, stat)
+	}
+	sortStats(stats)
+	return stats
+}
+
+// Lines returns the statistics for each source code line executed, sorted
+// from the most to the least time-consuming. Lines are named like
+// "story.romulang:12 (Main@1)". Without debug info, all the code of a function
+// or Passage is reported as a single line.
+func (p *Profiler) Lines() []ProfileStat {
+	lines := map[profileLocation]*profileCounters{}
+	for _, s := range p.samples {
+		loc := s.stack[0]
+		if _, ok := lines[loc]; !ok {
+			lines[loc] = &profileCounters{}
+		}
+		lines[loc].add(s.profileCounters)
+	}
+
+	stats := []ProfileStat{}
+	for loc, c := range lines {
+		stats = append(stats, ProfileStat{
+			Name:         fmt.Sprintf("%v (%v)", p.describeLine(loc), p.chunkName(loc.chunkIndex)),
+			Instructions: c.instructions,
+			Time:         c.time,
+		})
+	}
+	sortStats(stats)
+	return stats
+}
+
+// Opcodes returns the statistics for each opcode executed, sorted from the
+// most to the least time-consuming.
+func (p *Profiler) Opcodes() []ProfileStat {
+	stats := []ProfileStat{}
+	for op, c := range p.opcodes {
+		if c.instructions > 0 {
+			stats = append(stats, ProfileStat{
+				Name:         p.opcodeNames[op],
+				Instructions: c.instructions,
+				Time:         c.time,
+			})
+		}
+	}
+	sortStats(stats)
+	return stats
+}
+
+// WriteReport writes a human-readable report with the statistics collected to
+// w.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	var total profileCounters
+	for _, s := range p.samples {
+		total.add(s.profileCounters)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Instructions executed: %v\n", total.instructions)
+	fmt.Fprintf(&sb, "Time: %v\n", total.time)
+
+	writeTable := func(title string, stats []ProfileStat, cumulative bool) {
+		fmt.Fprintf(&sb, "\n== %v ==\n", title)
+		fmt.Fprintf(&sb, "%12v %7v %12v %7v", "instructions", "", "time", "")
+		if cumulative {
+			fmt.Fprintf(&sb, " %12v %7v %12v %7v", "cum instrs", "", "cum time", "")
+		}
+		sb.WriteString("  name\n")
+
+		for _, stat := range stats {
+			fmt.Fprintf(&sb, "%12d %6.2f%% %12v %6.2f%%",
+				stat.Instructions, percentOf(float64(stat.Instructions), float64(total.instructions)),
+				stat.Time, percentOf(float64(stat.Time), float64(total.time)))
+			if cumulative {
+				fmt.Fprintf(&sb, " %12d %6.2f%% %12v %6.2f%%",
+					stat.CumInstructions, percentOf(float64(stat.CumInstructions), float64(total.instructions)),
+					stat.CumTime, percentOf(float64(stat.CumTime), float64(total.time)))
+			}
+			fmt.Fprintf(&sb, "  %v\n", stat.Name)
+		}
+	}
+
+	writeTable("Functions and Passages", p.Functions(), true)
+	writeTable("Lines", p.Lines(), false)
+	writeTable("Opcodes", p.Opcodes(), false)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// instruction is called by the VM right before running each instruction.
+// opcode is the instruction opcode. The time since the previous call is
+// attributed to the previous instruction.
+func (p *Profiler) instruction(vm *VM, opcode byte) {
+	now := time.Now()
+	if p.current != nil {
+		p.account(now)
+	} else if p.start.IsZero() {
+		p.start = now
+	}
+
+	if p.csw == nil {
+		p.csw = vm.csw
+		p.di = vm.debugInfo
+	}
+
+	p.current = p.sample(vm)
+	p.current.instructions++
+	p.currentOpcode = opcode
+	p.opcodes[opcode].instructions++
+	if p.opcodeNames[opcode] == "" {
+		p.opcodeNames[opcode] = p.opcodeName(vm.currentChunk(), vm.frame.ip)
+	}
+
+	// Start counting only now, so that the time spent on the bookkeeping above
+	// is not attributed to the instruction.
+	p.last = time.Now()
+}
+
+// stop is called by the VM when it stops running, so that the time spent in
+// the last instruction is accounted for.
+func (p *Profiler) stop() {
+	if p.current != nil {
+		p.account(time.Now())
+		p.current = nil
+	}
+}
+
+// account attributes the time from p.last to now to the current instruction.
+func (p *Profiler) account(now time.Time) {
+	elapsed := now.Sub(p.last)
+	p.current.time += elapsed
+	p.opcodes[p.currentOpcode].time += elapsed
+}
+
+// sample returns the sample for the current call stack of vm, creating it if
+// needed.
+func (p *Profiler) sample(vm *VM) *profileSample {
+	p.key = p.key[:0]
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		loc := p.location(vm.frames[i], i == len(vm.frames)-1)
+		p.key = appendUvarint(p.key, uint64(loc.chunkIndex))
+		p.key = appendUvarint(p.key, uint64(loc.line))
+	}
+
+	if s, ok := p.samples[string(p.key)]; ok {
+		return s
+	}
+
+	s := &profileSample{}
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		s.stack = append(s.stack, p.location(vm.frames[i], i == len(vm.frames)-1))
+	}
+	p.samples[string(p.key)] = s
+	return s
+}
+
+// location returns the location being run in a given frame. For the innermost
+// frame, this is the next instruction to run; for the others, this is the call
+// instruction.
+func (p *Profiler) location(frame *callFrame, innermost bool) profileLocation {
+	loc := profileLocation{chunkIndex: frame.chunkIndex}
+	if p.di != nil {
+		ip := frame.ip
+		if !innermost {
+			ip--
+		}
+		loc.line = p.di.ChunksLines[frame.chunkIndex][ip]
+	}
+	return loc
+}
+
+// opcodeName returns the name of the opcode of the instruction at a given
+// offset of chunk. The name is taken from the disassembler, so that we don't
+// need to keep a second list of opcode names.
+func (p *Profiler) opcodeName(chunk *bytecode.Chunk, offset int) string {
+	var sb strings.Builder
+	p.csw.DisassembleOpcode(chunk, &sb, offset, nil)
+	if fields := strings.Fields(sb.String()); len(fields) > 0 {
+		return fields[0]
+	}
+	return fmt.Sprintf("opcode %v", chunk.Code[offset])
+}
+
+// chunkName returns the name of the function or Passage in the Chunk at
+// chunkIndex.
+func (p *Profiler) chunkName(chunkIndex int) string {
+	if p.di == nil {
+		return fmt.Sprintf("chunk %v", chunkIndex)
+	}
+	return p.di.ChunksNames[chunkIndex]
+}
+
+// chunkFile returns the name of the source file of the Chunk at chunkIndex, or
+// an empty string if not known.
+func (p *Profiler) chunkFile(chunkIndex int) string {
+	if p.di == nil {
+		return ""
+	}
+	return p.di.ChunkFile(chunkIndex)
+}
+
+// describeLine returns the source code line of loc in a human-readable way,
+// like "story.romulang:12".
+func (p *Profiler) describeLine(loc profileLocation) string {
+	if loc.line == 0 {
+		return "line ?"
+	}
+	if file := p.chunkFile(loc.chunkIndex); file != "" {
+		return fmt.Sprintf("%v:%v", file, loc.line)
+	}
+	return fmt.Sprintf("line %v", loc.line)
+}
+
+// appendUvarint appends x, encoded as an unsigned varint, to buf.
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// addCounters adds c to the counters for key in m.
+func addCounters(m map[int]*profileCounters, key int, c profileCounters) {
+	if _, ok := m[key]; !ok {
+		m[key] = &profileCounters{}
+	}
+	m[key].add(c)
+}
+
+// sortStats sorts stats from the most to the least time-consuming. Ties are
+// broken by the number of instructions and then by name, so that the order is
+// stable.
+func sortStats(stats []ProfileStat) {
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		if a.Instructions != b.Instructions {
+			return a.Instructions > b.Instructions
+		}
+		return a.Name < b.Name
+	})
+}
+
+// percentOf returns x as a percentage of total.
+func percentOf(x, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * x / total
+}
@@ -0,0 +1,78 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import "gitlab.com/stackedboxes/romulang/pkg/bytecode"
+
+// Sink is something that receives what a Storyworld says. It is implemented by
+// the program running the Storyworld (the host), which decides how to show the
+// narrative to the player.
+type Sink interface {
+	// Say is called whenever a say statement is executed.
+	Say(event *SayEvent)
+}
+
+// SinkFunc is an adapter that allows to use an ordinary function as a Sink.
+type SinkFunc func(event *SayEvent)
+
+// Say calls f(event).
+func (f SinkFunc) Say(event *SayEvent) {
+	f(event)
+}
+
+// SayEvent is what a Sink receives when a say statement is executed.
+type SayEvent struct {
+	// Attributes contains the attributes said, in the order they appear in the
+	// source code.
+	Attributes Attributes
+}
+
+// ListenEvent is what the VM received from a listen expression, in which it is
+// waiting for the player's choice.
+type ListenEvent struct {
+	// Attributes contains the attributes passed to the listen expression, in
+	// the order they appear in the source code. They typically describe the
+	// choices available to the player.
+	Attributes Attributes
+}
+
+// Attribute is one of the attributes passed to a say statement or a listen
+// expression.
+type Attribute struct {
+	// Name is the attribute name.
+	Name string
+
+	// Value is the attribute value. It is always of one of the basic types:
+	// int, float, bnum, bool or string.
+	Value bytecode.Value
+}
+
+// Attributes is a list of attributes.
+type Attributes []Attribute
+
+// Get returns the value of the attribute named name. The second return value
+// is false if there is no such attribute.
+func (attrs Attributes) Get(name string) (bytecode.Value, bool) {
+	for _, attr := range attrs {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return bytecode.Value{}, false
+}
+
+// Text returns the "text" attribute, which is the one set by the short forms of
+// the say statement and listen expression (like `say "Some text"`). Returns an
+// empty string if there is no such attribute.
+func (attrs Attributes) Text() string {
+	v, ok := attrs.Get("text")
+	if !ok {
+		return ""
+	}
+	return v.String()
+}
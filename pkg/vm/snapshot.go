@@ -0,0 +1,192 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+)
+
+// Snapshot writes the state of the running Storyworld to w, so that it can be
+// restored later with Restore(). This is how saved games are implemented.
+//
+// Snapshots can only be taken while the Storyworld is waiting for input, which
+// is the only moment the host gets control back with a Storyworld that is still
+// running.
+func (vm *VM) Snapshot(w io.Writer) error {
+	if vm.listening == nil {
+		return errors.New("snapshots can only be taken while the Storyworld is waiting for input")
+	}
+
+	s := &bytecode.Snapshot{
+		GlobalsVersion: vm.csw.GlobalsVersion,
+		Strings:        vm.csw.Strings.Strings(),
+		Stack:          append([]bytecode.Value{}, vm.stack.data...),
+	}
+
+	// Functions and Passages are code, which always comes from the
+	// Storyworld we restore into. Only variables are saved.
+	for _, g := range vm.csw.Globals {
+		if !g.Value.IsFunction() && !g.Value.IsPassage() {
+			s.Globals = append(s.Globals, g)
+		}
+	}
+
+	for i, name := range vm.csw.ChunksNames() {
+		s.Chunks = append(s.Chunks, bytecode.SnapshotChunk{Name: name, Hash: vm.csw.ChunkHash(i)})
+	}
+
+	for _, frame := range vm.frames {
+		s.Frames = append(s.Frames, bytecode.SnapshotFrame{
+			ChunkIndex: frame.chunkIndex,
+			IP:         frame.ip,
+			StackBase:  frame.stack.base,
+		})
+	}
+
+	for _, attr := range vm.listening.Attributes {
+		s.Listening = append(s.Listening, bytecode.SnapshotAttribute{Name: attr.Name, Value: attr.Value})
+	}
+
+	_, err := s.WriteTo(w)
+	return err
+}
+
+// Restore reads a snapshot taken with Snapshot() from r and restores it, so
+// that the VM is again waiting for input exactly like when the snapshot was
+// taken. Use VM.Listening() and VM.Resume() to continue running the Storyworld
+// from there. di is the debug information corresponding to csw; it is optional
+// and can be nil.
+//
+// csw must be either the same Storyworld the snapshot was taken from, or a newer
+// version of it. In the latter case, the globals are upgraded as described in
+// CompiledStoryworld.UpgradeGlobals(), and the functions and Passages that were
+// running when the snapshot was taken must be unchanged. The saved variables
+// are merged by name into csw.Globals. Returns an error if the
+// snapshot doesn't match csw; in this case the VM is left untouched.
+func (vm *VM) Restore(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo, r io.Reader) error {
+	s, err := bytecode.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	chunkMap := s.MatchChunks(csw)
+
+	// remapValue makes Values referring to Chunks point to the Chunks in csw,
+	// and interns strings.
+	remapValue := func(v bytecode.Value) (bytecode.Value, error) {
+		switch {
+		case v.IsString():
+			return bytecode.NewValueString(csw.Strings.Intern(v.AsString())), nil
+		case v.IsFunction(), v.IsPassage():
+			var chunkIndex int
+			if v.IsPassage() {
+				chunkIndex = v.AsPassage().ChunkIndex
+			} else {
+				chunkIndex = v.AsFunction().ChunkIndex
+			}
+			if chunkIndex < 0 || chunkIndex >= len(chunkMap) {
+				return bytecode.Value{}, fmt.Errorf("reference to invalid chunk %v", chunkIndex)
+			}
+			newIndex := chunkMap[chunkIndex]
+			if newIndex < 0 {
+				return bytecode.Value{}, fmt.Errorf("'%v' does not exist in the compiled storyworld",
+					s.Chunks[chunkIndex].Name)
+			}
+			if v.IsPassage() {
+				return bytecode.NewValuePassage(newIndex), nil
+			}
+			return bytecode.NewValueFunction(newIndex), nil
+		default:
+			return v, nil
+		}
+	}
+
+	frames := make([]*callFrame, 0, len(s.Frames))
+	for _, f := range s.Frames {
+		if f.ChunkIndex < 0 || f.ChunkIndex >= len(s.Chunks) {
+			return fmt.Errorf("cannot restore snapshot: reference to invalid chunk %v", f.ChunkIndex)
+		}
+		chunk := s.Chunks[f.ChunkIndex]
+		newIndex := chunkMap[f.ChunkIndex]
+		if newIndex < 0 {
+			return fmt.Errorf("cannot restore snapshot: '%v' is running, but does not exist in the compiled storyworld",
+				chunk.Name)
+		}
+		if !bytes.Equal(chunk.Hash, csw.ChunkHash(newIndex)) {
+			return fmt.Errorf("cannot restore snapshot: '%v' is running, but its code has changed", chunk.Name)
+		}
+		if !csw.IsInstructionStart(newIndex, f.IP) {
+			return fmt.Errorf("cannot restore snapshot: invalid instruction pointer %v in '%v'", f.IP, chunk.Name)
+		}
+		frames = append(frames, &callFrame{
+			chunkIndex: newIndex,
+			ip:         f.IP,
+			stack:      &StackView{base: f.StackBase},
+		})
+	}
+	if len(frames) == 0 {
+		return errors.New("cannot restore snapshot: no call frames")
+	}
+
+	stack := &Stack{}
+	for _, v := range s.Stack {
+		v, err = remapValue(v)
+		if err != nil {
+			return fmt.Errorf("cannot restore snapshot: %w", err)
+		}
+		stack.push(v)
+	}
+
+	listening := &ListenEvent{}
+	for _, a := range s.Listening {
+		v, err := remapValue(a.Value)
+		if err != nil {
+			return fmt.Errorf("cannot restore snapshot: %w", err)
+		}
+		listening.Attributes = append(listening.Attributes, Attribute{Name: a.Name, Value: v})
+	}
+
+	globals, err := csw.UpgradeGlobals(s.GlobalsVersion, s.Globals)
+	if err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+	for i, g := range globals {
+		// Functions and Passages in globals already come from csw, so we only
+		// need to take care of strings here.
+		if g.Value.IsString() {
+			globals[i].Value = bytecode.NewValueString(csw.Strings.Intern(g.Value.AsString()))
+		}
+	}
+
+	// Everything checked, we can change the VM state now.
+	for _, str := range s.Strings {
+		csw.Strings.Intern(str)
+	}
+	for _, frame := range frames {
+		frame.stack.stack = stack
+	}
+	for _, g := range globals {
+		if i := csw.GetGlobalIndex(g.Name); i >= 0 {
+			csw.Globals[i].Value = g.Value
+		}
+	}
+	vm.csw = csw
+	vm.debugInfo = di
+	vm.stack = stack
+	vm.frames = frames
+	vm.frame = frames[len(frames)-1]
+	vm.listening = listening
+	vm.paused = false
+
+	return nil
+}
@@ -44,6 +44,14 @@ func (s *Stack) popN(n int) {
 	s.data = s.data[:len(s.data)-n]
 }
 
+// moveTop moves the n values on the top of the stack down, so that the first of
+// them ends up at index. Everything that was between index and these values is
+// discarded. Panics if trying to move values beyond the bottom of the stack.
+func (s *Stack) moveTop(n, index int) {
+	copy(s.data[index:], s.data[len(s.data)-n:])
+	s.data = s.data[:index+n]
+}
+
 // peek returns a value on the stack that is a given distance from the top.
 // Passing 0 means "give me the value on the top of the stack". The stack is not
 // changed at all. Panics if trying to get a value beyond the bottom of the
@@ -0,0 +1,203 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+)
+
+// Tracer is something that receives every instruction executed by the VM. This
+// is meant for debugging the VM and the compiler. See TextTracer and
+// JSONTracer for ready-to-use implementations.
+type Tracer interface {
+	// Trace is called right before each instruction is executed.
+	Trace(event *TraceEvent)
+}
+
+// TracerFunc is an adapter that allows to use an ordinary function as a
+// Tracer.
+type TracerFunc func(event *TraceEvent)
+
+// Trace calls f(event).
+func (f TracerFunc) Trace(event *TraceEvent) {
+	f(event)
+}
+
+// TraceEvent is what a Tracer receives for each instruction executed.
+type TraceEvent struct {
+	// Storyworld is the compiled storyworld being run.
+	Storyworld *bytecode.CompiledStoryworld
+
+	// DebugInfo is the debug information corresponding to Storyworld. It may
+	// be nil.
+	DebugInfo *bytecode.DebugInfo
+
+	// ChunkIndex is the index of the Chunk containing the instruction.
+	ChunkIndex int
+
+	// Offset is the offset of the instruction in the Chunk.
+	Offset int
+
+	// Line is the source code line that generated the instruction, or zero if
+	// not known.
+	Line int
+
+	// Stack is a snapshot of the VM stack before the instruction is executed,
+	// from the bottom to the top.
+	Stack []bytecode.Value
+}
+
+// ChunkName returns the name of the function or Passage containing the
+// instruction, or an empty string if not known.
+func (e *TraceEvent) ChunkName() string {
+	if e.DebugInfo == nil {
+		return ""
+	}
+	return e.DebugInfo.ChunksNames[e.ChunkIndex]
+}
+
+// Instruction returns the disassembled instruction, like "READ_LOCAL 1 (x)".
+func (e *TraceEvent) Instruction() string {
+	var sb strings.Builder
+	e.Storyworld.DisassembleOpcode(e.Storyworld.Chunks[e.ChunkIndex], &sb, e.Offset, e.locals())
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// locals returns the local variables of the Chunk containing the instruction,
+// or nil if not known.
+func (e *TraceEvent) locals() []bytecode.LocalVar {
+	if e.DebugInfo == nil || e.ChunkIndex >= len(e.DebugInfo.ChunksLocals) {
+		return nil
+	}
+	return e.DebugInfo.ChunksLocals[e.ChunkIndex]
+}
+
+// TextTracer is a Tracer that writes a human-readable trace: the stack
+// contents, followed by the disassembled instruction. Write errors are not
+// reported while tracing; see Err().
+type TextTracer struct {
+	w   io.Writer
+	err error
+}
+
+// NewTextTracer creates a new TextTracer writing to w.
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{w: w}
+}
+
+// Trace implements the Tracer interface.
+func (t *TextTracer) Trace(event *TraceEvent) {
+	if t.err != nil {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("          ")
+	for _, v := range event.Stack {
+		fmt.Fprintf(&sb, "[ %v ]", v)
+	}
+	sb.WriteString("\n")
+
+	var lines []int
+	if event.DebugInfo != nil {
+		lines = event.DebugInfo.ChunksLines[event.ChunkIndex]
+	}
+	event.Storyworld.DisassembleInstruction(event.Storyworld.Chunks[event.ChunkIndex], &sb, event.Offset, lines,
+		event.locals())
+
+	_, t.err = io.WriteString(t.w, sb.String())
+}
+
+// Err returns the first error that happened while writing the trace, if any.
+func (t *TextTracer) Err() error {
+	return t.err
+}
+
+// JSONTracer is a Tracer that writes a trace in the JSON Lines format: one JSON
+// object per instruction, each on its own line. Objects look like this (but
+// without the line breaks):
+//
+//	{"chunk":0,"name":"Main@1","offset":2,"line":3,
+//	 "instruction":"READ_LOCAL 1 (counter)",
+//	 "stack":[{"kind":"passage","value":"<passage 0>"},{"kind":"int","value":"0"}]}
+//
+// The name and line are omitted when there is no debug information. Write
+// errors are not reported while tracing; see Err().
+type JSONTracer struct {
+	encoder *json.Encoder
+	err     error
+}
+
+// jsonTraceEntry is the format of each entry written by the JSONTracer.
+type jsonTraceEntry struct {
+	Chunk       int              `json:"chunk"`
+	Name        string           `json:"name,omitempty"`
+	Offset      int              `json:"offset"`
+	Line        int              `json:"line,omitempty"`
+	Instruction string           `json:"instruction"`
+	Stack       []jsonTraceValue `json:"stack"`
+}
+
+// jsonTraceValue is the format of each stack value written by the JSONTracer.
+type jsonTraceValue struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// NewJSONTracer creates a new JSONTracer writing to w.
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &JSONTracer{encoder: encoder}
+}
+
+// Trace implements the Tracer interface.
+func (t *JSONTracer) Trace(event *TraceEvent) {
+	if t.err != nil {
+		return
+	}
+
+	entry := &jsonTraceEntry{
+		Chunk:       event.ChunkIndex,
+		Name:        event.ChunkName(),
+		Offset:      event.Offset,
+		Line:        event.Line,
+		Instruction: event.Instruction(),
+		Stack:       make([]jsonTraceValue, len(event.Stack)),
+	}
+	for i, v := range event.Stack {
+		entry.Stack[i] = jsonTraceValue{Kind: v.Kind().String(), Value: v.String()}
+	}
+
+	t.err = t.encoder.Encode(entry)
+}
+
+// Err returns the first error that happened while writing the trace, if any.
+func (t *JSONTracer) Err() error {
+	return t.err
+}
+
+// trace sends the instruction about to be executed to the Tracer.
+func (vm *VM) trace() {
+	event := &TraceEvent{
+		Storyworld: vm.csw,
+		DebugInfo:  vm.debugInfo,
+		ChunkIndex: vm.frame.chunkIndex,
+		Offset:     vm.frame.ip,
+		Stack:      append([]bytecode.Value{}, vm.stack.data...),
+	}
+	if lines := vm.currentLines(); lines != nil {
+		event.Line = lines[vm.frame.ip]
+	}
+	vm.Tracer.Trace(event)
+}
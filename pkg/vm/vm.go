@@ -10,24 +10,36 @@ package vm
 import (
 	"fmt"
 	"math"
-	"os"
 	"strconv"
+	"strings"
 
 	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
 )
 
 // VM is a Romualdo Virtual Machine.
 type VM struct {
-	// Set DebugTraceExecution to true to make the VM disassemble the code as it
-	// runs through it.
-	DebugTraceExecution bool
+	// Tracer, if not nil, receives each instruction right before it runs. See
+	// TextTracer and JSONTracer.
+	Tracer Tracer
+
+	// Debugger, if not nil, is consulted before running each instruction, and
+	// can pause the execution.
+	Debugger Debugger
+
+	// Profiler, if not nil, collects statistics about the instructions run.
+	Profiler *Profiler
+
+	// Sink receives whatever the Storyworld says. This is how the program
+	// running the Storyworld gets the narrative text to show to the player. If
+	// nil, anything said is simply discarded.
+	Sink Sink
 
 	// csw is the compiled storyworld we are executing.
 	csw *bytecode.CompiledStoryworld
 
-	// debugInfo contains the debug information corresponding to csw.
-	// TODO: Make this optional. If nil, issue less friendly error messages,
-	// etc.
+	// debugInfo contains the debug information corresponding to csw. This is
+	// optional: if nil, we issue less friendly error messages, traces, etc.
 	debugInfo *bytecode.DebugInfo
 
 	// stack is the VM stack, used for storing values during interpretation.
@@ -39,18 +51,72 @@ type VM struct {
 
 	// The current call frame (the one on top of VM.frames).
 	frame *callFrame
+
+	// natives contains the native functions registered with the VM, indexed
+	// by name.
+	natives map[string]*nativeFunction
+
+	// listening contains what was passed to the listen expression the VM is
+	// currently waiting on. It is nil if the VM is not waiting for input.
+	listening *ListenEvent
+
+	// lastError is the runtime error that stopped the last execution, if any.
+	lastError *diagnostic.Diagnostic
+
+	// lastStackTrace is the stack trace captured along with lastError.
+	lastStackTrace []string
+
+	// paused tells if the execution was paused by the Debugger.
+	paused bool
+}
+
+// Status is the status of the VM after it stops running the Storyworld.
+type Status int
+
+const (
+	// StatusFinished means that the Storyworld ran to completion.
+	StatusFinished Status = iota
+
+	// StatusWaitingForInput means that the Storyworld is waiting on a listen
+	// expression. The execution can be resumed with VM.Resume().
+	StatusWaitingForInput
+
+	// StatusRuntimeError means that the execution was aborted by a runtime
+	// error.
+	StatusRuntimeError
+
+	// StatusPaused means that the execution was paused by the Debugger. It can
+	// be continued with VM.Continue().
+	StatusPaused
+)
+
+// String converts the Status to a string.
+func (s Status) String() string {
+	switch s {
+	case StatusFinished:
+		return "finished"
+	case StatusWaitingForInput:
+		return "waiting for input"
+	case StatusRuntimeError:
+		return "runtime error"
+	case StatusPaused:
+		return "paused"
+	default:
+		return fmt.Sprintf("<invalid status %d>", int(s))
+	}
 }
 
 // New returns a new Virtual Machine.
 func New() *VM {
 	return &VM{
-		stack: &Stack{},
+		stack:   &Stack{},
+		natives: map[string]*nativeFunction{},
 	}
 }
 
 // currentChunk returns the chunk currently being executed.
 func (vm *VM) currentChunk() *bytecode.Chunk {
-	return vm.csw.Chunks[vm.frame.function.ChunkIndex]
+	return vm.csw.Chunks[vm.frame.chunkIndex]
 }
 
 // currentLines returns the map from instruction to source code lines for the
@@ -59,7 +125,7 @@ func (vm *VM) currentLines() []int {
 	if vm.debugInfo == nil {
 		return nil
 	}
-	return vm.debugInfo.ChunksLines[vm.frame.function.ChunkIndex]
+	return vm.debugInfo.ChunksLines[vm.frame.chunkIndex]
 }
 
 // readByte reads a byte from the current Chunk.
@@ -69,28 +135,99 @@ func (vm *VM) readByte() byte {
 	return vm.currentChunk().Code[index]
 }
 
-// Interpret interprets a given compiled Storyworld.
-// TODO: DebugInfo should be optional.
-func (vm *VM) Interpret(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) bool {
+// Interpret starts interpreting a given compiled Storyworld. di is the debug
+// information corresponding to csw; it is optional and can be nil. Runs until
+// the Storyworld finishes, a runtime error happens, or the Storyworld waits for
+// input from the player. In the latter case, the choices offered to the player
+// are available from VM.Listening(), and the execution can be continued with
+// VM.Resume().
+func (vm *VM) Interpret(csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) Status {
 	vm.csw = csw
 	vm.debugInfo = di
+	vm.stack = &Stack{}
+	vm.frames = nil
+	vm.listening = nil
+	vm.lastError = nil
+	vm.lastStackTrace = nil
+	vm.paused = false
+
+	return vm.runProtected(func() {
+		vm.callEntryPassage()
+	})
+}
 
-	// TODO: Eventually, we'll start from a Passage, not a function.
+// Resume continues the execution of a Storyworld that is waiting for input.
+// choice is the player's choice, which will be the value of the listen
+// expression the Storyworld is waiting on. It is an error to call Resume when
+// the VM is not waiting for input.
+func (vm *VM) Resume(choice string) Status {
+	if vm.listening == nil {
+		panic("vm.Resume() called but the VM is not waiting for input")
+	}
 
-	// Function calls push the callable thing. Here we have an implicit call to
-	// the initial function, so we push the initial function. This keeps this
-	// implicit call consistent with calls made by the user, and avoid having to
-	// treat it as a special case elsewhere.
-	vm.push(bytecode.NewValueFunction(csw.FirstChunk))
-	f := bytecode.Function{ChunkIndex: csw.FirstChunk}
-	vm.callFunction(f, 0)
-	vm.frame = vm.frames[0]
+	vm.listening = nil
+	vm.lastError = nil
+	vm.lastStackTrace = nil
+	return vm.runProtected(func() {
+		vm.push(vm.NewInternedValueString(choice))
+	})
+}
+
+// Listening returns what was passed to the listen expression the VM is waiting
+// on (typically, the choices available to the player). Returns nil if the VM is
+// not waiting for input.
+func (vm *VM) Listening() *ListenEvent {
+	return vm.listening
+}
+
+// runProtected calls prepare, then runs the code from the current point until
+// the execution stops. Runtime errors are recovered from and reported as
+// StatusRuntimeError.
+func (vm *VM) runProtected(prepare func()) (status Status) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isRuntimeError := r.(*runtimeErrorPanic); isRuntimeError {
+				vm.listening = nil
+				status = StatusRuntimeError
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	if vm.Profiler != nil {
+		defer vm.Profiler.stop()
+	}
+
+	prepare()
+
+	if !vm.run() {
+		return StatusRuntimeError
+	}
+
+	if vm.paused {
+		return StatusPaused
+	}
+
+	if vm.listening != nil {
+		return StatusWaitingForInput
+	}
 
-	r := vm.run()
 	if vm.stack.size() != 0 {
 		vm.runtimeError("Stack size should be zero after execution, was %v.", vm.stack.size())
 	}
-	return r
+	return StatusFinished
+}
+
+// callEntryPassage prepares the VM to run the entry Passage of the Storyworld.
+func (vm *VM) callEntryPassage() {
+	// Function calls push the callable thing. Here we have an implicit call to
+	// the entry Passage, so we push the entry Passage. This keeps this implicit
+	// call consistent with calls made by the user, and avoid having to treat it
+	// as a special case elsewhere.
+	vm.push(bytecode.NewValuePassage(vm.csw.EntryPassage))
+	vm.callChunk(vm.csw.EntryPassage, 0)
+	vm.frame = vm.frames[0]
 }
 
 // NewInternedValueString creates a new Value initialized to the interned string
@@ -105,19 +242,22 @@ func (vm *VM) NewInternedValueString(v string) bytecode.Value {
 	return bytecode.NewValueString(s)
 }
 
-// run runs the code in vm.chunk.
+// run runs the code from the current point. Returns true if the execution
+// stopped without errors, either because the Storyworld finished, because it
+// is waiting for input, or because the Debugger paused it.
 func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 	for {
-		if vm.DebugTraceExecution {
-			fmt.Print("          ")
-
-			for _, v := range vm.stack.data {
-				fmt.Printf("[ %v ]", v)
-			}
+		if vm.Debugger != nil && vm.Debugger.ShouldPause(vm) {
+			vm.paused = true
+			return true
+		}
 
-			fmt.Print("\n")
+		if vm.Tracer != nil {
+			vm.trace()
+		}
 
-			vm.csw.DisassembleInstruction(vm.currentChunk(), os.Stdout, vm.frame.ip, vm.currentLines())
+		if vm.Profiler != nil {
+			vm.Profiler.instruction(vm, vm.currentChunk().Code[vm.frame.ip])
 		}
 
 		currentChunk := vm.currentChunk()
@@ -156,43 +296,43 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			vm.push(bytecode.NewValueBool(!bytecode.ValuesEqual(a, b)))
 
 		case bytecode.OpGreater:
-			a, b, ok := vm.popTwoUnboundedNumberOperands()
+			a, b, ok := vm.popTwoComparableOperands()
 			if !ok {
 				return false
 			}
 			vm.push(bytecode.NewValueBool(a > b))
 
 		case bytecode.OpGreaterEqual:
-			a, b, ok := vm.popTwoUnboundedNumberOperands()
+			a, b, ok := vm.popTwoComparableOperands()
 			if !ok {
 				return false
 			}
 			vm.push(bytecode.NewValueBool(a >= b))
 
 		case bytecode.OpLess:
-			a, b, ok := vm.popTwoUnboundedNumberOperands()
+			a, b, ok := vm.popTwoComparableOperands()
 			if !ok {
 				return false
 			}
 			vm.push(bytecode.NewValueBool(a < b))
 
 		case bytecode.OpLessEqual:
-			a, b, ok := vm.popTwoUnboundedNumberOperands()
+			a, b, ok := vm.popTwoComparableOperands()
 			if !ok {
 				return false
 			}
 			vm.push(bytecode.NewValueBool(a <= b))
 
 		case bytecode.OpAdd:
-			switch {
-			case vm.peek(0).IsString() && vm.peek(1).IsString():
+			switch vm.commonOperandsKind() {
+			case bytecode.ValueString:
 				a, b, ok := vm.popTwoStringOperands()
 				if !ok {
 					return false
 				}
 				vm.push(vm.NewInternedValueString(a + b))
 
-			case vm.peek(0).IsInt() && vm.peek(1).IsInt():
+			case bytecode.ValueInt:
 				a, b, ok := vm.popTwoIntOperands()
 				if !ok {
 					return false
@@ -208,16 +348,16 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			}
 
 		case bytecode.OpAddBNum:
-			a, b, ok := vm.popTwoFloatOperands()
+			a, b, ok := vm.popTwoBNumOperands()
 			if !ok {
 				return false
 			}
 			a = boundedInverseTransform(a)
 			b = boundedInverseTransform(b)
-			vm.push(bytecode.NewValueFloat(boundedTransform(a + b)))
+			vm.push(bytecode.NewValueBNum(boundedTransform(a + b)))
 
 		case bytecode.OpSubtract:
-			if vm.peek(0).IsInt() && vm.peek(1).IsInt() {
+			if vm.commonOperandsKind() == bytecode.ValueInt {
 				a, b, ok := vm.popTwoIntOperands()
 				if !ok {
 					return false
@@ -232,16 +372,16 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			}
 
 		case bytecode.OpSubtractBNum:
-			a, b, ok := vm.popTwoFloatOperands()
+			a, b, ok := vm.popTwoBNumOperands()
 			if !ok {
 				return false
 			}
 			a = boundedInverseTransform(a)
 			b = boundedInverseTransform(b)
-			vm.push(bytecode.NewValueFloat(boundedTransform(a - b)))
+			vm.push(bytecode.NewValueBNum(boundedTransform(a - b)))
 
 		case bytecode.OpMultiply:
-			if vm.peek(0).IsInt() && vm.peek(1).IsInt() {
+			if vm.commonOperandsKind() == bytecode.ValueInt {
 				a, b, ok := vm.popTwoIntOperands()
 				if !ok {
 					return false
@@ -270,13 +410,13 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			vm.push(bytecode.NewValueFloat(math.Pow(a, b)))
 
 		case bytecode.OpBlend:
-			x, y, weight, ok := vm.popThreeFloatOperands()
+			x, y, weight, ok := vm.popThreeBNumOperands()
 			if !ok {
 				return false
 			}
 			uWeight := 1 - ((1 - weight) / 2)
 			result := y*uWeight + x*(1-uWeight)
-			vm.push(bytecode.NewValueFloat(result))
+			vm.push(bytecode.NewValueBNum(result))
 
 		case bytecode.OpJump:
 			jumpOffset := int8(vm.readByte())
@@ -335,13 +475,16 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			vm.push(bytecode.NewValueBool(!vm.pop().AsBool()))
 
 		case bytecode.OpNegate:
-			switch {
-			case vm.peek(0).IsInt():
+			switch vm.peek(0).Kind() {
+			case bytecode.ValueInt:
 				vm.push(bytecode.NewValueInt(-vm.pop().AsInt()))
 
-			case vm.peek(0).IsFloat():
+			case bytecode.ValueFloat:
 				vm.push(bytecode.NewValueFloat(-vm.pop().AsFloat()))
 
+			case bytecode.ValueBNum:
+				vm.push(bytecode.NewValueBNum(-vm.pop().AsBNum()))
+
 			default:
 				vm.runtimeError("Operand must be a number.")
 				return false
@@ -352,6 +495,27 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			vm.callValue(vm.peek(argCount), argCount)
 			vm.frame = vm.frames[len(vm.frames)-1]
 
+		case bytecode.OpGosub:
+			argCount := int(vm.readByte())
+			callee := vm.peek(argCount)
+			if !callee.IsPassage() {
+				vm.runtimeError("Trying to gosub a non-Passage value: %v", callee)
+			}
+			vm.callChunk(callee.AsPassage().ChunkIndex, argCount)
+			vm.frame = vm.frames[len(vm.frames)-1]
+
+		case bytecode.OpCallNative:
+			argCount := int(vm.readByte())
+			vm.callNative(argCount)
+
+		case bytecode.OpGoto:
+			argCount := int(vm.readByte())
+			callee := vm.peek(argCount)
+			if !callee.IsPassage() {
+				vm.runtimeError("Trying to goto a non-Passage value: %v", callee)
+			}
+			vm.replaceFrame(callee.AsPassage().ChunkIndex, argCount)
+
 		case bytecode.OpReturnValue:
 			retVal := vm.stack.pop()
 			if vm.executeReturnOp() {
@@ -372,25 +536,25 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			d := vm.pop().AsInt()
 			v := vm.pop()
 
-			switch {
-			case v.IsInt():
+			switch v.Kind() {
+			case bytecode.ValueInt:
 				vm.push(v)
-			case v.IsFloat():
+			case bytecode.ValueFloat:
 				vm.push(bytecode.NewValueInt(int64(v.AsFloat())))
-			case v.IsBool():
+			case bytecode.ValueBool:
 				r := int64(0)
 				if v.AsBool() {
 					r = 1
 				}
 				vm.push(bytecode.NewValueInt(r))
-			case v.IsString():
+			case bytecode.ValueString:
 				r, err := strconv.ParseInt(v.AsString(), 10, 64)
 				if err != nil {
 					r = d
 				}
 				vm.push(bytecode.NewValueInt(r))
 			default:
-				vm.runtimeError("Unexpected type on conversion to int: %T", v.Value)
+				vm.runtimeError("Unexpected type on conversion to int: %v", v.Kind())
 			}
 
 		case bytecode.OpToFloat:
@@ -401,50 +565,56 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			d := vm.pop().AsFloat()
 			v := vm.pop()
 
-			switch {
-			case v.IsFloat():
+			switch v.Kind() {
+			case bytecode.ValueFloat:
 				vm.push(v)
-			case v.IsInt():
+			case bytecode.ValueBNum:
+				vm.push(bytecode.NewValueFloat(v.AsBNum()))
+			case bytecode.ValueInt:
 				vm.push(bytecode.NewValueFloat(float64(v.AsInt())))
-			case v.IsBool():
+			case bytecode.ValueBool:
 				r := float64(0.0)
 				if v.AsBool() {
 					r = 1.0
 				}
 				vm.push(bytecode.NewValueFloat(r))
-			case v.IsString():
+			case bytecode.ValueString:
 				r, err := strconv.ParseFloat(v.AsString(), 64)
 				if err != nil {
 					r = d
 				}
 				vm.push(bytecode.NewValueFloat(r))
 			default:
-				vm.runtimeError("Unexpected type on conversion to float: %T", v.Value)
+				vm.runtimeError("Unexpected type on conversion to float: %v", v.Kind())
 			}
 
 		case bytecode.OpToBNum:
-			if !vm.peek(0).IsFloat() {
-				vm.runtimeError("Default value for conversion to bnum must be a floating point number.")
+			if !vm.peek(0).IsBNum() {
+				vm.runtimeError("Default value for conversion to bnum must be a bounded number.")
 				return false
 			}
-			d := vm.pop().AsFloat()
+			d := vm.pop().AsBNum()
 			v := vm.pop()
 
-			switch {
-			case v.IsFloat():
+			switch v.Kind() {
+			case bytecode.ValueBNum:
+				vm.push(v)
+			case bytecode.ValueFloat:
 				r := v.AsFloat()
-				if r <= 0.0 || r >= 1.0 {
+				if r <= -1.0 || r >= 1.0 {
 					r = d
 				}
-				vm.push(bytecode.NewValueFloat(r))
-			case v.IsString():
-				r, err := strconv.ParseFloat(v.AsString(), 64)
-				if err != nil || r <= 0.0 || r >= 1.0 {
+				vm.push(bytecode.NewValueBNum(r))
+			case bytecode.ValueString:
+				// Accept both "0.1" and "0.1b", so that converting a bnum to a
+				// string and back yields the original value.
+				r, err := strconv.ParseFloat(strings.TrimSuffix(v.AsString(), "b"), 64)
+				if err != nil || r <= -1.0 || r >= 1.0 {
 					r = d
 				}
-				vm.push(bytecode.NewValueFloat(r))
+				vm.push(bytecode.NewValueBNum(r))
 			default:
-				vm.runtimeError("Unexpected type on conversion to bnum: %T", v.Value)
+				vm.runtimeError("Unexpected type on conversion to bnum: %v", v.Kind())
 			}
 
 		case bytecode.OpToString:
@@ -456,6 +626,21 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			v := vm.pop()
 			fmt.Printf("%v\n", v)
 
+		case bytecode.OpSay:
+			event := &SayEvent{
+				Attributes: vm.popAttributes(int(vm.readByte())),
+			}
+			if vm.Sink != nil {
+				vm.Sink.Say(event)
+			}
+
+		case bytecode.OpListen:
+			// Suspend the execution. The choice will be pushed by Resume().
+			vm.listening = &ListenEvent{
+				Attributes: vm.popAttributes(int(vm.readByte())),
+			}
+			return true
+
 		case bytecode.OpReadGlobal:
 			value := vm.readGlobal()
 			vm.push(value)
@@ -469,6 +654,14 @@ func (vm *VM) run() bool { // nolint: funlen, gocyclo, gocognit
 			value := vm.top()
 			vm.writeGlobal(value)
 
+		case bytecode.OpReadGlobalLong:
+			value := vm.readLongGlobal()
+			vm.push(value)
+
+		case bytecode.OpWriteGlobalLong:
+			value := vm.top()
+			vm.writeLongGlobal(value)
+
 		case bytecode.OpWriteLocal:
 			value := vm.top()
 			index := vm.readByte()
@@ -499,6 +692,17 @@ func (vm *VM) executeReturnOp() bool {
 	return false
 }
 
+// popAttributes pops attrCount attributes (name and value pairs) from the
+// stack, as used by the SAY and LISTEN instructions.
+func (vm *VM) popAttributes(attrCount int) Attributes {
+	attrs := make(Attributes, attrCount)
+	for i := attrCount - 1; i >= 0; i-- {
+		attrs[i].Value = vm.pop()
+		attrs[i].Name = vm.pop().AsString()
+	}
+	return attrs
+}
+
 // readConstant reads a single-byte constant index from the chunk bytecode and
 // returns the corresponding constant value.
 func (vm *VM) readConstant() bytecode.Value {
@@ -533,6 +737,23 @@ func (vm *VM) writeGlobal(value bytecode.Value) {
 	vm.frame.ip++
 }
 
+// readLongGlobal reads a four-byte global index from the chunk bytecode and
+// returns the corresponding global variable value.
+func (vm *VM) readLongGlobal() bytecode.Value {
+	index := bytecode.DecodeUInt31(vm.currentChunk().Code[vm.frame.ip:])
+	vm.frame.ip += 4
+	return vm.csw.Globals[index].Value
+}
+
+// writeLongGlobal sets the value of a global variable to value. For the
+// variable, reads a four-byte index from the chunk bytecode and uses it as the
+// index into the globals table.
+func (vm *VM) writeLongGlobal(value bytecode.Value) {
+	index := bytecode.DecodeUInt31(vm.currentChunk().Code[vm.frame.ip:])
+	vm.frame.ip += 4
+	vm.csw.Globals[index].Value = value
+}
+
 // push pushes a value into the VM stack.
 func (vm *VM) push(value bytecode.Value) {
 	vm.stack.push(value)
@@ -560,48 +781,157 @@ func (vm *VM) peek(distance int) bytecode.Value {
 // Assumes that the callable thing and its arguments were pushed into the stack.
 // Pushes a new frame into vm.frames.
 func (vm *VM) callValue(callee bytecode.Value, argCount int) {
-	f, ok := callee.Value.(bytecode.Function)
-	if !ok {
+	switch {
+	case callee.IsFunction():
+		// TODO: This would be a good place to impose a limit to the call stack
+		//       size. See discussion in TODO.md.
+		vm.callChunk(callee.AsFunction().ChunkIndex, argCount)
+	case callee.IsPassage():
+		vm.runtimeError("Passages cannot be called like functions: %v", callee)
+	default:
 		vm.runtimeError("Trying to call a non-callable value: %v", callee)
 	}
-
-	// TODO: This would be a good place to impose a limit to the call stack
-	//       size. See discussion in TODO.md.
-
-	vm.callFunction(f, argCount)
 }
 
-// callFunction calls function f. Assumes that the function and its arguments
-// were pushed into the stack. Pushes a new frame into vm.frames.
-func (vm *VM) callFunction(f bytecode.Function, argCount int) {
+// callChunk calls the function or Passage whose code is in the Chunk at
+// chunkIndex. Assumes that the callable thing and its arguments were pushed
+// into the stack. Pushes a new frame into vm.frames.
+func (vm *VM) callChunk(chunkIndex int, argCount int) {
 	vm.frames = append(vm.frames, &callFrame{
-		function: f,
-		stack:    vm.stack.createView(argCount + 1), // "+1" is the callee, which is on the stack
+		chunkIndex: chunkIndex,
+		stack:      vm.stack.createView(argCount + 1), // "+1" is the callee, which is on the stack
 	})
 }
 
+// replaceFrame replaces the current call frame with one that runs the function
+// or Passage whose code is in the Chunk at chunkIndex. Assumes that the
+// callable thing and its arguments were pushed into the stack. These are moved
+// to the base of the current frame, replacing everything the current frame had
+// on the stack. This is what a goto does.
+func (vm *VM) replaceFrame(chunkIndex int, argCount int) {
+	vm.stack.moveTop(argCount+1, vm.frame.stack.base) // "+1" is the callee
+	vm.frame.chunkIndex = chunkIndex
+	vm.frame.ip = 0
+}
+
+// LastError returns the runtime error that stopped the last execution (started
+// by Interpret() or Resume()), or nil if it didn't stop because of an error.
+func (vm *VM) LastError() *diagnostic.Diagnostic {
+	return vm.lastError
+}
+
+// LastStackTrace returns the stack trace captured when the runtime error
+// returned by LastError() happened, one line per call frame, innermost frame
+// first. Returns nil if the last execution didn't stop because of an error.
+func (vm *VM) LastStackTrace() []string {
+	return vm.lastStackTrace
+}
+
 // runtimeError stops the execution and reports a runtime error with a given
-// message and fmt.Printf-like arguments.
+// message and fmt.Printf-like arguments. The error is stored (see LastError()),
+// along with a stack trace (see LastStackTrace()); showing them is up to the
+// host. With debug information, the error points to the exact expression or
+// statement that failed, and the stack trace shows the values of the local
+// variables of each frame.
+// If we don't have debug information, the stack trace shows chunk indices and
+// code offsets instead of function names and source code lines.
 //
 // TODO: I need to think better about error handling in Romualdo. Especially
 // those runtime errors that should be (an AFAIK are) caught in compile-time.
 func (vm *VM) runtimeError(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	vm.lastError = &diagnostic.Diagnostic{
+		Code:     diagnostic.CodeRuntimeError,
+		Severity: diagnostic.SeverityError,
+		File:     vm.currentFile(),
+		Line:     vm.currentLine(),
+		Message:  fmt.Sprintf(format, a...),
+	}
+	if span := vm.currentSpan(); span.StartLine > 0 {
+		vm.lastError.Line = span.StartLine
+		vm.lastError.Column = span.StartColumn
+		vm.lastError.EndLine = span.EndLine
+		vm.lastError.EndColumn = span.EndColumn
+	}
 
+	vm.lastStackTrace = []string{}
 	for i := len(vm.frames) - 1; i >= 0; i-- {
 		frame := vm.frames[i]
-		function := frame.function
 		instructionOffset := frame.ip - 1
-		chunkIndex := function.ChunkIndex
+		chunkIndex := frame.chunkIndex
+		if vm.debugInfo == nil {
+			vm.lastStackTrace = append(vm.lastStackTrace,
+				fmt.Sprintf("[offset %v] in chunk %v", instructionOffset, chunkIndex))
+			continue
+		}
 		lineNumber := vm.debugInfo.ChunksLines[chunkIndex][instructionOffset]
 		functionName := vm.debugInfo.ChunksNames[chunkIndex]
-		fmt.Fprintf(os.Stderr, "[line %v] in %v\n", lineNumber, functionName)
+		if file := vm.debugInfo.ChunkFile(chunkIndex); file != "" {
+			vm.lastStackTrace = append(vm.lastStackTrace,
+				fmt.Sprintf("[%v:%v] in %v%v", file, lineNumber, functionName, vm.describeLocals(i)))
+			continue
+		}
+		vm.lastStackTrace = append(vm.lastStackTrace,
+			fmt.Sprintf("[line %v] in %v%v", lineNumber, functionName, vm.describeLocals(i)))
+	}
+
+	panic(&runtimeErrorPanic{})
+}
+
+// describeLocals returns the local variables of the frame at frameIndex and
+// their values, formatted for stack traces, like " (x = 1, name = Bob)".
+// Returns an empty string if there are no local variables or if they are not
+// known.
+func (vm *VM) describeLocals(frameIndex int) string {
+	frame := vm.frames[frameIndex]
+	end := vm.stack.size()
+	if frameIndex < len(vm.frames)-1 {
+		end = vm.frames[frameIndex+1].stack.base
+	}
+
+	vars := []string{}
+	for _, local := range vm.debugInfo.LocalsAt(frame.chunkIndex, frame.ip-1) {
+		if slot := frame.stack.base + local.Slot; slot < end {
+			vars = append(vars, fmt.Sprintf("%v = %v", local.Name, vm.stack.data[slot]))
+		}
 	}
 
-	fmt.Fprint(os.Stderr, "\n")
-	panic("runtimeError() called, aborting execution")
+	if len(vars) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(vars, ", ") + ")"
 }
 
+// currentLine returns the source code line of the instruction being executed,
+// or zero if not known.
+func (vm *VM) currentLine() int {
+	if vm.debugInfo == nil || vm.frame == nil || vm.frame.ip == 0 {
+		return 0
+	}
+	return vm.debugInfo.ChunksLines[vm.frame.chunkIndex][vm.frame.ip-1]
+}
+
+// currentFile returns the name of the source file of the code being executed,
+// or an empty string if not known.
+func (vm *VM) currentFile() string {
+	if vm.debugInfo == nil || vm.frame == nil {
+		return ""
+	}
+	return vm.debugInfo.ChunkFile(vm.frame.chunkIndex)
+}
+
+// currentSpan returns the region of the source code that generated the
+// instruction being executed, or a zero SourceSpan if not known.
+func (vm *VM) currentSpan() bytecode.SourceSpan {
+	if vm.debugInfo == nil || vm.debugInfo.ChunksSpans == nil || vm.frame == nil || vm.frame.ip == 0 {
+		return bytecode.SourceSpan{}
+	}
+	return vm.debugInfo.ChunksSpans[vm.frame.chunkIndex][vm.frame.ip-1]
+}
+
+// runtimeErrorPanic is the type used in the panic raised by runtimeError. It is
+// recovered by Interpret, which then reports the failure to its caller.
+type runtimeErrorPanic struct{}
+
 // popTwoIntOperands pops and returns two values from the stack, assumed to be
 // integers, to be used as operands of a binary operator.
 func (vm *VM) popTwoIntOperands() (a, b int64, ok bool) {
@@ -615,33 +945,43 @@ func (vm *VM) popTwoIntOperands() (a, b int64, ok bool) {
 	return
 }
 
-// popTwoFloatOperands pops and returns two values from the stack, assumed to be
-// floating point numbers, to be used as operands of a binary operator.
-func (vm *VM) popTwoFloatOperands() (a, b float64, ok bool) {
-	if !vm.peek(0).IsFloat() || !vm.peek(1).IsFloat() {
-		vm.runtimeError("Operands must be floating point numbers.")
+// popTwoBNumOperands pops and returns two values from the stack, assumed to be
+// bounded numbers, to be used as operands of a binary operator.
+func (vm *VM) popTwoBNumOperands() (a, b float64, ok bool) {
+	if !vm.peek(0).IsBNum() || !vm.peek(1).IsBNum() {
+		vm.runtimeError("Operands must be bounded numbers.")
 		return
 	}
-	b = vm.pop().AsFloat()
-	a = vm.pop().AsFloat()
+	b = vm.pop().AsBNum()
+	a = vm.pop().AsBNum()
 	ok = true
 	return
 }
 
-// popThreeFloatOperands pops and returns three values from the stack, assumed
-// to be floating point numbers, to be used as operands of an operator.
-func (vm *VM) popThreeFloatOperands() (a, b, c float64, ok bool) {
-	if !vm.peek(0).IsFloat() || !vm.peek(1).IsFloat() || !vm.peek(2).IsFloat() {
-		vm.runtimeError("Operands must be floating point numbers.")
+// popThreeBNumOperands pops and returns three values from the stack, assumed
+// to be bounded numbers, to be used as operands of an operator.
+func (vm *VM) popThreeBNumOperands() (a, b, c float64, ok bool) {
+	if !vm.peek(0).IsBNum() || !vm.peek(1).IsBNum() || !vm.peek(2).IsBNum() {
+		vm.runtimeError("Operands must be bounded numbers.")
 		return
 	}
-	c = vm.pop().AsFloat()
-	b = vm.pop().AsFloat()
-	a = vm.pop().AsFloat()
+	c = vm.pop().AsBNum()
+	b = vm.pop().AsBNum()
+	a = vm.pop().AsBNum()
 	ok = true
 	return
 }
 
+// popTwoComparableOperands pops and returns two values from the stack, to be
+// used as operands of a relational operator. They must be either two bounded
+// numbers or two unbounded numbers (integers or floats).
+func (vm *VM) popTwoComparableOperands() (a, b float64, ok bool) {
+	if vm.commonOperandsKind() == bytecode.ValueBNum {
+		return vm.popTwoBNumOperands()
+	}
+	return vm.popTwoUnboundedNumberOperands()
+}
+
 // popTwoUnboundedNumberOperands pops and returns two values from the stack,
 // assumed to be integers ot floats, to be used as operands of a binary
 // operator.
@@ -664,10 +1004,10 @@ func (vm *VM) popTwoUnboundedNumberOperands() (a, b float64, ok bool) {
 // assumed to be and integer ot float, to be used as and operand of some
 // operator.
 func (vm *VM) popUnboundedNumberOperand() (v float64, ok bool) {
-	switch {
-	case vm.peek(0).IsFloat():
+	switch vm.peek(0).Kind() {
+	case bytecode.ValueFloat:
 		return vm.pop().AsFloat(), true
-	case vm.peek(0).IsInt():
+	case bytecode.ValueInt:
 		return float64(vm.pop().AsInt()), true
 	default:
 		vm.runtimeError("Operands must be integer or floating-point numbers.")
@@ -675,6 +1015,21 @@ func (vm *VM) popUnboundedNumberOperand() (v float64, ok bool) {
 	}
 }
 
+// noCommonKind is returned by commonOperandsKind() when the operands have
+// different kinds.
+const noCommonKind bytecode.ValueKind = -1
+
+// commonOperandsKind returns the kind of the two values at the top of the
+// stack, which are the operands of a binary operator, if both have the same
+// kind. Otherwise returns noCommonKind. Doesn't pop anything.
+func (vm *VM) commonOperandsKind() bytecode.ValueKind {
+	k := vm.peek(0).Kind()
+	if vm.peek(1).Kind() != k {
+		return noCommonKind
+	}
+	return k
+}
+
 // popTwoStringOperands pops and returns two values from the stack, assumed to
 // be strings to be used as operands of a binary operator.
 func (vm *VM) popTwoStringOperands() (a, b string, ok bool) {
@@ -709,13 +1064,12 @@ func boundedInverseTransform(boundedNumber float64) float64 {
 // callFrame contains the information needed at runtime about an ongoing
 // function call.
 type callFrame struct {
-	// function is the function running.
-	// TODO: Smells like this could be a Chunk. (Would be better for when
-	// implementing Passages)
-	function bytecode.Function
+	// chunkIndex is the index of the Chunk running, which contains the code of
+	// either a function or a Passage.
+	chunkIndex int
 
 	// ip is the instruction pointer, which points to the next instruction to be
-	// executed (it's an index into function's chunk).
+	// executed (it's an index into the Chunk at chunkIndex).
 	ip int
 
 	// stack is the first index into the VM stack that this function can
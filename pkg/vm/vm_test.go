@@ -0,0 +1,975 @@
+/******************************************************************************\
+* The Romualdo Language                                                        *
+*                                                                              *
+* Copyright 2020-2022 Leandro Motta Barros                                     *
+* Licensed under the MIT license (see LICENSE.txt for details)                 *
+\******************************************************************************/
+
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/stackedboxes/romulang/pkg/ast"
+	"gitlab.com/stackedboxes/romulang/pkg/backend"
+	"gitlab.com/stackedboxes/romulang/pkg/bytecode"
+	"gitlab.com/stackedboxes/romulang/pkg/diagnostic"
+	"gitlab.com/stackedboxes/romulang/pkg/frontend"
+)
+
+// testStoryworldsGlob matches all the test storyworlds that are expected to
+// compile and run successfully.
+const testStoryworldsGlob = "../../tests/new/*.romulang"
+
+// failingStoryworldsGlob matches all the test storyworlds that are expected to
+// fail to compile. Each of them contains a "# expect:" comment listing the
+// codes of the errors expected, in order.
+const failingStoryworldsGlob = "../../tests/fail/*.romulang"
+
+// multiFileStoryworldsGlob matches the directories containing test storyworlds
+// split over multiple files. Those containing "# expect:" comments are expected
+// to fail to compile; the others to compile and run successfully.
+const multiFileStoryworldsGlob = "../../tests/multi/*"
+
+// Tests that every test storyworld runs successfully, both with and without
+// debug information. Whenever a storyworld listens, it gets "a" as the choice.
+func TestRunTestStoryworlds(t *testing.T) {
+	paths, err := filepath.Glob(testStoryworldsGlob)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			csw, di := compileTestStoryworld(t, path)
+
+			theVM := New()
+			assert.Equal(t, StatusFinished, runToCompletion(theVM, csw, di))
+
+			csw, _ = compileTestStoryworld(t, path)
+			theVM = New()
+			assert.Equal(t, StatusFinished, runToCompletion(theVM, csw, nil))
+
+			csw, _ = compileTestStoryworld(t, path)
+			theVM = New()
+			trace := &bytes.Buffer{}
+			theVM.Tracer = NewTextTracer(trace)
+			assert.Equal(t, StatusFinished, runToCompletion(theVM, csw, nil))
+			assert.NotEmpty(t, trace.String())
+
+			assert.NotEmpty(t, csw.Disassemble(nil))
+		})
+	}
+}
+
+// Tests that every failing test storyworld fails to compile with the expected
+// error codes.
+func TestFailingStoryworlds(t *testing.T) {
+	paths, err := filepath.Glob(failingStoryworldsGlob)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			source, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+
+			expected := expectedErrorCodes(string(source))
+			assert.NotEmpty(t, expected, "No '# expect:' comment found")
+
+			root, diags := frontend.Parse(string(source))
+			err = diags.Err()
+			if err == nil {
+				_, _, err = backend.GenerateCode(root)
+			}
+			assert.Equal(t, expected, errorCodes(err))
+		})
+	}
+}
+
+// Tests that storyworlds split over multiple files compile and run, and that
+// the visibility rules for private names are enforced.
+func TestMultiFileStoryworlds(t *testing.T) {
+	paths, err := filepath.Glob(multiFileStoryworldsGlob)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			fs := frontend.NewFileSet()
+			assert.Nil(t, fs.AddDir(path))
+
+			expected := []diagnostic.Code{}
+			for _, file := range fs.Files() {
+				expected = append(expected, expectedErrorCodes(file.Source)...)
+			}
+
+			root, diags := frontend.ParseFileSet(fs, nil)
+			if len(expected) > 0 {
+				assert.Equal(t, expected, diags.Codes())
+				return
+			}
+			assert.Empty(t, diags)
+
+			csw, di, err := backend.GenerateCode(root)
+			assert.Nil(t, err)
+			for i := range csw.Chunks {
+				assert.True(t, strings.HasPrefix(di.ChunkFile(i), path))
+			}
+
+			theVM := New()
+			assert.Equal(t, StatusFinished, runToCompletion(theVM, csw, di))
+		})
+	}
+}
+
+// Tests that private names declared in different files are kept apart when
+// running.
+func TestPrivateNameCollisions(t *testing.T) {
+	csw, di := compileTestDir(t, "../../tests/multi/private_collision")
+
+	said := []string{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.Equal(t, []string{"main helper", "main intro", "other helper 100", "11"}, said)
+}
+
+// Tests that private names are qualified in the same way no matter the working
+// directory the Storyworld is compiled from.
+func TestPrivateNamesDontDependOnWorkingDir(t *testing.T) {
+	csw1, _ := compileTestDir(t, "../../tests/multi/private_collision")
+
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir("../../tests/multi"))
+	defer func() { assert.Nil(t, os.Chdir(wd)) }()
+	csw2, _ := compileTestDir(t, "private_collision")
+
+	var buf1, buf2 bytes.Buffer
+	_, err = csw1.WriteTo(&buf1)
+	assert.Nil(t, err)
+	_, err = csw2.WriteTo(&buf2)
+	assert.Nil(t, err)
+	assert.Equal(t, buf1.Bytes(), buf2.Bytes())
+}
+
+// Tests that snapshots can be restored after adding a file that declares a
+// private name already declared in another file.
+func TestRestoreAfterPrivateNameCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romulang-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	main := "globals@1\n" +
+		"    count: int = 10\n" +
+		"end\n" +
+		"\n" +
+		"passage Main@1(): void\n" +
+		"    count = count + 1\n" +
+		"    var answer: string = \"\"\n" +
+		"    answer = listen \"Continue?\"\n" +
+		"    say answer + string(count)\n" +
+		"end\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "main.romulang"), []byte(main), 0644))
+
+	csw, di := compileTestDir(t, dir)
+	theVM := New()
+	assert.Equal(t, StatusWaitingForInput, theVM.Interpret(csw, di))
+	var snapshot bytes.Buffer
+	assert.NoError(t, theVM.Snapshot(&snapshot))
+
+	other := "function count(): int\n" +
+		"    return 100\n" +
+		"end\n" +
+		"\n" +
+		"passage Other@1(): void\n" +
+		"    say string(count())\n" +
+		"end\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "other.romulang"), []byte(other), 0644))
+
+	csw, di = compileTestDir(t, dir)
+	said := []string{}
+	restoredVM := New()
+	restoredVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.NoError(t, restoredVM.Restore(csw, di, &snapshot))
+	assert.Equal(t, StatusFinished, restoredVM.Resume("count="))
+	assert.Equal(t, []string{"count=11"}, said)
+}
+
+// Tests that runtime errors are reported gracefully, both with and without
+// debug information.
+func TestRuntimeError(t *testing.T) {
+	// A function that tries to negate a string.
+	csw := bytecode.NewCompiledStoryworld()
+	csw.Chunks = []*bytecode.Chunk{{}}
+	csw.EntryPassage = 0
+	csw.AddConstant(bytecode.NewValueString(csw.Strings.Intern("oops")))
+	csw.Chunks[0].Code = []byte{
+		bytecode.OpConstant, 0,
+		bytecode.OpNegate,
+		bytecode.OpReturnVoid,
+	}
+
+	di := &bytecode.DebugInfo{
+		CSWHash:     csw.Hash(),
+		ChunksNames: []string{"main"},
+		ChunksLines: [][]int{{1, 1, 2, 3}},
+	}
+
+	theVM := New()
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, di))
+	assert.Equal(t, diagnostic.CodeRuntimeError, theVM.LastError().Code)
+	assert.Equal(t, 2, theVM.LastError().Line)
+	assert.Equal(t, 0, theVM.LastError().Column)
+	assert.Equal(t, []string{"[line 2] in main"}, theVM.LastStackTrace())
+
+	// With spans in the debug info, the error points to the exact expression.
+	negateSpan := bytecode.SourceSpan{StartLine: 2, StartColumn: 5, EndLine: 2, EndColumn: 12}
+	di.ChunksSpans = [][]bytecode.SourceSpan{{{}, {}, negateSpan, {}}}
+	theVM = New()
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, di))
+	assert.Equal(t, 2, theVM.LastError().Line)
+	assert.Equal(t, 5, theVM.LastError().Column)
+	assert.Equal(t, 12, theVM.LastError().EndColumn)
+	assert.Equal(t, "", theVM.LastError().File)
+
+	// And with file names, it tells which file.
+	di.ChunksFiles = []string{"main.romulang"}
+	theVM = New()
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, di))
+	assert.Equal(t, "main.romulang", theVM.LastError().File)
+
+	theVM = New()
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, nil))
+	assert.Equal(t, 0, theVM.LastError().Line)
+	assert.Equal(t, []string{"[offset 2] in chunk 0"}, theVM.LastStackTrace())
+
+	// The same VM can be used again after a runtime error.
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, nil))
+}
+
+// Tests that say statements deliver their attributes to the sink.
+func TestSay(t *testing.T) {
+	csw, di := compileTestStoryworld(t, "../../tests/new/say.romulang")
+
+	events := []*SayEvent{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		events = append(events, event)
+	})
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+
+	assert.Equal(t, 2, len(events))
+
+	assert.Equal(t, 1, len(events[0].Attributes))
+	assert.Equal(t, "Once upon a time", events[0].Attributes.Text())
+
+	attrs := events[1].Attributes
+	assert.Equal(t, 4, len(attrs))
+	assert.Equal(t, "Hello!", attrs.Text())
+	assert.Equal(t, "speaker", attrs[1].Name)
+	assert.Equal(t, "Knight", attrs[1].Value.AsString())
+	count, ok := attrs.Get("count")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), count.AsInt())
+	brave, ok := attrs.Get("brave")
+	assert.True(t, ok)
+	assert.True(t, brave.AsBool())
+	_, ok = attrs.Get("mood")
+	assert.False(t, ok)
+}
+
+// Tests that bnums are a distinct kind of value at runtime, and that they are
+// formatted, compared and converted as such.
+func TestBNums(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var x: bnum = 0.25b\n" +
+		"    var y: float = 0.25\n" +
+		"    say string(x)\n" +
+		"    say string(y)\n" +
+		"    say string(x + 0.5b)\n" +
+		"    say string(-x)\n" +
+		"    say string(0.2b~0.8b~0.5b)\n" +
+		"    say string(x < 0.5b)\n" +
+		"    say string(x >= 0.5b)\n" +
+		"    say string(x == 0.25b)\n" +
+		"    say string(float(x))\n" +
+		"    say string(bnum(y))\n" +
+		"    say string(bnum(string(x)))\n" +
+		"    say string(bnum(1.5, 0.1b))\n" +
+		"    say string(bnum(-0.5, 0.1b))\n" +
+		"    say string(bnum(string(-x), 0.1b))\n" +
+		"    say string(bnum(-1.0, 0.1b))\n" +
+		"    say { text = \"mood\", mood = x }\n" +
+		"end\n"
+	csw, di := compileTestSource(t, "bnums", source)
+
+	events := []*SayEvent{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		events = append(events, event)
+	})
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+
+	said := []string{}
+	for _, e := range events {
+		said = append(said, e.Attributes.Text())
+	}
+	assert.Equal(t, []string{
+		"0.25b", "0.25", "0.5714285714285714b", "-0.25b", "0.6500000000000001b", "true", "false",
+		"true", "0.25", "0.25b", "0.25b", "0.1b",
+		"-0.5b", "-0.25b", "0.1b", "mood"}, said)
+
+	mood, ok := events[len(events)-1].Attributes.Get("mood")
+	assert.True(t, ok)
+	assert.True(t, mood.IsBNum())
+	assert.Equal(t, 0.25, mood.AsBNum())
+}
+
+// Tests that listen expressions suspend the VM until it is resumed with the
+// player's choice.
+func TestListen(t *testing.T) {
+	csw, di := compileTestStoryworld(t, "../../tests/new/listen.romulang")
+
+	said := []string{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.Nil(t, theVM.Listening())
+
+	status := theVM.Interpret(csw, di)
+	assert.Equal(t, StatusWaitingForInput, status)
+	assert.Equal(t, "What is your name?", theVM.Listening().Attributes.Text())
+	assert.Empty(t, said)
+
+	status = theVM.Resume("Romualdo")
+	assert.Equal(t, StatusWaitingForInput, status)
+	assert.Equal(t, []string{"Hello, Romualdo!"}, said)
+	attrs := theVM.Listening().Attributes
+	assert.Equal(t, 3, len(attrs))
+	assert.Equal(t, "Where to?", attrs.Text())
+	assert.Equal(t, "b", attrs[2].Name)
+	assert.Equal(t, "South", attrs[2].Value.AsString())
+
+	status = theVM.Resume("b")
+	assert.Equal(t, StatusWaitingForInput, status)
+
+	status = theVM.Resume("a")
+	assert.Equal(t, StatusFinished, status)
+	assert.Nil(t, theVM.Listening())
+	assert.Equal(t, []string{"Hello, Romualdo!", "Can't go there.", "Going north."}, said)
+
+	assert.Panics(t, func() { theVM.Resume("a") })
+}
+
+// Tests that goto abandons the current Passage and gosub returns to the caller.
+func TestGotoGosub(t *testing.T) {
+	csw, di := compileTestStoryworld(t, "../../tests/new/goto_gosub.romulang")
+
+	said := []string{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.Equal(t, []string{"Once upon a time.", "The end (good).", "Back to Main."}, said)
+}
+
+// Tests that versioned globals blocks are recorded in the compiled storyworld,
+// and that globals saved under an older version can be upgraded.
+func TestGlobalsVersions(t *testing.T) {
+	csw, _ := compileTestStoryworld(t, "../../tests/new/globals_versions.romulang")
+	assert.Equal(t, 2, csw.GlobalsVersion)
+
+	versions := map[string]int{}
+	for _, g := range csw.Globals {
+		versions[g.Name] = g.Version
+	}
+	assert.Equal(t, map[string]int{"name": 1, "gold": 1, "level": 2, "Main@1": 0}, versions)
+
+	saved := []bytecode.GlobalVar{
+		{Name: "name", Value: bytecode.NewValueString("Saved"), Version: 1},
+		{Name: "gold", Value: bytecode.NewValueInt(99), Version: 1},
+	}
+	upgraded, err := csw.UpgradeGlobals(1, saved)
+	assert.NoError(t, err)
+	csw.Globals = upgraded
+
+	// The VM updates the globals in place: gold was 99 in the save, plus the
+	// initial value of the new level variable.
+	assert.Equal(t, StatusFinished, New().Interpret(csw, nil))
+	assert.Equal(t, bytecode.NewValueInt(100), csw.Globals[csw.GetGlobalIndex("gold")].Value)
+}
+
+// Tests a Storyworld with more than 256 globals, which requires the long
+// variants of the instructions reading and writing globals.
+func TestManyPassages(t *testing.T) {
+	const passageCount = 300
+
+	var source strings.Builder
+	source.WriteString("passage Main@1(): void\n")
+	for i := 0; i < passageCount; i++ {
+		fmt.Fprintf(&source, "    gosub P%v()\n", i)
+	}
+	source.WriteString("end\n")
+	for i := 0; i < passageCount; i++ {
+		fmt.Fprintf(&source, "passage P%v@1(): void\n    count = count + 1\nend\n", i)
+	}
+
+	// Declared last, so that its index doesn't fit in a byte.
+	source.WriteString("globals@1\n    count: int = 0\nend\n")
+
+	csw, di := compileTestSource(t, "many_passages", source.String())
+	assert.Greater(t, csw.GetGlobalIndex("count"), 255)
+	assert.Contains(t, csw.Disassemble(di), "READ_GLOBAL_LONG")
+	assert.Contains(t, csw.Disassemble(di), "WRITE_GLOBAL_LONG")
+
+	assert.Equal(t, StatusFinished, New().Interpret(csw, di))
+	assert.Equal(t, bytecode.NewValueInt(passageCount), csw.Globals[csw.GetGlobalIndex("count")].Value)
+}
+
+// Tests that a snapshot taken while listening can be restored in a new VM, and
+// the execution continues from the same point.
+func TestSnapshotRestore(t *testing.T) {
+	csw, di := compileTestStoryworld(t, "../../tests/new/listen.romulang")
+
+	theVM := New()
+	assert.Error(t, theVM.Snapshot(&bytes.Buffer{}))
+	assert.Equal(t, StatusWaitingForInput, theVM.Interpret(csw, di))
+	assert.Equal(t, StatusWaitingForInput, theVM.Resume("Romualdo"))
+
+	var snapshot bytes.Buffer
+	assert.NoError(t, theVM.Snapshot(&snapshot))
+
+	// Restore into a new VM, running a freshly compiled Storyworld.
+	csw, di = compileTestStoryworld(t, "../../tests/new/listen.romulang")
+	said := []string{}
+	restoredVM := New()
+	restoredVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.NoError(t, restoredVM.Restore(csw, di, &snapshot))
+	assert.Equal(t, "Where to?", restoredVM.Listening().Attributes.Text())
+
+	assert.Equal(t, StatusWaitingForInput, restoredVM.Resume("b"))
+	assert.Equal(t, StatusFinished, restoredVM.Resume("a"))
+	assert.Equal(t, []string{"Can't go there.", "Going north."}, said)
+}
+
+// Tests restoring snapshots with newer versions of the Storyworld.
+func TestRestoreUpgrade(t *testing.T) {
+	const main = "passage Main@1(): void\n" +
+		"    visits = visits + 1\n" +
+		"    var answer: string = \"\"\n" +
+		"    answer = listen \"Continue?\"\n" +
+		"    say answer + string(visits)\n" +
+		"end\n"
+
+	const v1 = "globals@1\n" +
+		"    visits: int = 10\n" +
+		"end\n" + main
+
+	// Adds a global variable and a Passage. Indices into the globals and
+	// constants are baked into the code, so the new stuff must come after
+	// what the running Passage uses.
+	const v2 = "globals@1\n" +
+		"    visits: int = 10\n" +
+		"end\n" +
+		"globals@2\n" +
+		"    visits: int = 0\n" +
+		"    bonus: int = 5\n" +
+		"end\n" + main +
+		"passage Other@1(): void\n" +
+		"    say string(bonus)\n" +
+		"end\n"
+
+	// Changes the running Passage.
+	const v3 = "globals@1\n" +
+		"    visits: int = 10\n" +
+		"end\n" +
+		"passage Main@1(): void\n" +
+		"    var answer: string = \"\"\n" +
+		"    answer = listen \"Continue?\"\n" +
+		"end\n"
+
+	csw, _ := compileTestSource(t, "v1", v1)
+	theVM := New()
+	assert.Equal(t, StatusWaitingForInput, theVM.Interpret(csw, nil))
+	var snapshot bytes.Buffer
+	assert.NoError(t, theVM.Snapshot(&snapshot))
+
+	csw, _ = compileTestSource(t, "v2", v2)
+	said := []string{}
+	theVM = New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.NoError(t, theVM.Restore(csw, nil, bytes.NewReader(snapshot.Bytes())))
+	assert.Equal(t, StatusFinished, theVM.Resume("ok"))
+	assert.Equal(t, []string{"ok11"}, said)
+	assert.Equal(t, bytecode.NewValueInt(5), csw.Globals[csw.GetGlobalIndex("bonus")].Value)
+
+	csw, _ = compileTestSource(t, "v3", v3)
+	err := New().Restore(csw, nil, bytes.NewReader(snapshot.Bytes()))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "'Main@1' is running, but its code has changed")
+}
+
+// Tests that removing functions and Passages that are not running doesn't
+// prevent restoring a snapshot, and that the saved variables are merged into
+// the new version of the Storyworld.
+func TestRestoreWithRemovedCode(t *testing.T) {
+	const main = "passage Main@1(): void\n" +
+		"    visits = visits + 1\n" +
+		"    var answer: string = \"\"\n" +
+		"    answer = listen \"Continue?\"\n" +
+		"    say answer + string(visits)\n" +
+		"end\n"
+
+	const v1 = "globals@1\n" +
+		"    visits: int = 10\n" +
+		"end\n" + main +
+		"function unused(): int\n" +
+		"    return 1\n" +
+		"end\n" +
+		"passage Unused@1(): void\n" +
+		"    meta\n" +
+		"        seen: bool = false\n" +
+		"    end\n" +
+		"    say \"Unused\"\n" +
+		"end\n"
+
+	const v2 = "globals@1\n" +
+		"    visits: int = 10\n" +
+		"end\n" + main
+
+	csw, _ := compileTestSource(t, "v1", v1)
+	theVM := New()
+	assert.Equal(t, StatusWaitingForInput, theVM.Interpret(csw, nil))
+	var snapshot bytes.Buffer
+	assert.NoError(t, theVM.Snapshot(&snapshot))
+
+	// Only variables are saved.
+	s, err := bytecode.ReadSnapshot(bytes.NewReader(snapshot.Bytes()))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, g := range s.Globals {
+		names = append(names, g.Name)
+	}
+	assert.ElementsMatch(t, []string{"visits", "Unused@1.seen"}, names)
+
+	csw, _ = compileTestSource(t, "v2", v2)
+	globalsCount := len(csw.Globals)
+	said := []string{}
+	theVM = New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.NoError(t, theVM.Restore(csw, nil, bytes.NewReader(snapshot.Bytes())))
+	assert.Equal(t, globalsCount, len(csw.Globals))
+	assert.Equal(t, bytecode.NewValueInt(11), csw.Globals[csw.GetGlobalIndex("visits")].Value)
+	assert.Equal(t, StatusFinished, theVM.Resume("ok"))
+	assert.Equal(t, []string{"ok11"}, said)
+}
+
+// Tests that snapshots that don't match the Storyworld, or are corrupted, are
+// rejected with an error.
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	const source = "passage Main@1(): void\n" +
+		"    var answer: string = \"\"\n" +
+		"    answer = listen \"Continue?\"\n" +
+		"    say answer + \"!\"\n" +
+		"end\n"
+
+	csw, _ := compileTestSource(t, "v1", source)
+	theVM := New()
+	assert.Equal(t, StatusWaitingForInput, theVM.Interpret(csw, nil))
+	var snapshot bytes.Buffer
+	assert.NoError(t, theVM.Snapshot(&snapshot))
+
+	// Same code, but a different constant.
+	csw, _ = compileTestSource(t, "v2", strings.Replace(source, "\"!\"", "\"?\"", 1))
+	err := New().Restore(csw, nil, bytes.NewReader(snapshot.Bytes()))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "its code has changed")
+
+	// Instruction pointers out of the Chunk or in the middle of an
+	// instruction.
+	for _, ip := range []int{1, 10_000} {
+		s, err := bytecode.ReadSnapshot(bytes.NewReader(snapshot.Bytes()))
+		assert.NoError(t, err)
+		s.Frames[0].IP = ip
+		var corrupted bytes.Buffer
+		_, err = s.WriteTo(&corrupted)
+		assert.NoError(t, err)
+
+		csw, _ = compileTestSource(t, "v1", source)
+		err = New().Restore(csw, nil, &corrupted)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid instruction pointer")
+	}
+}
+
+// Tests calling native functions registered by the host.
+func TestNativeFunctions(t *testing.T) {
+	theVM := New()
+	played := []string{}
+	err := theVM.RegisterNative("playSound", []*ast.Type{ast.TheTypeString, ast.TheTypeFloat}, ast.TheTypeVoid,
+		func(args []bytecode.Value) (bytecode.Value, error) {
+			played = append(played, fmt.Sprintf("%v@%v", args[0].AsString(), args[1].AsFloat()))
+			return bytecode.Value{}, nil
+		})
+	assert.NoError(t, err)
+	err = theVM.RegisterNative("itemCount", []*ast.Type{ast.TheTypeString}, ast.TheTypeInt,
+		func(args []bytecode.Value) (bytecode.Value, error) {
+			return bytecode.NewValueInt(int64(len(args[0].AsString()))), nil
+		})
+	assert.NoError(t, err)
+	err = theVM.RegisterNative("fail", []*ast.Type{}, ast.TheTypeBool,
+		func(args []bytecode.Value) (bytecode.Value, error) {
+			return bytecode.Value{}, errors.New("host failure")
+		})
+	assert.NoError(t, err)
+
+	// Bad registrations
+	noop := func(args []bytecode.Value) (bytecode.Value, error) { return bytecode.Value{}, nil }
+	assert.Error(t, theVM.RegisterNative("print", nil, ast.TheTypeVoid, noop))
+	assert.Error(t, theVM.RegisterNative("itemCount", nil, ast.TheTypeVoid, noop))
+	assert.Error(t, theVM.RegisterNative("9lives", nil, ast.TheTypeVoid, noop))
+	assert.Error(t, theVM.RegisterNative("f", []*ast.Type{ast.TheTypeVoid}, ast.TheTypeVoid, noop))
+	assert.Error(t, theVM.RegisterNative("g", nil, ast.TheTypeVoid, nil))
+
+	natives := theVM.NativeFunctions()
+	assert.Equal(t, 3, len(natives))
+	assert.Equal(t, "fail", natives[0].Name)
+	assert.Equal(t, "function(string):int", natives[1].Type.String())
+
+	source := "passage Main@1(): void\n" +
+		"    .playSound(\"boom\", 0.5)\n" +
+		"    say string(.itemCount(\"swords\") * 2)\n" +
+		"end\n"
+	root, diags := frontend.ParseWithNatives(source, natives)
+	assert.Empty(t, diags)
+	csw, di, err := backend.GenerateCode(root)
+	assert.NoError(t, err)
+
+	said := []string{}
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.Equal(t, []string{"boom@0.5"}, played)
+	assert.Equal(t, []string{"12"}, said)
+
+	// Errors returned by native functions are runtime errors. They point to
+	// the exact call that failed.
+	root, diags = frontend.ParseWithNatives("passage Main@1(): void\n if not .fail() then end\nend\n", natives)
+	assert.Empty(t, diags)
+	csw, di, err = backend.GenerateCode(root)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRuntimeError, theVM.Interpret(csw, di))
+	assert.Equal(t, 2, theVM.LastError().Line)
+	assert.Equal(t, 9, theVM.LastError().Column)
+	assert.Equal(t, 16, theVM.LastError().EndColumn)
+
+	// Calls are type-checked against the native function declarations.
+	_, diags = frontend.Parse("passage Main@1(): void\n .itemCount(\"x\")\nend\n")
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeUnknownNativeFunction}, diags.Codes())
+	_, diags = frontend.ParseWithNatives("passage Main@1(): void\n .itemCount(1)\nend\n", natives)
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeWrongArgumentType}, diags.Codes())
+	_, diags = frontend.ParseWithNatives("passage Main@1(): void\n .itemCount()\nend\n", natives)
+	assert.Equal(t, []diagnostic.Code{diagnostic.CodeWrongArgumentCount}, diags.Codes())
+}
+
+// runToCompletion runs csw on theVM until it finishes, always answering "a"
+// when the storyworld listens. Returns the final status.
+func runToCompletion(theVM *VM, csw *bytecode.CompiledStoryworld, di *bytecode.DebugInfo) Status {
+	status := theVM.Interpret(csw, di)
+	for status == StatusWaitingForInput {
+		status = theVM.Resume("a")
+	}
+	return status
+}
+
+// Tests that Tracers receive every instruction executed, and that the
+// provided ones write the expected formats.
+func TestTracers(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var n: int = 1\n" +
+		"    say string(n)\n" +
+		"end\n"
+
+	// Events have all the details.
+	csw, di := compileTestSource(t, "trace", source)
+	events := []*TraceEvent{}
+	theVM := New()
+	theVM.Tracer = TracerFunc(func(event *TraceEvent) {
+		events = append(events, event)
+	})
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.Equal(t, 8, len(events))
+	assert.Equal(t, "Main@1", events[0].ChunkName())
+	assert.Equal(t, 0, events[0].Offset)
+	assert.Equal(t, 2, events[0].Line)
+	assert.Equal(t, "CONSTANT 0 '1'", events[0].Instruction())
+	assert.Equal(t, 1, len(events[0].Stack))
+	assert.Equal(t, 2, events[1].Offset)
+	assert.Equal(t, "CONSTANT 1 'text'", events[1].Instruction())
+	assert.Equal(t, "READ_LOCAL 1 (n)", events[2].Instruction())
+	assert.Equal(t, int64(1), events[2].Stack[1].AsInt())
+
+	// Human-readable format.
+	buf := &bytes.Buffer{}
+	tracer := NewTextTracer(buf)
+	theVM = New()
+	theVM.Tracer = tracer
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.NoError(t, tracer.Err())
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "          [ <passage 0> ]", lines[0])
+	assert.Equal(t, "0000    2 CONSTANT            0 '1'", lines[1])
+	assert.Equal(t, "          [ <passage 0> ][ 1 ][ text ]", lines[4])
+	assert.Equal(t, "0004    | READ_LOCAL          1 (n)", lines[5])
+
+	// JSON Lines format.
+	buf.Reset()
+	jsonTracer := NewJSONTracer(buf)
+	theVM = New()
+	theVM.Tracer = jsonTracer
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+	assert.NoError(t, jsonTracer.Err())
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(events), len(lines))
+	assert.Equal(t, `{"chunk":0,"name":"Main@1","offset":4,"line":3,"instruction":"READ_LOCAL 1 (n)",`+
+		`"stack":[{"kind":"passage","value":"<passage 0>"},{"kind":"int","value":"1"},`+
+		`{"kind":"string","value":"text"}]}`, lines[2])
+
+	// Without debug info, there are no names and lines.
+	buf.Reset()
+	theVM = New()
+	theVM.Tracer = NewJSONTracer(buf)
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, nil))
+	assert.True(t, strings.HasPrefix(buf.String(), `{"chunk":0,"offset":0,"instruction":"CONSTANT 0 '1'","stack":`))
+}
+
+// Tests that the Profiler collects statistics per function, line and opcode,
+// and that it can write them in the supported formats.
+func TestProfiler(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    var i: int = 0\n" +
+		"    while i < 3 do\n" +
+		"        i = twice(i) + 1\n" +
+		"    end\n" +
+		"end\n" +
+		"\n" +
+		"function twice(x: int): int\n" +
+		"    return x * 2\n" +
+		"end\n"
+
+	csw, di := compileTestSource(t, "profile", source)
+	instructions := int64(0)
+	theVM := New()
+	theVM.Tracer = TracerFunc(func(event *TraceEvent) {
+		instructions++
+	})
+	theVM.Profiler = NewProfiler()
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, di))
+
+	// Per function and Passage.
+	stats := map[string]ProfileStat{}
+	for _, stat := range theVM.Profiler.Functions() {
+		stats[stat.Name] = stat
+	}
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, instructions, stats["Main@1"].CumInstructions)
+	assert.Equal(t, instructions, stats["Main@1"].Instructions+stats["twice"].Instructions)
+	assert.Equal(t, stats["twice"].Instructions, stats["twice"].CumInstructions)
+	assert.Equal(t, int64(8), stats["twice"].Instructions)
+
+	// Per line.
+	stats = map[string]ProfileStat{}
+	total := int64(0)
+	for _, stat := range theVM.Profiler.Lines() {
+		stats[stat.Name] = stat
+		total += stat.Instructions
+	}
+	assert.Equal(t, instructions, total)
+	assert.Equal(t, int64(8), stats["line 9 (twice)"].Instructions)
+	assert.Equal(t, int64(1), stats["line 2 (Main@1)"].Instructions)
+
+	// Per opcode.
+	stats = map[string]ProfileStat{}
+	total = 0
+	for _, stat := range theVM.Profiler.Opcodes() {
+		stats[stat.Name] = stat
+		total += stat.Instructions
+	}
+	assert.Equal(t, instructions, total)
+	assert.Equal(t, int64(2), stats["MULTIPLY"].Instructions)
+	assert.Equal(t, int64(2), stats["RETURN_VALUE"].Instructions)
+
+	// Text report.
+	buf := &bytes.Buffer{}
+	assert.NoError(t, theVM.Profiler.WriteReport(buf))
+	report := buf.String()
+	assert.Contains(t, report, fmt.Sprintf("Instructions executed: %v\n", instructions))
+	assert.Contains(t, report, "== Functions and Passages ==")
+	assert.Contains(t, report, "  line 9 (twice)\n")
+	assert.Contains(t, report, "  MULTIPLY\n")
+
+	// The pprof profile is a gzipped Protocol Buffers message.
+	buf.Reset()
+	assert.NoError(t, theVM.Profiler.WritePprof(buf))
+	gz, err := gzip.NewReader(buf)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(data, []byte("twice")))
+	assert.True(t, bytes.Contains(data, []byte("nanoseconds")))
+
+	// Without debug info, statistics are per Chunk only.
+	theVM = New()
+	theVM.Profiler = NewProfiler()
+	assert.Equal(t, StatusFinished, theVM.Interpret(csw, nil))
+	lines := theVM.Profiler.Lines()
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, []string{lines[0].Name, lines[1].Name}, "line ? (chunk 1)")
+}
+
+// Tests that a Debugger can pause the execution, which can then be inspected
+// and continued.
+func TestDebuggerPause(t *testing.T) {
+	source := "passage Main@1(): void\n" +
+		"    say \"one\"\n" +
+		"    say string(twice(21))\n" +
+		"end\n" +
+		"function twice(x: int): int\n" +
+		"    return 2 * x\n" +
+		"end\n"
+	csw, di := compileTestSource(t, "pause", source)
+	twice := csw.Globals[csw.GetGlobalIndex("twice")].Value.AsFunction().ChunkIndex
+
+	said := []string{}
+	theVM := New()
+	theVM.Sink = SinkFunc(func(event *SayEvent) {
+		said = append(said, event.Attributes.Text())
+	})
+	pauses := 0
+	theVM.Debugger = pauseAt(func(vm *VM) bool {
+		chunkIndex, ip, _ := vm.Position()
+		if chunkIndex == twice && ip == 0 {
+			pauses++
+			return pauses == 1
+		}
+		return false
+	})
+
+	assert.Panics(t, func() { theVM.Continue() })
+
+	assert.Equal(t, StatusPaused, theVM.Interpret(csw, di))
+	assert.Equal(t, []string{"one"}, said)
+	chunkIndex, ip, depth := theVM.Position()
+	assert.Equal(t, twice, chunkIndex)
+	assert.Equal(t, 0, ip)
+	assert.Equal(t, 2, depth)
+
+	frames := theVM.CallStack()
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, csw.EntryPassage, frames[0].ChunkIndex)
+	assert.Equal(t, twice, frames[1].ChunkIndex)
+	assert.Equal(t, 2, len(frames[1].Slots))
+	assert.Equal(t, int64(21), frames[1].Slots[1].AsInt())
+
+	// The debugger is consulted again when continuing, but it doesn't pause
+	// the second time.
+	assert.Equal(t, StatusFinished, theVM.Continue())
+	assert.Equal(t, 2, pauses)
+	assert.Equal(t, []string{"one", "42"}, said)
+}
+
+// pauseAt is a Debugger implemented as a function.
+type pauseAt func(vm *VM) bool
+
+// ShouldPause implements the Debugger interface.
+func (p pauseAt) ShouldPause(vm *VM) bool {
+	return p(vm)
+}
+
+// compileTestStoryworld compiles the test storyworld at path.
+func compileTestStoryworld(t *testing.T, path string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo) {
+	source, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	return compileTestSource(t, path, string(source))
+}
+
+// compileTestDir compiles the storyworld made of the source files in dir.
+func compileTestDir(t *testing.T, dir string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo) {
+	fs := frontend.NewFileSet()
+	assert.Nil(t, fs.AddDir(dir))
+	root, diags := frontend.ParseFileSet(fs, nil)
+	if diags.HasErrors() {
+		t.Fatalf("Compilation of %v failed: %v", dir, diags)
+	}
+
+	csw, di, err := backend.GenerateCode(root)
+	if err != nil {
+		t.Fatalf("Code generation of %v failed: %v", dir, err)
+	}
+
+	return csw, di
+}
+
+// compileTestSource compiles the storyworld source code source. name is used
+// in error messages.
+func compileTestSource(t *testing.T, name, source string) (*bytecode.CompiledStoryworld, *bytecode.DebugInfo) {
+	root, diags := frontend.Parse(source)
+	if diags.HasErrors() {
+		t.Fatalf("Compilation of %v failed: %v", name, diags)
+	}
+
+	csw, di, err := backend.GenerateCode(root)
+	if err != nil {
+		t.Fatalf("Code generation of %v failed: %v", name, err)
+	}
+
+	return csw, di
+}
+
+// expectedErrorCodes returns the error codes listed in the "# expect:" comments
+// in source, in order.
+func expectedErrorCodes(source string) []diagnostic.Code {
+	expected := []diagnostic.Code{}
+	for _, line := range strings.Split(source, "\n") {
+		if strings.HasPrefix(line, "# expect:") {
+			for _, code := range strings.Fields(strings.TrimPrefix(line, "# expect:")) {
+				expected = append(expected, diagnostic.Code(code))
+			}
+		}
+	}
+	return expected
+}
+
+// errorCodes returns the codes of the Diagnostics in err, which is expected to
+// be a diagnostic.List (or nil).
+func errorCodes(err error) []diagnostic.Code {
+	var diags diagnostic.List
+	if !errors.As(err, &diags) {
+		return nil
+	}
+	return diags.Codes()
+}